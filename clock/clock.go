@@ -0,0 +1,59 @@
+package clock
+
+//
+// time, for code that should run either for real or in a
+// simulation (see sim.go).
+//
+// c := clock.Real{} -- the wall clock and real goroutines.
+// c := clock.NewSim(seed) -- virtual time, one task at a time.
+//
+// c.Now(), c.Since(t), c.Sleep(d) -- as in package time.
+// c.AfterFunc(d, f) -- run f after d, in its own goroutine.
+// c.Go(f) -- run f in a new goroutine.
+// c.Until(cond) -- wait until cond() is true.
+//
+// code that takes a Clock should do all its sleeping and
+// waiting for other goroutines through it.
+//
+
+import (
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	AfterFunc(d time.Duration, f func())
+	Go(f func())
+	Until(cond func() bool)
+}
+
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (Real) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) {
+	time.AfterFunc(d, f)
+}
+
+func (Real) Go(f func()) {
+	go f()
+}
+
+// checks cond every millisecond.
+func (Real) Until(cond func() bool) {
+	for !cond() {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,271 @@
+package clock
+
+//
+// a simulated Clock, so that a test run can be replayed exactly
+// and a simulated minute takes a few real seconds.
+//
+// s := NewSim(seed) -- the calling goroutine becomes the
+//   simulation's first task; time starts at Epoch.
+// s.Go(f), s.AfterFunc(d, f) -- more tasks.
+// s.Sleep(d), s.Until(cond) -- let other tasks run.
+// s.Rand() -- the simulation's randomness. every random choice
+//   that should replay from the seed must come from it.
+// s.Stop() -- end the simulation. tasks still waiting exit, and
+//   from then on Sleep and Until return at once.
+//
+// only one task runs at a time. it runs until it sleeps, waits
+// in Until, or returns; the simulation then picks the next at
+// random from the tasks that can run, or, if none can, moves
+// time on to the next timer. the seed thus fixes the order of
+// everything, and sleeping costs no real time.
+//
+// so tasks must not block except in Sleep and Until, nor hold
+// a lock that another task may want while they do: the
+// simulation can't see other ways of waiting, and would hang.
+// sending on a buffered channel that has room is fine; to
+// receive, wait in Until for something to be there.
+//
+
+import (
+	"container/heap"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// where a simulation's time starts.
+var Epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type task struct {
+	wake    chan bool   // true to run, false to exit
+	cond    func() bool // what the task waits for in Until
+	checked int         // Sim.steps when cond was last false
+}
+
+type timer struct {
+	at  time.Time
+	seq int    // to break ties in the order they were set
+	t   *task  // to wake, or
+	f   func() // to run as a new task
+}
+
+type timers []timer
+
+func (h timers) Len() int { return len(h) }
+func (h timers) Less(i, j int) bool {
+	return h[i].at.Before(h[j].at) || (h[i].at.Equal(h[j].at) && h[i].seq < h[j].seq)
+}
+func (h timers) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *timers) Push(x interface{}) { *h = append(*h, x.(timer)) }
+func (h *timers) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+type Sim struct {
+	mu      sync.Mutex
+	rand    *rand.Rand
+	now     time.Time
+	cur     *task   // the running task
+	runq    []*task // tasks that can run now
+	waiting []*task // tasks in Until
+	timers  timers
+	seq     int
+	steps   int // how many times a task has stopped running
+	stopped bool
+}
+
+func NewSim(seed int64) *Sim {
+	s := &Sim{}
+	s.rand = rand.New(rand.NewSource(seed))
+	s.now = Epoch
+	s.cur = &task{wake: make(chan bool, 1)}
+	return s
+}
+
+func (s *Sim) Rand() *rand.Rand {
+	return s.rand
+}
+
+func (s *Sim) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+func (s *Sim) Since(t time.Time) time.Duration {
+	return s.Now().Sub(t)
+}
+
+func (s *Sim) Sleep(d time.Duration) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	me := s.cur
+	if d <= 0 {
+		s.runq = append(s.runq, me)
+	} else {
+		s.seq++
+		heap.Push(&s.timers, timer{at: s.now.Add(d), seq: s.seq, t: me})
+	}
+	s.switchFrom(me)
+}
+
+func (s *Sim) AfterFunc(d time.Duration, f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.seq++
+	heap.Push(&s.timers, timer{at: s.now.Add(d), seq: s.seq, f: f})
+}
+
+func (s *Sim) Go(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.runq = append(s.runq, s.spawn(f))
+}
+
+// cond runs with the simulation's lock held, and should
+// only look at things, or receive from a channel.
+func (s *Sim) Until(cond func() bool) {
+	if cond() {
+		return
+	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	me := s.cur
+	me.cond = cond
+	me.checked = s.steps
+	s.waiting = append(s.waiting, me)
+	s.switchFrom(me)
+}
+
+func (s *Sim) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	for _, t := range s.runq {
+		t.wake <- false
+	}
+	for _, t := range s.waiting {
+		t.wake <- false
+	}
+	for _, tm := range s.timers {
+		if tm.t != nil {
+			tm.t.wake <- false
+		}
+	}
+	s.runq, s.waiting, s.timers = nil, nil, nil
+}
+
+// a goroutine for f that waits its turn.
+func (s *Sim) spawn(f func()) *task {
+	t := &task{wake: make(chan bool, 1)}
+	go func() {
+		if !<-t.wake {
+			return
+		}
+		defer s.exit()
+		f()
+	}()
+	return t
+}
+
+func (s *Sim) exit() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.switchFrom(nil)
+}
+
+// run the next task and, unless me is nil (it has returned),
+// wait for me's turn. caller holds s.mu; this releases it.
+func (s *Sim) switchFrom(me *task) {
+	s.steps++
+	next := s.next()
+	s.cur = next
+	if next == me {
+		s.mu.Unlock()
+		return
+	}
+	if next == nil {
+		stuck := len(s.waiting)
+		s.mu.Unlock()
+		if stuck > 0 {
+			panic("clock: simulation deadlock: every task is waiting in Until")
+		}
+		return
+	}
+	next.wake <- true
+	s.mu.Unlock()
+	if me != nil && !<-me.wake {
+		runtime.Goexit()
+	}
+}
+
+// pick a task to run, moving time on if need be; nil if no
+// task can ever run again. caller holds s.mu.
+func (s *Sim) next() *task {
+	for {
+		cands := append([]*task{}, s.runq...)
+		for _, t := range s.waiting {
+			if t.checked < s.steps {
+				cands = append(cands, t)
+			}
+		}
+		if len(cands) == 0 {
+			if len(s.timers) == 0 {
+				return nil
+			}
+			tm := heap.Pop(&s.timers).(timer)
+			if tm.at.After(s.now) {
+				s.now = tm.at
+			}
+			if tm.t == nil {
+				tm.t = s.spawn(tm.f)
+			}
+			s.runq = append(s.runq, tm.t)
+			continue
+		}
+
+		t := cands[s.rand.Intn(len(cands))]
+		if i := indexOf(s.runq, t); i >= 0 {
+			s.runq = append(s.runq[:i], s.runq[i+1:]...)
+			return t
+		}
+		if t.cond() {
+			i := indexOf(s.waiting, t)
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			t.cond = nil
+			return t
+		}
+		t.checked = s.steps
+	}
+}
+
+func indexOf(ts []*task, t *task) int {
+	for i := range ts {
+		if ts[i] == t {
+			return i
+		}
+	}
+	return -1
+}
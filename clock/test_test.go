@@ -0,0 +1,122 @@
+package clock
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// run a few tasks that sleep for random times and log what
+// they do, and return the log.
+func trace(seed int64) []string {
+	s := NewSim(seed)
+	defer s.Stop()
+
+	var log []string
+	done := 0
+	for i := 0; i < 4; i++ {
+		i := i
+		s.Go(func() {
+			for j := 0; j < 5; j++ {
+				s.Sleep(time.Duration(s.Rand().Intn(100)) * time.Millisecond)
+				log = append(log, fmt.Sprintf("%v %v %v", s.Since(Epoch), i, j))
+			}
+			done++
+		})
+	}
+	s.Until(func() bool { return done == 4 })
+	return log
+}
+
+func TestReplay(t *testing.T) {
+	a := trace(1)
+	b := trace(1)
+	if len(a) != 20 {
+		t.Fatalf("expected 20 entries, got %v", len(a))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("same seed, different runs: %v vs %v", a[i], b[i])
+		}
+	}
+
+	c := trace(2)
+	same := true
+	for i := range a {
+		if a[i] != c[i] {
+			same = false
+		}
+	}
+	if same {
+		t.Fatalf("different seeds, same run")
+	}
+}
+
+func TestVirtualTime(t *testing.T) {
+	s := NewSim(1)
+	defer s.Stop()
+
+	t0 := time.Now()
+	s.Sleep(time.Hour)
+	if d := s.Since(Epoch); d != time.Hour {
+		t.Fatalf("slept an hour, but %v passed", d)
+	}
+	if time.Since(t0) > time.Second {
+		t.Fatalf("an hour of virtual time took %v", time.Since(t0))
+	}
+}
+
+func TestAfterFunc(t *testing.T) {
+	s := NewSim(1)
+	defer s.Stop()
+
+	var order []int
+	s.AfterFunc(30*time.Millisecond, func() { order = append(order, 3) })
+	s.AfterFunc(10*time.Millisecond, func() { order = append(order, 1) })
+	s.AfterFunc(20*time.Millisecond, func() { order = append(order, 2) })
+	s.Until(func() bool { return len(order) == 3 })
+
+	for i, x := range order {
+		if x != i+1 {
+			t.Fatalf("timers ran out of order: %v", order)
+		}
+	}
+	if d := s.Since(Epoch); d != 30*time.Millisecond {
+		t.Fatalf("expected 30ms to pass, got %v", d)
+	}
+}
+
+func TestStop(t *testing.T) {
+	s := NewSim(1)
+
+	exited := make(chan bool, 1)
+	s.Go(func() {
+		defer func() { exited <- true }()
+		s.Until(func() bool { return false })
+		t.Errorf("Until returned after Stop")
+	})
+	s.Sleep(time.Second)
+	s.Stop()
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatalf("waiting task didn't exit after Stop")
+	}
+
+	// from now on nothing waits.
+	s.Sleep(time.Hour)
+	s.Until(func() bool { return false })
+}
+
+func TestDeadlock(t *testing.T) {
+	s := NewSim(1)
+	defer s.Stop()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a deadlock panic")
+		}
+	}()
+	s.Until(func() bool { return false })
+}
@@ -0,0 +1,410 @@
+package dashbridge
+
+//
+// a real Raft cluster on a labrpc network, described the way the
+// dashboard's backend.js describes its simulated one.
+//
+// peers are numbered from 0, as in package raft; the dashboard's
+// node ids are peer+1.
+//
+// the messages a frame shows are the network's (see labrpc's
+// Subscribe), so a drop is one the network really made.
+//
+
+import (
+	"fmt"
+	"mitraft/labrpc"
+	"mitraft/raft"
+	"sync"
+)
+
+// how many of a node's newest log entries a frame shows.
+const maxNodeLog = 50
+
+// where the dashboard draws each node, from raftCluster/positions.js.
+var positions = []Position{
+	{Left: 65, Top: 30},
+	{Left: 80, Top: 55},
+	{Left: 50, Top: 80},
+	{Left: 20, Top: 55},
+	{Left: 35, Top: 30},
+}
+
+type Position struct {
+	Left int `json:"left"`
+	Top  int `json:"top"`
+}
+
+type Entry struct {
+	Term    int         `json:"term"`
+	Command interface{} `json:"command"`
+}
+
+type Node struct {
+	Id       int      `json:"id"`
+	Role     string   `json:"role"`  // follower, candidate or leader
+	State    string   `json:"state"` // the same
+	Status   string   `json:"status"`
+	Term     int      `json:"term"`
+	Log      []Entry  `json:"log"`
+	Position Position `json:"position"`
+	LossPct  int      `json:"lossPct"`
+}
+
+// an RPC seen since the last frame. a Type ending in "(drop)"
+// never arrived.
+type Message struct {
+	FromId int    `json:"fromId"`
+	ToId   int    `json:"toId"`
+	Type   string `json:"type"`
+}
+
+// the payload of a "state" message.
+type State struct {
+	Step      int       `json:"step"`
+	Mode      string    `json:"mode"`
+	Nodes     []Node    `json:"nodes"`
+	Messages  []Message `json:"messages"`
+	Committed []Entry   `json:"committed"`
+	DropRate  float64   `json:"dropRate"`
+}
+
+type Cluster struct {
+	mu       sync.Mutex
+	n        int
+	net      *labrpc.Network
+	rafts    []*raft.Raft // the current or, if crashed, last incarnation
+	crashed  []bool
+	saved    []*raft.Persister
+	endnames [][]string
+	gen      int // to name each incarnation's ends afresh
+
+	events    *recorder
+	observers []raft.Observer // added to every incarnation of every peer
+	cancel    func()          // stops the network's feed
+}
+
+// MakeCluster starts n peers, each watched by observers. on an
+// unreliable network labrpc delays RPCs and drops some of them.
+func MakeCluster(n int, unreliable bool, observers ...raft.Observer) *Cluster {
+	c := &Cluster{
+		n:        n,
+		net:      labrpc.MakeNetwork(),
+		rafts:    make([]*raft.Raft, n),
+		crashed:  make([]bool, n),
+		saved:    make([]*raft.Persister, n),
+		endnames: make([][]string, n),
+		events:   makeRecorder(),
+
+		observers: observers,
+	}
+	c.net.Reliable(!unreliable)
+	var feed <-chan labrpc.MessageEvent
+	feed, c.cancel = c.net.Subscribe(1000)
+	go func() {
+		for ev := range feed {
+			c.events.message(ev)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c.saved[i] = raft.MakePersister()
+		c.start1(i)
+	}
+	return c
+}
+
+// start or restart peer i from its persisted state. caller must
+// hold c.mu or be MakeCluster.
+func (c *Cluster) start1(i int) {
+	c.gen++
+	c.endnames[i] = make([]string, c.n)
+	ends := make([]*labrpc.ClientEnd, c.n)
+	for j := 0; j < c.n; j++ {
+		c.endnames[i][j] = fmt.Sprintf("%v-%v-%v", c.gen, i, j)
+		ends[j] = c.net.MakeEnd(c.endnames[i][j])
+		c.net.Connect(c.endnames[i][j], j)
+		c.net.SetOwner(c.endnames[i][j], i)
+		c.net.Enable(c.endnames[i][j], true)
+	}
+
+	// a fresh persister, so that a killed incarnation can't
+	// overwrite the new one's state.
+	c.saved[i] = c.saved[i].Copy()
+
+	applyCh := make(chan raft.ApplyMsg)
+	go func() {
+		for range applyCh {
+			// the recorder hears of applied entries from EntryApplied.
+		}
+	}()
+	rf := raft.Make(ends, i, c.saved[i], applyCh)
+	rf.AddObserver(c.events)
+	for _, o := range c.observers {
+		rf.AddObserver(o)
+	}
+	c.rafts[i] = rf
+	c.crashed[i] = false
+
+	srv := labrpc.MakeServer()
+	srv.AddService(labrpc.MakeService(rf))
+	c.net.AddServer(i, srv)
+}
+
+func (c *Cluster) check(peer int) error {
+	if peer < 0 || peer >= c.n {
+		return fmt.Errorf("no node %v", peer+1)
+	}
+	return nil
+}
+
+// Crash kills peer, keeping its persisted state.
+func (c *Cluster) Crash(peer int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(peer); err != nil || c.crashed[peer] {
+		return err
+	}
+	for j := 0; j < c.n; j++ {
+		c.net.Enable(c.endnames[peer][j], false)
+	}
+	c.net.DeleteServer(peer)
+	c.rafts[peer].Kill()
+	c.crashed[peer] = true
+	return nil
+}
+
+// Recover restarts a crashed peer.
+func (c *Cluster) Recover(peer int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(peer); err != nil || !c.crashed[peer] {
+		return err
+	}
+	c.start1(peer)
+	return nil
+}
+
+// Command submits cmd at peer, or at the leader if peer is -1.
+func (c *Cluster) Command(cmd interface{}, peer int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if peer == -1 {
+		for i, rf := range c.rafts {
+			if _, isLeader := rf.GetState(); isLeader && !c.crashed[i] {
+				peer = i
+			}
+		}
+		if peer == -1 {
+			return fmt.Errorf("no leader")
+		}
+	}
+	if err := c.check(peer); err != nil {
+		return err
+	}
+	if c.crashed[peer] {
+		return fmt.Errorf("node %v is crashed", peer+1)
+	}
+	if _, _, ok := c.rafts[peer].Start(cmd); !ok {
+		return fmt.Errorf("node %v is not the leader", peer+1)
+	}
+	return nil
+}
+
+// ForceTimeout makes peer stand for election now.
+func (c *Cluster) ForceTimeout(peer int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check(peer); err != nil {
+		return err
+	}
+	if c.crashed[peer] {
+		return fmt.Errorf("node %v is crashed", peer+1)
+	}
+	go c.rafts[peer].ForceElection()
+	return nil
+}
+
+// Kill shuts the whole cluster down.
+func (c *Cluster) Kill() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, rf := range c.rafts {
+		if !c.crashed[i] {
+			rf.Kill()
+		}
+	}
+	c.cancel()
+	c.net.Cleanup()
+}
+
+// State describes the cluster now, with the messages sent since
+// the last call.
+func (c *Cluster) State(step int) State {
+	c.mu.Lock()
+	rafts := append([]*raft.Raft(nil), c.rafts...)
+	crashed := append([]bool(nil), c.crashed...)
+	c.mu.Unlock()
+
+	msgs, committed, dropRate := c.events.take()
+	st := State{
+		Step:      step,
+		Mode:      "dynamic",
+		Nodes:     make([]Node, len(rafts)),
+		Messages:  msgs,
+		Committed: committed,
+		DropRate:  dropRate,
+	}
+	for i, rf := range rafts {
+		rs := rf.Status()
+		node := Node{
+			Id:       i + 1,
+			Status:   "healthy",
+			Term:     rs.Term,
+			Log:      []Entry{},
+			Position: Position{Left: 50, Top: 50},
+			LossPct:  int(dropRate * 100),
+		}
+		switch rs.Role {
+		case raft.Leader:
+			node.Role = "leader"
+		case raft.Candidate:
+			node.Role = "candidate"
+		default:
+			node.Role = "follower"
+		}
+		if crashed[i] {
+			node.Status = "crashed"
+		}
+		node.State = node.Role
+		if i < len(positions) {
+			node.Position = positions[i]
+		}
+		from := rs.FirstLogIndex
+		if rs.LastLogIndex-from+1 > maxNodeLog {
+			from = rs.LastLogIndex - maxNodeLog + 1
+		}
+		entries, _ := rf.Entries(from, rs.LastLogIndex)
+		for _, e := range entries {
+			node.Log = append(node.Log, Entry{Term: e.Term, Command: e.Command})
+		}
+		st.Nodes[i] = node
+	}
+	return st
+}
+
+// turns the network's and Raft's events into dashboard messages
+// and the committed log. its lock is never held while calling into Raft, which
+// calls it with rf.mu held.
+type recorder struct {
+	raft.NopObserver
+
+	mu        sync.Mutex
+	msgs      []Message
+	seen      map[Message]bool // dedupes msgs
+	committed []Entry          // committed[i] is log index i+1
+	sent      int
+	dropped   int
+}
+
+func makeRecorder() *recorder {
+	return &recorder{seen: map[Message]bool{}}
+}
+
+func (r *recorder) add(from, to int, typ string) {
+	m := Message{FromId: from + 1, ToId: to + 1, Type: typ}
+	if !r.seen[m] {
+		r.seen[m] = true
+		r.msgs = append(r.msgs, m)
+	}
+}
+
+// the messages since the last take, the committed log, and the
+// fraction of RPCs that have failed so far.
+func (r *recorder) take() ([]Message, []Entry, float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.msgs
+	if msgs == nil {
+		msgs = []Message{}
+	}
+	r.msgs = nil
+	r.seen = map[Message]bool{}
+	rate := 0.0
+	if r.sent > 0 {
+		rate = float64(r.dropped) / float64(r.sent)
+	}
+	return msgs, append([]Entry{}, r.committed...), rate
+}
+
+// the dashboard's name for an RPC.
+func messageType(svcMeth string) string {
+	switch svcMeth {
+	case "Raft.AppendEntries":
+		return "appendEntries"
+	case "Raft.RequestVote":
+		return "requestVote"
+	case "Raft.InstallSnapshot":
+		return "installSnapshot"
+	case "Raft.TimeoutNow":
+		return "timeoutNow"
+	}
+	return svcMeth
+}
+
+func (r *recorder) RoleChanged(peer int, term int, from, to string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch to {
+	case raft.Leader:
+		r.add(peer, peer, "elected")
+	case raft.Candidate:
+		r.add(peer, peer, "becameCandidate")
+	}
+}
+
+func (r *recorder) EntryApplied(peer int, entry raft.LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.committed) < entry.Index {
+		r.committed = append(r.committed, Entry{})
+	}
+	r.committed[entry.Index-1] = Entry{Term: entry.Term, Command: entry.Command}
+}
+
+func (r *recorder) message(ev labrpc.MessageEvent) {
+	from, ok1 := ev.From.(int)
+	to, ok2 := ev.To.(int)
+	if !ok1 || !ok2 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch ev.Kind {
+	case labrpc.MsgSent:
+		r.sent++
+		r.add(from, to, messageType(ev.Method))
+	case labrpc.MsgDropped:
+		r.dropped++
+		r.add(from, to, messageType(ev.Method)+"(drop)")
+	case labrpc.MsgReplied:
+		// RPCReplied shows RequestVote replies, since only
+		// Raft knows whether the vote was granted.
+		if ev.Method != "Raft.RequestVote" {
+			r.add(to, from, "reply")
+		}
+	}
+}
+
+func (r *recorder) RPCReplied(peer int, to int, svcMeth string, args, reply interface{}) {
+	rv, ok := reply.(*raft.RequestVoteReply)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rv.VoteGranted {
+		r.add(to, peer, "voteGiven")
+	} else {
+		r.add(to, peer, "reply")
+	}
+}
@@ -0,0 +1,125 @@
+package dashbridge
+
+//
+// turn a raft.EventLog trace into the steps of
+// raft-dashboard/server/raftCluster/steps.js, one step for each
+// window of time in which something happened.
+//
+
+import (
+	"mitraft/raft"
+	"sort"
+	"strings"
+	"time"
+)
+
+type StepNode struct {
+	Id    int    `json:"id"`
+	State string `json:"state"` // follower, candidate, leader or crashed
+	Term  int    `json:"term"`
+}
+
+// one frame of the dashboard's static movie.
+type Step struct {
+	Nodes     []StepNode `json:"nodes"`
+	Messages  []Message  `json:"messages"`
+	Committed []Entry    `json:"committed"`
+}
+
+// Replay groups events into windows of the given length and
+// returns a step for each window that has any, showing the
+// nodes as they were at its end and the messages sent,
+// answered or lost in it.
+func Replay(events []raft.Event, window time.Duration) []Step {
+	n := 0
+	for _, e := range events {
+		if e.Node+1 > n {
+			n = e.Node + 1
+		}
+		if e.Peer+1 > n {
+			n = e.Peer + 1
+		}
+	}
+	nodes := make([]StepNode, n)
+	for i := range nodes {
+		nodes[i] = StepNode{Id: i + 1, State: "follower"}
+	}
+	committed := map[int]Entry{}
+
+	var steps []Step
+	var msgs []Message
+	seen := map[Message]bool{}
+	add := func(from, to int, typ string) {
+		m := Message{FromId: from + 1, ToId: to + 1, Type: typ}
+		if !seen[m] {
+			seen[m] = true
+			msgs = append(msgs, m)
+		}
+	}
+	flush := func() {
+		st := Step{
+			Nodes:     append([]StepNode(nil), nodes...),
+			Messages:  msgs,
+			Committed: []Entry{},
+		}
+		if st.Messages == nil {
+			st.Messages = []Message{}
+		}
+		idx := make([]int, 0, len(committed))
+		for i := range committed {
+			idx = append(idx, i)
+		}
+		sort.Ints(idx)
+		for _, i := range idx {
+			st.Committed = append(st.Committed, committed[i])
+		}
+		steps = append(steps, st)
+		msgs = nil
+		seen = map[Message]bool{}
+	}
+
+	var end time.Time
+	for _, e := range events {
+		if e.Time.After(end) || end.IsZero() {
+			if !end.IsZero() {
+				flush()
+			}
+			end = e.Time.Add(window)
+		}
+
+		node := &nodes[e.Node]
+		if node.State == "crashed" && (e.Kind == raft.EventDeliver || e.Kind == raft.EventRole) {
+			// restarted. a killed server's last RPCs may still
+			// be reported, so only count what a live one does.
+			node.State = "follower"
+		}
+		switch e.Kind {
+		case raft.EventSend:
+			add(e.Node, e.Peer, messageType(e.Method))
+		case raft.EventReply:
+			if e.Granted {
+				add(e.Peer, e.Node, "voteGiven")
+			} else {
+				add(e.Peer, e.Node, "reply")
+			}
+		case raft.EventDrop:
+			add(e.Node, e.Peer, messageType(e.Method)+"(drop)")
+		case raft.EventRole:
+			node.State = strings.ToLower(e.Role)
+			node.Term = e.Term
+			if e.Role == raft.Leader {
+				add(e.Node, e.Node, "elected")
+			}
+		case raft.EventTerm:
+			node.Term = e.Term
+		case raft.EventApply:
+			committed[e.Index] = Entry{Term: e.Term, Command: e.Command}
+		case raft.EventCrash:
+			node.State = "crashed"
+		}
+	}
+	if !end.IsZero() {
+		flush()
+	}
+	return steps
+}
@@ -0,0 +1,328 @@
+package dashbridge
+
+//
+// serves the protocol of raft-dashboard/server/backend.js, so the
+// React client can watch and poke a real Go cluster.
+//
+// over the WebSocket at /ws, both ways, {"type": ..., "payload": ...}.
+// the server sends "state" (a State), "ack", "info" and "error";
+// the client may send get_state, start, pause, reset, advance_step,
+// crash_node, recover_node, force_timeout ({"nodeId": N}) and
+// client_command ({"command": C, "nodeId": N}, nodeId optional).
+//
+// the cluster runs in real time whatever the client does: "pause"
+// stops the frames, not Raft, and "reset" starts a fresh cluster.
+//
+// the REST routes of backend.js are served too.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mitraft/raft"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	Nodes      int           // cluster size; default 5
+	Unreliable bool          // drop and delay RPCs
+	Interval   time.Duration // between frames; default 500ms
+	Events     io.Writer     // if not nil, a raft.EventLog of every cluster
+}
+
+type wsMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type nodePayload struct {
+	NodeId  *int        `json:"nodeId"`
+	Command interface{} `json:"command"`
+}
+
+type Server struct {
+	opts   Options
+	mux    *http.ServeMux
+	events *raft.EventLog // nil unless opts.Events
+
+	mu      sync.Mutex
+	cluster *Cluster
+	step    int
+	running bool
+	clients map[*wsConn]bool
+	done    chan struct{}
+}
+
+// NewServer starts a cluster and the loop that sends its frames.
+// it begins running; Close stops everything.
+func NewServer(opts Options) *Server {
+	if opts.Nodes == 0 {
+		opts.Nodes = 5
+	}
+	if opts.Interval == 0 {
+		opts.Interval = 500 * time.Millisecond
+	}
+	s := &Server{
+		opts:    opts,
+		running: true,
+		clients: map[*wsConn]bool{},
+		done:    make(chan struct{}),
+	}
+	if opts.Events != nil {
+		s.events = raft.NewEventLog(opts.Events, nil)
+	}
+	s.cluster = s.makeCluster()
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/ws", s.serveWS)
+	s.mux.HandleFunc("/raft/state", s.restState)
+	s.mux.HandleFunc("/raft/reset", s.restReset)
+	s.mux.HandleFunc("/nodes/", s.restNode)
+	go s.ticker()
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.done)
+	s.cluster.Kill()
+	for c := range s.clients {
+		c.close()
+	}
+	if s.events != nil {
+		s.events.Flush()
+	}
+}
+
+func (s *Server) makeCluster() *Cluster {
+	if s.events != nil {
+		return MakeCluster(s.opts.Nodes, s.opts.Unreliable, s.events)
+	}
+	return MakeCluster(s.opts.Nodes, s.opts.Unreliable)
+}
+
+func (s *Server) ticker() {
+	t := time.NewTicker(s.opts.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		running := s.running
+		s.mu.Unlock()
+		if running {
+			s.broadcastState()
+		}
+	}
+}
+
+// the next frame.
+func (s *Server) state() State {
+	s.mu.Lock()
+	c := s.cluster
+	s.step++
+	step := s.step
+	s.mu.Unlock()
+	return c.State(step)
+}
+
+func encode(typ string, payload interface{}) []byte {
+	p, _ := json.Marshal(payload)
+	b, _ := json.Marshal(wsMessage{Type: typ, Payload: p})
+	return b
+}
+
+func (s *Server) broadcast(typ string, payload interface{}) {
+	b := encode(typ, payload)
+	s.mu.Lock()
+	clients := make([]*wsConn, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.writeText(b)
+	}
+}
+
+func (s *Server) broadcastState() {
+	s.broadcast("state", s.state())
+}
+
+func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
+	c, err := wsUpgrade(w, r)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.clients[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+		c.close()
+	}()
+
+	c.writeText(encode("state", s.state()))
+	for {
+		data, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			c.writeText(encode("error", map[string]string{"message": "invalid json"}))
+			continue
+		}
+		if err := s.handle(c, m); err != nil {
+			c.writeText(encode("error", map[string]string{"message": err.Error()}))
+		}
+	}
+}
+
+// the dashboard's node id in p, as a peer number.
+func (p nodePayload) peer() (int, error) {
+	if p.NodeId == nil {
+		return 0, fmt.Errorf("missing nodeId")
+	}
+	return *p.NodeId - 1, nil
+}
+
+func (s *Server) handle(c *wsConn, m wsMessage) error {
+	var p nodePayload
+	if len(m.Payload) > 0 {
+		if err := json.Unmarshal(m.Payload, &p); err != nil {
+			return fmt.Errorf("bad payload: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	cl := s.cluster
+	s.mu.Unlock()
+
+	switch m.Type {
+	case "get_state":
+		c.writeText(encode("state", s.state()))
+		return nil
+	case "advance_step":
+		// there are no steps; time moves on by itself.
+	case "start", "pause":
+		s.mu.Lock()
+		s.running = m.Type == "start"
+		s.mu.Unlock()
+	case "reset":
+		s.reset()
+	case "crash_node", "recover_node", "force_timeout":
+		peer, err := p.peer()
+		if err != nil {
+			return err
+		}
+		switch m.Type {
+		case "crash_node":
+			err = cl.Crash(peer)
+		case "recover_node":
+			err = cl.Recover(peer)
+		default:
+			err = cl.ForceTimeout(peer)
+			c.writeText(encode("ack", map[string]bool{"ok": err == nil}))
+		}
+		if err != nil {
+			return err
+		}
+	case "client_command":
+		peer := -1
+		if p.NodeId != nil {
+			peer = *p.NodeId - 1
+		}
+		if err := cl.Command(fmt.Sprint(p.Command), peer); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown event")
+	}
+	s.broadcastState()
+	return nil
+}
+
+// replace the cluster with a fresh one.
+func (s *Server) reset() {
+	fresh := s.makeCluster()
+	s.mu.Lock()
+	old := s.cluster
+	s.cluster = fresh
+	s.step = 0
+	s.mu.Unlock()
+	old.Kill()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) restState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.state())
+}
+
+func (s *Server) restReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "POST only"})
+		return
+	}
+	s.reset()
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Reset successful"})
+}
+
+// POST /nodes/:id/crash, /nodes/:id/recover, /nodes/:id/force-timeout
+func (s *Server) restNode(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/nodes/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if r.Method != "POST" || len(parts) != 2 || err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	s.mu.Lock()
+	cl := s.cluster
+	s.mu.Unlock()
+	var done string
+	switch parts[1] {
+	case "crash":
+		err, done = cl.Crash(id-1), "crashed"
+	case "recover":
+		err, done = cl.Recover(id-1), "recovered"
+	case "force-timeout":
+		err, done = cl.ForceTimeout(id-1), "forced to timeout"
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("Node %v %v.", id, done)})
+	s.broadcastState()
+}
+
+// ListenAndServe serves the dashboard protocol on addr until
+// the server fails.
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("raft bridge: %v nodes, ws://%v/ws", s.opts.Nodes, addr)
+	return http.ListenAndServe(addr, s)
+}
@@ -0,0 +1,317 @@
+package dashbridge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mitraft/raft"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// open a WebSocket to srv's /ws.
+func dial(t *testing.T, srv *httptest.Server) *wsConn {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", key)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad handshake response: %v %v", resp.Status, resp.Header)
+	}
+	return &wsConn{conn: conn, br: br, client: true}
+}
+
+func send(t *testing.T, c *wsConn, typ string, payload interface{}) {
+	p, _ := json.Marshal(payload)
+	b, _ := json.Marshal(wsMessage{Type: typ, Payload: p})
+	if err := c.writeText(b); err != nil {
+		t.Fatalf("send %v: %v", typ, err)
+	}
+}
+
+// read messages until a "state" satisfies ok, failing after timeout.
+func waitState(t *testing.T, c *wsConn, what string, ok func(State) bool) State {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		data, err := c.readMessage()
+		if err != nil {
+			t.Fatalf("waiting for %v: %v", what, err)
+		}
+		var m wsMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("bad message %q", data)
+		}
+		if m.Type != "state" {
+			continue
+		}
+		var st State
+		if err := json.Unmarshal(m.Payload, &st); err != nil {
+			t.Fatalf("bad state %q", m.Payload)
+		}
+		if ok(st) {
+			return st
+		}
+	}
+}
+
+func leaderOf(st State) int {
+	leader := 0
+	for _, n := range st.Nodes {
+		if n.Role == "leader" && n.Status == "healthy" {
+			if leader != 0 {
+				return 0
+			}
+			leader = n.Id
+		}
+	}
+	return leader
+}
+
+func hasCommitted(st State, cmd string) bool {
+	for _, e := range st.Committed {
+		if e.Command == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBridge(t *testing.T) {
+	t.Setenv("RAFT_METRICS_DIR", t.TempDir())
+	s := NewServer(Options{Nodes: 5, Interval: 50 * time.Millisecond})
+	defer s.Close()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	c := dial(t, srv)
+	defer c.close()
+
+	st := waitState(t, c, "the first frame", func(State) bool { return true })
+	if len(st.Nodes) != 5 || st.Mode != "dynamic" || st.Nodes[0].Id != 1 || st.Nodes[0].Position != positions[0] {
+		t.Fatalf("bad first frame %+v", st)
+	}
+
+	var sawAppend, sawVote bool
+	st = waitState(t, c, "a leader", func(st State) bool {
+		for _, m := range st.Messages {
+			sawAppend = sawAppend || m.Type == "appendEntries"
+			sawVote = sawVote || m.Type == "voteGiven"
+		}
+		return leaderOf(st) != 0 && sawAppend
+	})
+	if !sawVote {
+		t.Fatalf("leader elected without a voteGiven message")
+	}
+	leader := leaderOf(st)
+
+	send(t, c, "client_command", map[string]interface{}{"command": "x"})
+	st = waitState(t, c, "x to commit", func(st State) bool { return hasCommitted(st, "x") })
+
+	// crash the leader; the others elect a new one and carry on.
+	send(t, c, "crash_node", map[string]int{"nodeId": leader})
+	st = waitState(t, c, "a new leader", func(st State) bool {
+		return st.Nodes[leader-1].Status == "crashed" && leaderOf(st) != 0 && leaderOf(st) != leader
+	})
+	leader2 := leaderOf(st)
+	send(t, c, "client_command", map[string]interface{}{"command": "y", "nodeId": leader2})
+	waitState(t, c, "y to commit", func(st State) bool { return hasCommitted(st, "y") })
+
+	// the old leader comes back and catches up.
+	send(t, c, "recover_node", map[string]int{"nodeId": leader})
+	waitState(t, c, "the old leader to catch up", func(st State) bool {
+		n := st.Nodes[leader-1]
+		return n.Status == "healthy" && len(n.Log) == 2 && n.Log[1].Command == "y"
+	})
+
+	// a forced timeout starts an election in a later term.
+	term := st.Nodes[0].Term
+	follower := leader2%5 + 1
+	send(t, c, "force_timeout", map[string]int{"nodeId": follower})
+	waitState(t, c, "a forced election", func(st State) bool {
+		return st.Nodes[follower-1].Term > term && leaderOf(st) != 0
+	})
+
+	// errors go back to the sender.
+	send(t, c, "crash_node", map[string]int{"nodeId": 9})
+	send(t, c, "bogus", nil)
+	var errs []string
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(errs) < 2 {
+		data, err := c.readMessage()
+		if err != nil {
+			t.Fatalf("waiting for errors: %v", err)
+		}
+		var m wsMessage
+		json.Unmarshal(data, &m)
+		if m.Type == "error" {
+			errs = append(errs, string(m.Payload))
+		}
+	}
+	if !strings.Contains(errs[0], "no node 9") || !strings.Contains(errs[1], "unknown event") {
+		t.Fatalf("wrong errors %v", errs)
+	}
+	c.conn.SetReadDeadline(time.Time{})
+
+	// a reset starts over with a fresh cluster.
+	send(t, c, "reset", nil)
+	waitState(t, c, "a fresh cluster", func(st State) bool { return len(st.Committed) == 0 && st.Step <= 2 })
+}
+
+// the messages come from the network: a crashed peer's heartbeats
+// show up as drops, and its followers' acks as replies.
+func TestNetworkMessages(t *testing.T) {
+	t.Setenv("RAFT_METRICS_DIR", t.TempDir())
+	c := MakeCluster(3, false)
+	defer c.Kill()
+
+	var leader int
+	for i := 0; i < 50 && leader == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		leader = leaderOf(c.State(i))
+	}
+	if leader == 0 {
+		t.Fatalf("no leader")
+	}
+	down := leader%3 + 1
+	c.Crash(down - 1)
+	c.State(0)
+	time.Sleep(500 * time.Millisecond)
+
+	st := c.State(0)
+	seen := map[Message]bool{}
+	for _, m := range st.Messages {
+		seen[m] = true
+	}
+	up := 6 - leader - down
+	if !seen[Message{leader, down, "appendEntries(drop)"}] || !seen[Message{leader, down, "appendEntries"}] {
+		t.Fatalf("no dropped heartbeats to crashed node %v in %v", down, st.Messages)
+	}
+	if !seen[Message{up, leader, "reply"}] {
+		t.Fatalf("no replies from node %v in %v", up, st.Messages)
+	}
+	if st.DropRate == 0 {
+		t.Fatalf("zero drop rate with a crashed node")
+	}
+}
+
+func TestRest(t *testing.T) {
+	t.Setenv("RAFT_METRICS_DIR", t.TempDir())
+	s := NewServer(Options{Nodes: 3, Interval: time.Hour})
+	defer s.Close()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	resp, err := srv.Client().Post(srv.URL+"/nodes/2/crash", "application/json", nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /nodes/2/crash: %v %v", err, resp.Status)
+	}
+	resp.Body.Close()
+
+	resp, err = srv.Client().Get(srv.URL + "/raft/state")
+	if err != nil {
+		t.Fatalf("GET /raft/state: %v", err)
+	}
+	defer resp.Body.Close()
+	var st State
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatalf("bad state: %v", err)
+	}
+	if len(st.Nodes) != 3 || st.Nodes[1].Status != "crashed" || st.Nodes[0].Status != "healthy" {
+		t.Fatalf("wrong state %+v", st)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("no CORS header")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	t0 := time.Now()
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+	events := []raft.Event{
+		{Time: at(0), Kind: raft.EventRole, Node: 0, Peer: -1, Term: 1, Role: raft.Candidate},
+		{Time: at(1), Kind: raft.EventSend, Node: 0, Peer: 1, Method: "Raft.RequestVote"},
+		{Time: at(2), Kind: raft.EventTerm, Node: 1, Peer: -1, Term: 1},
+		{Time: at(3), Kind: raft.EventReply, Node: 0, Peer: 1, Method: "Raft.RequestVote", Granted: true},
+		{Time: at(4), Kind: raft.EventRole, Node: 0, Peer: -1, Term: 1, Role: raft.Leader},
+		{Time: at(100), Kind: raft.EventSend, Node: 0, Peer: 1, Method: "Raft.AppendEntries"},
+		{Time: at(101), Kind: raft.EventSend, Node: 0, Peer: 1, Method: "Raft.AppendEntries"},
+		{Time: at(102), Kind: raft.EventApply, Node: 0, Peer: -1, Index: 1, Term: 1, Command: "x"},
+		{Time: at(200), Kind: raft.EventCrash, Node: 1, Peer: -1},
+		{Time: at(201), Kind: raft.EventDrop, Node: 0, Peer: 1, Method: "Raft.AppendEntries"},
+		{Time: at(300), Kind: raft.EventDeliver, Node: 1, Peer: 0, Method: "Raft.AppendEntries"},
+	}
+	steps := Replay(events, 50*time.Millisecond)
+	if len(steps) != 4 {
+		t.Fatalf("%v steps, expected 4: %+v", len(steps), steps)
+	}
+
+	s := steps[0]
+	if s.Nodes[0] != (StepNode{Id: 1, State: "leader", Term: 1}) || s.Nodes[1] != (StepNode{Id: 2, State: "follower", Term: 1}) {
+		t.Fatalf("wrong nodes after election: %+v", s.Nodes)
+	}
+	want := []Message{{1, 2, "requestVote"}, {2, 1, "voteGiven"}, {1, 1, "elected"}}
+	if fmt.Sprint(s.Messages) != fmt.Sprint(want) {
+		t.Fatalf("election messages %v, expected %v", s.Messages, want)
+	}
+
+	s = steps[1]
+	if len(s.Messages) != 1 || s.Messages[0] != (Message{1, 2, "appendEntries"}) {
+		t.Fatalf("duplicate messages not merged: %v", s.Messages)
+	}
+	if len(s.Committed) != 1 || s.Committed[0] != (Entry{Term: 1, Command: "x"}) {
+		t.Fatalf("wrong committed %v", s.Committed)
+	}
+
+	s = steps[2]
+	if s.Nodes[1].State != "crashed" || s.Messages[0] != (Message{1, 2, "appendEntries(drop)"}) {
+		t.Fatalf("crash not shown: %+v", s)
+	}
+	if steps[3].Nodes[1].State != "follower" {
+		t.Fatalf("restarted node still crashed: %+v", steps[3])
+	}
+
+	// the format round-trips through a real cluster's EventLog.
+	var buf bytes.Buffer
+	el := raft.NewEventLog(&buf, nil)
+	t.Setenv("RAFT_METRICS_DIR", t.TempDir())
+	c := MakeCluster(3, false, el)
+	time.Sleep(time.Second)
+	c.Kill()
+	el.Flush()
+	recorded, err := raft.ReadEvents(&buf)
+	if err != nil || len(recorded) == 0 {
+		t.Fatalf("ReadEvents: %v events, %v", len(recorded), err)
+	}
+	// leave out the Kill.
+	live := recorded[:0]
+	for _, e := range recorded {
+		if e.Kind != raft.EventCrash {
+			live = append(live, e)
+		}
+	}
+	steps = Replay(live, 50*time.Millisecond)
+	leaders := 0
+	for _, n := range steps[len(steps)-1].Nodes {
+		if n.State == "leader" {
+			leaders++
+		}
+	}
+	if leaders != 1 {
+		t.Fatalf("%v leaders at the end of the replay: %+v", leaders, steps[len(steps)-1])
+	}
+}
@@ -0,0 +1,209 @@
+package dashbridge
+
+//
+// just enough of RFC 6455 for the dashboard: text messages,
+// ping/pong and close, no extensions. the server's frames are
+// unmasked; a client's must be masked.
+//
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// the biggest message we will read.
+const wsMaxMessage = 1 << 20
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+type wsConn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // we are the client, so mask what we send
+
+	wmu sync.Mutex // one writer at a time
+}
+
+// the Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerHas(r *http.Request, name, token string) bool {
+	for _, v := range strings.Split(r.Header.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgrade an HTTP request to a WebSocket, or fail with a 400.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !headerHas(r, "Connection", "upgrade") ||
+		!headerHas(r, "Upgrade", "websocket") || key == "" ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot hijack connection", http.StatusInternalServerError)
+		return nil, errors.New("cannot hijack connection")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
+
+// read one frame.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.br, h[:]); err != nil {
+		return
+	}
+	fin = h[0]&0x80 != 0
+	op = h[0] & 0x0F
+	masked := h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7F)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > wsMaxMessage {
+		err = fmt.Errorf("websocket: %d byte frame is too big", n)
+		return
+	}
+	if masked == c.client {
+		err = errors.New("websocket: wrong frame masking")
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// read the next text or binary message, answering pings on the
+// way. returns io.EOF once the peer has closed.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opText, opBinary, opContinuation:
+			msg = append(msg, payload...)
+			if len(msg) > wsMaxMessage {
+				return nil, errors.New("websocket: message is too big")
+			}
+			if fin {
+				return msg, nil
+			}
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+		case opPong:
+		case opClose:
+			c.writeFrame(opClose, nil)
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+	}
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := []byte{0x80 | op}
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	n := len(payload)
+	switch {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if c.client {
+		// the mask only defeats proxy cache poisoning; a fixed
+		// one is fine for tests.
+		mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i%4])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *wsConn) writeText(p []byte) error {
+	return c.writeFrame(opText, p)
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,141 @@
+package labrpc
+
+//
+// a feed of what happens to each message on the network, for
+// tools that want to draw or log real traffic.
+//
+// ch, cancel := net.Subscribe(1000) -- a channel of MessageEvents
+//   with room for 1000; cancel() stops the feed and closes ch.
+//   Cleanup() closes every subscriber's channel too.
+//
+// each request gets an Id, and goes through:
+//
+//   MsgSent      the network took the request from an end
+//   MsgDelivered the request reached the handler
+//   MsgReplied   the reply reached the caller
+//   MsgDropped   the caller got no reply; Outcome says why
+//
+// a held-back or duplicated request is delivered again, late,
+// after its Dropped or Replied event. a subscriber that falls more
+// than its channel's capacity behind misses events; Missed() says
+// how many.
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type MessageKind int
+
+const (
+	MsgSent MessageKind = iota
+	MsgDelivered
+	MsgReplied
+	MsgDropped
+)
+
+func (k MessageKind) String() string {
+	switch k {
+	case MsgSent:
+		return "sent"
+	case MsgDelivered:
+		return "delivered"
+	case MsgReplied:
+		return "replied"
+	case MsgDropped:
+		return "dropped"
+	}
+	return fmt.Sprintf("MessageKind(%d)", int(k))
+}
+
+type MessageEvent struct {
+	Kind    MessageKind
+	Id      uint64      // the same for every event of one request
+	Endname interface{} // the sending end
+	From    interface{} // the server that owns it (see SetOwner), or nil
+	To      interface{} // the server it is connected to, or nil
+	Method  string      // e.g. "Raft.AppendEntries"
+	Bytes   int         // of the request, or for MsgReplied the reply
+	Outcome Outcome     // for MsgDropped: Dropped, TimedOut or ServerDead
+	Sent    time.Time   // when the network took the request
+	Time    time.Time   // when this happened
+}
+
+type feed struct {
+	mu     sync.Mutex
+	subs   map[chan MessageEvent]bool
+	closed bool
+	missed int64
+}
+
+func (rn *Network) Subscribe(capacity int) (<-chan MessageEvent, func()) {
+	ch := make(chan MessageEvent, capacity)
+	rn.feed.mu.Lock()
+	defer rn.feed.mu.Unlock()
+	if rn.feed.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	rn.feed.subs[ch] = true
+	return ch, func() {
+		rn.feed.mu.Lock()
+		defer rn.feed.mu.Unlock()
+		if rn.feed.subs[ch] {
+			delete(rn.feed.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// how many events slow subscribers have missed, in all.
+func (rn *Network) Missed() int64 {
+	rn.feed.mu.Lock()
+	defer rn.feed.mu.Unlock()
+	return rn.feed.missed
+}
+
+// close every subscriber's channel.
+func (f *feed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		close(ch)
+	}
+	f.subs = map[chan MessageEvent]bool{}
+	f.closed = true
+}
+
+// tell subscribers about req. never blocks.
+func (rn *Network) publish(kind MessageKind, req reqMsg, servername interface{}, outcome Outcome, bytes int) {
+	rn.feed.mu.Lock()
+	defer rn.feed.mu.Unlock()
+	if len(rn.feed.subs) == 0 {
+		return
+	}
+
+	rn.mu.Lock()
+	from := rn.owners[req.endname]
+	rn.mu.Unlock()
+
+	ev := MessageEvent{
+		Kind:    kind,
+		Id:      req.id,
+		Endname: req.endname,
+		From:    from,
+		To:      servername,
+		Method:  req.svcMeth,
+		Bytes:   bytes,
+		Outcome: outcome,
+		Sent:    req.sent,
+		Time:    rn.clock.Now(),
+	}
+	for ch := range rn.feed.subs {
+		select {
+		case ch <- ev:
+		default:
+			rn.feed.missed++
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package labrpc
+
+//
+// what an unreliable network does to the RPCs it carries.
+//
+// net.SetFaults(FaultModel{...}) -- the model for every link.
+// net.SetLinkFaults(endname, &FaultModel{...}) -- overrides it for
+//   one ClientEnd, i.e. one client/server pair; nil removes the override.
+// end.DropRate() -- the drop probability now in effect for end.
+//
+// Reliable(false), LongReordering(true) and RequestReordering(true)
+// are shorthands that set the network-wide model's Drop/Latency,
+// Reorder, and HoldBack/Duplicate respectively.
+//
+// a held-back request fails at once for the caller, which will
+// usually try again, and reaches the handler later; so does the
+// second copy of a duplicated one. whatever server then answers
+// for the end runs it, and the reply goes nowhere.
+//
+
+import (
+	"math/rand"
+	"time"
+)
+
+type FaultModel struct {
+	Drop      float64 // probability that a request, and again its reply, is lost
+	Latency   Latency // delay before a request is delivered; nil means none
+	Duplicate float64 // probability that the handler runs a request twice, the second time late
+	Reorder   float64 // probability that a reply is held back 200ms-2.2s
+	HoldBack  float64 // probability that a request is lost to the caller but delivered late
+	Stale     Latency // how late; nil means uniformly 100ms-1s
+}
+
+// what Reliable(false) has always meant.
+var unreliableDrop = 0.1
+var unreliableLatency = Uniform{Max: 27 * time.Millisecond}
+
+// what LongReordering(true) has always meant.
+var longReorder = 600.0 / 900.0
+
+// what RequestReordering(true) means.
+var requestHoldBack = 0.1
+var requestDuplicate = 0.1
+
+var defaultStale = Uniform{Min: 100 * time.Millisecond, Max: time.Second}
+
+// a latency distribution.
+type Latency interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+// uniformly distributed in [Min, Max).
+type Uniform struct {
+	Min, Max time.Duration
+}
+
+func (u Uniform) Sample(r *rand.Rand) time.Duration {
+	if u.Max <= u.Min {
+		return u.Min
+	}
+	return u.Min + time.Duration(r.Int63n(int64(u.Max-u.Min)))
+}
+
+// Min plus an exponentially distributed delay with mean Mean,
+// for a long tail.
+type Exponential struct {
+	Min, Mean time.Duration
+}
+
+func (x Exponential) Sample(r *rand.Rand) time.Duration {
+	return x.Min + time.Duration(r.ExpFloat64()*float64(x.Mean))
+}
+
+// normally distributed, but never negative.
+type Normal struct {
+	Mean, StdDev time.Duration
+}
+
+func (n Normal) Sample(r *rand.Rand) time.Duration {
+	d := n.Mean + time.Duration(r.NormFloat64()*float64(n.StdDev))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// math/rand's top-level functions as a Source, so that a
+// network that hasn't been given a Rand is safe to share.
+type globalSource struct{}
+
+func (globalSource) Int63() int64 { return rand.Int63() }
+func (globalSource) Seed(int64)   {}
+
+func (rn *Network) chance(p float64) bool {
+	return p > 0 && rn.rand.Float64() < p
+}
+
+func (rn *Network) delay(fm FaultModel) {
+	if fm.Latency != nil {
+		rn.clock.Sleep(fm.Latency.Sample(rn.rand))
+	}
+}
+
+func (rn *Network) staleDelay(fm FaultModel) time.Duration {
+	if fm.Stale != nil {
+		return fm.Stale.Sample(rn.rand)
+	}
+	return defaultStale.Sample(rn.rand)
+}
+
+// how long to hold back a reordered reply.
+func (rn *Network) reorderDelay() time.Duration {
+	return time.Duration(200+rn.rand.Intn(1+rn.rand.Intn(2000))) * time.Millisecond
+}
+
+// deliver req again, late, to whichever server then answers for
+// its end, and throw the reply away.
+func (rn *Network) redeliver(req reqMsg, fm FaultModel) {
+	rn.clock.AfterFunc(rn.staleDelay(fm), func() {
+		select {
+		case <-rn.done:
+			return
+		default:
+		}
+		enabled, servername, server, _ := rn.readEndnameInfo(req.endname)
+		if enabled && servername != nil && server != nil {
+			rn.publish(MsgDelivered, req, servername, Delivered, len(req.args))
+			server.dispatch(req)
+		}
+	})
+}
+
+func (rn *Network) SetFaults(fm FaultModel) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.faults = fm
+}
+
+func (rn *Network) Faults() FaultModel {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	return rn.faults
+}
+
+// override the network's model for one end, or with nil
+// go back to it.
+func (rn *Network) SetLinkFaults(endname interface{}, fm *FaultModel) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if fm == nil {
+		delete(rn.linkFaults, endname)
+	} else {
+		rn.linkFaults[endname] = *fm
+	}
+}
+
+// the model in effect for endname. caller must hold rn.mu.
+func (rn *Network) faultsFor(endname interface{}) FaultModel {
+	if fm, ok := rn.linkFaults[endname]; ok {
+		return fm
+	}
+	return rn.faults
+}
+
+// the probability that a request on this end, or its reply,
+// is dropped.
+func (e *ClientEnd) DropRate() float64 {
+	e.net.mu.Lock()
+	defer e.net.mu.Unlock()
+
+	return e.net.faultsFor(e.endname).Drop
+}
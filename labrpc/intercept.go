@@ -0,0 +1,79 @@
+package labrpc
+
+//
+// interceptors: code that runs around every RPC, on either side.
+//
+// end.Use(ic ...ClientInterceptor) -- around end's Call()s, before
+//   args are encoded and after the reply is decoded.
+// srv.Use(ic ...ServerInterceptor) -- around every handler srv runs.
+// svc.Use(ic ...ServerInterceptor) -- around svc's handlers only,
+//   inside srv's.
+//
+// interceptors run in the order they were added, each calling
+// next to go on. one can look at or change args and reply, sleep,
+// or return without calling next. a client interceptor's error is
+// what CallContext returns; a server interceptor's non-nil error
+// means the caller gets no reply, as if the network had lost it.
+//
+// a server interceptor may pass next different args, but must
+// fill in the reply it was given.
+//
+
+import (
+	"context"
+	"reflect"
+)
+
+type Invoker func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error
+
+type ClientInterceptor func(ctx context.Context, svcMeth string, args interface{}, reply interface{}, next Invoker) error
+
+type Handler func(svcMeth string, args interface{}, reply interface{}) error
+
+type ServerInterceptor func(svcMeth string, args interface{}, reply interface{}, next Handler) error
+
+func (e *ClientEnd) Use(ics ...ClientInterceptor) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.interceptors = append(e.interceptors[:len(e.interceptors):len(e.interceptors)], ics...)
+}
+
+func (rs *Server) Use(ics ...ServerInterceptor) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.interceptors = append(rs.interceptors[:len(rs.interceptors):len(rs.interceptors)], ics...)
+}
+
+func (svc *Service) Use(ics ...ServerInterceptor) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.interceptors = append(svc.interceptors[:len(svc.interceptors):len(svc.interceptors)], ics...)
+}
+
+func chainClient(ics []ClientInterceptor, call Invoker) Invoker {
+	for i := len(ics) - 1; i >= 0; i-- {
+		ic, next := ics[i], call
+		call = func(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+			return ic(ctx, svcMeth, args, reply, next)
+		}
+	}
+	return call
+}
+
+func chainServer(ics []ServerInterceptor, h Handler) Handler {
+	for i := len(ics) - 1; i >= 0; i-- {
+		ic, next := ics[i], h
+		h = func(svcMeth string, args interface{}, reply interface{}) error {
+			return ic(svcMeth, args, reply, next)
+		}
+	}
+	return h
+}
+
+// a Handler that calls method on svc's receiver.
+func (svc *Service) handler(method reflect.Method) Handler {
+	return func(svcMeth string, args interface{}, reply interface{}) error {
+		method.Func.Call([]reflect.Value{svc.rcvr, reflect.ValueOf(args), reflect.ValueOf(reply)})
+		return nil
+	}
+}
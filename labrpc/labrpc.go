@@ -22,8 +22,18 @@ package labrpc
 // net.Connect(endname, servername) -- connect a client to a server.
 // net.Enable(endname, enabled) -- enable/disable a client.
 // net.Reliable(bool) -- false means drop/delay messages
+// net.SetFaults(FaultModel) -- finer control of drops, delays, etc.; see fault.go.
+// net.Partition(groups) -- split the servers; see partition.go.
+// net.Stats() -- RPC counts and bytes by method, link and outcome; see stats.go.
+// net.Subscribe(n) -- a channel of every message's fate; see capture.go.
+// net.SetClock(c), net.SetRand(r) -- the time and randomness the network
+//   uses; by default the wall clock and math/rand's. with a clock.Sim,
+//   each Call() runs in the caller's task, handler and all.
 //
 // end.Call("Raft.AppendEntries", &args, &reply) -- send an RPC, wait for reply.
+// end.CallContext(ctx, "Raft.AppendEntries", &args, &reply) -- the same,
+//   but give up when ctx is done; returns an error instead of a bool.
+// end.Use(interceptor), srv.Use(interceptor) -- middleware; see intercept.go.
 // the "Raft" is the name of the server struct to be called.
 // the "AppendEntries" is the name of the method to be called.
 // Call() returns true to indicate that the server executed the request
@@ -51,8 +61,11 @@ package labrpc
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"log"
 	"math/rand"
+	"mitraft/clock"
 	"mitraft/labgob"
 	"reflect"
 	"strings"
@@ -67,6 +80,8 @@ type reqMsg struct {
 	argsType reflect.Type
 	args     []byte
 	replyCh  chan replyMsg
+	id       uint64    // set by the network, for its feed
+	sent     time.Time // when the network took it
 }
 
 type replyMsg struct {
@@ -76,25 +91,60 @@ type replyMsg struct {
 
 type ClientEnd struct {
 	endname interface{}   // this end-point's name
+	net     *Network      // the network it belongs to
 	ch      chan reqMsg   // copy of Network.endCh
 	done    chan struct{} // closed when Network is cleaned up
+
+	mu           sync.Mutex
+	interceptors []ClientInterceptor
 }
 
+// CallContext's error when the network lost the request or the
+// reply, or the server is down.
+var ErrLost = errors.New("labrpc: no reply")
+
 // send an RPC, wait for the reply.
 // the return value indicates success; false means that
 // no reply was received from the server.
 func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	return e.CallContext(context.Background(), svcMeth, args, reply) == nil
+}
+
+// send an RPC, wait for the reply or for ctx to be done.
+// returns nil if the reply is valid, ErrLost if no reply came,
+// and ctx.Err() -- context.Canceled or context.DeadlineExceeded
+// -- if the caller stopped waiting. the request may still reach
+// the server after that.
+func (e *ClientEnd) CallContext(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	e.mu.Lock()
+	ics := e.interceptors
+	e.mu.Unlock()
+	return chainClient(ics, e.call)(ctx, svcMeth, args, reply)
+}
+
+// CallContext without the interceptors.
+func (e *ClientEnd) call(ctx context.Context, svcMeth string, args interface{}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	req := reqMsg{}
 	req.endname = e.endname
 	req.svcMeth = svcMeth
 	req.argsType = reflect.TypeOf(args)
-	req.replyCh = make(chan replyMsg)
+	// buffered, so the network can reply to a caller that has
+	// gone away without blocking.
+	req.replyCh = make(chan replyMsg, 1)
 
 	qb := new(bytes.Buffer)
 	qe := labgob.NewEncoder(qb)
 	qe.Encode(args)
 	req.args = qb.Bytes()
 
+	if e.net.simulated() {
+		return e.simCall(ctx, req, reply)
+	}
+
 	//
 	// send the request.
 	//
@@ -103,47 +153,98 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 		// the request has been sent.
 	case <-e.done:
 		// entire Network has been destroyed.
-		return false
+		return ErrLost
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
 	//
 	// wait for the reply.
 	//
-	rep := <-req.replyCh
+	var rep replyMsg
+	select {
+	case rep = <-req.replyCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return decodeReply(rep, reply)
+}
+
+// call() in a simulation: no goroutines, just the caller's task.
+func (e *ClientEnd) simCall(ctx context.Context, req reqMsg, reply interface{}) error {
+	select {
+	case <-e.done:
+		return ErrLost
+	default:
+	}
+	e.net.accept(req)
+	e.net.processReq(req)
+
+	var rep replyMsg
+	got := false
+	e.net.clock.Until(func() bool {
+		select {
+		case rep = <-req.replyCh:
+			got = true
+		default:
+		}
+		return got || ctx.Err() != nil
+	})
+	if !got {
+		return ctx.Err()
+	}
+	return decodeReply(rep, reply)
+}
+
+func decodeReply(rep replyMsg, reply interface{}) error {
 	if rep.ok {
 		rb := bytes.NewBuffer(rep.reply)
 		rd := labgob.NewDecoder(rb)
 		if err := rd.Decode(reply); err != nil {
 			log.Fatalf("ClientEnd.Call(): decode reply: %v\n", err)
 		}
-		return true
+		return nil
 	} else {
-		return false
+		return ErrLost
 	}
 }
 
 type Network struct {
-	mu             sync.Mutex
-	reliable       bool
-	longDelays     bool                        // pause a long time on send on disabled connection
-	longReordering bool                        // sometimes delay replies a long time
-	ends           map[interface{}]*ClientEnd  // ends, by name
-	enabled        map[interface{}]bool        // by end name
-	servers        map[interface{}]*Server     // servers, by name
-	connections    map[interface{}]interface{} // endname -> servername
-	endCh          chan reqMsg
-	done           chan struct{} // closed when Network is cleaned up
-	count          int32         // total RPC count, for statistics
-	bytes          int64         // total bytes send, for statistics
+	mu          sync.Mutex
+	faults      FaultModel                  // for every link without its own
+	linkFaults  map[interface{}]FaultModel  // by end name
+	longDelays  bool                        // pause a long time on send on disabled connection
+	ends        map[interface{}]*ClientEnd  // ends, by name
+	enabled     map[interface{}]bool        // by end name
+	servers     map[interface{}]*Server     // servers, by name
+	connections map[interface{}]interface{} // endname -> servername
+	owners      map[interface{}]interface{} // endname -> servername it sends for
+	groups      map[interface{}][]int       // servername -> partition groups; nil if none
+	cut         map[link]bool               // one-way links that are down
+	stats       Stats                       // see stats.go
+	feed        feed                        // see capture.go
+	seq         uint64                      // the last request's id
+	clock       clock.Clock
+	rand        *rand.Rand
+	endCh       chan reqMsg
+	done        chan struct{} // closed when Network is cleaned up
+	count       int32         // total RPC count, for statistics
+	bytes       int64         // total bytes send, for statistics
 }
 
 func MakeNetwork() *Network {
 	rn := &Network{}
-	rn.reliable = true
+	rn.linkFaults = map[interface{}]FaultModel{}
 	rn.ends = map[interface{}]*ClientEnd{}
 	rn.enabled = map[interface{}]bool{}
 	rn.servers = map[interface{}]*Server{}
 	rn.connections = map[interface{}](interface{}){}
+	rn.owners = map[interface{}]interface{}{}
+	rn.cut = map[link]bool{}
+	rn.stats = Stats{}
+	rn.feed.subs = map[chan MessageEvent]bool{}
+	rn.clock = clock.Real{}
+	rn.rand = rand.New(globalSource{})
 	rn.endCh = make(chan reqMsg)
 	rn.done = make(chan struct{})
 
@@ -152,8 +253,7 @@ func MakeNetwork() *Network {
 		for {
 			select {
 			case xreq := <-rn.endCh:
-				atomic.AddInt32(&rn.count, 1)
-				atomic.AddInt64(&rn.bytes, int64(len(xreq.args)))
+				rn.accept(xreq)
 				go rn.processReq(xreq)
 			case <-rn.done:
 				return
@@ -164,22 +264,72 @@ func MakeNetwork() *Network {
 	return rn
 }
 
+// count a request the network has taken.
+func (rn *Network) accept(req reqMsg) {
+	atomic.AddInt32(&rn.count, 1)
+	atomic.AddInt64(&rn.bytes, int64(len(req.args)))
+}
+
+// call before the network carries any RPCs.
+func (rn *Network) SetClock(c clock.Clock) {
+	rn.clock = c
+}
+
+// call before the network carries any RPCs. r need not be safe
+// for concurrent use if the clock is a clock.Sim.
+func (rn *Network) SetRand(r *rand.Rand) {
+	rn.rand = r
+}
+
+// is the network part of a simulation, whose tasks run one
+// at a time?
+func (rn *Network) simulated() bool {
+	_, ok := rn.clock.(*clock.Sim)
+	return ok
+}
+
 func (rn *Network) Cleanup() {
 	close(rn.done)
+	rn.feed.close()
 }
 
 func (rn *Network) Reliable(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	rn.reliable = yes
+	if yes {
+		rn.faults.Drop = 0
+		rn.faults.Latency = nil
+	} else {
+		rn.faults.Drop = unreliableDrop
+		rn.faults.Latency = unreliableLatency
+	}
 }
 
 func (rn *Network) LongReordering(yes bool) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	rn.longReordering = yes
+	if yes {
+		rn.faults.Reorder = longReorder
+	} else {
+		rn.faults.Reorder = 0
+	}
+}
+
+// hold back and duplicate some requests, so that handlers see
+// them late and out of order.
+func (rn *Network) RequestReordering(yes bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	if yes {
+		rn.faults.HoldBack = requestHoldBack
+		rn.faults.Duplicate = requestDuplicate
+	} else {
+		rn.faults.HoldBack = 0
+		rn.faults.Duplicate = 0
+	}
 }
 
 func (rn *Network) LongDelays(yes bool) {
@@ -190,7 +340,7 @@ func (rn *Network) LongDelays(yes bool) {
 }
 
 func (rn *Network) readEndnameInfo(endname interface{}) (enabled bool,
-	servername interface{}, server *Server, reliable bool, longreordering bool,
+	servername interface{}, server *Server, faults FaultModel,
 ) {
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
@@ -199,9 +349,9 @@ func (rn *Network) readEndnameInfo(endname interface{}) (enabled bool,
 	servername = rn.connections[endname]
 	if servername != nil {
 		server = rn.servers[servername]
+		enabled = enabled && rn.linkUp(endname, servername)
 	}
-	reliable = rn.reliable
-	longreordering = rn.longReordering
+	faults = rn.faultsFor(endname)
 	return
 }
 
@@ -209,44 +359,67 @@ func (rn *Network) isServerDead(endname interface{}, servername interface{}, ser
 	rn.mu.Lock()
 	defer rn.mu.Unlock()
 
-	if rn.enabled[endname] == false || rn.servers[servername] != server {
+	if rn.enabled[endname] == false || rn.servers[servername] != server ||
+		!rn.linkUp(endname, servername) {
 		return true
 	}
 	return false
 }
 
 func (rn *Network) processReq(req reqMsg) {
-	enabled, servername, server, reliable, longreordering := rn.readEndnameInfo(req.endname)
+	enabled, servername, server, faults := rn.readEndnameInfo(req.endname)
+	req.id = atomic.AddUint64(&rn.seq, 1)
+	req.sent = rn.clock.Now()
+	rn.publish(MsgSent, req, servername, Delivered, len(req.args))
 
 	if enabled && servername != nil && server != nil {
-		if reliable == false {
-			// short delay
-			ms := (rand.Int() % 27)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
-		}
+		rn.delay(faults)
 
-		if reliable == false && (rand.Int()%1000) < 100 {
+		if rn.chance(faults.Drop) {
 			// drop the request, return as if timeout
+			rn.record(req, servername, Dropped, 0)
 			req.replyCh <- replyMsg{false, nil}
 			return
 		}
 
+		if rn.chance(faults.HoldBack) {
+			// return as if lost, but deliver it later, after
+			// newer requests.
+			rn.record(req, servername, Dropped, 0)
+			req.replyCh <- replyMsg{false, nil}
+			rn.redeliver(req, faults)
+			return
+		}
+
+		if rn.chance(faults.Duplicate) {
+			// the handler sees the request again later.
+			rn.redeliver(req, faults)
+		}
+
 		// execute the request (call the RPC handler).
 		// in a separate thread so that we can periodically check
 		// if the server has been killed and the RPC should get a
-		// failure reply.
+		// failure reply. a simulation runs one thing at a time,
+		// so there it can only run the handler and then check.
+		var reply replyMsg
+		replyOK := false
+		serverDead := false
 		ech := make(chan replyMsg)
-		go func() {
-			r := server.dispatch(req)
-			ech <- r
-		}()
+		if rn.simulated() {
+			rn.publish(MsgDelivered, req, servername, Delivered, len(req.args))
+			reply = server.dispatch(req)
+			replyOK = true
+		} else {
+			go func() {
+				rn.publish(MsgDelivered, req, servername, Delivered, len(req.args))
+				r := server.dispatch(req)
+				ech <- r
+			}()
+		}
 
 		// wait for handler to return,
 		// but stop waiting if DeleteServer() has been called,
 		// and return an error.
-		var reply replyMsg
-		replyOK := false
-		serverDead := false
 		for replyOK == false && serverDead == false {
 			select {
 			case reply = <-ech:
@@ -271,22 +444,25 @@ func (rn *Network) processReq(req reqMsg) {
 
 		if replyOK == false || serverDead == true {
 			// server was killed while we were waiting; return error.
+			rn.record(req, servername, ServerDead, 0)
 			req.replyCh <- replyMsg{false, nil}
-		} else if reliable == false && (rand.Int()%1000) < 100 {
+		} else if rn.chance(faults.Drop) {
 			// drop the reply, return as if timeout
+			rn.record(req, servername, Dropped, 0)
 			req.replyCh <- replyMsg{false, nil}
-		} else if longreordering == true && rand.Intn(900) < 600 {
+		} else if rn.chance(faults.Reorder) {
 			// delay the response for a while
-			ms := 200 + rand.Intn(1+rand.Intn(2000))
 			// Russ points out that this timer arrangement will decrease
 			// the number of goroutines, so that the race
 			// detector is less likely to get upset.
-			time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			rn.clock.AfterFunc(rn.reorderDelay(), func() {
 				atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
+				rn.record(req, servername, Delivered, len(reply.reply))
 				req.replyCh <- reply
 			})
 		} else {
 			atomic.AddInt64(&rn.bytes, int64(len(reply.reply)))
+			rn.record(req, servername, Delivered, len(reply.reply))
 			req.replyCh <- reply
 		}
 	} else {
@@ -295,13 +471,14 @@ func (rn *Network) processReq(req reqMsg) {
 		if rn.longDelays {
 			// let Raft tests check that leader doesn't send
 			// RPCs synchronously.
-			ms = (rand.Int() % 7000)
+			ms = (rn.rand.Int() % 7000)
 		} else {
 			// many kv tests require the client to try each
 			// server in fairly rapid succession.
-			ms = (rand.Int() % 100)
+			ms = (rn.rand.Int() % 100)
 		}
-		time.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+		rn.clock.AfterFunc(time.Duration(ms)*time.Millisecond, func() {
+			rn.record(req, servername, TimedOut, 0)
 			req.replyCh <- replyMsg{false, nil}
 		})
 	}
@@ -320,6 +497,7 @@ func (rn *Network) MakeEnd(endname interface{}) *ClientEnd {
 
 	e := &ClientEnd{}
 	e.endname = endname
+	e.net = rn
 	e.ch = rn.endCh
 	e.done = rn.done
 	rn.ends[endname] = e
@@ -383,9 +561,10 @@ func (rn *Network) GetTotalBytes() int64 {
 // the same rpc dispatcher. so that e.g. both a Raft
 // and a k/v server can listen to the same rpc endpoint.
 type Server struct {
-	mu       sync.Mutex
-	services map[string]*Service
-	count    int // incoming RPCs
+	mu           sync.Mutex
+	services     map[string]*Service
+	count        int // incoming RPCs
+	interceptors []ServerInterceptor
 }
 
 func MakeServer() *Server {
@@ -411,11 +590,12 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 	methodName := req.svcMeth[dot+1:]
 
 	service, ok := rs.services[serviceName]
+	ics := rs.interceptors
 
 	rs.mu.Unlock()
 
 	if ok {
-		return service.dispatch(methodName, req)
+		return service.dispatch(methodName, req, ics)
 	} else {
 		choices := []string{}
 		for k, _ := range rs.services {
@@ -440,6 +620,9 @@ type Service struct {
 	rcvr    reflect.Value
 	typ     reflect.Type
 	methods map[string]reflect.Method
+
+	mu           sync.Mutex
+	interceptors []ServerInterceptor
 }
 
 func MakeService(rcvr interface{}) *Service {
@@ -473,7 +656,9 @@ func MakeService(rcvr interface{}) *Service {
 	return svc
 }
 
-func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
+// run the handler inside outer, the server's interceptors, and
+// then svc's own.
+func (svc *Service) dispatch(methname string, req reqMsg, outer []ServerInterceptor) replyMsg {
 	if method, ok := svc.methods[methname]; ok {
 		// prepare space into which to read the argument.
 		// the Value's type will be a pointer to req.argsType.
@@ -490,8 +675,13 @@ func (svc *Service) dispatch(methname string, req reqMsg) replyMsg {
 		replyv := reflect.New(replyType)
 
 		// call the method.
-		function := method.Func
-		function.Call([]reflect.Value{svc.rcvr, args.Elem(), replyv})
+		svc.mu.Lock()
+		ics := append(outer[:len(outer):len(outer)], svc.interceptors...)
+		svc.mu.Unlock()
+		h := chainServer(ics, svc.handler(method))
+		if err := h(req.svcMeth, args.Elem().Interface(), replyv.Interface()); err != nil {
+			return replyMsg{false, nil}
+		}
 
 		// encode the reply.
 		rb := new(bytes.Buffer)
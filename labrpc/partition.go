@@ -0,0 +1,86 @@
+package labrpc
+
+//
+// partitions and one-way link failures, between servers.
+//
+// net.SetOwner(endname, servername) -- end sends on behalf of servername.
+//   ends without an owner, e.g. clerks', are never partitioned.
+// net.Partition([][]servername) -- a server can reach another only if
+//   some group holds both. a server in two groups bridges them; one in
+//   none is cut off from every server.
+// net.CutLink(from, to) -- RPCs from's ends send to to are lost;
+//   to's to from still work.
+// net.RestoreLink(from, to) -- undo CutLink.
+// net.Heal() -- undo Partition and every CutLink.
+//
+// a request over a link that is down looks like one from a disabled
+// end; a reply to a request whose link went down in the meantime is
+// lost.
+//
+
+type link struct {
+	from, to interface{}
+}
+
+func (rn *Network) SetOwner(endname interface{}, servername interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.owners[endname] = servername
+}
+
+func (rn *Network) Partition(groups [][]interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.groups = map[interface{}][]int{}
+	for g, servers := range groups {
+		for _, s := range servers {
+			rn.groups[s] = append(rn.groups[s], g)
+		}
+	}
+}
+
+func (rn *Network) CutLink(from, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.cut[link{from, to}] = true
+}
+
+func (rn *Network) RestoreLink(from, to interface{}) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	delete(rn.cut, link{from, to})
+}
+
+func (rn *Network) Heal() {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	rn.groups = nil
+	rn.cut = map[link]bool{}
+}
+
+// can endname reach servername? caller must hold rn.mu.
+func (rn *Network) linkUp(endname interface{}, servername interface{}) bool {
+	from, ok := rn.owners[endname]
+	if !ok {
+		return true
+	}
+	if rn.cut[link{from, servername}] {
+		return false
+	}
+	if rn.groups == nil || from == servername {
+		return true
+	}
+	for _, g := range rn.groups[from] {
+		for _, h := range rn.groups[servername] {
+			if g == h {
+				return true
+			}
+		}
+	}
+	return false
+}
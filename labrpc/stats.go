@@ -0,0 +1,146 @@
+package labrpc
+
+//
+// per-method, per-link and per-outcome RPC counts and bytes.
+//
+// st := net.Stats() -- a copy of everything so far.
+// st.Sub(old) -- what happened since old.
+// st.Group(func(k StatKey) StatKey { k.From, k.To = nil, nil; return k })
+//   -- add up over the fields the function blanks out.
+//
+// From is the server that owns the sending end (see SetOwner), or
+// nil; To is the server the end is connected to, or nil.
+//
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type Outcome int
+
+const (
+	Delivered  Outcome = iota // the caller got the reply
+	Dropped                   // the fault model lost the request or the reply
+	TimedOut                  // the end was disabled or had no server
+	ServerDead                // the server was deleted, or the link cut, while it ran the handler
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Delivered:
+		return "delivered"
+	case Dropped:
+		return "dropped"
+	case TimedOut:
+		return "timeout"
+	case ServerDead:
+		return "dead"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+type StatKey struct {
+	Method   string
+	From, To interface{}
+	Outcome  Outcome
+}
+
+type Stat struct {
+	Count        int
+	RequestBytes int64
+	ReplyBytes   int64 // of replies that reached the caller
+}
+
+type Stats map[StatKey]Stat
+
+func (s Stat) add(o Stat) Stat {
+	return Stat{s.Count + o.Count, s.RequestBytes + o.RequestBytes, s.ReplyBytes + o.ReplyBytes}
+}
+
+// count req's outcome, and tell the feed.
+func (rn *Network) record(req reqMsg, servername interface{}, outcome Outcome, replyBytes int) {
+	rn.mu.Lock()
+	k := StatKey{Method: req.svcMeth, From: rn.owners[req.endname], To: servername, Outcome: outcome}
+	rn.stats[k] = rn.stats[k].add(Stat{1, int64(len(req.args)), int64(replyBytes)})
+	rn.mu.Unlock()
+
+	if outcome == Delivered {
+		rn.publish(MsgReplied, req, servername, outcome, replyBytes)
+	} else {
+		rn.publish(MsgDropped, req, servername, outcome, len(req.args))
+	}
+}
+
+func (rn *Network) Stats() Stats {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+
+	st := Stats{}
+	for k, v := range rn.stats {
+		st[k] = v
+	}
+	return st
+}
+
+func (st Stats) Sub(old Stats) Stats {
+	d := Stats{}
+	for k, v := range st {
+		o := old[k]
+		if v != o {
+			d[k] = Stat{v.Count - o.Count, v.RequestBytes - o.RequestBytes, v.ReplyBytes - o.ReplyBytes}
+		}
+	}
+	return d
+}
+
+func (st Stats) Group(key func(StatKey) StatKey) Stats {
+	g := Stats{}
+	for k, v := range st {
+		k = key(k)
+		g[k] = g[k].add(v)
+	}
+	return g
+}
+
+func (st Stats) Total() Stat {
+	var t Stat
+	for _, v := range st {
+		t = t.add(v)
+	}
+	return t
+}
+
+// print a table with a row for each method: how many RPCs had
+// each outcome, and the bytes sent each way.
+func (st Stats) WriteTable(w io.Writer, indent string) {
+	type row struct {
+		n                  [ServerDead + 1]int
+		reqBytes, repBytes int64
+	}
+	rows := map[string]*row{}
+	var methods []string
+	for k, v := range st {
+		r := rows[k.Method]
+		if r == nil {
+			r = &row{}
+			rows[k.Method] = r
+			methods = append(methods, k.Method)
+		}
+		if k.Outcome >= Delivered && k.Outcome <= ServerDead {
+			r.n[k.Outcome] += v.Count
+		}
+		r.reqBytes += v.RequestBytes
+		r.repBytes += v.ReplyBytes
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintf(w, "%s%-24s %9s %7s %7s %5s %10s %10s\n", indent,
+		"method", Delivered, Dropped, TimedOut, ServerDead, "req bytes", "rep bytes")
+	for _, m := range methods {
+		r := rows[m]
+		fmt.Fprintf(w, "%s%-24s %9d %7d %7d %5d %10d %10d\n", indent,
+			m, r.n[Delivered], r.n[Dropped], r.n[TimedOut], r.n[ServerDead], r.reqBytes, r.repBytes)
+	}
+}
@@ -1,7 +1,9 @@
 package labrpc
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"runtime"
 	"strconv"
 	"sync"
@@ -265,6 +267,367 @@ func TestBytes(t *testing.T) {
 	}
 }
 
+// test net.Stats()
+func TestStats(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer(99, rs)
+
+	mk := func(name string, owner interface{}) *ClientEnd {
+		e := rn.MakeEnd(name)
+		rn.Connect(name, 99)
+		rn.Enable(name, true)
+		if owner != nil {
+			rn.SetOwner(name, owner)
+		}
+		return e
+	}
+	good := mk("good", "a")
+	lossy := mk("lossy", "b")
+	rn.SetLinkFaults("lossy", &FaultModel{Drop: 1})
+	off := mk("off", nil)
+	rn.Enable("off", false)
+
+	for i := 0; i < 5; i++ {
+		reply := ""
+		good.Call("JunkServer.Handler2", i, &reply)
+		lossy.Call("JunkServer.Handler2", i, &reply)
+	}
+	for i := 0; i < 3; i++ {
+		reply := 0
+		good.Call("JunkServer.Handler6", "xxxxxxxxxx", &reply)
+		off.Call("JunkServer.Handler6", "xxxxxxxxxx", &reply)
+	}
+
+	st := rn.Stats()
+	want := map[StatKey]int{
+		{"JunkServer.Handler2", "a", 99, Delivered}: 5,
+		{"JunkServer.Handler2", "b", 99, Dropped}:   5,
+		{"JunkServer.Handler6", "a", 99, Delivered}: 3,
+		{"JunkServer.Handler6", nil, 99, TimedOut}:  3,
+	}
+	if len(st) != len(want) {
+		t.Fatalf("Stats() %v, expected %v", st, want)
+	}
+	for k, n := range want {
+		if st[k].Count != n {
+			t.Fatalf("Stats()[%v] = %+v, expected %v RPCs", k, st[k], n)
+		}
+	}
+	if s := st[StatKey{"JunkServer.Handler2", "b", 99, Dropped}]; s.RequestBytes == 0 || s.ReplyBytes != 0 {
+		t.Fatalf("wrong bytes for dropped RPCs %+v", s)
+	}
+	if tot := st.Total(); tot.RequestBytes+tot.ReplyBytes != rn.GetTotalBytes() {
+		t.Fatalf("Total() %+v doesn't match GetTotalBytes() %v", tot, rn.GetTotalBytes())
+	}
+
+	byMethod := st.Group(func(k StatKey) StatKey { return StatKey{Method: k.Method} })
+	if byMethod[StatKey{Method: "JunkServer.Handler2"}].Count != 10 {
+		t.Fatalf("Group() %v", byMethod)
+	}
+
+	old := rn.Stats()
+	reply := ""
+	good.Call("JunkServer.Handler2", 1, &reply)
+	d := rn.Stats().Sub(old)
+	if len(d) != 1 || d[StatKey{"JunkServer.Handler2", "a", 99, Delivered}].Count != 1 {
+		t.Fatalf("Sub() %v", d)
+	}
+}
+
+// test Subscribe()
+func TestSubscribe(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer(99, rs)
+
+	ch, cancel := rn.Subscribe(100)
+	_, cancel2 := rn.Subscribe(0) // never read; must not hold anything up
+
+	good := rn.MakeEnd("good")
+	rn.Connect("good", 99)
+	rn.Enable("good", true)
+	rn.SetOwner("good", "a")
+	lossy := rn.MakeEnd("lossy")
+	rn.Connect("lossy", 99)
+	rn.Enable("lossy", true)
+	rn.SetLinkFaults("lossy", &FaultModel{Drop: 1})
+
+	reply := ""
+	t0 := time.Now()
+	if !good.Call("JunkServer.Handler2", 111, &reply) {
+		t.Fatalf("Call failed")
+	}
+	lossy.Call("JunkServer.Handler2", 222, &reply)
+
+	var got []MessageEvent
+	for len(got) < 5 {
+		select {
+		case ev := <-ch:
+			got = append(got, ev)
+		case <-time.After(time.Second):
+			t.Fatalf("only %v events: %v", len(got), got)
+		}
+	}
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Fatalf("more events after cancel")
+	}
+
+	want := []struct {
+		kind    MessageKind
+		endname string
+		from    interface{}
+		outcome Outcome
+	}{
+		{MsgSent, "good", "a", Delivered},
+		{MsgDelivered, "good", "a", Delivered},
+		{MsgReplied, "good", "a", Delivered},
+		{MsgSent, "lossy", nil, Delivered},
+		{MsgDropped, "lossy", nil, Dropped},
+	}
+	for i, w := range want {
+		ev := got[i]
+		if ev.Kind != w.kind || ev.Endname != w.endname || ev.From != w.from || ev.To != 99 ||
+			ev.Outcome != w.outcome || ev.Method != "JunkServer.Handler2" {
+			t.Fatalf("event %v is %+v, expected %+v", i, ev, w)
+		}
+		if ev.Bytes == 0 || ev.Sent.Before(t0) || ev.Time.Before(ev.Sent) {
+			t.Fatalf("wrong size or times in %+v", ev)
+		}
+	}
+	if got[0].Id != got[2].Id || got[3].Id != got[4].Id || got[0].Id == got[3].Id {
+		t.Fatalf("wrong ids %v %v %v %v", got[0].Id, got[2].Id, got[3].Id, got[4].Id)
+	}
+	if rn.Missed() < 5 {
+		t.Fatalf("the unread subscriber missed only %v events", rn.Missed())
+	}
+
+	rn.Cleanup()
+	cancel2()
+	ch3, _ := rn.Subscribe(1)
+	if _, ok := <-ch3; ok {
+		t.Fatalf("Subscribe() after Cleanup() gave an open channel")
+	}
+}
+
+// test CallContext's three ways of failing
+func TestCallContext(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+	rn.LongDelays(true)
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server", rs)
+
+	e := rn.MakeEnd("end")
+	rn.Connect("end", "server")
+	rn.Enable("end", true)
+
+	reply := ""
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 1, &reply); err != nil || reply != "handler2-1" {
+		t.Fatalf("CallContext: %v %v", err, reply)
+	}
+
+	// Handler3 takes 20 seconds.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	x := 0
+	if err := e.CallContext(ctx, "JunkServer.Handler3", 1, &x); err != context.DeadlineExceeded {
+		t.Fatalf("CallContext past its deadline returned %v", err)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("CallContext took %v to time out", d)
+	}
+
+	// a disabled end's RPCs fail after up to 7 seconds.
+	rn.Enable("end", false)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	t0 = time.Now()
+	if err := e.CallContext(ctx, "JunkServer.Handler2", 1, &reply); err != context.Canceled {
+		t.Fatalf("cancelled CallContext returned %v", err)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("CallContext took %v to notice cancellation", d)
+	}
+	if err := e.CallContext(ctx, "JunkServer.Handler2", 1, &reply); err != context.Canceled {
+		t.Fatalf("CallContext with a done ctx returned %v", err)
+	}
+
+	rn.LongDelays(false)
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 1, &reply); err != ErrLost {
+		t.Fatalf("CallContext on a disabled end returned %v", err)
+	}
+
+	// abandoned calls leave no goroutines behind.
+	rn.LongDelays(true)
+	n0 := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		e.CallContext(ctx, "JunkServer.Handler2", i, &reply)
+		cancel()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > n0+5 {
+		t.Fatalf("%v goroutines after abandoned calls, %v before", n, n0)
+	}
+}
+
+// test ClientEnd.Use()
+func TestClientInterceptors(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer("server", rs)
+
+	e := rn.MakeEnd("end")
+	rn.Connect("end", "server")
+	rn.Enable("end", true)
+
+	var order []string
+	trace := func(name string) ClientInterceptor {
+		return func(ctx context.Context, svcMeth string, args, reply interface{}, next Invoker) error {
+			order = append(order, name+" "+svcMeth)
+			err := next(ctx, svcMeth, args, reply)
+			order = append(order, name+" done")
+			return err
+		}
+	}
+	e.Use(trace("a"), trace("b"))
+
+	// change the args on the way out and the reply on the way in.
+	e.Use(func(ctx context.Context, svcMeth string, args, reply interface{}, next Invoker) error {
+		if svcMeth != "JunkServer.Handler4" {
+			return next(ctx, svcMeth, args, reply)
+		}
+		if err := next(ctx, svcMeth, &JunkArgs{X: args.(*JunkArgs).X + 1}, reply); err != nil {
+			return err
+		}
+		reply.(*JunkReply).X += "!"
+		return nil
+	})
+
+	reply := JunkReply{}
+	if err := e.CallContext(context.Background(), "JunkServer.Handler4", &JunkArgs{4}, &reply); err != nil || reply.X != "pointer!" {
+		t.Fatalf("wrong reply %v %v", err, reply.X)
+	}
+	want := "[a JunkServer.Handler4 b JunkServer.Handler4 b done a done]"
+	if fmt.Sprint(order) != want {
+		t.Fatalf("interceptors ran %v, expected %v", order, want)
+	}
+
+	// short-circuit: the network never sees the call.
+	errNo := fmt.Errorf("no")
+	e.Use(func(ctx context.Context, svcMeth string, args, reply interface{}, next Invoker) error {
+		if svcMeth == "JunkServer.Handler2" {
+			return errNo
+		}
+		return next(ctx, svcMeth, args, reply)
+	})
+	n0 := rn.GetTotalCount()
+	r2 := ""
+	if err := e.CallContext(context.Background(), "JunkServer.Handler2", 1, &r2); err != errNo {
+		t.Fatalf("short-circuited call returned %v", err)
+	}
+	if e.Call("JunkServer.Handler2", 1, &r2) {
+		t.Fatalf("short-circuited Call succeeded")
+	}
+	if rn.GetTotalCount() != n0 {
+		t.Fatalf("short-circuited calls reached the network")
+	}
+}
+
+// test Server.Use() and Service.Use()
+func TestServerInterceptors(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server", rs)
+
+	e := rn.MakeEnd("end")
+	rn.Connect("end", "server")
+	rn.Enable("end", true)
+
+	var order []string
+	rs.Use(func(svcMeth string, args, reply interface{}, next Handler) error {
+		order = append(order, fmt.Sprintf("server %v %v", svcMeth, args))
+		return next(svcMeth, args, reply)
+	})
+	svc.Use(func(svcMeth string, args, reply interface{}, next Handler) error {
+		order = append(order, "service")
+		switch svcMeth {
+		case "JunkServer.Handler2":
+			// value args: pass on new ones.
+			return next(svcMeth, args.(int)*10, reply)
+		case "JunkServer.Handler1":
+			// no reply at all.
+			return fmt.Errorf("dropped")
+		case "JunkServer.Handler6":
+			// answer without running the handler, after a while.
+			time.Sleep(50 * time.Millisecond)
+			*reply.(*int) = -1
+			return nil
+		}
+		return next(svcMeth, args, reply)
+	})
+
+	r2 := ""
+	if !e.Call("JunkServer.Handler2", 7, &r2) || r2 != "handler2-70" {
+		t.Fatalf("wrong reply %v", r2)
+	}
+	if want := "[server JunkServer.Handler2 7 service]"; fmt.Sprint(order) != want {
+		t.Fatalf("interceptors ran %v, expected %v", order, want)
+	}
+
+	r1 := 0
+	if e.Call("JunkServer.Handler1", "9", &r1) {
+		t.Fatalf("RPC succeeded though an interceptor failed it")
+	}
+
+	t0 := time.Now()
+	r6 := 0
+	if !e.Call("JunkServer.Handler6", "xyz", &r6) || r6 != -1 || time.Since(t0) < 50*time.Millisecond {
+		t.Fatalf("wrong reply %v after %v", r6, time.Since(t0))
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log1) != 0 || len(js.log2) != 1 || js.log2[0] != 70 {
+		t.Fatalf("handlers saw %v %v", js.log1, js.log2)
+	}
+}
+
 // test RPCs from concurrent ClientEnds
 func TestConcurrentMany(t *testing.T) {
 	runtime.GOMAXPROCS(4)
@@ -372,6 +735,235 @@ func TestUnreliable(t *testing.T) {
 	}
 }
 
+// test FaultModel, network-wide and per link
+func TestFaultModel(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer(1000, rs)
+
+	lossy := rn.MakeEnd("lossy")
+	rn.Connect("lossy", 1000)
+	rn.Enable("lossy", true)
+	clean := rn.MakeEnd("clean")
+	rn.Connect("clean", 1000)
+	rn.Enable("clean", true)
+
+	rn.Reliable(false)
+	if fm := rn.Faults(); fm.Drop != 0.1 || fm.Latency == nil {
+		t.Fatalf("Reliable(false) gave %+v", fm)
+	}
+
+	rn.SetFaults(FaultModel{Drop: 0.5})
+	rn.SetLinkFaults("clean", &FaultModel{})
+	if lossy.DropRate() != 0.5 || clean.DropRate() != 0 {
+		t.Fatalf("DropRate() %v and %v, expected 0.5 and 0", lossy.DropRate(), clean.DropRate())
+	}
+
+	// a call succeeds only if neither request nor reply is lost.
+	ok := 0
+	for i := 0; i < 400; i++ {
+		reply := ""
+		if lossy.Call("JunkServer.Handler2", i, &reply) {
+			ok++
+		}
+		if !clean.Call("JunkServer.Handler2", i, &reply) {
+			t.Fatalf("RPC failed on a link without faults")
+		}
+	}
+	if ok < 60 || ok > 140 {
+		t.Fatalf("%v of 400 RPCs succeeded with Drop 0.5, expected about 100", ok)
+	}
+
+	rn.SetLinkFaults("clean", nil)
+	if clean.DropRate() != 0.5 {
+		t.Fatalf("SetLinkFaults(nil) didn't restore the network's model")
+	}
+
+	// every request runs twice.
+	rn.SetFaults(FaultModel{Duplicate: 1, Stale: Uniform{Max: 10 * time.Millisecond}})
+	n0 := rn.GetCount(1000)
+	for i := 0; i < 10; i++ {
+		reply := ""
+		if !clean.Call("JunkServer.Handler2", i, &reply) || reply != "handler2-"+strconv.Itoa(i) {
+			t.Fatalf("wrong reply %v with duplication", reply)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := rn.GetCount(1000) - n0; n != 20 {
+		t.Fatalf("handler ran %v times for 10 duplicated RPCs, expected 20", n)
+	}
+
+	// delays.
+	for _, fm := range []FaultModel{
+		{Latency: Uniform{Min: 50 * time.Millisecond, Max: 60 * time.Millisecond}},
+		{Latency: Exponential{Min: 50 * time.Millisecond, Mean: time.Millisecond}},
+		{Latency: Normal{Mean: 55 * time.Millisecond}},
+		{Reorder: 1},
+	} {
+		rn.SetFaults(fm)
+		t0 := time.Now()
+		reply := ""
+		clean.Call("JunkServer.Handler2", 1, &reply)
+		if d := time.Since(t0); d < 50*time.Millisecond {
+			t.Fatalf("RPC took %v with %+v", d, fm)
+		}
+	}
+}
+
+// test held-back requests arriving after newer ones
+func TestHoldBack(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	rn.AddServer(1000, rs)
+
+	e := rn.MakeEnd("end")
+	rn.Connect("end", 1000)
+	rn.Enable("end", true)
+
+	rn.SetFaults(FaultModel{HoldBack: 1, Stale: Uniform{Min: 200 * time.Millisecond, Max: 300 * time.Millisecond}})
+	reply := ""
+	if e.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("held-back RPC succeeded")
+	}
+	rn.SetFaults(FaultModel{})
+	if !e.Call("JunkServer.Handler2", 2, &reply) {
+		t.Fatalf("RPC failed on a reliable network")
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log2) != 2 || js.log2[0] != 2 || js.log2[1] != 1 {
+		t.Fatalf("handler saw %v, expected [2 1]", js.log2)
+	}
+}
+
+// test that SetRand fixes which requests an unreliable net drops
+func TestSetRand(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	outcomes := func(seed int64) []bool {
+		rn := MakeNetwork()
+		defer rn.Cleanup()
+		rn.Reliable(false)
+		rn.SetRand(rand.New(rand.NewSource(seed)))
+
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(99, rs)
+
+		e := rn.MakeEnd("end1-99")
+		rn.Connect("end1-99", 99)
+		rn.Enable("end1-99", true)
+
+		var oks []bool
+		for i := 0; i < 30; i++ {
+			reply := ""
+			oks = append(oks, e.Call("JunkServer.Handler2", i, &reply))
+		}
+		return oks
+	}
+
+	a := outcomes(1)
+	b := outcomes(1)
+	dropped := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("call %v: ok=%v with seed 1, then ok=%v", i, a[i], b[i])
+		}
+		if !a[i] {
+			dropped++
+		}
+	}
+	if dropped == 0 || dropped == len(a) {
+		t.Fatalf("%v of %v calls dropped; expected some", dropped, len(a))
+	}
+}
+
+// test Partition, CutLink and Heal
+func TestPartition(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+	defer rn.Cleanup()
+
+	// servers 0..3, each with an end to every other.
+	ends := map[[2]int]*ClientEnd{}
+	for i := 0; i < 4; i++ {
+		rs := MakeServer()
+		rs.AddService(MakeService(&JunkServer{}))
+		rn.AddServer(i, rs)
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			name := fmt.Sprintf("%v-%v", i, j)
+			ends[[2]int{i, j}] = rn.MakeEnd(name)
+			rn.Connect(name, j)
+			rn.Enable(name, true)
+			rn.SetOwner(name, i)
+		}
+	}
+	// a clerk's end, owned by no server.
+	clerk := rn.MakeEnd("clerk")
+	rn.Connect("clerk", 3)
+	rn.Enable("clerk", true)
+
+	check := func(what string, up map[[2]int]bool) {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				reply := 0
+				ok := ends[[2]int{i, j}].Call("JunkServer.Handler1", "7", &reply)
+				if want := i == j || up[[2]int{i, j}]; ok != want {
+					t.Fatalf("%v: %v->%v ok=%v, expected %v", what, i, j, ok, want)
+				}
+			}
+		}
+		reply := 0
+		if !clerk.Call("JunkServer.Handler1", "7", &reply) {
+			t.Fatalf("%v: clerk's RPC failed", what)
+		}
+	}
+	both := func(pairs ...[2]int) map[[2]int]bool {
+		m := map[[2]int]bool{}
+		for _, p := range pairs {
+			m[p] = true
+			m[[2]int{p[1], p[0]}] = true
+		}
+		return m
+	}
+
+	rn.Partition([][]interface{}{{0, 1}, {2}})
+	check("{0,1} {2}", both([2]int{0, 1}))
+
+	// 1 bridges the two sides.
+	rn.Partition([][]interface{}{{0, 1}, {1, 2, 3}})
+	check("{0,1} {1,2,3}", both([2]int{0, 1}, [2]int{1, 2}, [2]int{1, 3}, [2]int{2, 3}))
+
+	rn.Heal()
+	all := both([2]int{0, 1}, [2]int{0, 2}, [2]int{0, 3}, [2]int{1, 2}, [2]int{1, 3}, [2]int{2, 3})
+	check("healed", all)
+
+	// one way only.
+	rn.CutLink(0, 1)
+	delete(all, [2]int{0, 1})
+	check("0->1 cut", all)
+	rn.RestoreLink(0, 1)
+	all[[2]int{0, 1}] = true
+	check("0->1 restored", all)
+}
+
 // test concurrent RPCs from a single ClientEnd
 func TestConcurrentOne(t *testing.T) {
 	runtime.GOMAXPROCS(4)
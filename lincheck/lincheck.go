@@ -0,0 +1,358 @@
+package lincheck
+
+//
+// a linearizability checker for histories of client operations,
+// in the style of Porcupine: Lowe's search for a linearization,
+// one partition (e.g. one key) of the history at a time.
+//
+// h := lincheck.NewHistory()
+// p := h.Invoke(client, input) -- as a client makes a call.
+// p.Return(output) -- as the call returns.
+// ops := h.Operations()
+//
+// res, info := lincheck.Check(model, ops, timeout)
+//   res is Ok, Illegal, or Unknown if timeout ran out first.
+//   info.WriteHTML(w), info.WriteJSON(w) -- each partition of the
+//   history, with the longest linearizable prefix that was found.
+//
+// KvModel (model.go) describes a key/value service's Get, Put
+// and Append.
+//
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Operation struct {
+	ClientId int
+	Input    interface{}
+	Call     int64       // nanoseconds since the history began
+	Output   interface{} // nil if the call never returned
+	Return   int64       // math.MaxInt64 if the call never returned
+}
+
+// a sequential specification of the service.
+type Model struct {
+	// split a history into parts that can be checked on their
+	// own, e.g. by key; nil means the history is one part.
+	Partition func(ops []Operation) [][]Operation
+
+	Init func() interface{}
+
+	// whether input can give output in state, and the state
+	// after. output is nil if the call never returned, and then
+	// any output should do.
+	Step func(state, input, output interface{}) (bool, interface{})
+
+	// whether two states are the same; nil means ==.
+	Equal func(a, b interface{}) bool
+
+	// for WriteHTML and WriteJSON; nil means %v.
+	DescribeOperation func(input, output interface{}) string
+	DescribeState     func(state interface{}) string
+}
+
+type CheckResult int
+
+const (
+	Ok CheckResult = iota
+	Illegal
+	Unknown // the check ran out of time
+)
+
+func (r CheckResult) String() string {
+	switch r {
+	case Ok:
+		return "Ok"
+	case Illegal:
+		return "Illegal"
+	case Unknown:
+		return "Unknown"
+	}
+	return fmt.Sprintf("CheckResult(%d)", int(r))
+}
+
+// what Check found, for WriteHTML and WriteJSON.
+type Info struct {
+	Result     CheckResult
+	Partitions []Partition
+	model      Model
+}
+
+type Partition struct {
+	Result     CheckResult
+	Ops        []Operation
+	Linearized []int // indices in Ops of the longest linearizable prefix found, in order
+}
+
+//
+// recording a history.
+//
+
+type History struct {
+	mu    sync.Mutex
+	start time.Time
+	ops   []Operation
+}
+
+// a call that hasn't returned yet.
+type Pending struct {
+	h *History
+	i int
+}
+
+func NewHistory() *History {
+	return &History{start: time.Now()}
+}
+
+func (h *History) Invoke(client int, input interface{}) Pending {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, Operation{
+		ClientId: client,
+		Input:    input,
+		Call:     int64(time.Since(h.start)),
+		Return:   math.MaxInt64,
+	})
+	return Pending{h, len(h.ops) - 1}
+}
+
+func (p Pending) Return(output interface{}) {
+	p.h.mu.Lock()
+	defer p.h.mu.Unlock()
+	op := &p.h.ops[p.i]
+	op.Output = output
+	op.Return = int64(time.Since(p.h.start))
+}
+
+// a copy of the history so far.
+func (h *History) Operations() []Operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Operation{}, h.ops...)
+}
+
+//
+// checking one.
+//
+
+// timeout <= 0 means no limit.
+func Check(m Model, ops []Operation, timeout time.Duration) (CheckResult, *Info) {
+	if m.Equal == nil {
+		m.Equal = func(a, b interface{}) bool { return a == b }
+	}
+	parts := [][]Operation{ops}
+	if m.Partition != nil {
+		parts = m.Partition(ops)
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	info := &Info{Result: Ok, model: m}
+	for _, part := range parts {
+		res, lin := checkPartition(m, part, deadline)
+		info.Partitions = append(info.Partitions, Partition{Result: res, Ops: part, Linearized: lin})
+		if res == Illegal || (res == Unknown && info.Result == Ok) {
+			info.Result = res
+		}
+	}
+	return info.Result, info
+}
+
+// the history as a list of calls and returns, in time order.
+// a call's match is its return. lift() takes a linearized
+// operation out of the list, and unlift() puts it back.
+type node struct {
+	op         int // index in the partition's ops
+	call       bool
+	match      *node
+	prev, next *node
+}
+
+func makeList(ops []Operation) *node {
+	type event struct {
+		t    int64
+		call bool
+		op   int
+	}
+	events := make([]event, 0, 2*len(ops))
+	for i, op := range ops {
+		events = append(events, event{op.Call, true, i}, event{op.Return, false, i})
+	}
+	// calls before returns at the same time, so that the
+	// operations overlap.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].t != events[j].t {
+			return events[i].t < events[j].t
+		}
+		return events[i].call && !events[j].call
+	})
+
+	head := &node{}
+	calls := make([]*node, len(ops))
+	returns := make([]*node, len(ops))
+	prev := head
+	for _, e := range events {
+		n := &node{op: e.op, call: e.call, prev: prev}
+		prev.next = n
+		prev = n
+		if e.call {
+			calls[e.op] = n
+		} else {
+			returns[e.op] = n
+		}
+	}
+	for i := range ops {
+		calls[i].match = returns[i]
+	}
+	return head
+}
+
+func lift(n *node) {
+	n.prev.next = n.next
+	if n.next != nil {
+		n.next.prev = n.prev
+	}
+	r := n.match
+	r.prev.next = r.next
+	if r.next != nil {
+		r.next.prev = r.prev
+	}
+}
+
+func unlift(n *node) {
+	r := n.match
+	r.prev.next = r
+	if r.next != nil {
+		r.next.prev = r
+	}
+	n.prev.next = n
+	if n.next != nil {
+		n.next.prev = n
+	}
+}
+
+// which operations have been linearized.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset{}, b...)
+}
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << (i % 64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << (i % 64) }
+
+func (b bitset) equal(c bitset) bool {
+	for i := range b {
+		if b[i] != c[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, w := range b {
+		h ^= w
+		h *= 1099511628211
+	}
+	return h
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+// Lowe's algorithm: linearize the earliest call whose operation
+// the model accepts next, and backtrack when a return comes up
+// whose call can't be. the cache of (linearized set, state)
+// pairs already tried keeps the search from repeating itself.
+func checkPartition(m Model, ops []Operation, deadline time.Time) (CheckResult, []int) {
+	type frame struct {
+		n     *node
+		state interface{}
+	}
+	var stack []frame
+	var longest []int
+	prefix := func() []int {
+		lin := make([]int, len(stack))
+		for i, f := range stack {
+			lin[i] = f.n.op
+		}
+		return lin
+	}
+
+	head := makeList(ops)
+	linearized := newBitset(len(ops))
+	cache := map[uint64][]cacheEntry{}
+	seen := func(lin bitset, state interface{}) bool {
+		for _, e := range cache[lin.hash()] {
+			if e.linearized.equal(lin) && m.Equal(e.state, state) {
+				return true
+			}
+		}
+		return false
+	}
+
+	state := m.Init()
+	n := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if steps%1024 == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			return Unknown, longest
+		}
+
+		if n.call {
+			op := ops[n.op]
+			if ok, next := m.Step(state, op.Input, op.Output); ok {
+				lin := linearized.clone()
+				lin.set(n.op)
+				if !seen(lin, next) {
+					h := lin.hash()
+					cache[h] = append(cache[h], cacheEntry{lin, next})
+					stack = append(stack, frame{n, state})
+					state = next
+					linearized.set(n.op)
+					lift(n)
+					n = head.next
+					continue
+				}
+			}
+			n = n.next
+			continue
+		}
+
+		if ops[n.op].Return == math.MaxInt64 {
+			// only calls that never returned are left; they
+			// needn't have taken effect.
+			return Ok, prefix()
+		}
+
+		// n's call can't be linearized before its return,
+		// given the stack. try the stack's top later instead.
+		if len(stack) > len(longest) {
+			longest = prefix()
+		}
+		if len(stack) == 0 {
+			return Illegal, longest
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.n.op)
+		unlift(top.n)
+		n = top.n.next
+	}
+	return Ok, prefix()
+}
@@ -0,0 +1,69 @@
+package lincheck
+
+import (
+	"fmt"
+)
+
+// KvModel's inputs and outputs.
+type KvInput struct {
+	Op    string // "Get", "Put" or "Append"
+	Key   string
+	Value string
+}
+
+type KvOutput struct {
+	Value string // what Get returned
+}
+
+// a key/value store with Get, Put and Append, checked one key at
+// a time. a missing key reads as "".
+var KvModel = Model{
+	Partition: func(ops []Operation) [][]Operation {
+		byKey := map[string][]Operation{}
+		var keys []string
+		for _, op := range ops {
+			key := op.Input.(KvInput).Key
+			if _, ok := byKey[key]; !ok {
+				keys = append(keys, key)
+			}
+			byKey[key] = append(byKey[key], op)
+		}
+		parts := make([][]Operation, len(keys))
+		for i, key := range keys {
+			parts[i] = byKey[key]
+		}
+		return parts
+	},
+	Init: func() interface{} {
+		return ""
+	},
+	Step: func(state, input, output interface{}) (bool, interface{}) {
+		s := state.(string)
+		in := input.(KvInput)
+		switch in.Op {
+		case "Get":
+			return output == nil || output.(KvOutput).Value == s, s
+		case "Put":
+			return true, in.Value
+		case "Append":
+			return true, s + in.Value
+		}
+		panic(fmt.Sprintf("lincheck: unknown KvInput.Op %q", in.Op))
+	},
+	DescribeOperation: func(input, output interface{}) string {
+		in := input.(KvInput)
+		switch in.Op {
+		case "Get":
+			if output == nil {
+				return fmt.Sprintf("get(%q) -> ?", in.Key)
+			}
+			return fmt.Sprintf("get(%q) -> %q", in.Key, output.(KvOutput).Value)
+		case "Put":
+			return fmt.Sprintf("put(%q, %q)", in.Key, in.Value)
+		}
+		return fmt.Sprintf("append(%q, %q)", in.Key, in.Value)
+	},
+	DescribeState: func(state interface{}) string {
+		return fmt.Sprintf("%q", state.(string))
+	},
+}
@@ -0,0 +1,203 @@
+package lincheck
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func get(client int, key, value string, call, ret int64) Operation {
+	return Operation{client, KvInput{"Get", key, ""}, call, KvOutput{value}, ret}
+}
+
+func put(client int, key, value string, call, ret int64) Operation {
+	return Operation{client, KvInput{"Put", key, value}, call, KvOutput{}, ret}
+}
+
+func appnd(client int, key, value string, call, ret int64) Operation {
+	return Operation{client, KvInput{"Append", key, value}, call, KvOutput{}, ret}
+}
+
+func TestKv(t *testing.T) {
+	cases := []struct {
+		name string
+		ops  []Operation
+		want CheckResult
+	}{
+		{"sequential", []Operation{
+			put(0, "x", "a", 0, 10),
+			appnd(1, "x", "b", 20, 30),
+			get(2, "x", "ab", 40, 50),
+		}, Ok},
+		{"stale read", []Operation{
+			put(0, "x", "a", 0, 10),
+			put(1, "x", "b", 20, 30),
+			get(2, "x", "a", 40, 50),
+		}, Illegal},
+		{"concurrent, either order", []Operation{
+			put(0, "x", "a", 0, 100),
+			put(1, "x", "b", 10, 90),
+			get(2, "x", "a", 110, 120),
+		}, Ok},
+		{"reads disagree on the order", []Operation{
+			put(0, "x", "a", 0, 100),
+			put(1, "x", "b", 0, 100),
+			get(2, "x", "a", 110, 120),
+			get(3, "x", "b", 130, 140),
+		}, Illegal},
+		{"duplicated append", []Operation{
+			appnd(0, "x", "a", 0, 10),
+			get(1, "x", "aa", 20, 30),
+		}, Illegal},
+		{"keys are independent", []Operation{
+			put(0, "x", "a", 0, 10),
+			put(1, "y", "b", 0, 10),
+			get(2, "x", "a", 20, 30),
+			get(2, "y", "b", 40, 50),
+		}, Ok},
+		{"a put that never returned took effect", []Operation{
+			{0, KvInput{"Put", "x", "a"}, 0, nil, math.MaxInt64},
+			get(1, "x", "a", 20, 30),
+		}, Ok},
+		{"or didn't", []Operation{
+			{0, KvInput{"Put", "x", "a"}, 0, nil, math.MaxInt64},
+			get(1, "x", "", 20, 30),
+		}, Ok},
+	}
+	for _, c := range cases {
+		res, _ := Check(KvModel, c.ops, 0)
+		if res != c.want {
+			t.Fatalf("%v: expected %v, got %v", c.name, c.want, res)
+		}
+	}
+}
+
+// histories of clients of a store that really is linearizable,
+// and of one that sometimes loses a Put.
+func TestRandomHistories(t *testing.T) {
+	run := func(lossy bool, seed int64) []Operation {
+		var mu sync.Mutex
+		store := map[string]string{}
+		h := NewHistory()
+		var wg sync.WaitGroup
+		for c := 0; c < 5; c++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed + int64(c)))
+				for i := 0; i < 40; i++ {
+					key := strconv.Itoa(r.Intn(3))
+					in := KvInput{Key: key, Value: strconv.Itoa(c) + "." + strconv.Itoa(i) + " "}
+					switch r.Intn(3) {
+					case 0:
+						in.Op = "Get"
+					case 1:
+						in.Op = "Put"
+					case 2:
+						in.Op = "Append"
+					}
+					p := h.Invoke(c, in)
+					time.Sleep(time.Duration(r.Intn(100)) * time.Microsecond)
+					mu.Lock()
+					out := KvOutput{}
+					switch in.Op {
+					case "Get":
+						out.Value = store[key]
+					case "Put":
+						if !lossy || r.Intn(4) != 0 {
+							store[key] = in.Value
+						}
+					case "Append":
+						store[key] += in.Value
+					}
+					mu.Unlock()
+					time.Sleep(time.Duration(r.Intn(100)) * time.Microsecond)
+					p.Return(out)
+				}
+			}(c)
+		}
+		wg.Wait()
+		return h.Operations()
+	}
+
+	for seed := int64(0); seed < 5; seed++ {
+		if res, _ := Check(KvModel, run(false, seed), 10*time.Second); res != Ok {
+			t.Fatalf("seed %v: a linearizable store's history was %v", seed, res)
+		}
+	}
+
+	illegal := 0
+	for seed := int64(0); seed < 5; seed++ {
+		if res, _ := Check(KvModel, run(true, seed), 10*time.Second); res == Illegal {
+			illegal++
+		}
+	}
+	if illegal == 0 {
+		t.Fatalf("never noticed lost Puts")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// many concurrent appends, and a read that no order gives.
+	var ops []Operation
+	for c := 0; c < 40; c++ {
+		ops = append(ops, appnd(c, "x", strconv.Itoa(c), 0, 100))
+	}
+	ops = append(ops, get(99, "x", "nope", 200, 300))
+
+	t0 := time.Now()
+	res, _ := Check(KvModel, ops, 100*time.Millisecond)
+	if res != Unknown {
+		t.Fatalf("expected Unknown, got %v", res)
+	}
+	if time.Since(t0) > 2*time.Second {
+		t.Fatalf("Check took %v to give up", time.Since(t0))
+	}
+}
+
+func TestVisualize(t *testing.T) {
+	ops := []Operation{
+		put(0, "x", "a", 0, 10),
+		put(1, "x", "b", 20, 30),
+		get(2, "x", "a", 40, 50),
+		put(0, "y", "<c>", 0, 10),
+	}
+	res, info := Check(KvModel, ops, 0)
+	if res != Illegal {
+		t.Fatalf("expected Illegal, got %v", res)
+	}
+
+	var jb bytes.Buffer
+	if err := info.WriteJSON(&jb); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var ji jsonInfo
+	if err := json.Unmarshal(jb.Bytes(), &ji); err != nil {
+		t.Fatalf("WriteJSON wrote bad JSON: %v", err)
+	}
+	if ji.Result != "Illegal" || len(ji.Partitions) != 2 {
+		t.Fatalf("wrong JSON: %v", jb.String())
+	}
+	p := ji.Partitions[0]
+	if p.Result != "Illegal" || len(p.Linearization) != 2 || p.Linearization[1].StateAfter != `"b"` {
+		t.Fatalf("wrong partition for x: %+v", p)
+	}
+
+	var hb bytes.Buffer
+	if err := info.WriteHTML(&hb); err != nil {
+		t.Fatalf("WriteHTML: %v", err)
+	}
+	html := hb.String()
+	if strings.Index(html, "partition 0: Illegal") > strings.Index(html, "partition 1: Ok") {
+		t.Fatalf("WriteHTML should put the Illegal partition first")
+	}
+	if !strings.Contains(html, `get(&#34;x&#34;) -&gt; &#34;a&#34;`) || strings.Contains(html, "<c>") {
+		t.Fatalf("WriteHTML didn't describe and escape operations:\n%v", html)
+	}
+}
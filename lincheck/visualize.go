@@ -0,0 +1,205 @@
+package lincheck
+
+//
+// what Check found, as JSON or as a page of timelines: a row
+// per client, a bar per operation from call to return. the
+// operations of the longest linearizable prefix are numbered in
+// linearization order; in an Illegal partition the rest are red,
+// and none of them can come next.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+)
+
+type jsonInfo struct {
+	Result     string          `json:"result"`
+	Partitions []jsonPartition `json:"partitions"`
+}
+
+type jsonPartition struct {
+	Result        string     `json:"result"`
+	Operations    []jsonOp   `json:"operations"`
+	Linearization []jsonStep `json:"linearization"` // the longest linearizable prefix found
+}
+
+type jsonOp struct {
+	Client      int    `json:"client"`
+	Call        int64  `json:"call"`   // ns
+	Return      int64  `json:"return"` // ns; -1 if the call never returned
+	Description string `json:"description"`
+}
+
+type jsonStep struct {
+	Op         int    `json:"op"` // index in operations
+	StateAfter string `json:"stateAfter"`
+}
+
+func (info *Info) describeOperation(op Operation) string {
+	if info.model.DescribeOperation != nil {
+		return info.model.DescribeOperation(op.Input, op.Output)
+	}
+	return fmt.Sprintf("%v -> %v", op.Input, op.Output)
+}
+
+func (info *Info) describeState(state interface{}) string {
+	if info.model.DescribeState != nil {
+		return info.model.DescribeState(state)
+	}
+	return fmt.Sprintf("%v", state)
+}
+
+func (info *Info) toJSON() jsonInfo {
+	ji := jsonInfo{Result: info.Result.String()}
+	for _, p := range info.Partitions {
+		jp := jsonPartition{Result: p.Result.String()}
+		for _, op := range p.Ops {
+			ret := op.Return
+			if ret == math.MaxInt64 {
+				ret = -1
+			}
+			jp.Operations = append(jp.Operations, jsonOp{op.ClientId, op.Call, ret, info.describeOperation(op)})
+		}
+		state := info.model.Init()
+		for _, i := range p.Linearized {
+			_, state = info.model.Step(state, p.Ops[i].Input, p.Ops[i].Output)
+			jp.Linearization = append(jp.Linearization, jsonStep{i, info.describeState(state)})
+		}
+		ji.Partitions = append(ji.Partitions, jp)
+	}
+	return ji
+}
+
+func (info *Info) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info.toJSON())
+}
+
+type htmlBar struct {
+	Left, Width float64 // percent
+	Label       string
+	Title       string
+	Class       string
+}
+
+type htmlRow struct {
+	Client int
+	Bars   []htmlBar
+}
+
+type htmlPartition struct {
+	Index  int
+	Result string
+	Rows   []htmlRow
+	Steps  []string
+}
+
+// place each call and return by its rank among the partition's
+// times, not by the time itself, so that bursts stay readable.
+func (info *Info) toHTML(pi int, jp jsonPartition) htmlPartition {
+	const never = math.MaxInt64
+	var times []int64
+	for _, op := range jp.Operations {
+		times = append(times, op.Call)
+		if op.Return >= 0 {
+			times = append(times, op.Return)
+		}
+	}
+	times = append(times, never)
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	pos := func(t int64) float64 {
+		i := sort.Search(len(times), func(i int) bool { return times[i] >= t })
+		return 100 * float64(i) / float64(len(times))
+	}
+
+	order := map[int]int{}
+	hp := htmlPartition{Index: pi, Result: jp.Result}
+	for k, s := range jp.Linearization {
+		order[s.Op] = k + 1
+		hp.Steps = append(hp.Steps, fmt.Sprintf("%v, then %v", jp.Operations[s.Op].Description, s.StateAfter))
+	}
+
+	rows := map[int]*htmlRow{}
+	var clients []int
+	for i, op := range jp.Operations {
+		row, ok := rows[op.Client]
+		if !ok {
+			row = &htmlRow{Client: op.Client}
+			rows[op.Client] = row
+			clients = append(clients, op.Client)
+		}
+		ret := op.Return
+		if ret < 0 {
+			ret = never
+		}
+		bar := htmlBar{Left: pos(op.Call), Title: op.Description, Label: op.Description, Class: "other"}
+		bar.Width = pos(ret) - bar.Left + 100/float64(len(times))/2
+		if k, ok := order[i]; ok {
+			bar.Label = fmt.Sprintf("%d: %v", k, op.Description)
+			bar.Class = "linearized"
+		} else if jp.Result == Illegal.String() {
+			bar.Class = "stuck"
+		}
+		row.Bars = append(row.Bars, bar)
+	}
+	sort.Ints(clients)
+	for _, c := range clients {
+		hp.Rows = append(hp.Rows, *rows[c])
+	}
+	return hp
+}
+
+var htmlPage = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>linearizability: {{.Result}}</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+.timeline { position: relative; margin: 8px 0 16px 80px; }
+.row { position: relative; height: 26px; border-bottom: 1px solid #eee; }
+.client { position: absolute; left: -80px; top: 5px; color: #666; }
+.bar { position: absolute; top: 3px; height: 18px; overflow: hidden; white-space: nowrap;
+       border-radius: 3px; padding: 0 3px; box-sizing: border-box; font-family: monospace; }
+.linearized { background: #b7e1b0; }
+.stuck { background: #f4b3b3; }
+.other { background: #ddd; }
+</style>
+</head>
+<body>
+<h2>history is {{.Result}}</h2>
+{{range .Partitions}}
+<h3>partition {{.Index}}: {{.Result}}</h3>
+<div class="timeline">
+{{range .Rows}}<div class="row"><span class="client">client {{.Client}}</span>
+{{range .Bars}}<div class="bar {{.Class}}" style="left: {{printf "%.3f" .Left}}%; width: {{printf "%.3f" .Width}}%" title="{{.Title}}">{{.Label}}</div>
+{{end}}</div>
+{{end}}</div>
+{{if .Steps}}<p>longest linearizable prefix:</p>
+<ol>{{range .Steps}}<li><code>{{.}}</code></li>{{end}}</ol>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// Illegal partitions come first.
+func (info *Info) WriteHTML(w io.Writer) error {
+	ji := info.toJSON()
+	page := struct {
+		Result     string
+		Partitions []htmlPartition
+	}{Result: ji.Result}
+	for i, jp := range ji.Partitions {
+		page.Partitions = append(page.Partitions, info.toHTML(i, jp))
+	}
+	sort.SliceStable(page.Partitions, func(i, j int) bool {
+		return page.Partitions[i].Result == Illegal.String() && page.Partitions[j].Result != Illegal.String()
+	})
+	return htmlPage.Execute(w, page)
+}
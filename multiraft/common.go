@@ -0,0 +1,61 @@
+package multiraft
+
+//
+// RPCs between multi-raft hosts. every Raft RPC is wrapped
+// with the id of the group it belongs to; heartbeats for all
+// groups bound for the same node travel together in one
+// Host.Heartbeat call.
+//
+
+import "mitraft/raft"
+
+type GroupRequestVoteArgs struct {
+	Group int
+	Args  raft.RequestVoteArgs
+}
+
+type GroupRequestVoteReply struct {
+	Missing bool // no such group on the receiving host
+	Reply   raft.RequestVoteReply
+}
+
+type GroupAppendEntriesArgs struct {
+	Group int
+	Args  raft.AppendEntriesArgs
+}
+
+type GroupAppendEntriesReply struct {
+	Missing bool
+	Reply   raft.AppendEntriesReply
+}
+
+type GroupInstallSnapshotArgs struct {
+	Group int
+	Args  raft.InstallSnapshotArgs
+}
+
+type GroupInstallSnapshotReply struct {
+	Missing bool
+	Reply   raft.InstallSnapshotReply
+}
+
+type GroupTimeoutNowArgs struct {
+	Group int
+	Args  raft.TimeoutNowArgs
+}
+
+type GroupTimeoutNowReply struct {
+	Missing bool
+	Reply   raft.TimeoutNowReply
+}
+
+// one Host.Heartbeat carries the AppendEntries of every group
+// whose leader is on the sending node, for one destination node.
+type HeartbeatArgs struct {
+	Items []GroupAppendEntriesArgs
+}
+
+// Items[i] answers HeartbeatArgs.Items[i].
+type HeartbeatReply struct {
+	Items []GroupAppendEntriesReply
+}
@@ -0,0 +1,201 @@
+package multiraft
+
+//
+// support for multi-raft host tester.
+//
+
+import (
+	"fmt"
+	"mitraft/labrpc"
+	"mitraft/raft"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type config struct {
+	mu      sync.Mutex
+	t       testing.TB
+	net     *labrpc.Network
+	n       int // nodes, i.e. hosts
+	hosts   []*Host
+	ngroups int
+	logs    []map[int]map[int]interface{} // node -> group -> index -> committed command
+	start   time.Time                     // time at which make_config() was called
+	t0      time.Time                     // time at which test_test.go called cfg.begin()
+	rpcs0   int                           // rpc count at start of test
+}
+
+func hostname(i int) string {
+	return "host" + strconv.Itoa(i)
+}
+
+// n hosts, each running its peer of each of ngroups groups.
+func make_config(t testing.TB, n int, ngroups int, perGroupHeartbeats bool) *config {
+	cfg := &config{}
+	cfg.t = t
+	cfg.net = labrpc.MakeNetwork()
+	cfg.n = n
+	cfg.ngroups = ngroups
+	cfg.hosts = make([]*Host, n)
+	cfg.logs = make([]map[int]map[int]interface{}, n)
+	cfg.start = time.Now()
+
+	for i := 0; i < n; i++ {
+		ends := make([]*labrpc.ClientEnd, n)
+		for j := 0; j < n; j++ {
+			endname := hostname(i) + "->" + hostname(j)
+			ends[j] = cfg.net.MakeEnd(endname)
+			cfg.net.Connect(endname, hostname(j))
+			cfg.net.Enable(endname, true)
+		}
+
+		h := MakeHost(ends, i)
+		h.SetPerGroupHeartbeats(perGroupHeartbeats)
+		cfg.hosts[i] = h
+
+		srv := labrpc.MakeServer()
+		srv.AddService(labrpc.MakeService(h))
+		cfg.net.AddServer(hostname(i), srv)
+
+		cfg.logs[i] = map[int]map[int]interface{}{}
+		for gid := 0; gid < ngroups; gid++ {
+			cfg.logs[i][gid] = map[int]interface{}{}
+			applyCh := make(chan raft.ApplyMsg)
+			go cfg.applier(i, gid, applyCh)
+			h.AddGroup(gid, raft.MakePersister(), applyCh)
+		}
+	}
+
+	return cfg
+}
+
+func (cfg *config) applier(i int, gid int, applyCh chan raft.ApplyMsg) {
+	for m := range applyCh {
+		if !m.CommandValid {
+			continue
+		}
+		cfg.mu.Lock()
+		cfg.logs[i][gid][m.CommandIndex] = m.Command
+		cfg.mu.Unlock()
+	}
+}
+
+func (cfg *config) cleanup() {
+	for _, h := range cfg.hosts {
+		h.Kill()
+	}
+	cfg.net.Cleanup()
+}
+
+// wait until every group has exactly one leader in its
+// latest term; returns the node leading each group.
+func (cfg *config) checkLeaders() []int {
+	leaders := make([]int, cfg.ngroups)
+	for iters := 0; iters < 40; iters++ {
+		time.Sleep(250 * time.Millisecond)
+
+		all := true
+		for gid := 0; gid < cfg.ngroups; gid++ {
+			leaders[gid] = -1
+			maxTerm := -1
+			for i, h := range cfg.hosts {
+				term, isLeader := h.Group(gid).GetState()
+				if isLeader && term > maxTerm {
+					leaders[gid] = i
+					maxTerm = term
+				} else if isLeader && term == maxTerm {
+					cfg.t.Fatalf("group %v has two leaders in term %v", gid, term)
+				}
+			}
+			if leaders[gid] == -1 {
+				all = false
+			}
+		}
+		if all {
+			return leaders
+		}
+	}
+	cfg.t.Fatalf("not every group elected a leader")
+	return nil
+}
+
+// how many groups currently have a leader?
+func (cfg *config) nLed() int {
+	n := 0
+	for gid := 0; gid < cfg.ngroups; gid++ {
+		for _, h := range cfg.hosts {
+			if _, isLeader := h.Group(gid).GetState(); isLeader {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// how many nodes have committed cmd at index in group gid?
+func (cfg *config) nCommitted(gid int, index int) int {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	count := 0
+	var cmd interface{}
+	for i := 0; i < cfg.n; i++ {
+		if cmd1, ok := cfg.logs[i][gid][index]; ok {
+			if count > 0 && cmd != cmd1 {
+				cfg.t.Fatalf("group %v: committed values do not match at index %v: %v, %v",
+					gid, index, cmd, cmd1)
+			}
+			count++
+			cmd = cmd1
+		}
+	}
+	return count
+}
+
+// submit cmd to group gid's leader and wait for all
+// nodes to commit it. returns the index.
+func (cfg *config) one(gid int, cmd interface{}) int {
+	t0 := time.Now()
+	for time.Since(t0) < 10*time.Second {
+		for _, h := range cfg.hosts {
+			index, _, ok := h.Group(gid).Start(cmd)
+			if !ok {
+				continue
+			}
+			for t1 := time.Now(); time.Since(t1) < 2*time.Second; {
+				if cfg.nCommitted(gid, index) == cfg.n {
+					return index
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cfg.t.Fatalf("group %v: one(%v) failed to reach agreement", gid, cmd)
+	return -1
+}
+
+// start a Test.
+// print the Test message.
+func (cfg *config) begin(description string) {
+	fmt.Printf("%s ...\n", description)
+	cfg.t0 = time.Now()
+	cfg.rpcs0 = cfg.net.GetTotalCount()
+}
+
+// end a Test -- the fact that we got here means there
+// was no failure.
+// print the Passed message,
+// and some performance numbers.
+func (cfg *config) end() {
+	if !cfg.t.Failed() {
+		t := time.Since(cfg.t0).Seconds()           // real time
+		nrpc := cfg.net.GetTotalCount() - cfg.rpcs0 // number of RPC sends
+
+		fmt.Printf("  ... Passed --")
+		fmt.Printf("  %4.1f  %d %4d %6d\n", t, cfg.n, cfg.ngroups, nrpc)
+	}
+}
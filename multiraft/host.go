@@ -0,0 +1,302 @@
+package multiraft
+
+//
+// a multi-raft host: one process (node) running many Raft groups.
+//
+// every group has one peer on each node, and peer i of every group
+// lives on node i. the groups share the host's ClientEnds to the
+// other nodes instead of each having their own, the host's timer
+// wheel drives all of their election timeouts, and one heartbeat
+// loop sends the AppendEntries of all groups led from this node to
+// each other node as a single Host.Heartbeat RPC.
+//
+// h := MakeHost(nodes, me) -- nodes[i] reaches node i's host.
+// rf := h.AddGroup(gid, persister, applyCh)
+// h.Kill()
+//
+// register the host with labrpc.MakeService(h), so that the
+// other nodes can reach its Host.* handlers.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mitraft/labrpc"
+	"mitraft/raft"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HeartbeatInterval = 100 * time.Millisecond
+	wheelTick         = 10 * time.Millisecond
+	wheelSlots        = 128 // more than one election timeout's worth of ticks
+)
+
+type Host struct {
+	mu     sync.Mutex
+	me     int
+	nodes  []*labrpc.ClientEnd // shared by all groups
+	groups map[int]*raft.Raft
+	wheel  *timerWheel
+	dead   int32 // set by Kill()
+
+	// send each group's heartbeats as its own Host.AppendEntries
+	// instead of coalescing them. for comparison only.
+	perGroupHeartbeats bool
+}
+
+func MakeHost(nodes []*labrpc.ClientEnd, me int) *Host {
+	h := &Host{}
+	h.me = me
+	h.nodes = nodes
+	h.groups = map[int]*raft.Raft{}
+	h.wheel = makeTimerWheel(wheelTick, wheelSlots, time.Now())
+
+	go h.runWheel()
+	go h.heartbeats()
+
+	return h
+}
+
+// SetPerGroupHeartbeats turns heartbeat coalescing off (true) or on.
+func (h *Host) SetPerGroupHeartbeats(yes bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.perGroupHeartbeats = yes
+}
+
+// start this node's peer of group gid.
+func (h *Host) AddGroup(gid int, persister *raft.Persister, applyCh chan raft.ApplyMsg) *raft.Raft {
+	rf := raft.MakeHosted(len(h.nodes), h.me, persister, applyCh, &groupTransport{h, gid})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if old, ok := h.groups[gid]; ok {
+		old.Kill()
+	}
+	h.groups[gid] = rf
+	h.wheel.schedule(gid, rf.ElectionTick(time.Now()))
+	return rf
+}
+
+// stop this node's peer of group gid.
+func (h *Host) RemoveGroup(gid int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if rf, ok := h.groups[gid]; ok {
+		rf.Kill()
+		delete(h.groups, gid)
+		h.wheel.cancel(gid)
+	}
+}
+
+func (h *Host) Group(gid int) *raft.Raft {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.groups[gid]
+}
+
+func (h *Host) Kill() {
+	atomic.StoreInt32(&h.dead, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, rf := range h.groups {
+		rf.Kill()
+	}
+}
+
+func (h *Host) killed() bool {
+	z := atomic.LoadInt32(&h.dead)
+	return z == 1
+}
+
+// the single timer behind every group's election timeout.
+func (h *Host) runWheel() {
+	for !h.killed() {
+		time.Sleep(wheelTick)
+
+		h.mu.Lock()
+		now := time.Now()
+		for !h.wheel.start.After(now) {
+			for _, gid := range h.wheel.advance() {
+				if rf, ok := h.groups[gid]; ok {
+					h.wheel.schedule(gid, rf.ElectionTick(now))
+				}
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// every HeartbeatInterval, collect the AppendEntries of every group
+// this node leads and send them, one RPC per destination node.
+func (h *Host) heartbeats() {
+	for !h.killed() {
+		h.mu.Lock()
+		gids := make([]int, 0, len(h.groups))
+		for gid := range h.groups {
+			gids = append(gids, gid)
+		}
+		perGroup := h.perGroupHeartbeats
+		h.mu.Unlock()
+		sort.Ints(gids)
+
+		batches := make([]HeartbeatArgs, len(h.nodes))
+		for _, gid := range gids {
+			rf := h.Group(gid)
+			if rf == nil {
+				continue
+			}
+			for peer, args := range rf.HeartbeatArgs() {
+				if args == nil {
+					continue
+				}
+				item := GroupAppendEntriesArgs{Group: gid, Args: *args}
+				if perGroup {
+					go h.sendAppendEntries(peer, rf, item)
+				} else {
+					batches[peer].Items = append(batches[peer].Items, item)
+				}
+			}
+		}
+
+		for peer := range batches {
+			if len(batches[peer].Items) > 0 {
+				go h.sendHeartbeat(peer, batches[peer])
+			}
+		}
+
+		time.Sleep(HeartbeatInterval)
+	}
+}
+
+func (h *Host) sendHeartbeat(peer int, args HeartbeatArgs) {
+	var reply HeartbeatReply
+	if !h.nodes[peer].Call("Host.Heartbeat", &args, &reply) {
+		return
+	}
+	for i := range args.Items {
+		if i >= len(reply.Items) || reply.Items[i].Missing {
+			continue
+		}
+		if rf := h.Group(args.Items[i].Group); rf != nil {
+			rf.HandleAppendEntriesReply(peer, &args.Items[i].Args, &reply.Items[i].Reply)
+		}
+	}
+}
+
+func (h *Host) sendAppendEntries(peer int, rf *raft.Raft, args GroupAppendEntriesArgs) {
+	var reply GroupAppendEntriesReply
+	if h.nodes[peer].Call("Host.AppendEntries", &args, &reply) && !reply.Missing {
+		rf.HandleAppendEntriesReply(peer, &args.Args, &reply.Reply)
+	}
+}
+
+// RPC handler: a coalesced heartbeat from another node.
+func (h *Host) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) {
+	reply.Items = make([]GroupAppendEntriesReply, len(args.Items))
+	for i := range args.Items {
+		h.AppendEntries(&args.Items[i], &reply.Items[i])
+	}
+}
+
+func (h *Host) AppendEntries(args *GroupAppendEntriesArgs, reply *GroupAppendEntriesReply) {
+	rf := h.Group(args.Group)
+	if rf == nil {
+		reply.Missing = true
+		return
+	}
+	rf.AppendEntries(&args.Args, &reply.Reply)
+}
+
+func (h *Host) RequestVote(args *GroupRequestVoteArgs, reply *GroupRequestVoteReply) {
+	rf := h.Group(args.Group)
+	if rf == nil {
+		reply.Missing = true
+		return
+	}
+	rf.RequestVote(&args.Args, &reply.Reply)
+}
+
+func (h *Host) InstallSnapshot(args *GroupInstallSnapshotArgs, reply *GroupInstallSnapshotReply) {
+	rf := h.Group(args.Group)
+	if rf == nil {
+		reply.Missing = true
+		return
+	}
+	rf.InstallSnapshot(&args.Args, &reply.Reply)
+}
+
+func (h *Host) TimeoutNow(args *GroupTimeoutNowArgs, reply *GroupTimeoutNowReply) {
+	rf := h.Group(args.Group)
+	if rf == nil {
+		reply.Missing = true
+		return
+	}
+	rf.TimeoutNow(&args.Args, &reply.Reply)
+}
+
+// the peer's host doesn't run the group.
+var errNoGroup = errors.New("multiraft: no such group")
+
+// carries one group's own RPCs (votes, snapshots, leadership
+// transfers, and AppendEntries if the group ever sends them
+// itself) over the host's shared ends.
+type groupTransport struct {
+	h   *Host
+	gid int
+}
+
+func (gt *groupTransport) Call(ctx context.Context, peer int, svcMeth string, args interface{}, reply interface{}) error {
+	switch svcMeth {
+	case "Raft.RequestVote":
+		gargs := GroupRequestVoteArgs{Group: gt.gid, Args: *args.(*raft.RequestVoteArgs)}
+		var greply GroupRequestVoteReply
+		if err := gt.h.nodes[peer].CallContext(ctx, "Host.RequestVote", &gargs, &greply); err != nil {
+			return err
+		}
+		if greply.Missing {
+			return errNoGroup
+		}
+		*reply.(*raft.RequestVoteReply) = greply.Reply
+		return nil
+	case "Raft.AppendEntries":
+		gargs := GroupAppendEntriesArgs{Group: gt.gid, Args: *args.(*raft.AppendEntriesArgs)}
+		var greply GroupAppendEntriesReply
+		if err := gt.h.nodes[peer].CallContext(ctx, "Host.AppendEntries", &gargs, &greply); err != nil {
+			return err
+		}
+		if greply.Missing {
+			return errNoGroup
+		}
+		*reply.(*raft.AppendEntriesReply) = greply.Reply
+		return nil
+	case "Raft.InstallSnapshot":
+		gargs := GroupInstallSnapshotArgs{Group: gt.gid, Args: *args.(*raft.InstallSnapshotArgs)}
+		var greply GroupInstallSnapshotReply
+		if err := gt.h.nodes[peer].CallContext(ctx, "Host.InstallSnapshot", &gargs, &greply); err != nil {
+			return err
+		}
+		if greply.Missing {
+			return errNoGroup
+		}
+		*reply.(*raft.InstallSnapshotReply) = greply.Reply
+		return nil
+	case "Raft.TimeoutNow":
+		gargs := GroupTimeoutNowArgs{Group: gt.gid, Args: *args.(*raft.TimeoutNowArgs)}
+		var greply GroupTimeoutNowReply
+		if err := gt.h.nodes[peer].CallContext(ctx, "Host.TimeoutNow", &gargs, &greply); err != nil {
+			return err
+		}
+		if greply.Missing {
+			return errNoGroup
+		}
+		*reply.(*raft.TimeoutNowReply) = greply.Reply
+		return nil
+	}
+	return fmt.Errorf("multiraft: can't carry %v", svcMeth)
+}
@@ -0,0 +1,169 @@
+package multiraft
+
+import (
+	"runtime"
+	"runtime/metrics"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	t0 := time.Now()
+	w := makeTimerWheel(10*time.Millisecond, 8, t0)
+
+	w.schedule(1, t0)                          // due now
+	w.schedule(2, t0.Add(25*time.Millisecond)) // rounds up to the third tick
+	w.schedule(3, t0.Add(time.Hour))           // beyond the wheel: parked in the last slot
+	w.schedule(4, t0.Add(15*time.Millisecond)) // rescheduled below
+	w.schedule(4, t0.Add(5*time.Millisecond))  // ... to the first tick
+	w.schedule(5, t0.Add(10*time.Millisecond)) // cancelled below
+	w.cancel(5)
+
+	fired := map[int]int{}
+	for tick := 0; tick < 8; tick++ {
+		for _, gid := range w.advance() {
+			fired[gid] = tick
+		}
+	}
+
+	expected := map[int]int{1: 0, 2: 3, 3: 7, 4: 1}
+	if len(fired) != len(expected) {
+		t.Fatalf("fired %v, expected %v", fired, expected)
+	}
+	for gid, tick := range expected {
+		if fired[gid] != tick {
+			t.Fatalf("group %v fired at tick %v, expected %v", gid, fired[gid], tick)
+		}
+	}
+}
+
+func TestElectAndAgree(t *testing.T) {
+	cfg := make_config(t, 3, 20, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: many groups elect and agree over one host each")
+
+	cfg.checkLeaders()
+	for gid := 0; gid < cfg.ngroups; gid++ {
+		for i := 1; i <= 3; i++ {
+			if index := cfg.one(gid, gid*100+i); index != i {
+				t.Fatalf("group %v: got index %v, expected %v", gid, index, i)
+			}
+		}
+	}
+
+	cfg.end()
+}
+
+// a failed node's groups must all re-elect on the survivors,
+// driven only by the host timer wheels.
+func TestReElection(t *testing.T) {
+	cfg := make_config(t, 3, 20, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: groups re-elect after a node fails")
+
+	cfg.checkLeaders()
+	cfg.net.DeleteServer(hostname(0))
+	cfg.hosts[0].Kill()
+
+	for iters := 0; ; iters++ {
+		time.Sleep(250 * time.Millisecond)
+		missing := 0
+		for gid := 0; gid < cfg.ngroups; gid++ {
+			_, l1 := cfg.hosts[1].Group(gid).GetState()
+			_, l2 := cfg.hosts[2].Group(gid).GetState()
+			if !l1 && !l2 {
+				missing++
+			}
+		}
+		if missing == 0 {
+			break
+		}
+		if iters > 20 {
+			t.Fatalf("%v groups have no leader on the surviving nodes", missing)
+		}
+	}
+
+	cfg.end()
+}
+
+// once every group has a leader, a quiet cluster should send
+// about one RPC per ordered pair of nodes per heartbeat,
+// no matter how many groups there are.
+func TestCoalescedHeartbeats(t *testing.T) {
+	const ngroups = 50
+	cfg := make_config(t, 3, ngroups, false)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: heartbeats are coalesced per destination node")
+
+	cfg.checkLeaders()
+	time.Sleep(HeartbeatInterval)
+
+	rpcs0 := cfg.net.GetTotalCount()
+	const intervals = 10
+	time.Sleep(intervals * HeartbeatInterval)
+	got := cfg.net.GetTotalCount() - rpcs0
+
+	pairs := cfg.n * (cfg.n - 1)
+	if got > 2*pairs*intervals {
+		t.Fatalf("too many RPCs for %v idle groups: got %v, expected about %v",
+			ngroups, got, pairs*intervals)
+	}
+
+	cfg.end()
+}
+
+// CPU time used by the whole process so far. the runtime only
+// brings this figure up to date at a GC, so force one.
+func cpuTime() time.Duration {
+	runtime.GC()
+	sample := []metrics.Sample{{Name: "/cpu/classes/total:cpu-seconds"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return time.Duration(sample[0].Value.Float64() * float64(time.Second))
+}
+
+// steady-state cost of 1000 idle groups on 3 nodes, per heartbeat
+// interval, with and without coalescing. on a small machine the
+// per-group variant may not keep every group's leader alive; the
+// groups-led metric says how many had one at the end.
+//
+//	go test -run xxx -bench Host1000 ./multiraft
+func BenchmarkHost1000Groups(b *testing.B) {
+	for _, bc := range []struct {
+		name     string
+		perGroup bool
+	}{
+		{"coalesced", false},
+		{"per-group", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cfg := make_config(b, 3, 1000, bc.perGroup)
+			defer cfg.cleanup()
+			for t0 := time.Now(); time.Since(t0) < 10*time.Second; {
+				if cfg.nLed() == cfg.ngroups {
+					break
+				}
+				time.Sleep(250 * time.Millisecond)
+			}
+
+			b.ResetTimer()
+			rpcs0 := cfg.net.GetTotalCount()
+			cpu0 := cpuTime()
+			for i := 0; i < b.N; i++ {
+				time.Sleep(HeartbeatInterval)
+			}
+			b.StopTimer()
+
+			rpcs := cfg.net.GetTotalCount() - rpcs0
+			cpu := cpuTime() - cpu0
+			b.ReportMetric(float64(rpcs)/float64(b.N), "rpcs/heartbeat")
+			b.ReportMetric(float64(cpu.Milliseconds())/float64(b.N), "cpu-ms/heartbeat")
+			b.ReportMetric(float64(cfg.nLed()), "groups-led")
+		})
+	}
+}
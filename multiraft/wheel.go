@@ -0,0 +1,65 @@
+package multiraft
+
+import "time"
+
+// a hashed timer wheel: one goroutine, one ticker, and a ring
+// of slots each holding the groups due in that slot. replaces
+// the per-group ticker() goroutines for election timeouts.
+// deadlines further out than one turn of the wheel are
+// parked in the last slot and re-checked when it fires.
+type timerWheel struct {
+	tick  time.Duration
+	slots []map[int]bool // slot -> set of group ids
+	at    map[int]int    // group id -> slot it is in
+	cur   int            // slot that fires next
+	start time.Time      // time at which slot cur fires
+}
+
+func makeTimerWheel(tick time.Duration, nslots int, now time.Time) *timerWheel {
+	w := &timerWheel{}
+	w.tick = tick
+	w.slots = make([]map[int]bool, nslots)
+	for i := range w.slots {
+		w.slots[i] = map[int]bool{}
+	}
+	w.at = map[int]int{}
+	w.start = now
+	return w
+}
+
+// (re)schedule gid to fire at deadline, rounded up to a tick.
+func (w *timerWheel) schedule(gid int, deadline time.Time) {
+	w.cancel(gid)
+
+	ticks := 0
+	if d := deadline.Sub(w.start); d > 0 {
+		ticks = int((d + w.tick - 1) / w.tick)
+	}
+	if ticks >= len(w.slots) {
+		ticks = len(w.slots) - 1
+	}
+	slot := (w.cur + ticks) % len(w.slots)
+	w.slots[slot][gid] = true
+	w.at[gid] = slot
+}
+
+func (w *timerWheel) cancel(gid int) {
+	if slot, ok := w.at[gid]; ok {
+		delete(w.slots[slot], gid)
+		delete(w.at, gid)
+	}
+}
+
+// fire the current slot and move the wheel on by one tick.
+// returns the groups that were due.
+func (w *timerWheel) advance() []int {
+	due := make([]int, 0, len(w.slots[w.cur]))
+	for gid := range w.slots[w.cur] {
+		due = append(due, gid)
+		delete(w.at, gid)
+	}
+	w.slots[w.cur] = map[int]bool{}
+	w.cur = (w.cur + 1) % len(w.slots)
+	w.start = w.start.Add(w.tick)
+	return due
+}
@@ -0,0 +1,315 @@
+package prom
+
+//
+// a tiny metrics registry that speaks the Prometheus text
+// exposition format (version 0.0.4), so that a dashboard can
+// scrape a node without this repo depending on the Prometheus
+// client library.
+//
+// reg := prom.NewRegistry()
+// c := reg.Counter("name_total", "help", "label1", ...)
+// c.With("value1", ...).Inc()
+// g := reg.Gauge("name", "help", "label1", ...)
+// g.With("value1").Set(x) -- or g.Func(fn, "value1"), sampled at scrape time
+// h := reg.Histogram("name_seconds", "help", prom.DefBuckets, "label1", ...)
+// h.With("value1").Observe(x)
+// http.Handle("/metrics", prom.Handler(reg))
+//
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the default histogram buckets, in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{}
+	r.families = map[string]*family{}
+	return r
+}
+
+// one named metric and all of its labelled series.
+type family struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	typ     string // "counter", "gauge" or "histogram"
+	labels  []string
+	buckets []float64          // histograms only
+	series  map[string]*series // joined label values -> series
+}
+
+type series struct {
+	values []string // label values, in family.labels order
+
+	mu     sync.Mutex
+	value  float64        // counters and gauges
+	fn     func() float64 // gauges set with Func
+	counts []uint64       // histograms: per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; ok {
+		panic("prom: metric " + name + " registered twice")
+	}
+	f := &family{name: name, help: help, typ: typ, labels: labels, buckets: buckets}
+	f.series = map[string]*series{}
+	r.families[name] = f
+	return f
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("prom: %v wants %v label values, got %v", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+//
+// counters.
+//
+
+type CounterVec struct{ f *family }
+type Counter struct{ s *series }
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(name, help, "counter", nil, labels)}
+}
+
+func (cv *CounterVec) With(values ...string) *Counter {
+	return &Counter{cv.f.with(values)}
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("prom: counters cannot go down")
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.s.value += v
+}
+
+func (c *Counter) Value() float64 {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.value
+}
+
+//
+// gauges.
+//
+
+type GaugeVec struct{ f *family }
+type Gauge struct{ s *series }
+
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(name, help, "gauge", nil, labels)}
+}
+
+func (gv *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{gv.f.with(values)}
+}
+
+// the series for values will be fn(), called at every scrape.
+// replaces any earlier Func or Set for the same values.
+func (gv *GaugeVec) Func(fn func() float64, values ...string) {
+	s := gv.f.with(values)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fn = fn
+}
+
+func (g *Gauge) Set(v float64) {
+	g.s.mu.Lock()
+	defer g.s.mu.Unlock()
+	g.s.fn = nil
+	g.s.value = v
+}
+
+func (g *Gauge) Value() float64 {
+	return g.s.get()
+}
+
+func (s *series) get() float64 {
+	s.mu.Lock()
+	fn := s.fn
+	v := s.value
+	s.mu.Unlock()
+	// outside s.mu, since fn may well take locks of its own.
+	if fn != nil {
+		return fn()
+	}
+	return v
+}
+
+//
+// histograms.
+//
+
+type HistogramVec struct{ f *family }
+type Histogram struct {
+	f *family
+	s *series
+}
+
+// buckets are upper bounds, in increasing order; the +Inf
+// bucket is implicit.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("prom: histogram buckets out of order")
+	}
+	return &HistogramVec{r.register(name, help, "histogram", buckets, labels)}
+}
+
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{hv.f, hv.f.with(values)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(h.f.buckets) {
+		h.s.counts[i]++
+	}
+	h.s.sum += v
+	h.s.count++
+}
+
+// how many observations so far.
+func (h *Histogram) Count() uint64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.count
+}
+
+//
+// exposition.
+//
+
+// Write writes every metric in r to w in the text format,
+// sorted by name and then by label values.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	fams := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		fams = append(fams, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(fams, func(i, j int) bool { return fams[i].name < fams[j].name })
+
+	var b strings.Builder
+	for _, f := range fams {
+		f.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) write(b *strings.Builder) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].values, "\xff") < strings.Join(all[j].values, "\xff")
+	})
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+	for _, s := range all {
+		if f.typ != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, f.labelString(s.values, ""), formatFloat(s.get()))
+			continue
+		}
+
+		s.mu.Lock()
+		counts := append([]uint64(nil), s.counts...)
+		sum, count := s.sum, s.count
+		s.mu.Unlock()
+
+		cum := uint64(0)
+		for i, ub := range f.buckets {
+			cum += counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelString(s.values, formatFloat(ub)), cum)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, f.labelString(s.values, "+Inf"), count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, f.labelString(s.values, ""), formatFloat(sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, f.labelString(s.values, ""), count)
+	}
+}
+
+// {a="x",b="y"}, plus le="..." for histogram buckets.
+func (f *family) labelString(values []string, le string) string {
+	if len(values) == 0 && le == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		parts = append(parts, f.labels[i]+`="`+escapeLabel(v)+`"`)
+	}
+	if le != "" {
+		parts = append(parts, `le="`+le+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// Handler serves r in the text format, e.g. at /metrics.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
@@ -0,0 +1,88 @@
+package prom
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTextFormat(t *testing.T) {
+	reg := NewRegistry()
+
+	c := reg.Counter("requests_total", "Requests served.", "node")
+	c.With("1").Inc()
+	c.With("0").Add(2)
+
+	g := reg.Gauge("temperature", "A \\ silly\nhelp.")
+	g.With().Set(-1.5)
+
+	n := 7
+	reg.Gauge("sampled", "Read at scrape time.", "who").Func(func() float64 { return float64(n) }, `a"b`)
+	n = 8
+
+	h := reg.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.With().Observe(0.05)
+	h.With().Observe(0.1)
+	h.With().Observe(3)
+
+	var b strings.Builder
+	if err := reg.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.15
+latency_seconds_count 3
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{node="0"} 2
+requests_total{node="1"} 1
+# HELP sampled Read at scrape time.
+# TYPE sampled gauge
+sampled{who="a\"b"} 8
+# HELP temperature A \\ silly\nhelp.
+# TYPE temperature gauge
+temperature -1.5
+`
+	if b.String() != expected {
+		t.Fatalf("wrong output:\n%v\nexpected:\n%v", b.String(), expected)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("x_total", "X.").With().Inc()
+
+	srv := httptest.NewServer(Handler(reg))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("wrong content type %q", ct)
+	}
+	if !strings.Contains(string(body), "x_total 1\n") {
+		t.Fatalf("counter missing from:\n%v", string(body))
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("x_total", "X.")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("registering x_total twice should panic")
+		}
+	}()
+	reg.Gauge("x_total", "X again.")
+}
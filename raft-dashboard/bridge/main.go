@@ -0,0 +1,54 @@
+package main
+
+//
+// drive the dashboard from a real Go Raft cluster:
+//
+// go run ./raft-dashboard/bridge [-nodes 5] [-unreliable] [-addr localhost:4000] [-events trace.jsonl]
+//
+// then start the client as usual; it connects to ws://localhost:4000/ws
+// just as it would to backend.js.
+//
+
+import (
+	"flag"
+	"log"
+	"mitraft/dashbridge"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:4000", "address to serve on")
+	nodes := flag.Int("nodes", 5, "number of Raft peers")
+	unreliable := flag.Bool("unreliable", false, "drop and delay RPCs")
+	interval := flag.Duration("interval", 500*time.Millisecond, "time between state frames")
+	events := flag.String("events", "", "record the cluster's events to this file (see ../replay)")
+	flag.Parse()
+
+	opts := dashbridge.Options{
+		Nodes:      *nodes,
+		Unreliable: *unreliable,
+		Interval:   *interval,
+	}
+	if *events != "" {
+		f, err := os.Create(*events)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		opts.Events = f
+	}
+	s := dashbridge.NewServer(opts)
+	defer s.Close()
+
+	// flush the event log on ^C.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+		s.Close()
+		os.Exit(0)
+	}()
+	log.Fatal(s.ListenAndServe(*addr))
+}
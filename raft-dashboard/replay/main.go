@@ -0,0 +1,59 @@
+package main
+
+//
+// turn a Raft event trace into dashboard steps:
+//
+// RAFT_EVENTS=/tmp/ev go test ./raft -run TestFigure82C
+// go run ./raft-dashboard/replay -window 50ms /tmp/ev/TestFigure82C.jsonl > /tmp/steps.json
+// cd raft-dashboard/server && RAFT_STEPS=/tmp/steps.json npm run dev
+//
+// with -js, write a module like raftCluster/steps.js instead.
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"mitraft/dashbridge"
+	"mitraft/raft"
+	"os"
+	"time"
+)
+
+func main() {
+	window := flag.Duration("window", 50*time.Millisecond, "time covered by each step")
+	js := flag.Bool("js", false, "write `export const steps = ...` rather than JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: replay [flags] trace.jsonl\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	events, err := raft.ReadEvents(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		log.Fatalf("%v: %v", flag.Arg(0), err)
+	}
+
+	steps := dashbridge.Replay(events, *window)
+	out, err := json.MarshalIndent(steps, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *js {
+		fmt.Printf("export const steps = %s;\n", out)
+	} else {
+		fmt.Printf("%s\n", out)
+	}
+	log.Printf("%v events, %v steps", len(events), len(steps))
+}
@@ -1,7 +1,14 @@
-import { steps } from "./steps.js";
+import { readFileSync } from "fs";
+import { steps as builtinSteps } from "./steps.js";
 import { nodePositions } from "./positions.js";
 import { initMetrics } from "../metrics.js";
 
+// RAFT_STEPS=steps.json replays a trace of the Go cluster
+// (see raft-dashboard/replay) instead of the built-in movie.
+const steps = process.env.RAFT_STEPS
+  ? JSON.parse(readFileSync(process.env.RAFT_STEPS, "utf8"))
+  : builtinSteps;
+
 const METRICS = await initMetrics({
   dir: "./metrics",
   scenario: process.env.RAFT_SCENARIO || "leader_crash_restart",
@@ -0,0 +1,190 @@
+package raft
+
+//
+// per-node HTTP admin API.
+//
+// http.Handle("/raft/", http.StripPrefix("/raft", NewAdminHandler(rf, AdminOptions{})))
+//
+// GET  /status                      -- Status() as JSON
+// GET  /log?from=N&to=M             -- entries N..M (to defaults to the end)
+// POST /transfer-leadership?to=P    -- hand leadership to P (default: best follower)
+// POST /snapshot                    -- have the service snapshot and compact the log
+// POST /step-down                   -- stop leading, without a transfer
+//
+// every response is JSON; failures are {"error": "..."}.
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the most entries one GET /log returns.
+const maxAdminEntries = 1000
+
+type AdminOptions struct {
+	// Snapshot asks the service to snapshot its state and pass
+	// it to rf.Snapshot(), returning the index it covers. if
+	// nil, POST /snapshot answers 501.
+	Snapshot func() (int, error)
+
+	// how long POST /transfer-leadership waits; default 2s.
+	TransferTimeout time.Duration
+}
+
+type adminEntry struct {
+	Index   int         `json:"index"`
+	Term    int         `json:"term"`
+	Command interface{} `json:"command"`
+}
+
+type adminLog struct {
+	From    int          `json:"from"`
+	To      int          `json:"to"`
+	Entries []adminEntry `json:"entries"`
+}
+
+// NewAdminHandler serves the admin API for rf. it can be mounted
+// anywhere in a service's own mux.
+func NewAdminHandler(rf *Raft, opts AdminOptions) http.Handler {
+	if opts.TransferTimeout == 0 {
+		opts.TransferTimeout = 2 * time.Second
+	}
+	a := &admin{rf: rf, opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.method("GET", a.status))
+	mux.HandleFunc("/log", a.method("GET", a.log))
+	mux.HandleFunc("/transfer-leadership", a.method("POST", a.transfer))
+	mux.HandleFunc("/snapshot", a.method("POST", a.snapshot))
+	mux.HandleFunc("/step-down", a.method("POST", a.stepDown))
+	return mux
+}
+
+type admin struct {
+	rf   *Raft
+	opts AdminOptions
+}
+
+func (a *admin) method(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			w.Header().Set("Allow", m)
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s only", m))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// an int query parameter, or def if it is absent.
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s: %q", name, s)
+	}
+	return v, nil
+}
+
+func (a *admin) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.rf.Status())
+}
+
+func (a *admin) log(w http.ResponseWriter, r *http.Request) {
+	st := a.rf.Status()
+	from, err := queryInt(r, "from", st.FirstLogIndex)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := queryInt(r, "to", st.LastLogIndex)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if from < 1 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad from: %d", from))
+		return
+	}
+	to = min(to, from+maxAdminEntries-1)
+
+	entries, err := a.rf.Entries(from, to)
+	if err == ErrCompacted {
+		writeError(w, http.StatusGone, err)
+		return
+	}
+	out := adminLog{From: from, To: from + len(entries) - 1, Entries: make([]adminEntry, len(entries))}
+	for i, e := range entries {
+		out.Entries[i] = adminEntry{Index: e.Index, Term: e.Term, Command: jsonable(e.Command)}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// commands are whatever the service passed to Start(); show
+// the ones JSON can't encode as text.
+func jsonable(v interface{}) interface{} {
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+func (a *admin) transfer(w http.ResponseWriter, r *http.Request) {
+	to, err := queryInt(r, "to", -1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = a.rf.TransferLeadership(to, a.opts.TransferTimeout)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, a.rf.Status())
+	case errors.Is(err, ErrNotLeader), errors.Is(err, ErrTransferInProgress):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrTransferTimeout):
+		writeError(w, http.StatusGatewayTimeout, err)
+	default:
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
+
+func (a *admin) snapshot(w http.ResponseWriter, r *http.Request) {
+	if a.opts.Snapshot == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("service does not support snapshots"))
+		return
+	}
+	if _, err := a.opts.Snapshot(); err != nil {
+		if errors.Is(err, ErrNotApplied) {
+			writeError(w, http.StatusConflict, err)
+		} else {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, a.rf.Status())
+}
+
+func (a *admin) stepDown(w http.ResponseWriter, r *http.Request) {
+	if err := a.rf.StepDown(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.rf.Status())
+}
@@ -0,0 +1,173 @@
+package raft
+
+//
+// a cluster's history as JSON Lines, one Event per line.
+//
+// el := NewEventLog(f, c) -- stamping events with clock c.
+// rf.AddObserver(el)   // for each peer; one log can take them all
+// ...
+// el.Close()
+//
+// el.Record(e) -- an event from outside the peers.
+//
+// events, err := ReadEvents(f)
+//
+// the tester writes one file per test to $RAFT_EVENTS/<test>.jsonl
+// when RAFT_EVENTS is set; raft-dashboard/replay turns a file into
+// steps the dashboard can scrub through.
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mitraft/clock"
+	"sync"
+	"time"
+)
+
+// Event kinds.
+const (
+	EventSend    = "send"    // Node sent Method to Peer
+	EventDeliver = "deliver" // Node received Method from Peer
+	EventReply   = "reply"   // Node got Peer's reply to Method
+	EventDrop    = "drop"    // Node's Method to Peer got no reply
+	EventRole    = "role"    // Node became Role in Term
+	EventTerm    = "term"    // Node moved to Term
+	EventCommit  = "commit"  // Node's commitIndex rose to Index
+	EventApply   = "apply"   // Node applied Command at Index, from Term
+	EventCrash   = "crash"   // Node was killed
+	EventStep    = "step"    // a model checker chose Step (see raftsim/modelcheck.go)
+)
+
+type Event struct {
+	Time    time.Time   `json:"time"`
+	Kind    string      `json:"kind"`
+	Node    int         `json:"node"`
+	Peer    int         `json:"peer"` // -1 unless an RPC
+	Method  string      `json:"method,omitempty"`
+	Granted bool        `json:"granted,omitempty"` // a RequestVote reply's VoteGranted
+	Term    int         `json:"term,omitempty"`
+	Role    string      `json:"role,omitempty"`
+	Index   int         `json:"index,omitempty"`
+	Command interface{} `json:"command,omitempty"`
+	Step    string      `json:"step,omitempty"` // what an EventStep chose
+}
+
+// EventLog is an Observer that writes every event it hears of.
+type EventLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	bw  *bufio.Writer
+	enc *json.Encoder
+	c   clock.Clock // for the events' times
+	err error       // the first write error
+}
+
+// NewEventLog writes to w, buffered; call Flush or Close when done.
+// events are stamped with c's time, the peers' clock, so that a
+// simulated run's log replays exactly; nil means clock.Real{}.
+func NewEventLog(w io.Writer, c clock.Clock) *EventLog {
+	if c == nil {
+		c = clock.Real{}
+	}
+	bw := bufio.NewWriter(w)
+	return &EventLog{w: w, bw: bw, enc: json.NewEncoder(bw), c: c}
+}
+
+// Record writes e, stamped with the time, for events that don't
+// come from a peer.
+func (el *EventLog) Record(e Event) {
+	el.record(e)
+}
+
+func (el *EventLog) record(e Event) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	e.Time = el.c.Now() // under the lock, so the file is in time order
+	if err := el.enc.Encode(e); err != nil && el.err == nil {
+		el.err = err
+	}
+}
+
+func (el *EventLog) Flush() error {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	if err := el.bw.Flush(); err != nil && el.err == nil {
+		el.err = err
+	}
+	return el.err
+}
+
+// Close flushes, and closes the writer if it is an io.Closer.
+func (el *EventLog) Close() error {
+	err := el.Flush()
+	if c, ok := el.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ReadEvents reads a log written by an EventLog.
+func ReadEvents(r io.Reader) ([]Event, error) {
+	var events []Event
+	dec := json.NewDecoder(r)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+}
+
+func (el *EventLog) RoleChanged(peer int, term int, from, to string) {
+	el.record(Event{Kind: EventRole, Node: peer, Peer: -1, Term: term, Role: to})
+}
+
+func (el *EventLog) TermChanged(peer int, from, to int) {
+	el.record(Event{Kind: EventTerm, Node: peer, Peer: -1, Term: to})
+}
+
+// a vote shows up as the candidate's reply event.
+func (el *EventLog) VoteGranted(peer int, term int, candidate int) {}
+
+// appends show up as the deliver events that carry them.
+func (el *EventLog) EntryAppended(peer int, entry LogEntry) {}
+
+func (el *EventLog) CommitAdvanced(peer int, from, to int) {
+	el.record(Event{Kind: EventCommit, Node: peer, Peer: -1, Index: to})
+}
+
+func (el *EventLog) EntryApplied(peer int, entry LogEntry) {
+	el.record(Event{Kind: EventApply, Node: peer, Peer: -1, Term: entry.Term, Index: entry.Index,
+		Command: jsonable(entry.Command)})
+}
+
+func (el *EventLog) RPCSent(peer int, to int, svcMeth string, args interface{}) {
+	el.record(Event{Kind: EventSend, Node: peer, Peer: to, Method: svcMeth})
+}
+
+func (el *EventLog) RPCReceived(peer int, from int, svcMeth string, args interface{}) {
+	el.record(Event{Kind: EventDeliver, Node: peer, Peer: from, Method: svcMeth})
+}
+
+func (el *EventLog) RPCReplied(peer int, to int, svcMeth string, args, reply interface{}) {
+	e := Event{Kind: EventReply, Node: peer, Peer: to, Method: svcMeth}
+	if rv, ok := reply.(*RequestVoteReply); ok {
+		e.Granted = rv.VoteGranted
+	}
+	el.record(e)
+}
+
+func (el *EventLog) PeerUnreachable(peer int, to int, svcMeth string) {
+	el.record(Event{Kind: EventDrop, Node: peer, Peer: to, Method: svcMeth})
+}
+
+func (el *EventLog) Killed(peer int) {
+	el.record(Event{Kind: EventCrash, Node: peer, Peer: -1})
+}
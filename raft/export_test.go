@@ -0,0 +1,16 @@
+package raft
+
+// for the tests in package raft_test.
+
+type OtlpSpan = otlpSpan
+type OtlpExportRequest = otlpExportRequest
+
+// FuzzHandlers' input for the requests a peer received, each a
+// *RequestVoteArgs or *AppendEntriesArgs.
+func HandlerFuzzInput(rpcs []interface{}) []byte {
+	return encodeFuzzOps(rpcs)
+}
+
+func (rf *Raft) DropRate() float64 {
+	return rf.dropRate()
+}
@@ -0,0 +1,257 @@
+package raft
+
+//
+// fuzz targets.
+//
+// FuzzHandlers -- a sequence of RequestVote and AppendEntries
+//   requests, with arbitrary fields, to one peer.
+// FuzzReadPersist -- arbitrary bytes as a peer's persisted state.
+//
+// after each request, and after restoring, the peer's state must
+// hang together (see checkFuzzState), its term and commitIndex
+// must not have gone backwards, and nothing may panic.
+//
+// go test ./raft -run XXX -fuzz FuzzHandlers -fuzztime 1m
+//
+// the seed corpora in testdata/fuzz come from cluster runs; see
+// TestFuzzCorpus.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"mitraft/clock"
+	"mitraft/labgob"
+	"mitraft/labrpc"
+	"testing"
+)
+
+// how many peers the fuzzed peer thinks there are.
+const fuzzPeers = 3
+
+// a clock that runs what a handler starts only when asked, so
+// that each request is handled to the end, on the fuzzer's
+// goroutine, before the next arrives.
+type fuzzClock struct {
+	clock.Real
+	pending []func()
+}
+
+func (fc *fuzzClock) Go(f func()) {
+	fc.pending = append(fc.pending, f)
+}
+
+func (fc *fuzzClock) run() {
+	for len(fc.pending) > 0 {
+		f := fc.pending[0]
+		fc.pending = fc.pending[1:]
+		f()
+	}
+}
+
+// a peer that sends nothing and runs no timers, so it only
+// changes when it's sent a request.
+func makeFuzzRaft(persister *Persister, applyCh chan ApplyMsg) (*Raft, *fuzzClock) {
+	fc := &fuzzClock{}
+	rf := newRaft(make([]*labrpc.ClientEnd, fuzzPeers), 0, persister, applyCh, Options{Clock: fc})
+	return rf, fc
+}
+
+// the fuzz input format: a request is a kind byte, then its
+// fields as varints. an AppendEntries' entries follow it, each a
+// term, an offset of its index from where it belongs, and an
+// int command. input that runs out reads as zeros.
+const (
+	fuzzRequestVote   = 0
+	fuzzAppendEntries = 1
+)
+
+// the most entries one fuzzed AppendEntries carries.
+const fuzzMaxEntries = 8
+
+type fuzzReader struct {
+	r *bytes.Reader
+}
+
+func (fr fuzzReader) byte() byte {
+	b, _ := fr.r.ReadByte()
+	return b
+}
+
+func (fr fuzzReader) int() int {
+	x, _ := binary.ReadVarint(fr.r)
+	return int(int32(x))
+}
+
+// the requests in data, each *RequestVoteArgs or *AppendEntriesArgs.
+func decodeFuzzOps(data []byte) []interface{} {
+	fr := fuzzReader{bytes.NewReader(data)}
+	var ops []interface{}
+	for fr.r.Len() > 0 {
+		if fr.byte()%2 == fuzzRequestVote {
+			ops = append(ops, &RequestVoteArgs{
+				Term:         fr.int(),
+				CandidateId:  fr.int(),
+				LastLogIndex: fr.int(),
+				LastLogTerm:  fr.int(),
+			})
+			continue
+		}
+		args := &AppendEntriesArgs{
+			Term:         fr.int(),
+			LeaderId:     fr.int(),
+			PrevLogIndex: fr.int(),
+			PrevLogTerm:  fr.int(),
+			LeaderCommit: fr.int(),
+		}
+		n := int(fr.byte()) % (fuzzMaxEntries + 1)
+		for i := 0; i < n; i++ {
+			term := fr.int()
+			index := args.PrevLogIndex + 1 + i + fr.int()
+			args.Entries = append(args.Entries, LogEntry{Term: term, Index: index, Command: fr.int()})
+		}
+		ops = append(ops, args)
+	}
+	return ops
+}
+
+// the inverse of decodeFuzzOps, for requests a real peer received.
+// commands other than ints become 0, and longer AppendEntries
+// are cut short.
+func encodeFuzzOps(ops []interface{}) []byte {
+	var b []byte
+	put := func(x int) { b = binary.AppendVarint(b, int64(x)) }
+	for _, op := range ops {
+		switch args := op.(type) {
+		case *RequestVoteArgs:
+			b = append(b, fuzzRequestVote)
+			put(args.Term)
+			put(args.CandidateId)
+			put(args.LastLogIndex)
+			put(args.LastLogTerm)
+		case *AppendEntriesArgs:
+			b = append(b, fuzzAppendEntries)
+			put(args.Term)
+			put(args.LeaderId)
+			put(args.PrevLogIndex)
+			put(args.PrevLogTerm)
+			put(args.LeaderCommit)
+			n := min(len(args.Entries), fuzzMaxEntries)
+			b = append(b, byte(n))
+			for i, e := range args.Entries[:n] {
+				put(e.Term)
+				put(e.Index - (args.PrevLogIndex + 1 + i))
+				cmd, _ := e.Command.(int)
+				put(cmd)
+			}
+		}
+	}
+	return b
+}
+
+// a description of what's wrong with rf's state, or "".
+// caller must hold rf.mu.
+func checkFuzzState(rf *Raft) string {
+	if len(rf.log) == 0 {
+		return "empty log"
+	}
+	for i, e := range rf.log {
+		if e.Index != rf.log[0].Index+i {
+			return fmt.Sprintf("log[%v] has index %v, after %v", i, e.Index, rf.log[0].Index)
+		}
+		if i > 0 && e.Term < rf.log[i-1].Term {
+			return fmt.Sprintf("index %v's term %v is less than the one before", e.Index, e.Term)
+		}
+	}
+	if rf.lastTerm() > rf.currentTerm {
+		return fmt.Sprintf("last entry's term %v is after currentTerm %v", rf.lastTerm(), rf.currentTerm)
+	}
+	if rf.commitIndex < rf.baseIndex() || rf.commitIndex > rf.lastIndex() {
+		return fmt.Sprintf("commitIndex %v outside the log [%v, %v]", rf.commitIndex, rf.baseIndex(), rf.lastIndex())
+	}
+	if rf.lastApplied > rf.commitIndex {
+		return fmt.Sprintf("lastApplied %v is past commitIndex %v", rf.lastApplied, rf.commitIndex)
+	}
+	if rf.votedFor < -1 || rf.votedFor >= len(rf.peers) {
+		return fmt.Sprintf("votedFor %v isn't a peer", rf.votedFor)
+	}
+	return ""
+}
+
+func FuzzHandlers(f *testing.F) {
+	f.Add(encodeFuzzOps([]interface{}{
+		&RequestVoteArgs{Term: 1, CandidateId: 1},
+		&AppendEntriesArgs{Term: 1, LeaderId: 1, Entries: []LogEntry{{1, 101, 1}, {1, 102, 2}}, LeaderCommit: 1},
+		&AppendEntriesArgs{Term: 2, LeaderId: 2, PrevLogIndex: 1, PrevLogTerm: 1,
+			Entries: []LogEntry{{2, 103, 2}}, LeaderCommit: 2},
+	}))
+	f.Add(encodeFuzzOps([]interface{}{
+		&AppendEntriesArgs{Term: 1, LeaderId: 1, PrevLogIndex: -1, Entries: []LogEntry{{1, 101, 0}}},
+	}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ops := decodeFuzzOps(data)
+		applyCh := make(chan ApplyMsg, 1+fuzzMaxEntries*len(ops))
+		rf, fc := makeFuzzRaft(MakePersister(), applyCh)
+
+		term, commit := 0, 0
+		for i, op := range ops {
+			switch args := op.(type) {
+			case *RequestVoteArgs:
+				rf.RequestVote(args, &RequestVoteReply{})
+			case *AppendEntriesArgs:
+				rf.AppendEntries(args, &AppendEntriesReply{})
+			}
+			fc.run()
+
+			rf.mu.Lock()
+			v := checkFuzzState(rf)
+			if rf.currentTerm < term {
+				v = fmt.Sprintf("term went from %v back to %v", term, rf.currentTerm)
+			}
+			if rf.commitIndex < commit {
+				v = fmt.Sprintf("commitIndex went from %v back to %v", commit, rf.commitIndex)
+			}
+			term, commit = rf.currentTerm, rf.commitIndex
+			rf.mu.Unlock()
+			if v != "" {
+				t.Fatalf("after request %v, %+v: %v", i, op, v)
+			}
+		}
+	})
+}
+
+func FuzzReadPersist(f *testing.F) {
+	labgob.Register(0)
+	state := func(term, votedFor int, log []LogEntry) []byte {
+		w := new(bytes.Buffer)
+		e := labgob.NewEncoder(w)
+		e.Encode(term)
+		e.Encode(votedFor)
+		e.Encode(log)
+		return w.Bytes()
+	}
+	f.Add(state(0, -1, []LogEntry{{Term: 0}}))
+	f.Add(state(3, 1, []LogEntry{{0, nil, 0}, {1, 101, 1}, {3, 102, 2}}))
+	f.Add(state(2, -1, []LogEntry{{2, nil, 5}, {2, 106, 6}}))
+	f.Add(state(1, 7, []LogEntry{}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		persister := MakePersister()
+		persister.SaveRaftState(data)
+		rf, _ := makeFuzzRaft(persister, make(chan ApplyMsg))
+		rf.readPersist(persister.ReadRaftState())
+		if v := checkFuzzState(rf); v != "" {
+			t.Fatalf("restored state: %v", v)
+		}
+
+		// what was restored should survive another round.
+		again, _ := makeFuzzRaft(persister, make(chan ApplyMsg))
+		again.readPersist(rf.raftState())
+		if again.currentTerm != rf.currentTerm || again.votedFor != rf.votedFor ||
+			len(again.log) != len(rf.log) || again.lastIndex() != rf.lastIndex() {
+			t.Fatalf("restored state didn't survive persisting again")
+		}
+	})
+}
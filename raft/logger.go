@@ -0,0 +1,133 @@
+package raft
+
+//
+// structured, leveled logging.
+//
+// rf.SetLogger(NewTextLogger(os.Stderr, LevelDebug))
+//
+// or run with RAFT_LOG=debug (or info, warn, error) to have
+// Make() log to stderr. every record carries the peer's id,
+// term and role; rf.logf() adds them, so call sites only say
+// what happened.
+//
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel accepts debug, info, warn or error, in any case.
+func ParseLevel(s string) (Level, bool) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, true
+	case "info":
+		return LevelInfo, true
+	case "warn":
+		return LevelWarn, true
+	case "error":
+		return LevelError, true
+	}
+	return LevelInfo, false
+}
+
+type Record struct {
+	Time  time.Time
+	Level Level
+	Node  int
+	Term  int
+	Role  string
+	Msg   string
+	Attrs []interface{} // alternating keys and values
+}
+
+// time level node= term= role= msg, then the attrs as key=value.
+func (r Record) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s node=%d term=%d role=%s %s",
+		r.Time.Format("15:04:05.000000"), r.Level, r.Node, r.Term, r.Role, r.Msg)
+	for i := 0; i+1 < len(r.Attrs); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", r.Attrs[i], r.Attrs[i+1])
+	}
+	return b.String()
+}
+
+// Log is called with the peer's lock held; it must not call
+// back into Raft. Enabled lets a peer skip building records
+// that would be thrown away.
+type Logger interface {
+	Enabled(level Level) bool
+	Log(r Record)
+}
+
+type textLogger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	min Level
+}
+
+// NewTextLogger writes records at level min and above to w,
+// one line each.
+func NewTextLogger(w io.Writer, min Level) Logger {
+	return &textLogger{w: w, min: min}
+}
+
+func (tl *textLogger) Enabled(level Level) bool {
+	return level >= tl.min
+}
+
+func (tl *textLogger) Log(r Record) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	fmt.Fprintln(tl.w, r.String())
+}
+
+// SetLogger replaces the peer's logger; nil turns logging off.
+func (rf *Raft) SetLogger(l Logger) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.logger = l
+}
+
+// log msg with alternating keys and values in attrs.
+// caller must hold rf.mu.
+func (rf *Raft) logf(level Level, msg string, attrs ...interface{}) {
+	if rf.logger == nil || !rf.logger.Enabled(level) {
+		return
+	}
+	rf.logger.Log(Record{
+		Time:  rf.clock.Now(),
+		Level: level,
+		Node:  rf.me,
+		Term:  rf.currentTerm,
+		Role:  rf.state,
+		Msg:   msg,
+		Attrs: attrs,
+	})
+}
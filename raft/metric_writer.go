@@ -3,6 +3,7 @@ package raft
 import (
 	"encoding/csv"
 	"fmt"
+	"mitraft/clock"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -11,8 +12,10 @@ import (
 )
 
 // ---- MetricsWriter: writes 3 CSVs in ./metrics (same repo root) ----
+// an Observer; Make() registers one on every peer.
 
 type metricsWriter struct {
+	NopObserver
 	mu sync.Mutex
 
 	// files + csv writers
@@ -26,11 +29,14 @@ type metricsWriter struct {
 
 	// experiment tags
 	scenario                string
-	seed, trial             int
+	seed                    int64
+	trial                   int
 	timeoutLow, timeoutHigh int
+	dropRate                func() float64 // the network's now; nil means 0
 
-	// monotonic origin
-	t0 time.Time
+	// monotonic origin, by the observed peers' clock
+	clock clock.Clock
+	t0    time.Time
 
 	// per-election state
 	lastLeaderID   int
@@ -41,9 +47,15 @@ type metricsWriter struct {
 	electStartMs int64
 	electedMs    int64
 	firstHbMs    int64
+
+	// what the observed peers are doing
+	roles     map[int]string // peer -> role
+	firstHB   map[int]bool   // term -> first heartbeat already recorded
+	startMs   map[int]int64  // log index -> startMs (leader-side)
+	startTerm map[int]int    // log index -> term at Start
 }
 
-func nowMs(from time.Time) int64 { return time.Since(from).Milliseconds() }
+func (m *metricsWriter) nowMs() int64 { return m.clock.Since(m.t0).Milliseconds() }
 
 func ensureCSV(path string, header []string) (*os.File, *csv.Writer, error) {
 	new := false
@@ -62,7 +74,7 @@ func ensureCSV(path string, header []string) (*os.File, *csv.Writer, error) {
 	return f, w, nil
 }
 
-func newMetrics(dir, scenario string, seed, trial, toutLow, toutHigh int) (*metricsWriter, error) {
+func newMetrics(dir, scenario string, seed int64, trial, toutLow, toutHigh int, clk clock.Clock) (*metricsWriter, error) {
 	if dir == "" {
 		dir = "./metrics"
 	}
@@ -101,8 +113,13 @@ func newMetrics(dir, scenario string, seed, trial, toutLow, toutHigh int) (*metr
 		tenureFile: tenureFile, tenureCSV: tenureCSV,
 		scenario: scenario, seed: seed, trial: trial,
 		timeoutLow: toutLow, timeoutHigh: toutHigh,
-		t0:           time.Now(),
+		clock:        clk,
+		t0:           clk.Now(),
 		lastLeaderID: -1, lastLeaderFrom: -1,
+		roles:     map[int]string{},
+		firstHB:   map[int]bool{},
+		startMs:   map[int]int64{},
+		startTerm: map[int]int{},
 	}, nil
 }
 
@@ -134,26 +151,26 @@ func (m *metricsWriter) Close() {
 func (m *metricsWriter) RecordLeaderCrash(oldLeader int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.crashTimeMs = nowMs(m.t0)
+	m.crashTimeMs = m.nowMs()
 }
 
 func (m *metricsWriter) RecordElectionStart() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.electStartMs = nowMs(m.t0)
+	m.electStartMs = m.nowMs()
 }
 
 func (m *metricsWriter) RecordLeaderElected(newLeader, term int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.electedMs = nowMs(m.t0)
+	m.electedMs = m.nowMs()
 
 	// close previous leader tenure, if any
 	if m.lastLeaderFrom >= 0 && m.lastLeaderID >= 0 {
 		end := m.electedMs
 		_ = m.tenureCSV.Write([]string{
 			m.scenario,
-			strconv.Itoa(m.seed), strconv.Itoa(m.trial),
+			strconv.FormatInt(m.seed, 10), strconv.Itoa(m.trial),
 			strconv.Itoa(m.lastLeaderID), strconv.Itoa(term - 1),
 			strconv.FormatInt(m.lastLeaderFrom, 10), strconv.FormatInt(end, 10),
 			strconv.FormatInt(end-m.lastLeaderFrom, 10),
@@ -167,7 +184,7 @@ func (m *metricsWriter) RecordLeaderElected(newLeader, term int) {
 func (m *metricsWriter) RecordFirstHeartbeat(newLeader int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.firstHbMs = nowMs(m.t0)
+	m.firstHbMs = m.nowMs()
 	if m.crashTimeMs == 0 { // if no explicit crash recorded, still emit row with failover from election→HB
 		m.crashTimeMs = m.electedMs // fallback
 	}
@@ -175,7 +192,7 @@ func (m *metricsWriter) RecordFirstHeartbeat(newLeader int) {
 	_ = m.failoverCSV.Write([]string{
 		m.scenario,
 		strconv.Itoa(m.timeoutLow), strconv.Itoa(m.timeoutHigh),
-		strconv.Itoa(m.seed), strconv.Itoa(m.trial),
+		strconv.FormatInt(m.seed, 10), strconv.Itoa(m.trial),
 		"-1", strconv.Itoa(newLeader),
 		strconv.FormatInt(m.crashTimeMs, 10),
 		strconv.FormatInt(m.electStartMs, 10),
@@ -191,20 +208,95 @@ func (m *metricsWriter) RecordFirstHeartbeat(newLeader int) {
 func (m *metricsWriter) RecordStart(index int, leaderTerm int, dropRate float64) int64 {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return nowMs(m.t0)
+	return m.nowMs()
 }
 
 func (m *metricsWriter) RecordCommit(index int, leaderTerm int, dropRate float64, startMs int64) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	commit := nowMs(m.t0)
+	commit := m.nowMs()
 	_ = m.replCSV.Write([]string{
 		m.scenario,
 		fmt.Sprintf("%.2f", dropRate),
-		strconv.Itoa(m.seed), strconv.Itoa(m.trial),
+		strconv.FormatInt(m.seed, 10), strconv.Itoa(m.trial),
 		strconv.Itoa(index), strconv.Itoa(leaderTerm),
 		strconv.FormatInt(startMs, 10), strconv.FormatInt(commit, 10),
 		strconv.FormatInt(commit-startMs, 10),
 	})
 	m.replCSV.Flush()
 }
+
+// ---- Observer ----
+
+func (m *metricsWriter) role(peer int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.roles[peer]
+}
+
+func (m *metricsWriter) RoleChanged(peer int, term int, from, to string) {
+	m.mu.Lock()
+	m.roles[peer] = to
+	m.mu.Unlock()
+
+	switch to {
+	case Candidate:
+		m.RecordElectionStart()
+	case Leader:
+		m.RecordLeaderElected(peer, term)
+	}
+}
+
+func (m *metricsWriter) RPCSent(peer int, to int, svcMeth string, args interface{}) {
+	ae, ok := args.(*AppendEntriesArgs)
+	if !ok || m.role(peer) != Leader {
+		return
+	}
+	m.mu.Lock()
+	first := !m.firstHB[ae.Term]
+	m.firstHB[ae.Term] = true
+	m.mu.Unlock()
+	if first {
+		m.RecordFirstHeartbeat(peer)
+	}
+}
+
+func (m *metricsWriter) currentDropRate() float64 {
+	if m.dropRate == nil {
+		return 0
+	}
+	return m.dropRate()
+}
+
+func (m *metricsWriter) EntryAppended(peer int, entry LogEntry) {
+	if m.role(peer) != Leader {
+		return
+	}
+	start := m.RecordStart(entry.Index, entry.Term, m.currentDropRate())
+	m.mu.Lock()
+	m.startMs[entry.Index] = start
+	m.startTerm[entry.Index] = entry.Term
+	m.mu.Unlock()
+}
+
+func (m *metricsWriter) EntryApplied(peer int, entry LogEntry) {
+	if m.role(peer) != Leader {
+		return
+	}
+	m.mu.Lock()
+	start, ok := m.startMs[entry.Index]
+	term := m.startTerm[entry.Index]
+	delete(m.startMs, entry.Index)
+	delete(m.startTerm, entry.Index)
+	m.mu.Unlock()
+	if ok {
+		m.RecordCommit(entry.Index, term, m.currentDropRate(), start)
+	}
+}
+
+// mark crash time if the peer is the leader at kill time.
+func (m *metricsWriter) Killed(peer int) {
+	if m.role(peer) == Leader {
+		m.RecordLeaderCrash(peer)
+	}
+}
@@ -0,0 +1,147 @@
+package raft
+
+//
+// instrumentation hooks.
+//
+// rf.AddObserver(o) -- o hears about everything peer rf does
+// from then on. a peer may have any number of observers, and one
+// observer may watch many peers; every event says which peer
+// (rf.me) it came from.
+//
+// events are delivered synchronously, often with rf.mu held, so
+// an observer must be quick and must never call back into the
+// Raft it is watching.
+//
+
+import "time"
+
+type Observer interface {
+	// the peer went from role from to role to (Follower,
+	// Candidate, Leader) in term. a candidate that times out
+	// and starts another election goes from Candidate to
+	// Candidate, so every election is reported.
+	RoleChanged(peer int, term int, from, to string)
+
+	// the peer's currentTerm went from from to to.
+	TermChanged(peer int, from, to int)
+
+	// the peer granted its vote in term to candidate.
+	VoteGranted(peer int, term int, candidate int)
+
+	// entry was added to the peer's log, by Start() on a
+	// leader or by AppendEntries on a follower.
+	EntryAppended(peer int, entry LogEntry)
+
+	// the peer's commitIndex moved from from to to.
+	CommitAdvanced(peer int, from, to int)
+
+	// the peer delivered entry on applyCh.
+	EntryApplied(peer int, entry LogEntry)
+
+	// the peer is sending args to peer to (svcMeth is e.g.
+	// "Raft.AppendEntries"), or has received args from peer from.
+	RPCSent(peer int, to int, svcMeth string, args interface{})
+	RPCReceived(peer int, from int, svcMeth string, args interface{})
+
+	// peer to answered the peer's RPC with reply.
+	RPCReplied(peer int, to int, svcMeth string, args, reply interface{})
+
+	// an RPC from the peer to peer to got no reply.
+	PeerUnreachable(peer int, to int, svcMeth string)
+
+	// Kill() was called on the peer.
+	Killed(peer int)
+}
+
+// NopObserver ignores every event. embed it to implement
+// only the Observer methods you care about.
+type NopObserver struct{}
+
+func (NopObserver) RoleChanged(peer int, term int, from, to string)                      {}
+func (NopObserver) TermChanged(peer int, from, to int)                                   {}
+func (NopObserver) VoteGranted(peer int, term int, candidate int)                        {}
+func (NopObserver) EntryAppended(peer int, entry LogEntry)                               {}
+func (NopObserver) CommitAdvanced(peer int, from, to int)                                {}
+func (NopObserver) EntryApplied(peer int, entry LogEntry)                                {}
+func (NopObserver) RPCSent(peer int, to int, svcMeth string, args interface{})           {}
+func (NopObserver) RPCReceived(peer int, from int, svcMeth string, args interface{})     {}
+func (NopObserver) RPCReplied(peer int, to int, svcMeth string, args, reply interface{}) {}
+func (NopObserver) PeerUnreachable(peer int, to int, svcMeth string)                     {}
+func (NopObserver) Killed(peer int)                                                      {}
+
+// AddObserver registers o for all of this peer's future events.
+func (rf *Raft) AddObserver(o Observer) {
+	rf.obsMu.Lock()
+	defer rf.obsMu.Unlock()
+	// copy on write, so notify() never races with a slice being appended to.
+	obs := make([]Observer, len(rf.observers), len(rf.observers)+1)
+	copy(obs, rf.observers)
+	rf.observers = append(obs, o)
+}
+
+func (rf *Raft) notify(f func(o Observer)) {
+	rf.obsMu.Lock()
+	obs := rf.observers
+	rf.obsMu.Unlock()
+	for _, o := range obs {
+		f(o)
+	}
+}
+
+//
+// state transitions that observers hear about.
+// caller must hold rf.mu.
+//
+
+func (rf *Raft) setTerm(term int) {
+	if term == rf.currentTerm {
+		return
+	}
+	from := rf.currentTerm
+	rf.currentTerm = term
+	rf.leaderId = -1
+	rf.renewContext()
+	rf.logf(LevelDebug, "new term", "from", from)
+	rf.notify(func(o Observer) { o.TermChanged(rf.me, from, term) })
+}
+
+func (rf *Raft) setRole(role string) {
+	if role == rf.state && role != Candidate {
+		return
+	}
+	from := rf.state
+	rf.state = role
+	rf.renewContext()
+	switch {
+	case role == Candidate:
+		rf.logf(LevelInfo, "starting election", "from", from)
+	case role == Leader:
+		rf.leaderId = rf.me
+		for i := range rf.lastContact {
+			rf.lastContact[i] = time.Time{}
+		}
+		rf.logf(LevelInfo, "elected leader", "lastIndex", rf.lastIndex())
+	default:
+		rf.logf(LevelInfo, "stepping down", "from", from)
+	}
+	if from == Leader {
+		rf.traceAbandon()
+		rf.leadTransferee = -1
+	}
+	rf.notify(func(o Observer) { o.RoleChanged(rf.me, rf.currentTerm, from, role) })
+}
+
+func (rf *Raft) setCommitIndex(index int) {
+	if index == rf.commitIndex {
+		return
+	}
+	from := rf.commitIndex
+	rf.commitIndex = index
+	rf.logf(LevelDebug, "commit advanced", "from", from, "to", index)
+	rf.notify(func(o Observer) { o.CommitAdvanced(rf.me, from, index) })
+}
+
+func (rf *Raft) appendEntry(entry LogEntry) {
+	rf.log = append(rf.log, entry)
+	rf.notify(func(o Observer) { o.EntryAppended(rf.me, entry) })
+}
@@ -9,12 +9,16 @@ package raft
 // test with the original before submitting.
 //
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type Persister struct {
 	mu        sync.Mutex
 	raftstate []byte
 	snapshot  []byte
+	delay     time.Duration // see SetWriteDelay
 }
 
 func MakePersister() *Persister {
@@ -30,7 +34,25 @@ func (ps *Persister) Copy() *Persister {
 	return np
 }
 
+// make each save take d longer, in real time, like a slow disk.
+// a Copy() is fast again.
+func (ps *Persister) SetWriteDelay(d time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.delay = d
+}
+
+func (ps *Persister) write() {
+	ps.mu.Lock()
+	d := ps.delay
+	ps.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
 func (ps *Persister) SaveRaftState(state []byte) {
+	ps.write()
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	ps.raftstate = state
@@ -51,6 +73,7 @@ func (ps *Persister) RaftStateSize() int {
 // Save both Raft state and K/V snapshot as a single atomic action,
 // to help avoid them getting out of sync.
 func (ps *Persister) SaveStateAndSnapshot(state []byte, snapshot []byte) {
+	ps.write()
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	ps.raftstate = state
@@ -0,0 +1,188 @@
+package raft
+
+//
+// Prometheus metrics for Raft peers.
+//
+// reg := prom.NewRegistry()
+// pm := NewPromMetrics(reg)
+// pm.Watch(rf) -- for each peer to export; every series is labelled node="<rf.me>"
+// http.Handle("/metrics", prom.Handler(reg))
+//
+// the histograms cover what the CSVs do: replication latency is
+// the time from Start() to apply on the leader, and failover time
+// runs from the old leader's crash (or, if this registry never saw
+// the crash, from the first election after it) to the new
+// leader's first heartbeat.
+//
+
+import (
+	"mitraft/clock"
+	"mitraft/prom"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type PromMetrics struct {
+	NopObserver
+
+	term        *prom.GaugeVec
+	role        *prom.GaugeVec
+	commitIndex *prom.GaugeVec
+	lastApplied *prom.GaugeVec
+	logLength   *prom.GaugeVec
+	stateBytes  *prom.GaugeVec
+
+	electionsStarted *prom.CounterVec
+	electionsWon     *prom.CounterVec
+	aeSent           *prom.CounterVec
+	aeRejected       *prom.CounterVec
+
+	replicationLatency *prom.HistogramVec
+	failover           *prom.HistogramVec
+
+	mu        sync.Mutex
+	clock     clock.Clock // the watched peers'
+	roles     map[int]string
+	starts    map[int]map[int]time.Time // node -> log index -> Start() time
+	outageAt  time.Time                 // leader crashed or first election since; zero if a leader is up
+	lastHBFor int                       // term whose first heartbeat ended the last outage
+}
+
+// the value of the raft_role gauge for each role.
+var roleValue = map[string]float64{Follower: 0, Candidate: 1, Leader: 2}
+
+func NewPromMetrics(reg *prom.Registry) *PromMetrics {
+	pm := &PromMetrics{}
+	pm.term = reg.Gauge("raft_term", "Current term.", "node")
+	pm.role = reg.Gauge("raft_role", "Current role: 0 follower, 1 candidate, 2 leader.", "node")
+	pm.commitIndex = reg.Gauge("raft_commit_index", "Highest log index known to be committed.", "node")
+	pm.lastApplied = reg.Gauge("raft_last_applied", "Highest log index applied to the state machine.", "node")
+	pm.logLength = reg.Gauge("raft_log_length", "Number of entries in the log.", "node")
+	pm.stateBytes = reg.Gauge("raft_persisted_state_bytes", "Size of the persisted Raft state.", "node")
+
+	pm.electionsStarted = reg.Counter("raft_elections_started_total", "Elections this node started as candidate.", "node")
+	pm.electionsWon = reg.Counter("raft_elections_won_total", "Elections this node won.", "node")
+	pm.aeSent = reg.Counter("raft_append_entries_sent_total", "AppendEntries RPCs sent, heartbeats included.", "node")
+	pm.aeRejected = reg.Counter("raft_append_entries_rejected_total", "AppendEntries RPCs a follower answered with Success false.", "node")
+
+	pm.replicationLatency = reg.Histogram("raft_replication_latency_seconds",
+		"Time from Start() to apply on the leader.", prom.DefBuckets, "node")
+	pm.failover = reg.Histogram("raft_failover_seconds",
+		"Time from losing a leader to the new leader's first heartbeat.", prom.DefBuckets, "node")
+
+	pm.roles = map[int]string{}
+	pm.starts = map[int]map[int]time.Time{}
+	pm.clock = clock.Real{}
+	return pm
+}
+
+// Watch exports rf's state, and counts its events, under
+// node="<rf.me>". watching a restarted peer replaces the old one.
+func (pm *PromMetrics) Watch(rf *Raft) {
+	node := strconv.Itoa(rf.me)
+	sample := func(f func() int) func() float64 {
+		return func() float64 {
+			rf.mu.Lock()
+			defer rf.mu.Unlock()
+			return float64(f())
+		}
+	}
+	pm.term.Func(sample(func() int { return rf.currentTerm }), node)
+	pm.role.Func(func() float64 {
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		return roleValue[rf.state]
+	}, node)
+	pm.commitIndex.Func(sample(func() int { return rf.commitIndex }), node)
+	pm.lastApplied.Func(sample(func() int { return rf.lastApplied }), node)
+	pm.logLength.Func(sample(func() int { return len(rf.log) - 1 }), node) // not the sentinel
+	pm.stateBytes.Func(func() float64 { return float64(rf.persister.RaftStateSize()) }, node)
+
+	// make the counters show up as 0 before anything happens.
+	pm.electionsStarted.With(node)
+	pm.electionsWon.With(node)
+	pm.aeSent.With(node)
+	pm.aeRejected.With(node)
+
+	rf.mu.Lock()
+	role := rf.state
+	rf.mu.Unlock()
+	pm.mu.Lock()
+	pm.roles[rf.me] = role
+	pm.clock = rf.clock
+	pm.starts[rf.me] = map[int]time.Time{}
+	pm.mu.Unlock()
+
+	rf.AddObserver(pm)
+}
+
+func (pm *PromMetrics) RoleChanged(peer int, term int, from, to string) {
+	node := strconv.Itoa(peer)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.roles[peer] = to
+	switch to {
+	case Candidate:
+		pm.electionsStarted.With(node).Inc()
+		if pm.outageAt.IsZero() {
+			pm.outageAt = pm.clock.Now()
+		}
+	case Leader:
+		pm.electionsWon.With(node).Inc()
+	}
+	if from == Leader {
+		pm.starts[peer] = map[int]time.Time{}
+	}
+}
+
+func (pm *PromMetrics) RPCSent(peer int, to int, svcMeth string, args interface{}) {
+	ae, ok := args.(*AppendEntriesArgs)
+	if !ok {
+		return
+	}
+	node := strconv.Itoa(peer)
+	pm.aeSent.With(node).Inc()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if !pm.outageAt.IsZero() && pm.roles[peer] == Leader && ae.Term > pm.lastHBFor {
+		pm.failover.With(node).Observe(pm.clock.Since(pm.outageAt).Seconds())
+		pm.outageAt = time.Time{}
+		pm.lastHBFor = ae.Term
+	}
+}
+
+func (pm *PromMetrics) RPCReplied(peer int, to int, svcMeth string, args, reply interface{}) {
+	if r, ok := reply.(*AppendEntriesReply); ok && !r.Success {
+		pm.aeRejected.With(strconv.Itoa(peer)).Inc()
+	}
+}
+
+func (pm *PromMetrics) EntryAppended(peer int, entry LogEntry) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.roles[peer] == Leader && pm.starts[peer] != nil {
+		pm.starts[peer][entry.Index] = pm.clock.Now()
+	}
+}
+
+func (pm *PromMetrics) EntryApplied(peer int, entry LogEntry) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if t0, ok := pm.starts[peer][entry.Index]; ok {
+		delete(pm.starts[peer], entry.Index)
+		pm.replicationLatency.With(strconv.Itoa(peer)).Observe(pm.clock.Since(t0).Seconds())
+	}
+}
+
+func (pm *PromMetrics) Killed(peer int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.roles[peer] == Leader {
+		pm.outageAt = pm.clock.Now()
+	}
+	pm.roles[peer] = ""
+	pm.starts[peer] = nil
+}
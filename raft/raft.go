@@ -2,7 +2,9 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"math/rand"
+	"mitraft/clock"
 	"mitraft/labgob"
 	"mitraft/labrpc"
 	"os"
@@ -16,6 +18,13 @@ type ApplyMsg struct {
 	CommandValid bool
 	Command      interface{}
 	CommandIndex int
+
+	// a snapshot from the leader, replacing the service's state
+	// through SnapshotIndex.
+	SnapshotValid bool
+	Snapshot      []byte
+	SnapshotTerm  int
+	SnapshotIndex int
 }
 
 // A Go object implementing a single Raft peer.
@@ -33,21 +42,45 @@ type Raft struct {
 	commitIndex int
 	lastApplied int
 
-	nextIndex  []int
-	matchIndex []int
+	nextIndex   []int
+	matchIndex  []int
+	lastContact []time.Time // leader only: last AppendEntries reply from each peer
+	leaderId    int         // leader of currentTerm, if known, else -1
+
+	leadTransferee int // leader only: peer we are handing leadership to, or -1
 
 	state              string // Follower, Candidate, Leader
 	electionResetEvent time.Time
+	electionTimeout    time.Duration // current randomized timeout, hosted mode only
+
+	transport Transport   // how RPCs reach peers
+	hosted    bool        // driven by a multi-raft host instead of ticker()
+	clock     clock.Clock // for timeouts, and to start goroutines
+	rand      *rand.Rand  // for election timeouts; nil means math/rand's
+
+	// RPCs are sent with ctx, which is cancelled when the term or
+	// role they were sent for changes, or the peer is killed, so
+	// that callers stop waiting for answers no one needs.
+	ctx    context.Context
+	cancel context.CancelFunc
+	life   context.Context // parent of every ctx; cancelled by Kill
+	die    context.CancelFunc
 
 	voteCount int
 	applyCh   chan ApplyMsg
+	applyMu   sync.Mutex // held by ApplyLog while it sends on applyCh
+
+	snapshot        []byte // the service's latest snapshot, through log[0].Index
+	snapshotPending bool   // installed from the leader, not yet sent on applyCh
 
-	// For Metric writing....
-	mw                 *metricsWriter
-	startTimes         map[int]int64 // log index -> startMs (leader-side)
-	termOfStart        map[int]int   // index -> term at Start
-	firstHBSentForTerm map[int]bool  // dedupe FirstHeartbeat per term
+	obsMu     sync.Mutex // protects observers, so events can be sent without rf.mu
+	observers []Observer
 
+	logger    Logger              // nil unless logging
+	tracer    *Tracer             // nil unless tracing
+	traces    map[int]*entryTrace // leader only: log index -> open spans
+	traceRand *rand.Rand          // for span ids; set by SetTracer
+	seed      int64               // Options.Seed
 }
 
 type LogEntry struct {
@@ -76,6 +109,40 @@ func max(a, b int) int {
 	return b
 }
 
+// Transport carries a peer's outgoing RPCs. The default sends over
+// the ClientEnds passed to Make; a multi-raft host substitutes one
+// that multiplexes many groups over a single connection per node.
+// Call returns nil if reply is valid, ctx.Err() if ctx was done
+// first, or another error if no reply came.
+type Transport interface {
+	Call(ctx context.Context, peer int, svcMeth string, args interface{}, reply interface{}) error
+}
+
+type endsTransport []*labrpc.ClientEnd
+
+func (ends endsTransport) Call(ctx context.Context, peer int, svcMeth string, args interface{}, reply interface{}) error {
+	return ends[peer].CallContext(ctx, svcMeth, args, reply)
+}
+
+// a new ctx for a new term or role, abandoning the old one's RPCs.
+// caller must hold rf.mu.
+func (rf *Raft) renewContext() {
+	rf.cancel()
+	rf.ctx, rf.cancel = context.WithCancel(rf.life)
+}
+
+// a call for server's RPC failed with err: tell observers, unless
+// it was given up on deliberately. caller must not hold rf.mu.
+func (rf *Raft) callFailed(server int, svcMeth string, err error) {
+	if err == context.Canceled {
+		rf.mu.Lock()
+		rf.logf(LevelDebug, "RPC abandoned", "to", server, "method", svcMeth)
+		rf.mu.Unlock()
+		return
+	}
+	rf.notify(func(o Observer) { o.PeerUnreachable(rf.me, server, svcMeth) })
+}
+
 func (rf *Raft) GetState() (int, bool) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
@@ -84,15 +151,19 @@ func (rf *Raft) GetState() (int, bool) {
 
 func (rf *Raft) persist() {
 	// Your code here (2C).
+	data := rf.raftState()           // Converts the state into byte form.
+	rf.persister.SaveRaftState(data) // Save the current state to restore it exactly from here after crash and restart.
+}
+
+func (rf *Raft) raftState() []byte {
 	w := new(bytes.Buffer)    // In-memory buffer to hold raw binary data.
 	e := labgob.NewEncoder(w) // This encoder will convert your Go variables (like int, struct, []LogEntry) into a byte stream.
 
 	e.Encode(rf.currentTerm) // CurrentTerm must persist across restarts to avoid granting votes to stale leaders.
 	e.Encode(rf.votedFor)    // To remember its votes
-	e.Encode(rf.log)         // To maintain consistency
+	e.Encode(rf.log)         // To maintain consistency; log[0] records the snapshot's last index and term
 
-	data := w.Bytes()                // Converts the encoded to data into byte form.
-	rf.persister.SaveRaftState(data) // Save the current state to restore it exactly from here after crash and restart.
+	return w.Bytes()
 }
 
 // restore previously persisted state.
@@ -111,16 +182,48 @@ func (rf *Raft) readPersist(data []byte) {
 	if d.Decode(&cTerm) != nil ||
 		d.Decode(&vFor) != nil ||
 		d.Decode(&lg) != nil {
+		rf.logf(LevelError, "can't decode persisted state; starting empty")
+		return
+	}
+	if problem := checkPersisted(cTerm, vFor, lg, len(rf.peers)); problem != "" {
+		rf.logf(LevelError, "corrupt persisted state; starting empty", "problem", problem)
 		return
 	}
 
 	rf.currentTerm = cTerm
 	rf.votedFor = vFor
 	rf.log = lg
+
+	// the service restores everything through the snapshot itself.
+	rf.snapshot = rf.persister.ReadSnapshot()
+	rf.commitIndex = rf.baseIndex()
+	rf.lastApplied = rf.baseIndex()
+}
+
+// what's wrong with a decoded persisted state, or "".
+func checkPersisted(term int, votedFor int, log []LogEntry, npeers int) string {
+	if term < 0 {
+		return "negative term"
+	}
+	if votedFor < -1 || votedFor >= npeers {
+		return "votedFor isn't a peer"
+	}
+	if len(log) == 0 || log[0].Index < 0 {
+		return "no snapshot entry"
+	}
+	for i, e := range log {
+		if e.Index != log[0].Index+i {
+			return "log indices aren't consecutive"
+		}
+		if e.Term < 0 || e.Term > term || (i > 0 && e.Term < log[i-1].Term) {
+			return "log terms out of order"
+		}
+	}
+	return ""
 }
 
 func (rf *Raft) isLogUpToDate(cLastIndex int, cLastTerm int) bool {
-	myLastIndex, myLastTerm := len(rf.log)-1, rf.log[len(rf.log)-1].Term
+	myLastIndex, myLastTerm := rf.lastIndex(), rf.lastTerm()
 
 	if cLastTerm == myLastTerm {
 		return cLastIndex >= myLastIndex
@@ -149,15 +252,24 @@ type RequestVoteReply struct {
 func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 	rf.mu.Lock()         // Protect shared state
 	defer rf.mu.Unlock() // Releases the lock before exiting
-	// fmt.Printf("[Node %d] Received RequestVote from %d for term %d (mine: %d)\n", rf.me, args.CandidateId, args.Term, rf.currentTerm)
+	rf.logf(LevelDebug, "RequestVote received", "from", args.CandidateId, "argsTerm", args.Term,
+		"lastLogIndex", args.LastLogIndex, "lastLogTerm", args.LastLogTerm)
+	rf.notify(func(o Observer) { o.RPCReceived(rf.me, args.CandidateId, "Raft.RequestVote", args) })
+	if args.CandidateId < 0 || args.CandidateId >= len(rf.peers) {
+		reply.Term = rf.currentTerm
+		reply.VoteGranted = false
+		rf.logf(LevelWarn, "vote refused: no such candidate", "candidate", args.CandidateId)
+		return
+	}
 	if args.Term < rf.currentTerm {
 		reply.Term = rf.currentTerm
 		reply.VoteGranted = false // vote rejected due to stale term
+		rf.logf(LevelDebug, "vote refused: stale term", "candidate", args.CandidateId, "argsTerm", args.Term)
 		return
 	}
 	if args.Term > rf.currentTerm {
-		rf.state = Follower
-		rf.currentTerm = args.Term
+		rf.setTerm(args.Term)
+		rf.setRole(Follower)
 		rf.votedFor = -1 // Reset vote due to greater term of candidate
 		rf.persist()
 	}
@@ -169,16 +281,23 @@ func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) {
 		rf.votedFor = args.CandidateId
 		reply.VoteGranted = true
 		rf.persist()
-		// fmt.Printf("[Node %d] voted for %d in term %d\n", rf.me, args.CandidateId, args.Term)
+		rf.electionResetEvent = rf.clock.Now() // granting a vote restarts the election timeout (Figure 2)
+		rf.notify(func(o Observer) { o.VoteGranted(rf.me, args.Term, args.CandidateId) })
+		rf.logf(LevelInfo, "vote granted", "candidate", args.CandidateId)
+	} else {
+		rf.logf(LevelDebug, "vote refused", "candidate", args.CandidateId, "votedFor", rf.votedFor,
+			"upToDate", rf.isLogUpToDate(args.LastLogIndex, args.LastLogTerm))
 	}
 
 }
 
-func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *RequestVoteReply) {
-	ok := rf.peers[server].Call("Raft.RequestVote", args, reply)
-	if !ok {
+func (rf *Raft) sendRequestVote(ctx context.Context, server int, args *RequestVoteArgs, reply *RequestVoteReply) {
+	rf.notify(func(o Observer) { o.RPCSent(rf.me, server, "Raft.RequestVote", args) })
+	if err := rf.transport.Call(ctx, server, "Raft.RequestVote", args, reply); err != nil {
+		rf.callFailed(server, "Raft.RequestVote", err)
 		return
 	}
+	rf.notify(func(o Observer) { o.RPCReplied(rf.me, server, "Raft.RequestVote", args, reply) })
 
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
@@ -188,30 +307,33 @@ func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *Reques
 	}
 
 	if reply.Term > rf.currentTerm {
-		rf.currentTerm = reply.Term
-		rf.state = Follower
+		rf.setTerm(reply.Term)
+		rf.setRole(Follower)
 		rf.votedFor = -1
 		rf.persist()
-		rf.electionResetEvent = time.Now()
+		rf.electionResetEvent = rf.clock.Now()
 		return
 	}
 
 	if reply.VoteGranted {
 		rf.voteCount++
 		if rf.voteCount > len(rf.peers)/2 {
-			rf.state = Leader
-			if rf.mw != nil {
-				rf.mw.RecordLeaderElected(rf.me, rf.currentTerm)
-			}
+			rf.setRole(Leader)
 			rf.persist()
 
 			for i := range rf.peers {
-				rf.nextIndex[i] = len(rf.log)
+				rf.nextIndex[i] = rf.lastIndex() + 1
 				rf.matchIndex[i] = 0
 			}
-			rf.electionResetEvent = time.Now()
+			rf.electionResetEvent = rf.clock.Now()
+
+			if rf.hosted {
+				// the host sends heartbeats for all its groups.
+				return
+			}
 
-			go func(term int) {
+			term := args.Term
+			rf.clock.Go(func() {
 				for !rf.killed() {
 					rf.mu.Lock()
 					if rf.state != Leader || rf.currentTerm != term {
@@ -220,28 +342,33 @@ func (rf *Raft) sendRequestVote(server int, args *RequestVoteArgs, reply *Reques
 					}
 					rf.mu.Unlock()
 					rf.broadcastAppendEntries()
-					time.Sleep(100 * time.Millisecond)
+					rf.clock.Sleep(100 * time.Millisecond)
 				}
-			}(args.Term)
+			})
 		}
 	}
 }
 
 func (rf *Raft) broadcastRequestVote() {
+	rf.mu.Lock()
 	if rf.state != Candidate {
+		rf.mu.Unlock()
 		return
 	}
 
 	args := RequestVoteArgs{
 		Term:         rf.currentTerm,
 		CandidateId:  rf.me,
-		LastLogIndex: len(rf.log) - 1,
-		LastLogTerm:  rf.log[len(rf.log)-1].Term,
+		LastLogIndex: rf.lastIndex(),
+		LastLogTerm:  rf.lastTerm(),
 	}
+	ctx := rf.ctx
+	rf.mu.Unlock()
 
 	for server := range rf.peers {
 		if server != rf.me {
-			go rf.sendRequestVote(server, &args, &RequestVoteReply{})
+			server := server
+			rf.clock.Go(func() { rf.sendRequestVote(ctx, server, &args, &RequestVoteReply{}) })
 		}
 	}
 }
@@ -250,22 +377,19 @@ func (rf *Raft) Start(command interface{}) (int, int, bool) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 
-	if rf.state != Leader {
+	if rf.state != Leader || rf.leadTransferee != -1 {
 		return -1, -1, false
 	}
 
-	prevIndex := len(rf.log) - 1
+	t0 := rf.clock.Now()
+	prevIndex := rf.lastIndex()
 	newEntry := LogEntry{rf.currentTerm, command, prevIndex + 1}
-	rf.log = append(rf.log, newEntry)
+	rf.appendEntry(newEntry)
 	rf.persist()
+	rf.traceStart(newEntry.Index, t0)
 	index := newEntry.Index
 	term := newEntry.Term
-	if rf.state == Leader && rf.mw != nil {
-		start := rf.mw.RecordStart(index, rf.currentTerm, 0.0)
-		rf.startTimes[index] = start
-		rf.termOfStart[index] = rf.currentTerm
-	}
-	// fmt.Printf("[%d] new entry during term [%v] having index in log [%d]", rf.me, rf.currentTerm, newEntry.Index)
+	rf.logf(LevelDebug, "Start", "index", index)
 
 	// go rf.broadcastAppendEntries()
 	return index, term, true
@@ -278,6 +402,7 @@ type AppendEntriesArgs struct {
 	PrevLogTerm  int
 	Entries      []LogEntry
 	LeaderCommit int
+	Traces       []TraceContext // Traces[i] is Entries[i]'s; nil unless tracing
 }
 
 type AppendEntriesReply struct {
@@ -286,11 +411,42 @@ type AppendEntriesReply struct {
 	Index   int
 }
 
+// what's wrong with args, or "". no leader sends a negative
+// PrevLogIndex, or entries that don't follow it in index order
+// with terms between PrevLogTerm and its own.
+func (args *AppendEntriesArgs) malformed() string {
+	if args.PrevLogIndex < 0 || args.PrevLogTerm < 0 {
+		return "negative prevLogIndex or prevLogTerm"
+	}
+	prevTerm := args.PrevLogTerm
+	for i, e := range args.Entries {
+		if e.Index != args.PrevLogIndex+1+i {
+			return "entries out of place"
+		}
+		if e.Term < prevTerm || e.Term > args.Term {
+			return "entries' terms out of order"
+		}
+		prevTerm = e.Term
+	}
+	return ""
+}
+
 func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
+	t0 := rf.clock.Now()
+
+	rf.logf(LevelDebug, "AppendEntries received", "from", args.LeaderId, "argsTerm", args.Term,
+		"prevLogIndex", args.PrevLogIndex, "prevLogTerm", args.PrevLogTerm,
+		"entries", len(args.Entries), "leaderCommit", args.LeaderCommit)
+	rf.notify(func(o Observer) { o.RPCReceived(rf.me, args.LeaderId, "Raft.AppendEntries", args) })
 
-	// fmt.Printf("[%d %s] received AppendEntries from [%d]", rf.me, rf.state, args.LeaderId)
+	if problem := args.malformed(); problem != "" {
+		reply.Success = false
+		reply.Term = rf.currentTerm
+		rf.logf(LevelWarn, "malformed AppendEntries", "from", args.LeaderId, "problem", problem)
+		return
+	}
 
 	if args.Term < rf.currentTerm {
 		reply.Success = false
@@ -298,101 +454,132 @@ func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply
 		return
 	}
 
-	rf.electionResetEvent = time.Now()
+	rf.electionResetEvent = rf.clock.Now()
 
 	if args.Term > rf.currentTerm {
-		// fmt.Printf("[%d] stepping down to follower from [%s] for term [%d]", rf.me, rf.state, args.Term)
-		rf.currentTerm = args.Term
-		rf.state = Follower
+		rf.setTerm(args.Term)
+		rf.setRole(Follower)
 		rf.votedFor = -1
 		rf.persist()
 		rf.voteCount = 0
 	}
+	rf.leaderId = args.LeaderId
 
-	lastIndex := len(rf.log) - 1
+	lastIndex := rf.lastIndex()
+	base := rf.baseIndex()
 
 	// consistency check
 	if args.PrevLogIndex > lastIndex {
 		reply.Success = false
 		reply.Term = rf.currentTerm
-		// Ask leader to back off to follower's nextIndex (len(log))
-		reply.Index = len(rf.log)
+		// Ask leader to back off to follower's nextIndex (lastIndex+1)
+		reply.Index = lastIndex + 1
+		rf.logf(LevelDebug, "log too short", "prevLogIndex", args.PrevLogIndex, "lastIndex", lastIndex)
 		return
 	}
 
-	if rf.log[args.PrevLogIndex].Term != args.PrevLogTerm {
+	if args.PrevLogIndex >= base && rf.entry(args.PrevLogIndex).Term != args.PrevLogTerm {
 		reply.Success = false
 		reply.Term = rf.currentTerm
-		conflictTerm := rf.log[args.PrevLogIndex].Term
+		conflictTerm := rf.entry(args.PrevLogIndex).Term
 		i := args.PrevLogIndex
-		for i > 0 && rf.log[i-1].Term == conflictTerm {
+		for i > base+1 && rf.entry(i-1).Term == conflictTerm {
 			i--
 		}
 		reply.Index = i
+		rf.logf(LevelInfo, "log conflict", "prevLogIndex", args.PrevLogIndex, "prevLogTerm", args.PrevLogTerm,
+			"conflictTerm", conflictTerm, "hint", i)
 		return
 	}
 
-	// Append new entries and handle conflicts
+	// Append new entries and handle conflicts. entries at or
+	// before base are in our snapshot, so committed and matching.
 	for i := 0; i < len(args.Entries); i++ {
 		newEntry := args.Entries[i]
 
-		if newEntry.Index < len(rf.log) {
-			if rf.log[newEntry.Index].Term != newEntry.Term {
-				rf.log = rf.log[:newEntry.Index]
-				rf.log = append(rf.log, newEntry)
+		if newEntry.Index <= base {
+			continue
+		}
+		if newEntry.Index <= rf.lastIndex() {
+			if rf.entry(newEntry.Index).Term != newEntry.Term {
+				if newEntry.Index <= rf.commitIndex {
+					// committed entries never change; a leader that
+					// says otherwise is broken.
+					reply.Success = false
+					reply.Term = rf.currentTerm
+					rf.logf(LevelError, "refusing to truncate committed entries", "from", newEntry.Index,
+						"commitIndex", rf.commitIndex)
+					return
+				}
+				rf.logf(LevelInfo, "truncating log", "from", newEntry.Index, "lastIndex", rf.lastIndex())
+				rf.log = rf.log[:newEntry.Index-base]
+				rf.appendEntry(newEntry)
 				rf.persist()
 			}
 		} else {
-			rf.log = append(rf.log, newEntry)
+			rf.appendEntry(newEntry)
 			rf.persist()
 		}
 	}
 
-	if len(args.Entries) > 0 {
-		lastEntryIndex := args.Entries[len(args.Entries)-1].Index
-		if len(rf.log)-1 > lastEntryIndex {
-			rf.log = rf.log[:lastEntryIndex+1]
-		}
-	}
-
-	if args.LeaderCommit > rf.commitIndex {
-		rf.commitIndex = min(args.LeaderCommit, len(rf.log)-1)
+	// entries after the ones sent are left alone: this request may
+	// be a stale or duplicate one, overtaken by a longer append
+	// whose entries might already be committed. nor are they known
+	// to match the leader's, so they can't be committed here yet.
+	lastNew := args.PrevLogIndex + len(args.Entries)
+	if commit := min(args.LeaderCommit, lastNew); commit > rf.commitIndex {
+		rf.setCommitIndex(commit)
 	}
+	rf.traceFollowerAppend(args, t0)
 
 	reply.Success = true
 	reply.Term = rf.currentTerm
 
-	go rf.ApplyLog()
+	rf.clock.Go(rf.ApplyLog)
 }
 
-func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
-	ok := rf.peers[server].Call("Raft.AppendEntries", args, reply)
-	if !ok {
+func (rf *Raft) sendAppendEntries(ctx context.Context, server int, args *AppendEntriesArgs, reply *AppendEntriesReply) bool {
+	rf.notify(func(o Observer) { o.RPCSent(rf.me, server, "Raft.AppendEntries", args) })
+	if err := rf.transport.Call(ctx, server, "Raft.AppendEntries", args, reply); err != nil {
+		rf.callFailed(server, "Raft.AppendEntries", err)
 		return false
 	}
 
+	rf.HandleAppendEntriesReply(server, args, reply)
+	return true
+}
+
+// HandleAppendEntriesReply processes a peer's answer to args, exactly
+// as if sendAppendEntries had received it. A multi-raft host uses it to
+// hand back the replies to a coalesced heartbeat.
+func (rf *Raft) HandleAppendEntriesReply(server int, args *AppendEntriesArgs, reply *AppendEntriesReply) {
+	rf.notify(func(o Observer) { o.RPCReplied(rf.me, server, "Raft.AppendEntries", args, reply) })
+
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 
 	// Ignore stale results / role changes
 	if rf.state != Leader || args.Term != rf.currentTerm {
-		return ok
+		return
 	}
 
+	rf.lastContact[server] = rf.clock.Now()
+
 	// Higher term discovered → step down & persist
 	if reply.Term > rf.currentTerm {
-		rf.currentTerm = reply.Term // <-- use reply.Term (bug fix)
-		rf.state = Follower
+		rf.setTerm(reply.Term) // <-- use reply.Term (bug fix)
+		rf.setRole(Follower)
 		rf.votedFor = -1
 		rf.voteCount = 0
 		rf.persist()
-		rf.electionResetEvent = time.Now()
-		return ok
+		rf.electionResetEvent = rf.clock.Now()
+		return
 	}
 
 	// If follower is behind, adjust indices
 	if reply.Success {
 		if len(args.Entries) > 0 {
+			rf.traceAck(server, args)
 			lastEntry := args.Entries[len(args.Entries)-1]
 			// Advance match/next cautiously
 			if lastEntry.Index > rf.matchIndex[server] {
@@ -413,21 +600,67 @@ func (rf *Raft) sendAppendEntries(server int, args *AppendEntriesArgs, reply *Ap
 	}
 
 	// Majority commit (only commit entries from current term)
-	for commitIdx := len(rf.log) - 1; commitIdx > rf.commitIndex; commitIdx-- {
+	for commitIdx := rf.lastIndex(); commitIdx > rf.commitIndex; commitIdx-- {
 		count := 1 // self
 		for i := range rf.peers {
 			if i != rf.me && rf.matchIndex[i] >= commitIdx {
 				count++
 			}
 		}
-		if count > len(rf.peers)/2 && rf.log[commitIdx].Term == rf.currentTerm {
-			rf.commitIndex = commitIdx
+		if count > len(rf.peers)/2 && rf.entry(commitIdx).Term == rf.currentTerm {
+			rf.setCommitIndex(commitIdx)
+			rf.traceCommit(commitIdx)
 			break
 		}
 	}
 
-	go rf.ApplyLog()
-	return ok
+	rf.clock.Go(rf.ApplyLog)
+}
+
+// does peer need the snapshot, its nextIndex having been
+// compacted away? caller must hold rf.mu.
+func (rf *Raft) needsSnapshot(peer int) bool {
+	return rf.nextIndex[peer] <= rf.baseIndex()
+}
+
+// build the AppendEntries for peer from its nextIndex, which
+// must not need the snapshot. caller must hold rf.mu and be
+// the leader.
+func (rf *Raft) appendEntriesArgs(peer int) AppendEntriesArgs {
+	// Clamp nextIndex to [base+1, lastIndex+1]
+	base := rf.baseIndex()
+	next := rf.nextIndex[peer]
+	if next < base+1 {
+		next = base + 1
+		rf.nextIndex[peer] = next
+	}
+	lastIndex := rf.lastIndex()
+	if next > lastIndex+1 { // safety (shouldn't usually happen)
+		next = lastIndex + 1
+	}
+
+	prevLogIndex := next - 1
+	prevLogTerm := rf.entry(prevLogIndex).Term
+
+	// Slice entries safely (may be empty → heartbeat)
+	var entries []LogEntry
+	if next <= lastIndex {
+		entries = make([]LogEntry, lastIndex-next+1)
+		copy(entries, rf.log[next-base:])
+	} else {
+		entries = nil
+	}
+
+	args := AppendEntriesArgs{
+		Term:         rf.currentTerm,
+		LeaderId:     rf.me,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  prevLogTerm,
+		Entries:      entries,
+		LeaderCommit: rf.commitIndex,
+	}
+	rf.traceSend(peer, &args)
+	return args
 }
 
 func (rf *Raft) broadcastAppendEntries() {
@@ -445,84 +678,100 @@ func (rf *Raft) broadcastAppendEntries() {
 			continue
 		}
 
-		// Clamp nextIndex to [1, len(log)]
-		next := rf.nextIndex[peer]
-		if next < 1 {
-			next = 1
-			rf.nextIndex[peer] = 1
-		}
-		lastIndex := len(rf.log) - 1
-		if next > len(rf.log) { // safety (shouldn't usually happen)
-			next = len(rf.log)
-		}
-
-		prevLogIndex := next - 1
-		if prevLogIndex < 0 {
-			prevLogIndex = 0
-		}
-		prevLogTerm := rf.log[prevLogIndex].Term
-
-		// Slice entries safely (may be empty → heartbeat)
-		var entries []LogEntry
-		if next <= lastIndex {
-			entries = make([]LogEntry, lastIndex-next+1)
-			copy(entries, rf.log[next:])
-		} else {
-			entries = nil
+		ctx := rf.ctx
+		if rf.needsSnapshot(peer) {
+			args := rf.installSnapshotArgs()
+			rf.mu.Unlock()
+			peer := peer
+			rf.clock.Go(func() { rf.sendInstallSnapshot(ctx, peer, &args) })
+			continue
 		}
 
-		args := AppendEntriesArgs{
-			Term:         rf.currentTerm,
-			LeaderId:     rf.me,
-			PrevLogIndex: prevLogIndex,
-			PrevLogTerm:  prevLogTerm,
-			Entries:      entries,
-			LeaderCommit: rf.commitIndex,
-		}
+		args := rf.appendEntriesArgs(peer)
 		rf.mu.Unlock()
 
 		var reply AppendEntriesReply
-		go rf.sendAppendEntries(peer, &args, &reply)
+		peer := peer
+		rf.clock.Go(func() { rf.sendAppendEntries(ctx, peer, &args, &reply) })
 	}
 }
 
-func (rf *Raft) ApplyLog() {
+// HeartbeatArgs returns the AppendEntries this peer would send to each
+// of the others on its next heartbeat, indexed by peer (nil for itself),
+// or nil if it is not the leader. Hosted mode only; the host delivers
+// them and reports back through HandleAppendEntriesReply.
+func (rf *Raft) HeartbeatArgs() []*AppendEntriesArgs {
 	rf.mu.Lock()
 	defer rf.mu.Unlock()
 
-	for rf.lastApplied < rf.commitIndex {
-		rf.lastApplied++
-		entry := rf.log[rf.lastApplied]
-		if rf.state == Leader && rf.mw != nil {
-			if start, ok := rf.startTimes[entry.Index]; ok {
-				term := rf.termOfStart[entry.Index]
-				go rf.mw.RecordCommit(entry.Index, term, 0.0, start)
-				delete(rf.startTimes, entry.Index)
-				delete(rf.termOfStart, entry.Index)
-			}
+	if rf.state != Leader {
+		return nil
+	}
+	all := make([]*AppendEntriesArgs, len(rf.peers))
+	for peer := range rf.peers {
+		if peer != rf.me && rf.needsSnapshot(peer) {
+			// too big to batch; send it on its own.
+			args := rf.installSnapshotArgs()
+			ctx, peer := rf.ctx, peer
+			rf.clock.Go(func() { rf.sendInstallSnapshot(ctx, peer, &args) })
+		} else if peer != rf.me {
+			args := rf.appendEntriesArgs(peer)
+			all[peer] = &args
+			rf.notify(func(o Observer) { o.RPCSent(rf.me, peer, "Raft.AppendEntries", &args) })
 		}
+	}
+	return all
+}
+
+// send newly committed entries, and any snapshot installed from the
+// leader, to the service. the messages are gathered under rf.mu but
+// sent without it, so the service may call back into Raft (e.g.
+// rf.Snapshot()) while handling them; applyMu keeps concurrent
+// calls from sending out of order.
+func (rf *Raft) ApplyLog() {
+	rf.applyMu.Lock()
+	defer rf.applyMu.Unlock()
+
+	rf.mu.Lock()
+	var msgs []ApplyMsg
+	var entries []LogEntry
+	if rf.snapshotPending {
+		rf.snapshotPending = false
+		msgs = append(msgs, ApplyMsg{
+			SnapshotValid: true,
+			Snapshot:      rf.snapshot,
+			SnapshotTerm:  rf.log[0].Term,
+			SnapshotIndex: rf.baseIndex(),
+		})
+		rf.lastApplied = max(rf.lastApplied, rf.baseIndex())
+	}
 
-		msg := ApplyMsg{
+	for rf.lastApplied < rf.commitIndex {
+		rf.lastApplied++
+		entry := rf.entry(rf.lastApplied)
+		msgs = append(msgs, ApplyMsg{
 			CommandValid: true,
 			Command:      entry.Command,
 			CommandIndex: entry.Index,
-		}
+		})
+		entries = append(entries, entry)
+		rf.traceApply(entry.Index)
+	}
+	rf.mu.Unlock()
 
+	for _, msg := range msgs {
 		rf.applyCh <- msg
 	}
+	for _, entry := range entries {
+		entry := entry
+		rf.notify(func(o Observer) { o.EntryApplied(rf.me, entry) })
+	}
 }
 
 func (rf *Raft) Kill() {
 	atomic.StoreInt32(&rf.dead, 1)
-	// mark crash time if this server is the leader at kill time
-	if rf.mw != nil {
-		rf.mu.Lock()
-		isLeader := (rf.state == Leader)
-		rf.mu.Unlock()
-		if isLeader {
-			go rf.mw.RecordLeaderCrash(rf.me)
-		}
-	}
+	rf.die()
+	rf.notify(func(o Observer) { o.Killed(rf.me) })
 }
 
 func (rf *Raft) killed() bool {
@@ -530,66 +779,78 @@ func (rf *Raft) killed() bool {
 	return z == 1
 }
 
+// check the election timeout often, so that peers whose
+// timeouts differ by a few ms don't both fire on the same
+// check; draw a new timeout only once it has run out.
+const tickInterval = 10 * time.Millisecond
+const heartbeatInterval = 100 * time.Millisecond
+
 func (rf *Raft) ticker() {
+	timeout := rf.randomElectionTimeout()
+	var lastHeartbeat time.Time
 	for !rf.killed() {
-		// Randomized election timeout between 250-500ms
-		timeout := time.Duration(250+rand.Intn(250)) * time.Millisecond
-
 		rf.mu.Lock()
 		state := rf.state
-		elapsed := time.Since(rf.electionResetEvent)
+		elapsed := rf.clock.Since(rf.electionResetEvent)
 		rf.mu.Unlock()
 
 		if state != Leader && elapsed >= timeout {
-			if rf.mw != nil {
-				// outside the lock is fine too; this call is cheap & mutexed internally
-				go rf.mw.RecordElectionStart()
-			}
-			go rf.startElection()
+			timeout = rf.randomElectionTimeout()
+			rf.startElection()
 		}
 
-		if state == Leader {
+		if state == Leader && rf.clock.Since(lastHeartbeat) >= heartbeatInterval {
+			lastHeartbeat = rf.clock.Now()
 			rf.broadcastAppendEntries()
-			if rf.mw != nil && !rf.firstHBSentForTerm[rf.currentTerm] {
-				rf.firstHBSentForTerm[rf.currentTerm] = true
-				go rf.mw.RecordFirstHeartbeat(rf.me)
-			}
 		}
 
-		time.Sleep(100 * time.Millisecond)
+		rf.clock.Sleep(tickInterval)
 	}
 }
 
 func (rf *Raft) startElection() {
 	rf.mu.Lock()
 
-	rf.state = Candidate
-	rf.currentTerm++
+	rf.setTerm(rf.currentTerm + 1)
+	rf.setRole(Candidate)
 	rf.votedFor = rf.me
 	rf.voteCount = 1 // vote for self
-	rf.electionResetEvent = time.Now()
+	rf.electionResetEvent = rf.clock.Now()
 
 	rf.mu.Unlock()
 
 	rf.broadcastRequestVote()
 
-	go func(term int) {
-		time.Sleep(1500 * time.Millisecond)
+	rf.mu.Lock()
+	term := rf.currentTerm
+	rf.mu.Unlock()
+	rf.clock.Go(func() {
+		rf.clock.Sleep(1500 * time.Millisecond)
 		rf.mu.Lock()
 		defer rf.mu.Unlock()
 		if rf.state != Leader && rf.currentTerm == term {
-			// fmt.Printf("[Node %d] still not a leader in term %d\n", rf.me, term)
+			rf.logf(LevelDebug, "still not a leader")
 		}
-	}(rf.currentTerm)
+	})
 }
 
-func Make(peers []*labrpc.ClientEnd, me int,
-	persister *Persister, applyCh chan ApplyMsg) *Raft {
+// fields shared by MakeWith and MakeHosted.
+func newRaft(peers []*labrpc.ClientEnd, me int,
+	persister *Persister, applyCh chan ApplyMsg, opts Options) *Raft {
 
 	rf := &Raft{}
 	rf.peers = peers
 	rf.persister = persister
 	rf.me = me
+	rf.transport = endsTransport(peers)
+	rf.clock = opts.Clock
+	if rf.clock == nil {
+		rf.clock = clock.Real{}
+	}
+	rf.rand = opts.Rand
+	rf.seed = opts.Seed
+	rf.life, rf.die = context.WithCancel(context.Background())
+	rf.ctx, rf.cancel = context.WithCancel(rf.life)
 
 	rf.currentTerm = 0
 	rf.votedFor = -1
@@ -601,34 +862,139 @@ func Make(peers []*labrpc.ClientEnd, me int,
 
 	rf.nextIndex = make([]int, len(peers))
 	rf.matchIndex = make([]int, len(peers))
+	rf.lastContact = make([]time.Time, len(peers))
+	rf.leaderId = -1
+	rf.leadTransferee = -1
 
 	rf.state = Follower
 	rf.applyCh = applyCh
-	rf.electionResetEvent = time.Now()
+	rf.electionResetEvent = rf.clock.Now()
 
-	rf.mw = nil
-	rf.startTimes = make(map[int]int64)
-	rf.termOfStart = make(map[int]int)
-	rf.firstHBSentForTerm = make(map[int]bool)
+	return rf
+}
+
+func Make(peers []*labrpc.ClientEnd, me int,
+	persister *Persister, applyCh chan ApplyMsg) *Raft {
+	return MakeWith(peers, me, persister, applyCh, Options{})
+}
+
+// what MakeWith can change about a peer. the zero Options are
+// what Make uses.
+type Options struct {
+	// for timeouts, heartbeats and the peer's goroutines; default
+	// clock.Real{}. a clock.Sim needs the peers' labrpc.Network to
+	// use it too, and applyCh to have room for what the peer applies
+	// before the service's task next runs.
+	Clock clock.Clock
+
+	// for election timeouts; default math/rand's. it need not be
+	// safe for concurrent use if Clock is a clock.Sim.
+	Rand *rand.Rand
+
+	// what Rand was seeded with, for the metrics' seed column;
+	// default $RAFT_SEED.
+	Seed int64
+}
+
+func MakeWith(peers []*labrpc.ClientEnd, me int,
+	persister *Persister, applyCh chan ApplyMsg, opts Options) *Raft {
+
+	rf := newRaft(peers, me, persister, applyCh, opts)
+
+	seed := opts.Seed
+	if seed == 0 {
+		seed = int64(getEnvInt("RAFT_SEED", 0))
+	}
 
 	// OPTIONAL: create the writer (you can guard with an env var or a flag)
-	mw, err := newMetrics("./metrics",
+	mw, err := newMetrics(getEnvStr("RAFT_METRICS_DIR", "./metrics"),
 		getEnvStr("RAFT_SCENARIO", "leader_crash_restart"),
-		getEnvInt("RAFT_SEED", 0),
+		seed,
 		getEnvInt("RAFT_TRIAL", 1),
-		600, 1000,
+		600, 1000, rf.clock,
 	)
 	if err == nil {
-		rf.mw = mw
+		mw.dropRate = rf.dropRate
+		rf.AddObserver(mw)
+	}
+	if level, ok := ParseLevel(getEnvStr("RAFT_LOG", "")); ok {
+		rf.logger = NewTextLogger(os.Stderr, level)
 	}
 
 	rf.readPersist(persister.ReadRaftState())
 
-	go rf.ticker()
+	rf.clock.Go(rf.ticker)
+
+	return rf
+}
+
+// MakeHosted creates a peer of one Raft group among many on a
+// multi-raft host. It has npeers peers, reached through tr, and
+// no goroutines of its own: the host drives elections through
+// ElectionTick and heartbeats through HeartbeatArgs.
+func MakeHosted(npeers int, me int, persister *Persister,
+	applyCh chan ApplyMsg, tr Transport) *Raft {
+	return MakeHostedWith(npeers, me, persister, applyCh, tr, Options{})
+}
+
+// MakeHostedWith is MakeHosted with Options, as for MakeWith; Seed
+// is unused.
+func MakeHostedWith(npeers int, me int, persister *Persister,
+	applyCh chan ApplyMsg, tr Transport, opts Options) *Raft {
+
+	rf := newRaft(make([]*labrpc.ClientEnd, npeers), me, persister, applyCh, opts)
+	rf.transport = tr
+	rf.hosted = true
+	rf.electionTimeout = rf.randomElectionTimeout()
+
+	rf.readPersist(persister.ReadRaftState())
 
 	return rf
 }
 
+// Randomized election timeout between 250-500ms
+func (rf *Raft) randomElectionTimeout() time.Duration {
+	if rf.rand != nil {
+		return time.Duration(250+rf.rand.Intn(250)) * time.Millisecond
+	}
+	return time.Duration(250+rand.Intn(250)) * time.Millisecond
+}
+
+// ElectionTick is the hosted counterpart of ticker()'s election
+// check: it starts an election if the timeout has run out, and
+// returns when it next wants to be ticked.
+func (rf *Raft) ElectionTick(now time.Time) time.Time {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.killed() || rf.state == Leader {
+		return now.Add(rf.electionTimeout)
+	}
+	deadline := rf.electionResetEvent.Add(rf.electionTimeout)
+	if now.Before(deadline) {
+		return deadline
+	}
+
+	rf.electionTimeout = rf.randomElectionTimeout()
+	rf.clock.Go(rf.startElection)
+	return now.Add(rf.electionTimeout)
+}
+
+// the mean drop probability of the links to the other peers.
+func (rf *Raft) dropRate() float64 {
+	sum, n := 0.0, 0
+	for i, end := range rf.peers {
+		if i != rf.me && end != nil {
+			sum += end.DropRate()
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
 func getEnvStr(k, def string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
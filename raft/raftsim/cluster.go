@@ -0,0 +1,1102 @@
+// Package raftsim runs a cluster of Rafts on a simulated network,
+// for tests of Raft and of services built on it.
+package raftsim
+
+//
+// cfg := raftsim.MakeCluster(t, n, raftsim.Options{...})
+// defer cfg.Cleanup()
+// cfg.Begin("Test: ...") ... cfg.End()
+//
+// cfg.Crash(i), cfg.Start(i) -- crash or (re)start server i,
+//   keeping what it persisted.
+// cfg.Connect(i), cfg.Disconnect(i), cfg.Partition(groups...),
+//   cfg.Isolate(servers...), cfg.Bridge(b, left, right),
+//   cfg.CutLink(i, j), cfg.RestoreLink(i, j), cfg.Heal()
+// cfg.SetUnreliable(), cfg.SetFaults(fm), cfg.SetLinkFaults(i, j, fm),
+//   cfg.SetLongReordering(), cfg.SetRequestReordering()
+// cfg.Pause(i), cfg.Resume(i)
+//
+// cfg.One(cmd, expectedServers, retry) -- agree on cmd; returns its index.
+// cfg.CheckOneLeader(), cfg.CheckTerms(), cfg.CheckNoLeader()
+// cfg.NCommitted(index), cfg.Wait(index, n, startTerm)
+// cfg.Snapshot(i) -- snapshot server i, as a service would.
+// cfg.Soak(budget) -- the soak test (soak.go).
+//
+// the cluster reads every server's applyCh and fails the test if
+// servers apply different commands at an index, or apply out of
+// order. with Options.StateMachine, each server's commands then go
+// to a StateMachine, which cfg.Snapshot(i) snapshots and a snapshot
+// from a leader, or a restart, restores.
+//
+// an online checker (invariants.go) watches the servers' state
+// for violations of Raft's safety properties throughout.
+//
+// ModelCheck(opts) (modelcheck.go) checks the same properties
+// over every short schedule of a small cluster's messages.
+//
+// the environment can change a run:
+//   RAFT_SIM=<seed>  run in simulated time, replayably.
+//   RAFT_SEED=<seed> fix the random choices (so does a -seed flag).
+//   RAFT_LOG=<level> log to stderr rather than keeping logs for a
+//                    failed test to print.
+//   RAFT_EVENTS=<dir> write every server's events to dir.
+//   RAFT_DROP_RATE=<fraction> drop this fraction of RPCs.
+//
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math/rand"
+	"mitraft/clock"
+	"mitraft/labgob"
+	"mitraft/labrpc"
+	"mitraft/raft"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	crand "crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+func randstring(n int) string {
+	b := make([]byte, 2*n)
+	crand.Read(b)
+	s := base64.URLEncoding.EncodeToString(b)
+	return s[0:n]
+}
+
+func makeSeed() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := crand.Int(crand.Reader, max)
+	x := bigx.Int64()
+	return x
+}
+
+// the seed for a test's random choices: -seed (a flag of the
+// tests'), else $RAFT_SEED, else a fresh one. under RAFT_SIM,
+// its value.
+func testSeed() int64 {
+	if f := flag.Lookup("seed"); f != nil && f.Value.String() != "0" {
+		seed, err := strconv.ParseInt(f.Value.String(), 10, 64)
+		if err != nil {
+			log.Fatalf("bad -seed %q", f.Value.String())
+		}
+		return seed
+	}
+	for _, k := range []string{"RAFT_SIM", "RAFT_SEED"} {
+		if s := os.Getenv(k); s != "" {
+			seed, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				log.Fatalf("bad %v %q", k, s)
+			}
+			return seed
+		}
+	}
+	return makeSeed()
+}
+
+// a *rand.Rand that's safe for concurrent use.
+func lockedRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (ls *lockedSource) Int63() int64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.src.Int63()
+}
+
+func (ls *lockedSource) Seed(seed int64) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.src.Seed(seed)
+}
+
+// a service's state, as each server would keep it.
+type StateMachine interface {
+	// command is committed at index; called in index order.
+	Apply(index int, command interface{})
+	// the state after every command Apply() has been given.
+	Snapshot() []byte
+	// replace the state with one from Snapshot().
+	Restore(snapshot []byte)
+}
+
+type Options struct {
+	Unreliable bool // drop and delay RPCs from the start
+
+	// a new StateMachine for server i, each time it starts;
+	// nil means the cluster only checks what the servers apply.
+	// its methods are called with the cluster's lock held, so
+	// they mustn't call the cluster.
+	//
+	// commands may be of any type labgob can send, and are
+	// compared with reflect.DeepEqual. labgob turns an empty slice
+	// or map in a struct into nil, which then isn't equal to what
+	// was sent, so commands shouldn't hold those.
+	StateMachine func(i int) StateMachine
+}
+
+type Cluster struct {
+	mu          sync.Mutex
+	t           testing.TB
+	opts        Options
+	net         *labrpc.Network
+	n           int
+	rafts       []*raft.Raft
+	dead        []*int32 // whether each Raft has been killed; see simApplier()
+	machines    []StateMachine
+	applyErr    []string // from apply channel readers
+	connected   []bool   // whether each server is on the net
+	saved       []*raft.Persister
+	endnames    [][]string                   // the port file names each sends to
+	logs        []map[int]interface{}        // copy of each server's committed entries
+	lastApplied []int                        // highest index each server has applied
+	start       time.Time                    // time at which MakeCluster() was called
+	observers   []raft.Observer              // registered on every Raft Start() makes
+	logcap      *logCapture                  // every Raft's log records, printed if the test fails
+	events      *raft.EventLog               // if RAFT_EVENTS is set
+	linkFaults  map[[2]int]labrpc.FaultModel // [from, to] -> faults, kept across restarts
+	clock       clock.Clock                  // the tester's, the network's and every Raft's
+	sim         *clock.Sim                   // if RAFT_SIM is set; else nil
+	seed        int64                        // fixes rand, and the network's and the Rafts' choices
+	rand        *rand.Rand                   // for the tests' random choices
+	invariants  *invariantChecker            // see invariants.go
+	finished    int32                        // set by Cleanup()
+	paused      []int32                      // whether each server is paused; see nemesis.go
+	limit       time.Duration                // how long the test may take
+	// Begin()/End() statistics
+	t0        time.Time // time at which the test called cfg.Begin()
+	rpcs0     int       // RPCTotal() at start of test
+	cmds0     int       // number of agreements
+	bytes0    int64
+	stats0    labrpc.Stats // net.Stats() at start of test
+	maxIndex  int
+	maxIndex0 int
+}
+
+var ncpu_once sync.Once
+
+// how many of a cluster's most recent log records to keep.
+const maxCapturedLogs = 20000
+
+// a Logger shared by all of a cluster's Rafts. it keeps the
+// latest records, interleaved, so that a failed test can show
+// what led up to the failure; passing tests print nothing.
+// set RAFT_LOG to log to stderr as things happen instead.
+type logCapture struct {
+	mu      sync.Mutex
+	recs    []raft.Record // a ring
+	next    int           // where the next record goes
+	dropped int           // records overwritten
+}
+
+func makeLogCapture(n int) *logCapture {
+	return &logCapture{recs: make([]raft.Record, 0, n)}
+}
+
+func (lc *logCapture) Enabled(level raft.Level) bool {
+	return true
+}
+
+func (lc *logCapture) Log(r raft.Record) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if len(lc.recs) < cap(lc.recs) {
+		lc.recs = append(lc.recs, r)
+		return
+	}
+	lc.recs[lc.next] = r
+	lc.next = (lc.next + 1) % len(lc.recs)
+	lc.dropped++
+}
+
+// the records kept, oldest first, and how many were not.
+func (lc *logCapture) records() ([]raft.Record, int) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	out := make([]raft.Record, 0, len(lc.recs))
+	out = append(out, lc.recs[lc.next:]...)
+	return append(out, lc.recs[:lc.next]...), lc.dropped
+}
+
+func (lc *logCapture) dump(w io.Writer) {
+	recs, dropped := lc.records()
+	fmt.Fprintf(w, "--- Raft log (%d records", len(recs))
+	if dropped > 0 {
+		fmt.Fprintf(w, ", %d earlier ones dropped", dropped)
+	}
+	fmt.Fprintf(w, ") ---\n")
+	for _, r := range recs {
+		fmt.Fprintln(w, r.String())
+	}
+}
+
+// n Rafts, connected and started.
+func MakeCluster(t testing.TB, n int, opts Options) *Cluster {
+	ncpu_once.Do(func() {
+		if runtime.NumCPU() < 2 {
+			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
+		}
+		rand.Seed(makeSeed())
+	})
+	runtime.GOMAXPROCS(4)
+	cfg := &Cluster{}
+	cfg.t = t
+	cfg.opts = opts
+	cfg.net = labrpc.MakeNetwork()
+	cfg.n = n
+	cfg.applyErr = make([]string, cfg.n)
+	cfg.rafts = make([]*raft.Raft, cfg.n)
+	cfg.dead = make([]*int32, cfg.n)
+	cfg.machines = make([]StateMachine, cfg.n)
+	cfg.connected = make([]bool, cfg.n)
+	cfg.saved = make([]*raft.Persister, cfg.n)
+	cfg.endnames = make([][]string, cfg.n)
+	cfg.logs = make([]map[int]interface{}, cfg.n)
+	cfg.lastApplied = make([]int, cfg.n)
+	cfg.paused = make([]int32, cfg.n)
+	cfg.limit = 120 * time.Second
+	cfg.linkFaults = map[[2]int]labrpc.FaultModel{}
+	cfg.seed = testSeed()
+	cfg.clock = clock.Real{}
+	cfg.rand = lockedRand(cfg.seed)
+	cfg.net.SetRand(lockedRand(cfg.seed + 1))
+	if os.Getenv("RAFT_SIM") != "" {
+		// run the test in simulated time; the seed fixes
+		// everything that happens, in one stream of choices.
+		cfg.sim = clock.NewSim(cfg.seed)
+		cfg.clock = cfg.sim
+		cfg.rand = cfg.sim.Rand()
+		cfg.net.SetClock(cfg.sim)
+		cfg.net.SetRand(cfg.rand)
+	}
+	cfg.start = cfg.clock.Now()
+	if os.Getenv("RAFT_LOG") == "" {
+		cfg.logcap = makeLogCapture(maxCapturedLogs)
+	}
+	if dir := os.Getenv("RAFT_EVENTS"); dir != "" {
+		cfg.recordEvents(dir)
+	}
+	cfg.invariants = makeInvariantChecker()
+	cfg.clock.Go(cfg.checkInvariantsLoop)
+
+	cfg.SetUnreliable(opts.Unreliable)
+	if s := os.Getenv("RAFT_DROP_RATE"); s != "" {
+		// for experiments: drop this fraction of RPCs and replies.
+		drop, err := strconv.ParseFloat(s, 64)
+		if err != nil || drop < 0 || drop > 1 {
+			log.Fatalf("bad RAFT_DROP_RATE %q", s)
+		}
+		fm := cfg.net.Faults()
+		fm.Drop = drop
+		cfg.net.SetFaults(fm)
+	}
+
+	cfg.net.LongDelays(true)
+
+	// create a full set of Rafts.
+	for i := 0; i < cfg.n; i++ {
+		cfg.logs[i] = map[int]interface{}{}
+		cfg.Start(i)
+	}
+
+	// connect everyone
+	for i := 0; i < cfg.n; i++ {
+		cfg.Connect(i)
+	}
+
+	return cfg
+}
+
+// shut down a Raft server but save its persistent state.
+func (cfg *Cluster) Crash(i int) {
+	cfg.Disconnect(i)
+	cfg.net.DeleteServer(i) // disable client connections to the server.
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	// a fresh persister, in case old instance
+	// continues to update the Persister.
+	// but copy old persister's content so that we always
+	// pass Make() the last persisted state.
+	if cfg.saved[i] != nil {
+		cfg.saved[i] = cfg.saved[i].Copy()
+	}
+
+	rf := cfg.rafts[i]
+	if rf != nil {
+		cfg.mu.Unlock()
+		rf.Kill()
+		cfg.mu.Lock()
+		atomic.StoreInt32(cfg.dead[i], 1)
+		cfg.rafts[i] = nil
+	}
+
+	if cfg.saved[i] != nil {
+		raftlog := cfg.saved[i].ReadRaftState()
+		snapshot := cfg.saved[i].ReadSnapshot()
+		cfg.saved[i] = &raft.Persister{}
+		cfg.saved[i].SaveStateAndSnapshot(raftlog, snapshot)
+	}
+}
+
+// start or re-start a Raft.
+// if one already exists, "kill" it first.
+// allocate new outgoing port file names, and a new
+// state persister, to isolate previous instance of
+// this server. since we cannot really kill it.
+func (cfg *Cluster) Start(i int) {
+	cfg.Crash(i)
+
+	// a fresh set of outgoing ClientEnd names.
+	// so that old crashed instance's ClientEnds can't send.
+	cfg.endnames[i] = make([]string, cfg.n)
+	for j := 0; j < cfg.n; j++ {
+		cfg.endnames[i][j] = randstring(20)
+	}
+
+	// a fresh set of ClientEnds.
+	ends := make([]*labrpc.ClientEnd, cfg.n)
+	for j := 0; j < cfg.n; j++ {
+		ends[j] = cfg.net.MakeEnd(cfg.endnames[i][j])
+		cfg.net.Connect(cfg.endnames[i][j], j)
+		cfg.net.SetOwner(cfg.endnames[i][j], i)
+		cfg.mu.Lock()
+		if fm, ok := cfg.linkFaults[[2]int{i, j}]; ok {
+			cfg.net.SetLinkFaults(cfg.endnames[i][j], &fm)
+		}
+		cfg.mu.Unlock()
+	}
+
+	cfg.mu.Lock()
+
+	// a fresh persister, so old instance doesn't overwrite
+	// new instance's persisted state.
+	// but copy old persister's content so that we always
+	// pass Make() the last persisted state.
+	if cfg.saved[i] != nil {
+		cfg.saved[i] = cfg.saved[i].Copy()
+	} else {
+		cfg.saved[i] = raft.MakePersister()
+	}
+
+	var sm StateMachine
+	if cfg.opts.StateMachine != nil {
+		sm = cfg.opts.StateMachine(i)
+	}
+	cfg.machines[i] = sm
+	snapshot := cfg.saved[i].ReadSnapshot()
+
+	cfg.mu.Unlock()
+
+	// as a service would, start from the last snapshot.
+	if len(snapshot) > 0 {
+		if err := cfg.ingestSnapshot(i, sm, snapshot, -1); err != "" {
+			cfg.t.Fatalf("%v", err)
+		}
+	}
+
+	// listen to messages from Raft indicating newly committed messages.
+	applyCh := make(chan raft.ApplyMsg)
+	if cfg.sim != nil {
+		applyCh = make(chan raft.ApplyMsg, simApplyBuffer)
+	}
+	apply := func(m raft.ApplyMsg) {
+		err_msg := ""
+		if m.SnapshotValid {
+			err_msg = cfg.ingestSnapshot(i, sm, m.Snapshot, m.SnapshotIndex)
+		} else if !m.CommandValid {
+			// ignore other types of ApplyMsg
+		} else {
+			v := m.Command
+			cfg.mu.Lock()
+			for j := 0; j < len(cfg.logs); j++ {
+				if old, oldok := cfg.logs[j][m.CommandIndex]; oldok && !sameCommand(old, v) {
+					// some server has already committed a different value for this entry!
+					err_msg = fmt.Sprintf("commit index=%v server=%v %v != server=%v %v",
+						m.CommandIndex, i, m.Command, j, old)
+				}
+			}
+			_, prevok := cfg.logs[i][m.CommandIndex-1]
+			cfg.logs[i][m.CommandIndex] = v
+			cfg.lastApplied[i] = m.CommandIndex
+			if m.CommandIndex > cfg.maxIndex {
+				cfg.maxIndex = m.CommandIndex
+			}
+			if sm != nil {
+				sm.Apply(m.CommandIndex, v)
+			}
+			cfg.mu.Unlock()
+
+			if m.CommandIndex > 1 && !prevok {
+				err_msg = fmt.Sprintf("server %v apply out of order %v", i, m.CommandIndex)
+			}
+		}
+
+		if err_msg != "" {
+			log.Fatalf("apply error: %v\n", err_msg)
+			cfg.applyErr[i] = err_msg
+			// keep reading after error so that Raft doesn't block
+			// holding locks...
+		}
+	}
+	if cfg.sim == nil {
+		go func() {
+			for m := range applyCh {
+				apply(m)
+			}
+		}()
+	}
+
+	opts := raft.Options{Clock: pausingClock{cfg.clock, &cfg.paused[i]}, Rand: cfg.rand, Seed: cfg.seed}
+	if cfg.sim == nil {
+		// each peer its own stream, so that how the others'
+		// goroutines interleave doesn't change its timeouts.
+		opts.Rand = lockedRand(cfg.seed + 2 + int64(i))
+	}
+	rf := raft.MakeWith(ends, i, cfg.saved[i], applyCh, opts)
+	dead := new(int32)
+	if cfg.sim != nil {
+		cfg.sim.Go(func() { simApplier(cfg.sim, dead, applyCh, apply) })
+	}
+
+	cfg.mu.Lock()
+	cfg.rafts[i] = rf
+	cfg.dead[i] = dead
+	if cfg.logcap != nil {
+		rf.SetLogger(cfg.logcap)
+	}
+	for _, o := range cfg.observers {
+		rf.AddObserver(o)
+	}
+	cfg.mu.Unlock()
+
+	svc := labrpc.MakeService(rf)
+	srv := labrpc.MakeServer()
+	srv.AddService(svc)
+	srv.Use(cfg.pauseHandlers(i))
+	cfg.net.AddServer(i, srv)
+}
+
+// how many ApplyMsgs a simulated Raft can send before the
+// tester's task reads them; a Raft blocked on applyCh would
+// hang the simulation.
+const simApplyBuffer = 10000
+
+// read a Raft's applyCh as a task of a simulation, until the
+// Raft is killed (*dead is set) and nothing is left.
+func simApplier(sim *clock.Sim, dead *int32, applyCh chan raft.ApplyMsg, apply func(raft.ApplyMsg)) {
+	for {
+		var m raft.ApplyMsg
+		got := false
+		sim.Until(func() bool {
+			select {
+			case m = <-applyCh:
+				got = true
+			default:
+			}
+			return got || atomic.LoadInt32(dead) == 1
+		})
+		if !got {
+			return
+		}
+		apply(m)
+	}
+}
+
+// snapshot server i's applied commands, and its StateMachine if
+// it has one, and hand it to its Raft, as a service would.
+// returns the index the snapshot covers.
+func (cfg *Cluster) Snapshot(i int) (int, error) {
+	cfg.mu.Lock()
+	rf := cfg.rafts[i]
+	index := cfg.lastApplied[i]
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(index)
+	var xlog []interface{}
+	for j := 1; j <= index; j++ {
+		xlog = append(xlog, cfg.logs[i][j])
+	}
+	e.Encode(xlog)
+	var state []byte
+	if cfg.machines[i] != nil {
+		state = cfg.machines[i].Snapshot()
+	}
+	e.Encode(state)
+	cfg.mu.Unlock()
+
+	if rf == nil {
+		return 0, fmt.Errorf("server %v is crashed", i)
+	}
+	if err := rf.Snapshot(index, w.Bytes()); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// replace server i's applied commands, and sm's state, with those
+// in a snapshot from its leader or its own persister. index is
+// where the leader said it ends, or -1. returns an error message,
+// or "".
+func (cfg *Cluster) ingestSnapshot(i int, sm StateMachine, snapshot []byte, index int) string {
+	r := bytes.NewBuffer(snapshot)
+	d := labgob.NewDecoder(r)
+	var lastIncluded int
+	var xlog []interface{}
+	var state []byte
+	if d.Decode(&lastIncluded) != nil || d.Decode(&xlog) != nil || d.Decode(&state) != nil {
+		return fmt.Sprintf("server %v: bad snapshot", i)
+	}
+	if (index != -1 && index != lastIncluded) || len(xlog) != lastIncluded {
+		return fmt.Sprintf("server %v: snapshot for %v holds %v commands, ApplyMsg says %v",
+			i, lastIncluded, len(xlog), index)
+	}
+
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.logs[i] = map[int]interface{}{}
+	for j, v := range xlog {
+		for k := 0; k < len(cfg.logs); k++ {
+			if old, oldok := cfg.logs[k][j+1]; oldok && !sameCommand(old, v) {
+				return fmt.Sprintf("snapshot index=%v server=%v %v != server=%v %v", j+1, i, v, k, old)
+			}
+		}
+		cfg.logs[i][j+1] = v
+	}
+	cfg.lastApplied[i] = lastIncluded
+	if sm != nil {
+		sm.Restore(state)
+	}
+	return ""
+}
+
+// write every server's events to dir/<test name>.jsonl.
+func (cfg *Cluster) recordEvents(dir string) {
+	name := strings.ReplaceAll(cfg.t.Name(), "/", "_") + ".jsonl"
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		cfg.t.Fatalf("RAFT_EVENTS: %v", err)
+	}
+	cfg.events = raft.NewEventLog(f, cfg.clock)
+	cfg.observers = append(cfg.observers, cfg.events)
+}
+
+// register o on every server, now and after restarts.
+func (cfg *Cluster) Observe(o raft.Observer) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.observers = append(cfg.observers, o)
+	for _, rf := range cfg.rafts {
+		if rf != nil {
+			rf.AddObserver(o)
+		}
+	}
+}
+
+func (cfg *Cluster) checkTimeout() {
+	// enforce a two minute real-time limit on each test
+	// (simulated time, in a simulation)
+	if !cfg.t.Failed() && cfg.clock.Since(cfg.start) > cfg.limit {
+		cfg.t.Fatalf("test took longer than %v", cfg.limit)
+	}
+}
+
+func (cfg *Cluster) Cleanup() {
+	defer func() {
+		if !cfg.t.Failed() {
+			return
+		}
+		cfg.printStatus(os.Stdout)
+		if cfg.logcap != nil {
+			cfg.logcap.dump(os.Stdout)
+		}
+		if cfg.sim != nil {
+			fmt.Printf("--- simulated; RAFT_SIM=%d replays this run ---\n", cfg.seed)
+		} else {
+			fmt.Printf("--- seed %d; -seed=%d makes the same random choices ---\n", cfg.seed, cfg.seed)
+		}
+	}()
+	atomic.StoreInt32(&cfg.finished, 1)
+	if cfg.sim != nil {
+		// no more simulated time; every task still waiting exits.
+		cfg.sim.Stop()
+	}
+	for i := 0; i < len(cfg.rafts); i++ {
+		if cfg.rafts[i] != nil {
+			cfg.rafts[i].Kill()
+			atomic.StoreInt32(cfg.dead[i], 1)
+		}
+	}
+	cfg.net.Cleanup()
+	if cfg.events != nil {
+		cfg.events.Close()
+	}
+	cfg.checkTimeout()
+}
+
+// every server's Status(), for diagnosing a failed test.
+func (cfg *Cluster) printStatus(w io.Writer) {
+	cfg.mu.Lock()
+	rafts := append([]*raft.Raft(nil), cfg.rafts...)
+	cfg.mu.Unlock()
+
+	fmt.Fprintf(w, "--- Raft status ---\n")
+	for i, rf := range rafts {
+		if rf == nil {
+			fmt.Fprintf(w, "[crashed] peer %d\n", i)
+			continue
+		}
+		net := "connected"
+		if !cfg.connected[i] {
+			net = "disconnected"
+		}
+		fmt.Fprintf(w, "[%s] %v\n", net, rf.Status())
+	}
+}
+
+// attach server i to the net.
+func (cfg *Cluster) Connect(i int) {
+	// fmt.Printf("connect(%d)\n", i)
+
+	cfg.connected[i] = true
+
+	// outgoing ClientEnds
+	for j := 0; j < cfg.n; j++ {
+		if cfg.connected[j] {
+			endname := cfg.endnames[i][j]
+			cfg.net.Enable(endname, true)
+		}
+	}
+
+	// incoming ClientEnds
+	for j := 0; j < cfg.n; j++ {
+		if cfg.connected[j] {
+			endname := cfg.endnames[j][i]
+			cfg.net.Enable(endname, true)
+		}
+	}
+}
+
+// detach server i from the net.
+func (cfg *Cluster) Disconnect(i int) {
+	// fmt.Printf("disconnect(%d)\n", i)
+
+	cfg.connected[i] = false
+
+	// outgoing ClientEnds
+	for j := 0; j < cfg.n; j++ {
+		if cfg.endnames[i] != nil {
+			endname := cfg.endnames[i][j]
+			cfg.net.Enable(endname, false)
+		}
+	}
+
+	// incoming ClientEnds
+	for j := 0; j < cfg.n; j++ {
+		if cfg.endnames[j] != nil {
+			endname := cfg.endnames[j][i]
+			cfg.net.Enable(endname, false)
+		}
+	}
+}
+
+// split the servers into groups that can only talk among
+// themselves. a server in two groups can talk to both; one
+// in none, to no one. connect() and disconnect() still apply.
+func (cfg *Cluster) Partition(groups ...[]int) {
+	gs := make([][]interface{}, len(groups))
+	for g, servers := range groups {
+		for _, i := range servers {
+			gs[g] = append(gs[g], i)
+		}
+	}
+	cfg.net.Partition(gs)
+}
+
+// cut servers off from the rest, which can still talk
+// among themselves.
+func (cfg *Cluster) Isolate(servers ...int) {
+	in := map[int]bool{}
+	for _, i := range servers {
+		in[i] = true
+	}
+	var rest []int
+	for i := 0; i < cfg.n; i++ {
+		if !in[i] {
+			rest = append(rest, i)
+		}
+	}
+	cfg.Partition(servers, rest)
+}
+
+// partition left from right, except for server b, which
+// sees both sides.
+func (cfg *Cluster) Bridge(b int, left, right []int) {
+	cfg.Partition(append([]int{b}, left...), append([]int{b}, right...))
+}
+
+// RPCs from server i to server j are lost, but j's to i
+// still arrive.
+func (cfg *Cluster) CutLink(i, j int) {
+	cfg.net.CutLink(i, j)
+}
+
+func (cfg *Cluster) RestoreLink(i, j int) {
+	cfg.net.RestoreLink(i, j)
+}
+
+// undo partition(), isolate(), bridge() and cutlink().
+func (cfg *Cluster) Heal() {
+	cfg.net.Heal()
+}
+
+func (cfg *Cluster) RPCCount(server int) int {
+	return cfg.net.GetCount(server)
+}
+
+func (cfg *Cluster) RPCTotal() int {
+	return cfg.net.GetTotalCount()
+}
+
+func (cfg *Cluster) SetUnreliable(unrel bool) {
+	cfg.net.Reliable(!unrel)
+}
+
+// the fault model for every link that doesn't have its own.
+func (cfg *Cluster) SetFaults(fm labrpc.FaultModel) {
+	cfg.net.SetFaults(fm)
+}
+
+// the fault model for RPCs from server i to server j, or with nil
+// the network's again. it outlasts restarts of i.
+func (cfg *Cluster) SetLinkFaults(i, j int, fm *labrpc.FaultModel) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if fm == nil {
+		delete(cfg.linkFaults, [2]int{i, j})
+	} else {
+		cfg.linkFaults[[2]int{i, j}] = *fm
+	}
+	cfg.net.SetLinkFaults(cfg.endnames[i][j], fm)
+}
+
+func (cfg *Cluster) BytesTotal() int64 {
+	return cfg.net.GetTotalBytes()
+}
+
+func (cfg *Cluster) SetLongReordering(longrel bool) {
+	cfg.net.LongReordering(longrel)
+}
+
+// deliver some requests late and some twice.
+func (cfg *Cluster) SetRequestReordering(yes bool) {
+	cfg.net.RequestReordering(yes)
+}
+
+// check that there's exactly one leader.
+// try a few times in case re-elections are needed.
+func (cfg *Cluster) CheckOneLeader() int {
+	cfg.checkInvariants()
+	for iters := 0; iters < 10; iters++ {
+		ms := 450 + (cfg.rand.Int63() % 100)
+		cfg.clock.Sleep(time.Duration(ms) * time.Millisecond)
+
+		leaders := make(map[int][]int)
+		for i := 0; i < cfg.n; i++ {
+			if cfg.connected[i] {
+				if term, leader := cfg.rafts[i].GetState(); leader {
+					leaders[term] = append(leaders[term], i)
+				}
+			}
+		}
+
+		lastTermWithLeader := -1
+		for term, leaders := range leaders {
+			if len(leaders) > 1 {
+				cfg.t.Fatalf("term %d has %d (>1) leaders", term, len(leaders))
+			}
+			if term > lastTermWithLeader {
+				lastTermWithLeader = term
+			}
+		}
+
+		if len(leaders) != 0 {
+			return leaders[lastTermWithLeader][0]
+		}
+	}
+	cfg.t.Fatalf("expected one leader, got none")
+	return -1
+}
+
+// check that everyone agrees on the term.
+func (cfg *Cluster) CheckTerms() int {
+	term := -1
+	for i := 0; i < cfg.n; i++ {
+		if cfg.connected[i] {
+			xterm, _ := cfg.rafts[i].GetState()
+			if term == -1 {
+				term = xterm
+			} else if term != xterm {
+				cfg.t.Fatalf("servers disagree on term")
+			}
+		}
+	}
+	return term
+}
+
+// check that there's no leader
+func (cfg *Cluster) CheckNoLeader() {
+	for i := 0; i < cfg.n; i++ {
+		if cfg.connected[i] {
+			_, is_leader := cfg.rafts[i].GetState()
+			if is_leader {
+				cfg.t.Fatalf("expected no leader, but %v claims to be leader", i)
+			}
+		}
+	}
+}
+
+// how many servers think a log entry is committed?
+func (cfg *Cluster) NCommitted(index int) (int, interface{}) {
+	count := 0
+	var cmd interface{} = nil
+	for i := 0; i < len(cfg.rafts); i++ {
+		if cfg.applyErr[i] != "" {
+			cfg.t.Fatal(cfg.applyErr[i])
+		}
+
+		cfg.mu.Lock()
+		cmd1, ok := cfg.logs[i][index]
+		cfg.mu.Unlock()
+
+		if ok {
+			if count > 0 && !sameCommand(cmd, cmd1) {
+				cfg.t.Fatalf("committed values do not match: index %v, %v, %v\n",
+					index, cmd, cmd1)
+			}
+			count += 1
+			cmd = cmd1
+		}
+	}
+	return count, cmd
+}
+
+// wait for at least n servers to commit.
+// but don't wait forever.
+func (cfg *Cluster) Wait(index int, n int, startTerm int) interface{} {
+	to := 10 * time.Millisecond
+	for iters := 0; iters < 30; iters++ {
+		nd, _ := cfg.NCommitted(index)
+		if nd >= n {
+			break
+		}
+		cfg.clock.Sleep(to)
+		if to < time.Second {
+			to *= 2
+		}
+		if startTerm > -1 {
+			for _, r := range cfg.rafts {
+				if t, _ := r.GetState(); t > startTerm {
+					// someone has moved on
+					// can no longer guarantee that we'll "win"
+					return -1
+				}
+			}
+		}
+	}
+	nd, cmd := cfg.NCommitted(index)
+	if nd < n {
+		cfg.t.Fatalf("only %d decided for index %d; wanted %d\n",
+			nd, index, n)
+	}
+	return cmd
+}
+
+// do a complete agreement.
+// it might choose the wrong leader initially,
+// and have to re-submit after giving up.
+// entirely gives up after about 10 seconds.
+// indirectly checks that the servers agree on the
+// same value, since NCommitted() checks this,
+// as do the threads that read from applyCh.
+// returns index.
+// if retry==true, may submit the command multiple
+// times, in case a leader fails just after Start().
+// if retry==false, calls Start() only once, in order
+// to simplify the early Lab 2B tests.
+func (cfg *Cluster) One(cmd interface{}, expectedServers int, retry bool) int {
+	cfg.checkInvariants()
+	t0 := cfg.clock.Now()
+	starts := 0
+	for cfg.clock.Since(t0).Seconds() < 10 {
+		// try all the servers, maybe one is the leader.
+		index := -1
+		for si := 0; si < cfg.n; si++ {
+			starts = (starts + 1) % cfg.n
+			var rf *raft.Raft
+			cfg.mu.Lock()
+			if cfg.connected[starts] {
+				rf = cfg.rafts[starts]
+			}
+			cfg.mu.Unlock()
+			if rf != nil {
+				index1, _, ok := rf.Start(cmd)
+				if ok {
+					index = index1
+					break
+				}
+			}
+		}
+
+		if index != -1 {
+			// somebody claimed to be the leader and to have
+			// submitted our command; wait a while for agreement.
+			t1 := cfg.clock.Now()
+			for cfg.clock.Since(t1).Seconds() < 2 {
+				nd, cmd1 := cfg.NCommitted(index)
+				if nd > 0 && nd >= expectedServers {
+					// committed
+					if sameCommand(cmd1, cmd) {
+						// and it was the command we submitted.
+						return index
+					}
+				}
+				cfg.clock.Sleep(20 * time.Millisecond)
+			}
+			if !retry {
+				cfg.t.Fatalf("one(%v) failed to reach agreement", cmd)
+			}
+		} else {
+			cfg.clock.Sleep(50 * time.Millisecond)
+		}
+	}
+	cfg.t.Fatalf("one(%v) failed to reach agreement", cmd)
+	return -1
+}
+
+// start a Test.
+// print the Test message.
+// e.g. cfg.Begin("Test (2B): RPC counts aren't too high")
+func (cfg *Cluster) Begin(description string) {
+	fmt.Printf("%s ...\n", description)
+	cfg.t0 = cfg.clock.Now()
+	cfg.rpcs0 = cfg.RPCTotal()
+	cfg.bytes0 = cfg.BytesTotal()
+	cfg.stats0 = cfg.net.Stats()
+	cfg.cmds0 = 0
+	cfg.maxIndex0 = cfg.maxIndex
+}
+
+// end a Test -- the fact that we got here means there
+// was no failure.
+// print the Passed message,
+// and some performance numbers.
+func (cfg *Cluster) End() {
+	cfg.checkTimeout()
+	cfg.checkInvariants()
+	if !cfg.t.Failed() {
+		cfg.mu.Lock()
+		t := cfg.clock.Since(cfg.t0).Seconds()  // real or simulated time
+		npeers := cfg.n                         // number of Raft peers
+		nrpc := cfg.RPCTotal() - cfg.rpcs0      // number of RPC sends
+		nbytes := cfg.BytesTotal() - cfg.bytes0 // number of bytes
+		ncmds := cfg.maxIndex - cfg.maxIndex0   // number of Raft agreements reported
+		cfg.mu.Unlock()
+
+		fmt.Printf("  ... Passed --")
+		fmt.Printf("  %4.1f  %d %4d %7d %4d\n", t, npeers, nrpc, nbytes, ncmds)
+		cfg.net.Stats().Sub(cfg.stats0).WriteTable(os.Stdout, "      ")
+	}
+}
+
+// server i's Raft, or nil if it's crashed.
+func (cfg *Cluster) Raft(i int) *raft.Raft {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	return cfg.rafts[i]
+}
+
+func (cfg *Cluster) Persister(i int) *raft.Persister {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	return cfg.saved[i]
+}
+
+func (cfg *Cluster) Connected(i int) bool {
+	return cfg.connected[i]
+}
+
+// the clock the cluster runs on, and a test should wait on.
+func (cfg *Cluster) Clock() clock.Clock {
+	return cfg.clock
+}
+
+// for the test's random choices, so that the seed fixes them.
+func (cfg *Cluster) Rand() *rand.Rand {
+	return cfg.rand
+}
+
+// whether the cluster runs in simulated time (RAFT_SIM).
+func (cfg *Cluster) Simulated() bool {
+	return cfg.sim != nil
+}
+
+func (cfg *Cluster) Net() *labrpc.Network {
+	return cfg.net
+}
+
+// the event log RAFT_EVENTS asked for, or nil.
+func (cfg *Cluster) Events() *raft.EventLog {
+	return cfg.events
+}
+
+// the servers' latest log records, oldest first; false if
+// RAFT_LOG sends them to stderr instead.
+func (cfg *Cluster) LogRecords() ([]raft.Record, bool) {
+	if cfg.logcap == nil {
+		return nil, false
+	}
+	recs, _ := cfg.logcap.records()
+	return recs, true
+}
+
+// goroutines a test starts and later waits for, on cfg's clock.
+type Group struct {
+	clock clock.Clock
+	n     int32 // how many are still running
+}
+
+func (cfg *Cluster) Group() *Group {
+	return &Group{clock: cfg.clock}
+}
+
+func (g *Group) Go(f func()) {
+	atomic.AddInt32(&g.n, 1)
+	g.clock.Go(func() {
+		defer atomic.AddInt32(&g.n, -1)
+		f()
+	})
+}
+
+func (g *Group) Wait() {
+	g.clock.Until(func() bool { return atomic.LoadInt32(&g.n) == 0 })
+}
@@ -0,0 +1,277 @@
+package raftsim
+
+//
+// the tester's online safety checker. every few milliseconds it
+// reads every live peer's state with Inspect() and checks the
+// properties of Figure 3 of the Raft paper that don't wait for
+// the apply channel:
+//
+//   election safety      at most one leader per term
+//   log matching         if two logs have an entry with the same
+//                        index and term, they agree up to it
+//   leader completeness  a leader has every entry committed in
+//                        an earlier term
+//
+// and that no peer's term or commitIndex goes backwards.
+//
+// the peers are read one at a time, not all at once, but each of
+// these holds across time as well, so that's fine.
+//
+// a violation is printed, with a diff of the logs involved, as
+// soon as it's seen, and fails the test at its next
+// cfg.checkInvariants() (One(), CheckOneLeader(), End()).
+//
+
+import (
+	"fmt"
+	"mitraft/raft"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// how often the checker reads the peers.
+const invariantInterval = 10 * time.Millisecond
+
+// an entry that some peer has committed.
+type committedEntry struct {
+	entry raft.LogEntry
+	peer  int             // the peer that had it at or below its commitIndex
+	term  int             // that peer's term then; leaders of later terms must have it
+	log   []raft.LogEntry // that peer's entries around it, for logDiff()
+}
+
+type invariantChecker struct {
+	leaders   map[int]int        // term -> the peer seen leading it
+	terms     map[*raft.Raft]int // the highest term seen of each Raft instance
+	commits   map[*raft.Raft]int // and commitIndex
+	committed map[int]committedEntry
+	violation string // the first one found
+}
+
+func makeInvariantChecker() *invariantChecker {
+	return &invariantChecker{
+		leaders:   map[int]int{},
+		terms:     map[*raft.Raft]int{},
+		commits:   map[*raft.Raft]int{},
+		committed: map[int]committedEntry{},
+	}
+}
+
+// one peer's state, as read by Inspect().
+type peerSample struct {
+	rf  *raft.Raft
+	st  raft.Status
+	log []raft.LogEntry
+}
+
+// check the peers' state until the test is over or something
+// is wrong.
+func (cfg *Cluster) checkInvariantsLoop() {
+	ic := cfg.invariants
+	for atomic.LoadInt32(&cfg.finished) == 0 {
+		t0 := time.Now()
+		cfg.mu.Lock()
+		rafts := append([]*raft.Raft{}, cfg.rafts...)
+		dead := append([]*int32{}, cfg.dead...)
+		cfg.mu.Unlock()
+
+		var samples []peerSample
+		for i, rf := range rafts {
+			if rf == nil || atomic.LoadInt32(dead[i]) == 1 {
+				continue
+			}
+			st, log := rf.Inspect()
+			samples = append(samples, peerSample{rf, st, log})
+		}
+
+		if v := ic.check(samples); v != "" {
+			fmt.Printf("safety violation: %v\n", v)
+			cfg.mu.Lock()
+			ic.violation = v
+			cfg.mu.Unlock()
+			return
+		}
+
+		// reading long logs takes a while; don't let it take
+		// over a long test. a simulation mustn't depend on
+		// real time, so there go by how long they are.
+		entries := 0
+		for _, s := range samples {
+			entries += len(s.log)
+		}
+		wait := invariantInterval * time.Duration(1+entries/1000)
+		if d := 10 * time.Since(t0); cfg.sim == nil && d > wait {
+			wait = d
+		}
+		cfg.clock.Sleep(wait)
+	}
+}
+
+// fail the test if the checker has found a violation.
+func (cfg *Cluster) checkInvariants() {
+	cfg.mu.Lock()
+	v := cfg.invariants.violation
+	cfg.mu.Unlock()
+	if v != "" {
+		cfg.t.Fatalf("safety violation: %v", v)
+	}
+}
+
+// a description of the first violation among samples, or "".
+func (ic *invariantChecker) check(samples []peerSample) string {
+	for _, s := range samples {
+		if t, ok := ic.terms[s.rf]; ok && s.st.Term < t {
+			return fmt.Sprintf("peer %v's term went from %v back to %v", s.st.Me, t, s.st.Term)
+		}
+		ic.terms[s.rf] = s.st.Term
+		if c, ok := ic.commits[s.rf]; ok && s.st.CommitIndex < c {
+			return fmt.Sprintf("peer %v's commitIndex went from %v back to %v", s.st.Me, c, s.st.CommitIndex)
+		}
+		ic.commits[s.rf] = s.st.CommitIndex
+
+		if s.st.Role == raft.Leader {
+			if l, ok := ic.leaders[s.st.Term]; ok && l != s.st.Me {
+				return fmt.Sprintf("peers %v and %v were both leader in term %v", l, s.st.Me, s.st.Term)
+			}
+			ic.leaders[s.st.Term] = s.st.Me
+		}
+	}
+
+	for i := range samples {
+		for j := i + 1; j < len(samples); j++ {
+			if v := checkLogMatching(samples[i], samples[j]); v != "" {
+				return v
+			}
+		}
+	}
+
+	for _, s := range samples {
+		for _, e := range s.log {
+			if e.Index > s.st.CommitIndex {
+				break
+			}
+			c, ok := ic.committed[e.Index]
+			if !ok {
+				ic.committed[e.Index] = committedEntry{e, s.st.Me, s.st.Term, around(s.log, e.Index)}
+				continue
+			}
+			if c.entry.Term != e.Term || !sameCommand(c.entry.Command, e.Command) {
+				return fmt.Sprintf("peers %v and %v committed different entries at index %v\n%v",
+					c.peer, s.st.Me, e.Index, logDiff(c.peer, c.log, s.st.Me, s.log, e.Index))
+			}
+		}
+	}
+
+	for _, s := range samples {
+		if s.st.Role != raft.Leader {
+			continue
+		}
+		for index, c := range ic.committed {
+			if c.term >= s.st.Term || index < s.st.FirstLogIndex {
+				continue
+			}
+			if e, ok := entryAt(s.log, index); !ok || e.Term != c.entry.Term || !sameCommand(e.Command, c.entry.Command) {
+				return fmt.Sprintf("leader %v of term %v lacks index %v, which peer %v had committed in term %v\n%v",
+					s.st.Me, s.st.Term, index, c.peer, c.term, logDiff(c.peer, c.log, s.st.Me, s.log, index))
+			}
+		}
+	}
+	return ""
+}
+
+// where two logs overlap, the indices at which they agree must
+// be a prefix: agreement after a disagreement breaks log matching.
+func checkLogMatching(a, b peerSample) string {
+	lo := max(a.st.FirstLogIndex, b.st.FirstLogIndex)
+	hi := min(a.st.LastLogIndex, b.st.LastLogIndex)
+	differ := -1
+	for index := lo; index <= hi; index++ {
+		ea, _ := entryAt(a.log, index)
+		eb, _ := entryAt(b.log, index)
+		if ea.Term != eb.Term {
+			if differ < 0 {
+				differ = index
+			}
+			continue
+		}
+		if differ >= 0 || !sameCommand(ea.Command, eb.Command) {
+			return fmt.Sprintf("peers %v and %v both have index %v in term %v, but not the same log before it\n%v",
+				a.st.Me, b.st.Me, index, ea.Term, logDiff(a.st.Me, a.log, b.st.Me, b.log, index))
+		}
+	}
+	return ""
+}
+
+func entryAt(log []raft.LogEntry, index int) (raft.LogEntry, bool) {
+	if len(log) == 0 || index < log[0].Index || index > log[len(log)-1].Index {
+		return raft.LogEntry{}, false
+	}
+	return log[index-log[0].Index], true
+}
+
+// how many entries either side of an index logDiff() shows.
+const diffContext = 5
+
+// a copy of the entries logDiff() would show of log.
+func around(log []raft.LogEntry, index int) []raft.LogEntry {
+	var w []raft.LogEntry
+	for i := index - diffContext; i <= index+diffContext; i++ {
+		if e, ok := entryAt(log, i); ok {
+			w = append(w, e)
+		}
+	}
+	return w
+}
+
+// do two commands match? they may be of any type, including ones
+// == can't compare, such as slices, maps, and structs holding them.
+func sameCommand(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// the two logs side by side, a few entries either side of index,
+// with the entries that differ marked.
+func logDiff(p int, a []raft.LogEntry, q int, b []raft.LogEntry, index int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "  %7s  %-20s  %-20s\n", "index", fmt.Sprintf("peer %v", p), fmt.Sprintf("peer %v", q))
+	for i := index - diffContext; i <= index+diffContext; i++ {
+		ea, oka := entryAt(a, i)
+		eb, okb := entryAt(b, i)
+		if !oka && !okb {
+			continue
+		}
+		mark := " "
+		if oka != okb || ea.Term != eb.Term || !sameCommand(ea.Command, eb.Command) {
+			mark = ">"
+		}
+		fmt.Fprintf(&sb, "%s %7d  %-20s  %-20s\n", mark, i, showEntry(ea, oka), showEntry(eb, okb))
+	}
+	return sb.String()
+}
+
+func showEntry(e raft.LogEntry, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	s := fmt.Sprintf("t%d %v", e.Term, e.Command)
+	if len(s) > 20 {
+		s = s[:17] + "..."
+	}
+	return s
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
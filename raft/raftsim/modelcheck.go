@@ -0,0 +1,628 @@
+package raftsim
+
+//
+// a bounded model checker: it runs every schedule of a small
+// cluster's messages, up to a depth, through the real Raft
+// handlers, and checks Raft's safety properties after each step.
+//
+// res := raftsim.ModelCheck(raftsim.ModelOptions{Servers: 3, Depth: 8, ...})
+// res.Violation, res.Schedule -- the shortest unsafe schedule, if any.
+// res.Trace -- its run, as raft.EventLog JSON Lines.
+// violation, err := raftsim.ReplayTrace(opts, events) -- run a
+//   trace's schedule again.
+//
+// the servers are hosted Rafts (raft.MakeHostedWith) on a
+// clock.Sim, so nothing happens unless a step makes it. a
+// schedule is a list of steps, each one of
+//
+//   timeout n     n starts an election
+//   heartbeat n   leader n sends each peer an AppendEntries
+//   request n     leader n is given the next command
+//   deliver m     message m is handled where it's going; a
+//                 request's reply becomes a new message
+//   duplicate m   m is delivered, and stays in flight
+//   drop m        m is lost
+//   crash n       n is killed, keeping what it persisted
+//   restart n     n starts again from that
+//
+// where messages are numbered from 1 in the order they're sent.
+// after each step, whatever the servers started runs until it has
+// finished or is waiting for a reply; the checker then reads the
+// servers with invariants.go's checker, and checks that no two
+// servers have applied different commands at an index.
+//
+// the search is breadth-first, and merges schedules that reach
+// the same state, so the first violation it finds has the
+// shortest schedule there is. in a trace, each step is an
+// EventStep event (Node and Peer are a message's destination and
+// source; Index is its number), followed by the servers' events
+// as it's taken.
+//
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mitraft/clock"
+	"mitraft/raft"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModelOptions bounds a ModelCheck.
+type ModelOptions struct {
+	Servers    int // default 3
+	Depth      int // the most steps in a schedule
+	Commands   int // the most requests in a schedule
+	Crashes    int // and crashes
+	Drops      int // and messages dropped
+	Duplicates int // and messages duplicated
+	MaxStates  int // give up after this many states; 0 for no limit
+
+	// if set, called with each reply before it's sent, to make a
+	// server misbehave, for tests of the checker.
+	Corrupt func(server int, svcMeth string, args, reply interface{})
+}
+
+type ModelResult struct {
+	States    int  // distinct states reached
+	Schedules int  // schedules run
+	Complete  bool // whether every schedule up to Depth was covered
+
+	Violation string   // the first violation found, or ""
+	Schedule  []string // the steps that led to it
+	Trace     []byte   // its run, as raft.EventLog JSON Lines
+}
+
+// step kinds.
+const (
+	stepTimeout   = "timeout"
+	stepHeartbeat = "heartbeat"
+	stepRequest   = "request"
+	stepDeliver   = "deliver"
+	stepDuplicate = "duplicate"
+	stepDrop      = "drop"
+	stepCrash     = "crash"
+	stepRestart   = "restart"
+)
+
+type step struct {
+	kind string
+	node int // the server, or a message's destination
+	msg  int // a message's number; 0 if not a message step
+}
+
+func (s step) String() string {
+	if s.msg != 0 {
+		return fmt.Sprintf("%v %v", s.kind, s.msg)
+	}
+	return fmt.Sprintf("%v %v", s.kind, s.node)
+}
+
+// a Call waiting for its reply.
+type modelCall struct {
+	reply     interface{} // where the reply goes
+	done      bool
+	err       error
+	abandoned bool // its ctx was done first
+}
+
+type message struct {
+	id     int
+	from   int
+	to     int
+	method string
+	args   interface{}
+	reply  interface{} // nil for a request
+	call   *modelCall  // the Call waiting on it, if any
+	leader *raft.Raft  // a heartbeat's sender, to give its reply to
+}
+
+func (m *message) String() string {
+	s := fmt.Sprintf("%v->%v %v %+v", m.from, m.to, m.method, m.args)
+	if m.reply != nil {
+		s += fmt.Sprintf(" reply %+v", m.reply)
+	}
+	if m.call != nil && m.call.abandoned {
+		s += " abandoned"
+	}
+	return s
+}
+
+var errModelDrop = errors.New("dropped by the model checker")
+
+// how long the checker lets the servers run after each step.
+// timers the servers set are far longer, so never fire.
+const modelSettle = time.Microsecond
+
+// a cluster being run through one schedule.
+type modelWorld struct {
+	opts       ModelOptions
+	sim        *clock.Sim
+	el         *raft.EventLog // nil unless tracing
+	rafts      []*raft.Raft
+	up         []bool
+	persisters []*raft.Persister
+	applyChs   []chan raft.ApplyMsg
+	lastApply  []int            // each server's last applied index
+	granted    []map[string]int // each server's votes received: "term voter" -> term
+	msgs       []*message       // in flight, in the order sent
+	sent       int
+
+	commands, crashes, drops, dups int // used up
+
+	ic        *invariantChecker
+	applied   map[int]interface{} // index -> the command applied there
+	violation string
+}
+
+type modelTransport struct {
+	w  *modelWorld
+	me int
+}
+
+// wait, as a task of the simulation, for the checker to deliver
+// or drop the request, or for ctx to be done.
+func (tr modelTransport) Call(ctx context.Context, peer int, svcMeth string, args interface{}, reply interface{}) error {
+	w := tr.w
+	c := &modelCall{reply: reply}
+	w.send(&message{from: tr.me, to: peer, method: svcMeth, args: args, call: c})
+	w.sim.Until(func() bool { return c.done || ctx.Err() != nil })
+	if c.done {
+		return c.err
+	}
+	c.abandoned = true
+	w.remove(func(m *message) bool { return m.call == c && m.reply != nil })
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errModelDrop
+}
+
+func makeModelWorld(opts ModelOptions, trace io.Writer) *modelWorld {
+	w := &modelWorld{opts: opts}
+	w.sim = clock.NewSim(1)
+	if trace != nil {
+		w.el = raft.NewEventLog(trace, w.sim)
+	}
+	n := opts.Servers
+	w.rafts = make([]*raft.Raft, n)
+	w.up = make([]bool, n)
+	w.persisters = make([]*raft.Persister, n)
+	w.applyChs = make([]chan raft.ApplyMsg, n)
+	w.lastApply = make([]int, n)
+	w.granted = make([]map[string]int, n)
+	w.ic = makeInvariantChecker()
+	w.applied = map[int]interface{}{}
+	for i := 0; i < n; i++ {
+		w.persisters[i] = raft.MakePersister()
+		w.start(i)
+	}
+	return w
+}
+
+func (w *modelWorld) start(i int) {
+	// room for everything a server could apply before the
+	// checker next looks.
+	w.applyChs[i] = make(chan raft.ApplyMsg, 2*w.opts.Commands+1)
+	opts := raft.Options{Clock: w.sim, Rand: rand.New(rand.NewSource(int64(i)))}
+	rf := raft.MakeHostedWith(w.opts.Servers, i, w.persisters[i], w.applyChs[i], modelTransport{w, i}, opts)
+	if w.el != nil {
+		rf.AddObserver(w.el)
+	}
+	w.rafts[i] = rf
+	w.up[i] = true
+	w.lastApply[i] = 0
+	w.granted[i] = map[string]int{}
+}
+
+func (w *modelWorld) send(m *message) {
+	w.sent++
+	m.id = w.sent
+	w.msgs = append(w.msgs, m)
+}
+
+func (w *modelWorld) remove(match func(m *message) bool) {
+	msgs := w.msgs[:0]
+	for _, m := range w.msgs {
+		if !match(m) {
+			msgs = append(msgs, m)
+		}
+	}
+	w.msgs = msgs
+}
+
+func (w *modelWorld) message(id int) *message {
+	for _, m := range w.msgs {
+		if m.id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// can m be delivered now?
+func (w *modelWorld) deliverable(m *message) bool {
+	if !w.up[m.to] {
+		return false
+	}
+	if m.reply != nil && m.leader != nil {
+		return m.leader == w.rafts[m.to]
+	}
+	return true
+}
+
+// the steps that can be taken now, within opts' bounds.
+func (w *modelWorld) enabled() []step {
+	var steps []step
+	for i, rf := range w.rafts {
+		if !w.up[i] {
+			steps = append(steps, step{kind: stepRestart, node: i})
+			continue
+		}
+		if _, isLeader := rf.GetState(); !isLeader {
+			steps = append(steps, step{kind: stepTimeout, node: i})
+		} else {
+			steps = append(steps, step{kind: stepHeartbeat, node: i})
+			if w.commands < w.opts.Commands {
+				steps = append(steps, step{kind: stepRequest, node: i})
+			}
+		}
+		if w.crashes < w.opts.Crashes {
+			steps = append(steps, step{kind: stepCrash, node: i})
+		}
+	}
+
+	// messages alike lead to the same states, so only the first
+	// of them need be tried.
+	seen := map[string]bool{}
+	for _, m := range w.msgs {
+		s := m.String()
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		if w.deliverable(m) {
+			steps = append(steps, step{kind: stepDeliver, node: m.to, msg: m.id})
+			// a Call takes only one reply.
+			if w.dups < w.opts.Duplicates && (m.reply == nil || m.call == nil) {
+				steps = append(steps, step{kind: stepDuplicate, node: m.to, msg: m.id})
+			}
+		}
+		if w.drops < w.opts.Drops {
+			steps = append(steps, step{kind: stepDrop, node: m.to, msg: m.id})
+		}
+	}
+	return steps
+}
+
+// take s, let the servers run, and check them. it fails if s
+// can't be taken, as when replaying a trace against other code.
+func (w *modelWorld) take(s step) error {
+	if s.node < 0 || s.node >= len(w.rafts) {
+		return fmt.Errorf("no server %v", s.node)
+	}
+	var m *message
+	if s.msg != 0 {
+		if m = w.message(s.msg); m == nil {
+			return fmt.Errorf("no message %v in flight", s.msg)
+		}
+	}
+	if w.el != nil {
+		e := raft.Event{Kind: raft.EventStep, Step: s.kind, Node: s.node, Peer: -1}
+		if m != nil {
+			e.Peer, e.Method, e.Index = m.from, m.method, m.id
+		}
+		w.el.Record(e)
+	}
+
+	rf := w.rafts[s.node]
+	if s.kind != stepRestart && m == nil && !w.up[s.node] {
+		return fmt.Errorf("server %v is down", s.node)
+	}
+	switch s.kind {
+	case stepTimeout:
+		// long after any election timeout.
+		rf.ElectionTick(w.sim.Now().Add(time.Hour))
+	case stepHeartbeat:
+		for peer, args := range rf.HeartbeatArgs() {
+			if args != nil {
+				w.send(&message{from: s.node, to: peer, method: "Raft.AppendEntries", args: args, leader: rf})
+			}
+		}
+	case stepRequest:
+		w.commands++
+		if _, _, ok := rf.Start(100 + w.commands); !ok {
+			return fmt.Errorf("server %v isn't leader", s.node)
+		}
+	case stepDeliver, stepDuplicate:
+		if m == nil || !w.deliverable(m) {
+			return fmt.Errorf("can't deliver message %v", s.msg)
+		}
+		if s.kind == stepDuplicate {
+			w.dups++
+		} else {
+			w.remove(func(x *message) bool { return x == m })
+		}
+		w.deliver(m, s.kind == stepDuplicate)
+	case stepDrop:
+		if m == nil {
+			return fmt.Errorf("no message to drop")
+		}
+		w.drops++
+		w.remove(func(x *message) bool { return x == m })
+		if m.call != nil && !m.call.abandoned {
+			m.call.done, m.call.err = true, errModelDrop
+		}
+	case stepCrash:
+		w.crashes++
+		rf.Kill()
+		w.up[s.node] = false
+		w.persisters[s.node] = w.persisters[s.node].Copy()
+		w.remove(func(x *message) bool { return x.leader == rf && x.reply != nil })
+	case stepRestart:
+		if w.up[s.node] {
+			return fmt.Errorf("server %v is up", s.node)
+		}
+		w.start(s.node)
+	default:
+		return fmt.Errorf("unknown step %q", s.kind)
+	}
+
+	w.sim.Sleep(modelSettle)
+	w.check()
+	return nil
+}
+
+func (w *modelWorld) deliver(m *message, duplicate bool) {
+	if m.reply != nil {
+		if m.call != nil {
+			switch r := m.call.reply.(type) {
+			case *raft.RequestVoteReply:
+				*r = *m.reply.(*raft.RequestVoteReply)
+				if r.VoteGranted {
+					args := m.args.(*raft.RequestVoteArgs)
+					w.granted[m.to][fmt.Sprintf("%v %v", args.Term, m.from)] = args.Term
+				}
+			case *raft.AppendEntriesReply:
+				*r = *m.reply.(*raft.AppendEntriesReply)
+			}
+			m.call.done = true
+			return
+		}
+		m.leader.HandleAppendEntriesReply(m.from, m.args.(*raft.AppendEntriesArgs), m.reply.(*raft.AppendEntriesReply))
+		return
+	}
+
+	rf := w.rafts[m.to]
+	var reply interface{}
+	switch args := m.args.(type) {
+	case *raft.RequestVoteArgs:
+		r := &raft.RequestVoteReply{}
+		rf.RequestVote(args, r)
+		reply = r
+	case *raft.AppendEntriesArgs:
+		r := &raft.AppendEntriesReply{}
+		rf.AppendEntries(args, r)
+		reply = r
+	}
+	if w.opts.Corrupt != nil {
+		w.opts.Corrupt(m.to, m.method, m.args, reply)
+	}
+
+	// a duplicate's reply goes nowhere, nor does one to a Call
+	// that has given up or a leader that has crashed.
+	if duplicate || (m.call != nil && m.call.abandoned) || (m.leader != nil && (!w.up[m.from] || m.leader != w.rafts[m.from])) {
+		return
+	}
+	w.send(&message{from: m.to, to: m.from, method: m.method, args: m.args, reply: reply,
+		call: m.call, leader: m.leader})
+}
+
+// record the first violation, if any, among the servers that are up.
+func (w *modelWorld) check() {
+	for i := range w.rafts {
+		for done := false; !done; {
+			select {
+			case msg := <-w.applyChs[i]:
+				w.checkApply(i, msg)
+			default:
+				done = true
+			}
+		}
+	}
+
+	var samples []peerSample
+	for i, rf := range w.rafts {
+		if w.up[i] {
+			st, log := rf.Inspect()
+			samples = append(samples, peerSample{rf, st, log})
+		}
+	}
+	if v := w.ic.check(samples); v != "" && w.violation == "" {
+		w.violation = v
+	}
+}
+
+func (w *modelWorld) checkApply(i int, msg raft.ApplyMsg) {
+	if !msg.CommandValid || w.violation != "" {
+		return
+	}
+	if msg.CommandIndex != w.lastApply[i]+1 {
+		w.violation = fmt.Sprintf("server %v applied index %v after %v", i, msg.CommandIndex, w.lastApply[i])
+	}
+	w.lastApply[i] = msg.CommandIndex
+	if cmd, ok := w.applied[msg.CommandIndex]; ok && !sameCommand(cmd, msg.Command) {
+		w.violation = fmt.Sprintf("server %v applied %v at index %v, where another applied %v",
+			i, msg.Command, msg.CommandIndex, cmd)
+	}
+	w.applied[msg.CommandIndex] = msg.Command
+}
+
+// everything that decides what can happen from here, as a string;
+// worlds with the same key are the same state.
+func (w *modelWorld) key() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "used %v %v %v %v\n", w.commands, w.crashes, w.drops, w.dups)
+	for i, rf := range w.rafts {
+		if !w.up[i] {
+			fmt.Fprintf(&b, "%v down\n", i)
+			continue
+		}
+		st, log := rf.Inspect()
+		fmt.Fprintf(&b, "%v %v %v %v %v %v %v", i, st.Role, st.Term, st.VotedFor, st.Leader,
+			st.CommitIndex, st.LastApplied)
+		for _, p := range st.Peers {
+			fmt.Fprintf(&b, " %v/%v", p.NextIndex, p.MatchIndex)
+		}
+		for _, e := range log {
+			fmt.Fprintf(&b, " %v:%v", e.Term, e.Command)
+		}
+		// a candidate's vote count.
+		var votes []string
+		for v, term := range w.granted[i] {
+			if term == st.Term {
+				votes = append(votes, v)
+			}
+		}
+		sort.Strings(votes)
+		fmt.Fprintf(&b, " votes %v\n", votes)
+	}
+
+	var msgs []string
+	for _, m := range w.msgs {
+		msgs = append(msgs, m.String())
+	}
+	sort.Strings(msgs)
+	fmt.Fprintf(&b, "msgs %q\n", msgs)
+
+	// and what the checker remembers of the past.
+	fmt.Fprintf(&b, "leaders %v\napplied %v\n", w.ic.leaders, w.applied)
+	var committed []string
+	for index, c := range w.ic.committed {
+		committed = append(committed, fmt.Sprintf("%v:%v:%v@%v", index, c.entry.Term, c.entry.Command, c.term))
+	}
+	sort.Strings(committed)
+	fmt.Fprintf(&b, "committed %v\n", committed)
+	return b.String()
+}
+
+// what running a schedule found.
+type modelRun struct {
+	violation string
+	key       string
+	enabled   []step
+}
+
+// run steps on a new cluster, stopping early at a violation,
+// and write its events to trace if it isn't nil.
+func runSchedule(opts ModelOptions, steps []step, trace io.Writer) (modelRun, error) {
+	w := makeModelWorld(opts, trace)
+	defer w.sim.Stop()
+	if w.el != nil {
+		defer w.el.Flush()
+	}
+	w.sim.Sleep(modelSettle)
+	for i, s := range steps {
+		if err := w.take(s); err != nil {
+			return modelRun{}, fmt.Errorf("step %v (%v): %v", i+1, s, err)
+		}
+		if w.violation != "" {
+			break
+		}
+	}
+	run := modelRun{violation: w.violation}
+	if run.violation == "" {
+		run.key = w.key()
+		run.enabled = w.enabled()
+	}
+	return run, nil
+}
+
+func (opts *ModelOptions) defaults() {
+	if opts.Servers == 0 {
+		opts.Servers = 3
+	}
+}
+
+// ModelCheck runs every schedule allowed by opts, shortest
+// first, until one breaks a safety property.
+func ModelCheck(opts ModelOptions) ModelResult {
+	opts.defaults()
+	var res ModelResult
+
+	type node struct {
+		steps   []step
+		enabled []step
+	}
+	root, err := runSchedule(opts, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+	visited := map[string]bool{root.key: true}
+	res.States = 1
+	frontier := []node{{nil, root.enabled}}
+
+	for depth := 0; depth < opts.Depth && len(frontier) > 0; depth++ {
+		var next []node
+		for _, n := range frontier {
+			for _, s := range n.enabled {
+				steps := append(append([]step{}, n.steps...), s)
+				run, err := runSchedule(opts, steps, nil)
+				if err != nil {
+					panic(err) // the schedule was just found to be possible
+				}
+				res.Schedules++
+				if run.violation != "" {
+					res.found(opts, steps)
+					return res
+				}
+				if visited[run.key] {
+					continue
+				}
+				if opts.MaxStates > 0 && res.States >= opts.MaxStates {
+					return res
+				}
+				visited[run.key] = true
+				res.States++
+				next = append(next, node{steps, run.enabled})
+			}
+		}
+		frontier = next
+	}
+	res.Complete = true
+	return res
+}
+
+// run steps again, to trace them.
+func (res *ModelResult) found(opts ModelOptions, steps []step) {
+	var buf bytes.Buffer
+	run, err := runSchedule(opts, steps, &buf)
+	if err != nil {
+		panic(err)
+	}
+	res.Violation = run.violation
+	for _, s := range steps {
+		res.Schedule = append(res.Schedule, s.String())
+	}
+	res.Trace = buf.Bytes()
+}
+
+// ReplayTrace runs the schedule in a ModelCheck trace again, on
+// a cluster made with opts, and returns the violation it ends in,
+// or "".
+func ReplayTrace(opts ModelOptions, events []raft.Event) (string, error) {
+	opts.defaults()
+	var steps []step
+	for _, e := range events {
+		if e.Kind == raft.EventStep {
+			steps = append(steps, step{kind: e.Step, node: e.Node, msg: e.Index})
+		}
+	}
+	run, err := runSchedule(opts, steps, nil)
+	return run.violation, err
+}
@@ -0,0 +1,160 @@
+package raftsim
+
+//
+// faults for the soak test (soak.go) to inject and later heal,
+// on top of what cluster.go can already do.
+//
+// cfg.Pause(i), cfg.Resume(i) -- stop server i as a GC pause or
+//   SIGSTOP would: its timers don't fire and its RPC handlers
+//   don't run until it resumes, but time goes on meanwhile.
+//
+// nemeses -- each kind of fault, with how to inject one and how
+//   to heal all of them.
+//
+
+import (
+	"fmt"
+	"mitraft/clock"
+	"mitraft/labrpc"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// a peer's clock, which holds back its sleepers, its timers and
+// anything it waits for while the peer is paused.
+type pausingClock struct {
+	clock.Clock
+	paused *int32
+}
+
+func (pc pausingClock) running() bool {
+	return atomic.LoadInt32(pc.paused) == 0
+}
+
+func (pc pausingClock) Sleep(d time.Duration) {
+	pc.Clock.Sleep(d)
+	pc.Clock.Until(pc.running)
+}
+
+func (pc pausingClock) AfterFunc(d time.Duration, f func()) {
+	pc.Clock.AfterFunc(d, func() {
+		pc.Clock.Until(pc.running)
+		f()
+	})
+}
+
+func (pc pausingClock) Until(cond func() bool) {
+	pc.Clock.Until(func() bool { return pc.running() && cond() })
+}
+
+// hold RPCs to server i while it's paused.
+func (cfg *Cluster) pauseHandlers(i int) labrpc.ServerInterceptor {
+	return func(svcMeth string, args interface{}, reply interface{}, next labrpc.Handler) error {
+		cfg.clock.Until(func() bool { return atomic.LoadInt32(&cfg.paused[i]) == 0 })
+		return next(svcMeth, args, reply)
+	}
+}
+
+func (cfg *Cluster) Pause(i int) {
+	atomic.StoreInt32(&cfg.paused[i], 1)
+}
+
+func (cfg *Cluster) Resume(i int) {
+	atomic.StoreInt32(&cfg.paused[i], 0)
+}
+
+// a kind of fault.
+type nemesis struct {
+	name     string
+	real     bool // whether it only works outside a simulation
+	replaces bool // whether each one undoes the last
+
+	// inject one, and say what it was.
+	inject func(cfg *Cluster) string
+
+	// undo every one injected.
+	heal func(cfg *Cluster)
+}
+
+var nemeses = []nemesis{
+	{
+		name: "crash",
+		inject: func(cfg *Cluster) string {
+			i := cfg.rand.Intn(cfg.n)
+			cfg.Crash(i)
+			return fmt.Sprintf("crash %v", i)
+		},
+		heal: func(cfg *Cluster) {
+			for i := 0; i < cfg.n; i++ {
+				if cfg.rafts[i] == nil {
+					cfg.Start(i)
+					cfg.Connect(i)
+				}
+			}
+		},
+	},
+	{
+		name: "partition",
+		inject: func(cfg *Cluster) string {
+			servers := cfg.rand.Perm(cfg.n)
+			k := 1 + cfg.rand.Intn(cfg.n-1)
+			left, right := servers[:k], servers[k:]
+			sort.Ints(left)
+			sort.Ints(right)
+			cfg.Partition(left, right)
+			return fmt.Sprintf("partition %v %v", left, right)
+		},
+		heal: func(cfg *Cluster) {
+			cfg.Heal()
+		},
+	},
+	{
+		name: "pause",
+		inject: func(cfg *Cluster) string {
+			i := cfg.rand.Intn(cfg.n)
+			cfg.Pause(i)
+			return fmt.Sprintf("pause %v", i)
+		},
+		heal: func(cfg *Cluster) {
+			for i := 0; i < cfg.n; i++ {
+				cfg.Resume(i)
+			}
+		},
+	},
+	{
+		// a slow Persister sleeps with the peer's lock held,
+		// which a simulation can't see.
+		name: "slow-disk",
+		real: true,
+		inject: func(cfg *Cluster) string {
+			i := cfg.rand.Intn(cfg.n)
+			d := time.Duration(5+cfg.rand.Intn(45)) * time.Millisecond
+			cfg.mu.Lock()
+			cfg.saved[i].SetWriteDelay(d)
+			cfg.mu.Unlock()
+			return fmt.Sprintf("slow-disk %v %v", i, d)
+		},
+		heal: func(cfg *Cluster) {
+			cfg.mu.Lock()
+			defer cfg.mu.Unlock()
+			for i := 0; i < cfg.n; i++ {
+				if cfg.saved[i] != nil {
+					cfg.saved[i].SetWriteDelay(0)
+				}
+			}
+		},
+	},
+	{
+		name:     "drop-rate",
+		replaces: true,
+		inject: func(cfg *Cluster) string {
+			drop := float64(5+cfg.rand.Intn(26)) / 100
+			cfg.SetFaults(labrpc.FaultModel{Drop: drop, Latency: labrpc.Uniform{Max: 27 * time.Millisecond}})
+			return fmt.Sprintf("drop-rate %.2f", drop)
+		},
+		heal: func(cfg *Cluster) {
+			cfg.SetFaults(labrpc.FaultModel{})
+		},
+	},
+}
@@ -0,0 +1,368 @@
+package raftsim
+
+//
+// the soak test: clients run a small key/value store on the
+// cluster while the nemeses (nemesis.go) come and go, for as long
+// as the test asks.
+//
+// cfg.Soak(30 * time.Minute)
+//
+// every soakEpoch everything is healed and the clients move on
+// to new keys; the old keys' history is then checked for
+// linearizability, and each peer snapshots. the invariant checker (invariants.go) runs
+// throughout. a line of progress is printed every so often.
+//
+// the test stops at the first violation. the seed, every fault
+// injected and healed, and for a history that isn't linearizable
+// a page showing why, are in a directory the test names as it
+// starts; the event log is written as things happen, so it's
+// there even if the test dies.
+//
+
+import (
+	"fmt"
+	"mitraft/labgob"
+	"mitraft/lincheck"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	soakEpoch   = 20 * time.Second
+	soakStep    = 700 * time.Millisecond // between faults
+	soakSettle  = 2 * time.Second        // for an epoch's last operations
+	soakClients = 4
+	soakKeys    = 3 // per epoch
+	soakFaults  = 3 // at most at once
+)
+
+// the store's commands.
+type soakOp struct {
+	Client int
+	Seq    int
+	Input  lincheck.KvInput
+}
+
+// what the store did with a command.
+type soakResult struct {
+	op    soakOp
+	value string // what a Get read
+}
+
+type soaker struct {
+	cfg     *Cluster
+	budget  time.Duration
+	t0      time.Time
+	dir     string
+	events  *os.File
+	history *lincheck.History
+	epoch   int32
+	stop    int32
+
+	mu      sync.Mutex
+	applied int                // how far the store has got through the log
+	kv      map[string]string  // the store
+	results map[int]soakResult // for operations whose clients haven't looked yet
+	nops    int                // operations the clients started
+	ndone   int                // and saw committed
+	nfaults int
+	active  map[string][]string // nemesis name -> the faults it has injected
+}
+
+func (cfg *Cluster) Soak(budget time.Duration) {
+	labgob.Register(soakOp{})
+	cfg.limit = budget + 2*time.Minute
+
+	s := &soaker{
+		cfg:     cfg,
+		budget:  budget,
+		t0:      cfg.clock.Now(),
+		history: lincheck.NewHistory(),
+		kv:      map[string]string{},
+		results: map[int]soakResult{},
+		active:  map[string][]string{},
+	}
+	dir, err := os.MkdirTemp("", "raft-soak-")
+	if err != nil {
+		cfg.t.Fatalf("soak: %v", err)
+	}
+	s.dir = dir
+	s.events, err = os.Create(filepath.Join(dir, "events.log"))
+	if err != nil {
+		cfg.t.Fatalf("soak: %v", err)
+	}
+	defer s.events.Close()
+	rerun := fmt.Sprintf("-seed=%v", cfg.seed)
+	if cfg.sim != nil {
+		rerun = fmt.Sprintf("RAFT_SIM=%v", cfg.seed)
+	}
+	fmt.Fprintf(s.events, "soak for %v; seed %v (%v replays it)\n", budget, cfg.seed, rerun)
+	fmt.Printf("  soak: seed %v, events in %v\n", cfg.seed, dir)
+
+	clients := cfg.Group()
+	for c := 0; c < soakClients; c++ {
+		c := c
+		clients.Go(func() { s.client(c) })
+	}
+
+	report := budget / 10
+	if report > time.Minute {
+		report = time.Minute
+	}
+	nextReport := report
+	for s.elapsed() < budget {
+		epoch := int(atomic.LoadInt32(&s.epoch))
+		end := s.elapsed() + soakEpoch
+		for s.elapsed() < end && s.elapsed() < budget {
+			s.step()
+			// often enough that faults pile up, but not so often
+			// that the cluster never gets anything done.
+			cfg.clock.Sleep(soakStep)
+			s.checkInvariants()
+			if s.elapsed() >= nextReport {
+				s.report()
+				nextReport = s.elapsed() + report
+			}
+		}
+
+		s.healAll()
+		atomic.AddInt32(&s.epoch, 1)
+		// let the epoch's last operations finish.
+		cfg.clock.Sleep(soakSettle)
+		s.checkInvariants()
+		s.checkEpoch(epoch)
+
+		// otherwise each peer persists its whole log on every
+		// append, which gets slow.
+		for i := 0; i < cfg.n; i++ {
+			if index, err := cfg.Snapshot(i); err == nil {
+				s.event("snapshot %v at %v", i, index)
+			}
+		}
+	}
+
+	atomic.StoreInt32(&s.stop, 1)
+	clients.Wait()
+	s.report()
+
+	s.mu.Lock()
+	ndone := s.ndone
+	s.mu.Unlock()
+	if ndone == 0 {
+		s.fail("no client operation completed")
+	}
+	os.RemoveAll(dir)
+}
+
+func (s *soaker) elapsed() time.Duration {
+	return s.cfg.clock.Since(s.t0)
+}
+
+// note an event in the log.
+func (s *soaker) event(format string, a ...interface{}) {
+	fmt.Fprintf(s.events, "%10v  %v\n", s.elapsed().Round(time.Millisecond), fmt.Sprintf(format, a...))
+}
+
+func (s *soaker) fail(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	s.event("violation: %v", msg)
+	s.cfg.t.Fatalf("soak: %v\n  seed %v; events in %v", msg, s.cfg.seed, s.dir)
+}
+
+// inject a fault, or heal one kind.
+func (s *soaker) step() {
+	var kinds []nemesis
+	for _, n := range nemeses {
+		if !n.real || s.cfg.sim == nil {
+			kinds = append(kinds, n)
+		}
+	}
+
+	s.mu.Lock()
+	nactive := 0
+	var healable []string
+	for name, faults := range s.active {
+		nactive += len(faults)
+		healable = append(healable, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(healable) // map order isn't the seed's
+
+	if nactive < soakFaults && (nactive == 0 || s.cfg.rand.Intn(100) < 60) {
+		n := kinds[s.cfg.rand.Intn(len(kinds))]
+		what := n.inject(s.cfg)
+		s.event("inject %v", what)
+		s.mu.Lock()
+		if n.replaces {
+			delete(s.active, n.name)
+		}
+		s.active[n.name] = append(s.active[n.name], what)
+		s.nfaults++
+		s.mu.Unlock()
+		return
+	}
+
+	name := healable[s.cfg.rand.Intn(len(healable))]
+	for _, n := range kinds {
+		if n.name == name {
+			n.heal(s.cfg)
+		}
+	}
+	s.event("heal %v", name)
+	s.mu.Lock()
+	delete(s.active, name)
+	s.mu.Unlock()
+}
+
+func (s *soaker) healAll() {
+	for _, n := range nemeses {
+		if !n.real || s.cfg.sim == nil {
+			n.heal(s.cfg)
+		}
+	}
+	s.event("heal all")
+	s.mu.Lock()
+	s.active = map[string][]string{}
+	s.mu.Unlock()
+}
+
+func (s *soaker) checkInvariants() {
+	s.cfg.mu.Lock()
+	v := s.cfg.invariants.violation
+	s.cfg.mu.Unlock()
+	if v != "" {
+		s.fail("safety violation: %v", v)
+	}
+}
+
+// check the history of epoch's keys.
+func (s *soaker) checkEpoch(epoch int) {
+	prefix := fmt.Sprintf("e%v.", epoch)
+	var ops []lincheck.Operation
+	for _, op := range s.history.Operations() {
+		if strings.HasPrefix(op.Input.(lincheck.KvInput).Key, prefix) {
+			ops = append(ops, op)
+		}
+	}
+
+	res, info := lincheck.Check(lincheck.KvModel, ops, time.Minute)
+	s.event("epoch %v: %v operations, %v", epoch, len(ops), res)
+	if res == lincheck.Illegal {
+		name := filepath.Join(s.dir, fmt.Sprintf("epoch-%v.html", epoch))
+		if f, err := os.Create(name); err == nil {
+			info.WriteHTML(f)
+			f.Close()
+		}
+		s.fail("epoch %v's history is not linearizable; see %v", epoch, name)
+	}
+}
+
+func (s *soaker) report() {
+	s.mu.Lock()
+	var now []string
+	for _, faults := range s.active {
+		now = append(now, faults...)
+	}
+	sort.Strings(now)
+	line := fmt.Sprintf("  soak %v/%v: epoch %v, %v ops (%v committed), %v faults",
+		s.elapsed().Round(time.Second), s.budget, atomic.LoadInt32(&s.epoch), s.nops, s.ndone, s.nfaults)
+	s.mu.Unlock()
+	if len(now) > 0 {
+		line += "; now " + strings.Join(now, ", ")
+	}
+	fmt.Println(line)
+}
+
+// one client of the store: it starts an operation at one
+// server that thinks it's leader, and waits a while for it to
+// commit. it never retries, so nothing is applied twice; an
+// operation it gives up on may yet take effect, which the
+// checker allows for.
+func (s *soaker) client(c int) {
+	cfg := s.cfg
+	for seq := 0; atomic.LoadInt32(&s.stop) == 0; seq++ {
+		in := lincheck.KvInput{
+			Key:   fmt.Sprintf("e%v.%v", atomic.LoadInt32(&s.epoch), cfg.rand.Intn(soakKeys)),
+			Value: fmt.Sprintf("%v.%v ", c, seq),
+		}
+		in.Op = []string{"Get", "Put", "Append"}[cfg.rand.Intn(3)]
+		op := soakOp{c, seq, in}
+
+		p := s.history.Invoke(c, in)
+		index, ok := s.start(op)
+		s.mu.Lock()
+		s.nops++
+		s.mu.Unlock()
+		if !ok {
+			cfg.clock.Sleep(time.Duration(79+c*17) * time.Millisecond)
+			continue
+		}
+		for _, to := range []int{10, 20, 50, 100, 200, 500, 1000} {
+			if v, committed, mine := s.result(index, op); committed {
+				if mine {
+					p.Return(lincheck.KvOutput{Value: v})
+				}
+				break
+			}
+			cfg.clock.Sleep(time.Duration(to) * time.Millisecond)
+		}
+	}
+}
+
+// Start op at the first server that takes it.
+func (s *soaker) start(op soakOp) (int, bool) {
+	for i := 0; i < s.cfg.n; i++ {
+		s.cfg.mu.Lock()
+		rf := s.cfg.rafts[i]
+		s.cfg.mu.Unlock()
+		if rf != nil {
+			if index, _, ok := rf.Start(op); ok {
+				return index, true
+			}
+		}
+	}
+	return -1, false
+}
+
+// whether index has committed, and if it's op, what op read.
+func (s *soaker) result(index int, op soakOp) (string, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// apply what has committed since last time.
+	for {
+		n, cmd := s.cfg.NCommitted(s.applied + 1)
+		if n == 0 {
+			break
+		}
+		s.applied++
+		if o, ok := cmd.(soakOp); ok {
+			r := soakResult{op: o}
+			switch o.Input.Op {
+			case "Get":
+				r.value = s.kv[o.Input.Key]
+			case "Put":
+				s.kv[o.Input.Key] = o.Input.Value
+			case "Append":
+				s.kv[o.Input.Key] += o.Input.Value
+			}
+			s.results[s.applied] = r
+		}
+	}
+
+	if index > s.applied {
+		return "", false, false
+	}
+	r, ok := s.results[index]
+	delete(s.results, index)
+	if !ok || r.op != op {
+		return "", true, false
+	}
+	s.ndone++
+	return r.value, true, true
+}
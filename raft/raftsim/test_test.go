@@ -0,0 +1,464 @@
+package raftsim
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"mitraft/labgob"
+	"mitraft/raft"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fixes the random choices of every test (see testSeed).
+var _ = flag.Int64("seed", 0, "seed for random choices; 0 picks one")
+
+// the online checker, on made-up states that break each property.
+func TestInvariants(t *testing.T) {
+	entries := func(terms ...int) []raft.LogEntry {
+		log := []raft.LogEntry{}
+		for i, term := range terms {
+			log = append(log, raft.LogEntry{Term: term, Command: 100 + i, Index: i + 1})
+		}
+		return log
+	}
+	sample := func(rf *raft.Raft, me int, role string, term, commit int, log []raft.LogEntry) peerSample {
+		st := raft.Status{Me: me, Role: role, Term: term, CommitIndex: commit, FirstLogIndex: 1, LastLogIndex: len(log)}
+		return peerSample{rf, st, log}
+	}
+	// entries whose commands == can't compare.
+	slices := func(cmds ...[]int) []raft.LogEntry {
+		log := []raft.LogEntry{}
+		for i, cmd := range cmds {
+			log = append(log, raft.LogEntry{Term: 1, Command: cmd, Index: i + 1})
+		}
+		return log
+	}
+	r0, r1, r2 := &raft.Raft{}, &raft.Raft{}, &raft.Raft{}
+	const leader, follower = raft.Leader, raft.Follower
+
+	fmt.Printf("Test: online invariant checker ...\n")
+
+	// a healthy history, then each kind of violation.
+	cases := []struct {
+		name    string
+		rounds  [][]peerSample
+		wantErr string
+	}{
+		{"ok", [][]peerSample{
+			{sample(r0, 0, leader, 1, 1, entries(1, 1)), sample(r1, 1, follower, 1, 1, entries(1))},
+			{sample(r0, 0, follower, 2, 2, entries(1, 1)), sample(r1, 1, leader, 2, 2, entries(1, 1, 2))},
+		}, ""},
+		{"two leaders", [][]peerSample{
+			{sample(r0, 0, leader, 3, 0, entries())},
+			{sample(r1, 1, leader, 3, 0, entries())},
+		}, "both leader in term 3"},
+		{"log matching", [][]peerSample{
+			{sample(r0, 0, follower, 3, 0, entries(1, 2, 3)), sample(r1, 1, follower, 3, 0, entries(1, 1, 3))},
+		}, "not the same log"},
+		{"leader completeness", [][]peerSample{
+			{sample(r0, 0, follower, 2, 2, entries(1, 2)), sample(r1, 1, leader, 3, 0, entries(1))},
+		}, "lacks index 2"},
+		{"term backwards", [][]peerSample{
+			{sample(r2, 2, follower, 4, 0, entries())},
+			{sample(r2, 2, follower, 3, 0, entries())},
+		}, "term went from 4 back to 3"},
+		{"slice commands", [][]peerSample{
+			{sample(r0, 0, leader, 1, 2, slices([]int{1}, []int{2})), sample(r1, 1, follower, 1, 2, slices([]int{1}, []int{2}))},
+		}, ""},
+		{"slice commands differ", [][]peerSample{
+			{sample(r0, 0, follower, 1, 0, slices([]int{1}, []int{2})), sample(r1, 1, follower, 1, 0, slices([]int{3}, []int{2}))},
+		}, "not the same log"},
+		{"commit backwards", [][]peerSample{
+			{sample(r2, 2, follower, 1, 2, entries(1, 1))},
+			{sample(r2, 2, follower, 1, 1, entries(1, 1))},
+		}, "commitIndex went from 2 back to 1"},
+	}
+	for _, c := range cases {
+		ic := makeInvariantChecker()
+		v := ""
+		for _, samples := range c.rounds {
+			if v = ic.check(samples); v != "" {
+				break
+			}
+		}
+		if c.wantErr == "" && v != "" {
+			t.Fatalf("%v: unexpected violation: %v", c.name, v)
+		}
+		if !strings.Contains(v, c.wantErr) {
+			t.Fatalf("%v: expected a violation containing %q, got %q", c.name, c.wantErr, v)
+		}
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a service that adds up the commands, and checks that it's
+// given each index once, in order.
+type summer struct {
+	mu   sync.Mutex
+	sum  int
+	last int    // the last index applied
+	err  string // the first thing that went wrong
+}
+
+func (s *summer) Apply(index int, command interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index != s.last+1 && s.err == "" {
+		s.err = fmt.Sprintf("applied %v after %v", index, s.last)
+	}
+	s.sum += command.(int)
+	s.last = index
+}
+
+func (s *summer) Snapshot() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(s.sum)
+	e.Encode(s.last)
+	return w.Bytes()
+}
+
+func (s *summer) Restore(snapshot []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := labgob.NewDecoder(bytes.NewBuffer(snapshot))
+	var sum, last int
+	if d.Decode(&sum) != nil || d.Decode(&last) != nil {
+		s.err = "bad snapshot"
+	}
+	s.sum, s.last = sum, last
+}
+
+func (s *summer) state() (int, int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sum, s.last, s.err
+}
+
+func TestStateMachine(t *testing.T) {
+	servers := 3
+	machines := make([]*summer, servers) // each server's latest
+	cfg := MakeCluster(t, servers, Options{
+		StateMachine: func(i int) StateMachine {
+			machines[i] = &summer{}
+			return machines[i]
+		},
+	})
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test: a service's state machine, snapshotted and restored")
+
+	// every server's machine should have applied up to index,
+	// and hold the sum of the commands committed there.
+	check := func(index int) {
+		want := 0
+		for j := 1; j <= index; j++ {
+			_, cmd := cfg.NCommitted(j)
+			want += cmd.(int)
+		}
+		for i := 0; i < servers; i++ {
+			sum, last, err := machines[i].state()
+			if err != "" {
+				t.Fatalf("server %v: %v", i, err)
+			}
+			if last != index || sum != want {
+				t.Fatalf("server %v's machine has %v at %v; expected %v at %v", i, sum, last, want, index)
+			}
+		}
+	}
+
+	for i := 1; i < 10; i++ {
+		cfg.One(i, servers, true)
+	}
+	check(cfg.One(10, servers, true))
+
+	// a follower misses some commands, which the others then
+	// snapshot, so it must catch up from a snapshot.
+	follower := (cfg.CheckOneLeader() + 1) % servers
+	cfg.Disconnect(follower)
+	index := 0
+	for i := 11; i <= 20; i++ {
+		index = cfg.One(i, servers-1, true)
+	}
+	for i := 0; i < servers; i++ {
+		if i != follower {
+			if at, err := cfg.Snapshot(i); err != nil || at != index {
+				t.Fatalf("Snapshot(%v) = %v, %v; expected %v", i, at, err, index)
+			}
+		}
+	}
+	cfg.Connect(follower)
+	check(cfg.One(21, servers, true))
+
+	// each restarts from its own snapshot.
+	for i := 0; i < servers; i++ {
+		cfg.Crash(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.Start(i)
+		cfg.Connect(i)
+	}
+	check(cfg.One(22, servers, true))
+
+	cfg.End()
+}
+
+// every short schedule is safe: long enough to commit a request,
+// or shorter with a crash and a lost and a duplicated message.
+func TestModelCheck(t *testing.T) {
+	fmt.Printf("Test: bounded model check of a 3-server cluster ...\n")
+
+	for _, opts := range []ModelOptions{
+		{Depth: 7, Commands: 1},
+		{Depth: 5, Commands: 1, Crashes: 1, Drops: 1, Duplicates: 1},
+	} {
+		res := ModelCheck(opts)
+		if res.Violation != "" {
+			t.Fatalf("%v after %v\n%s", res.Violation, strings.Join(res.Schedule, ", "), res.Trace)
+		}
+		if !res.Complete {
+			t.Fatalf("%+v: didn't cover every schedule", opts)
+		}
+		fmt.Printf("  ... depth %v: %v states, %v schedules\n", opts.Depth, res.States, res.Schedules)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a server that grants every vote lets two candidates lead in
+// one term; the checker should find the shortest way there, and
+// its trace should replay to the same violation.
+func TestModelCheckFindsViolation(t *testing.T) {
+	fmt.Printf("Test: model checker finds an unsafe vote ...\n")
+
+	opts := ModelOptions{Depth: 8, Corrupt: func(server int, svcMeth string, args, reply interface{}) {
+		if r, ok := reply.(*raft.RequestVoteReply); ok {
+			r.VoteGranted = true
+		}
+	}}
+	res := ModelCheck(opts)
+	if !strings.Contains(res.Violation, "both leader in term 1") {
+		t.Fatalf("expected two leaders in term 1, got %q", res.Violation)
+	}
+	// two timeouts, and a request and a reply to each candidate.
+	if len(res.Schedule) != 6 {
+		t.Fatalf("expected a schedule of 6 steps, got %v", strings.Join(res.Schedule, ", "))
+	}
+
+	events, err := raft.ReadEvents(bytes.NewReader(res.Trace))
+	if err != nil {
+		t.Fatalf("reading the trace: %v", err)
+	}
+	steps := 0
+	for _, e := range events {
+		if e.Kind == raft.EventStep {
+			steps++
+		}
+	}
+	if steps != len(res.Schedule) {
+		t.Fatalf("trace has %v steps, expected %v", steps, len(res.Schedule))
+	}
+	v, err := ReplayTrace(opts, events)
+	if err != nil || v != res.Violation {
+		t.Fatalf("replay gave %q, %v; expected %q", v, err, res.Violation)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// commands of types == can't compare, as services' often are.
+type uncomparable struct {
+	Key    string
+	Values []int
+	Groups map[int][]string
+}
+
+func TestUncomparableCommands(t *testing.T) {
+	labgob.Register([]int{})
+	labgob.Register(uncomparable{})
+	servers := 3
+	cfg := MakeCluster(t, servers, Options{})
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test: commands that == can't compare")
+
+	cfg.One([]int{1}, servers, true)
+	cfg.One(uncomparable{"a", []int{1, 2}, map[int][]string{1: {"x", "y"}}}, servers, true)
+
+	// a restarted follower catches up on them.
+	follower := (cfg.CheckOneLeader() + 1) % servers
+	cfg.Crash(follower)
+	cfg.One([]int{2, 3}, servers-1, true)
+	cfg.Start(follower)
+	cfg.Connect(follower)
+	cfg.One(uncomparable{"b", []int{3}, map[int][]string{2: {"z"}}}, servers, true)
+
+	cfg.End()
+}
+
+// a service whose commands, like shardctrler's, hold maps and
+// slices: each sets a group's servers and a config's shards.
+type groupsOp struct {
+	Gid     int
+	Servers []string
+	Shards  map[int]int // shard -> gid
+}
+
+type groupsMachine struct {
+	mu     sync.Mutex
+	groups map[int][]string
+	shards map[int]int
+	last   int
+}
+
+func makeGroupsMachine() *groupsMachine {
+	return &groupsMachine{groups: map[int][]string{}, shards: map[int]int{}}
+}
+
+func (g *groupsMachine) Apply(index int, command interface{}) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	op := command.(groupsOp)
+	g.groups[op.Gid] = append([]string{}, op.Servers...)
+	for shard, gid := range op.Shards {
+		g.shards[shard] = gid
+	}
+	g.last = index
+}
+
+func (g *groupsMachine) Snapshot() []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	w := new(bytes.Buffer)
+	e := labgob.NewEncoder(w)
+	e.Encode(g.groups)
+	e.Encode(g.shards)
+	e.Encode(g.last)
+	return w.Bytes()
+}
+
+func (g *groupsMachine) Restore(snapshot []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	d := labgob.NewDecoder(bytes.NewBuffer(snapshot))
+	groups, shards, last := map[int][]string{}, map[int]int{}, 0
+	if d.Decode(&groups) != nil || d.Decode(&shards) != nil || d.Decode(&last) != nil {
+		panic("bad snapshot")
+	}
+	g.groups, g.shards, g.last = groups, shards, last
+}
+
+func (g *groupsMachine) state() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return fmt.Sprintf("%v %v %v", g.last, g.groups, g.shards)
+}
+
+func TestStateMachineUncomparable(t *testing.T) {
+	labgob.Register(groupsOp{})
+	servers := 3
+	machines := make([]*groupsMachine, servers)
+	cfg := MakeCluster(t, servers, Options{
+		StateMachine: func(i int) StateMachine {
+			machines[i] = makeGroupsMachine()
+			return machines[i]
+		},
+	})
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test: a state machine whose commands hold maps and slices")
+
+	op := func(i int) groupsOp {
+		return groupsOp{Gid: i % 3, Servers: []string{fmt.Sprintf("s%v", i)}, Shards: map[int]int{i % 10: i % 3}}
+	}
+	// every server's machine should be in the same state.
+	check := func() {
+		for i := 1; i < servers; i++ {
+			if a, b := machines[0].state(), machines[i].state(); a != b {
+				t.Fatalf("servers 0 and %v differ: %v, %v", i, a, b)
+			}
+		}
+	}
+
+	for i := 1; i <= 5; i++ {
+		cfg.One(op(i), servers, true)
+	}
+	check()
+
+	// a follower catches up from a snapshot of them.
+	follower := (cfg.CheckOneLeader() + 1) % servers
+	cfg.Disconnect(follower)
+	for i := 6; i <= 10; i++ {
+		cfg.One(op(i), servers-1, true)
+	}
+	for i := 0; i < servers; i++ {
+		if i != follower {
+			if _, err := cfg.Snapshot(i); err != nil {
+				t.Fatalf("Snapshot(%v): %v", i, err)
+			}
+		}
+	}
+	cfg.Connect(follower)
+	cfg.One(op(11), servers, true)
+	check()
+
+	cfg.End()
+}
+
+// a seeded simulation should replay exactly: the same events, in
+// the same order, at the same simulated times.
+func TestSimReplay(t *testing.T) {
+	dir := t.TempDir()
+	trace := func(run int) []byte {
+		name := fmt.Sprintf("run%v", run)
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("RAFT_SIM", "7")
+			t.Setenv("RAFT_EVENTS", dir)
+			servers := 3
+			cfg := MakeCluster(t, servers, Options{})
+			defer cfg.Cleanup()
+
+			cfg.Begin("Test: a simulated run replays exactly")
+			for i := 1; i <= 3; i++ {
+				cfg.One(i, servers, true)
+			}
+			leader := cfg.CheckOneLeader()
+			cfg.Crash(leader)
+			cfg.One(4, servers-1, true)
+			cfg.Start(leader)
+			cfg.Connect(leader)
+			follower := (cfg.CheckOneLeader() + 1) % servers
+			cfg.Disconnect(follower)
+			cfg.One(5, servers-1, true)
+			cfg.Connect(follower)
+			cfg.One(6, servers, true)
+			cfg.End()
+		})
+		b, err := os.ReadFile(filepath.Join(dir, "TestSimReplay_"+name+".jsonl"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return b
+	}
+
+	a, b := trace(0), trace(1)
+	if len(a) == 0 {
+		t.Fatalf("no events recorded")
+	}
+	if !bytes.Equal(a, b) {
+		la, lb := strings.Split(string(a), "\n"), strings.Split(string(b), "\n")
+		for i := 0; i < len(la) && i < len(lb); i++ {
+			if la[i] != lb[i] {
+				t.Fatalf("the runs differ at event %v:\n  %v\n  %v", i+1, la[i], lb[i])
+			}
+		}
+		t.Fatalf("one run has %v events, the other %v", len(la), len(lb))
+	}
+}
@@ -0,0 +1,170 @@
+package raft
+
+//
+// log compaction.
+//
+// rf.Snapshot(index, snapshot) -- the service has saved its state
+//   through index in snapshot, so Raft may discard that part of its log.
+//
+// rf.log[0] is always a sentinel standing for the last entry in the
+// snapshot: its Index and Term are those of the last compacted entry
+// (0 and 0 before any compaction), and log index i lives at
+// rf.log[i-rf.baseIndex()]. a follower too far behind to be sent
+// entries gets the leader's snapshot by InstallSnapshot instead, and
+// passes it to the service as an ApplyMsg with SnapshotValid set.
+//
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrCompacted  = errors.New("raft: entries compacted into the snapshot")
+	ErrNotApplied = errors.New("raft: snapshot index not yet applied")
+)
+
+// index of the last entry compacted away.
+func (rf *Raft) baseIndex() int {
+	return rf.log[0].Index
+}
+
+func (rf *Raft) lastIndex() int {
+	return rf.log[len(rf.log)-1].Index
+}
+
+func (rf *Raft) lastTerm() int {
+	return rf.log[len(rf.log)-1].Term
+}
+
+// the entry at index, which must be in [baseIndex(), lastIndex()].
+func (rf *Raft) entry(index int) LogEntry {
+	return rf.log[index-rf.baseIndex()]
+}
+
+// save Raft state and the snapshot together.
+func (rf *Raft) persistWithSnapshot() {
+	rf.persister.SaveStateAndSnapshot(rf.raftState(), rf.snapshot)
+}
+
+// Snapshot tells Raft that the service's snapshot covers every
+// entry through index, so it can drop them from its log. index
+// must already have been applied, else Snapshot returns
+// ErrNotApplied; an index already compacted away is ignored.
+func (rf *Raft) Snapshot(index int, snapshot []byte) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if index > rf.lastApplied {
+		rf.logf(LevelWarn, "snapshot ahead of applied entries", "index", index, "lastApplied", rf.lastApplied)
+		return ErrNotApplied
+	}
+	if index <= rf.baseIndex() {
+		return nil
+	}
+	rf.compact(index, rf.entry(index).Term)
+	rf.snapshot = snapshot
+	rf.persistWithSnapshot()
+	rf.logf(LevelInfo, "log compacted", "through", index, "entries", len(rf.log)-1)
+	return nil
+}
+
+// drop entries through index, whose term is term, keeping any
+// that follow it. caller must hold rf.mu.
+func (rf *Raft) compact(index int, term int) {
+	rest := []LogEntry{}
+	if index < rf.lastIndex() && index >= rf.baseIndex() && rf.entry(index).Term == term {
+		rest = rf.log[index-rf.baseIndex()+1:]
+	}
+	log := make([]LogEntry, 0, len(rest)+1)
+	log = append(log, LogEntry{Index: index, Term: term})
+	rf.log = append(log, rest...)
+}
+
+type InstallSnapshotArgs struct {
+	Term              int
+	LeaderId          int
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Data              []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.notify(func(o Observer) { o.RPCReceived(rf.me, args.LeaderId, "Raft.InstallSnapshot", args) })
+
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return
+	}
+	rf.electionResetEvent = rf.clock.Now()
+	if args.Term > rf.currentTerm {
+		rf.setTerm(args.Term)
+		rf.votedFor = -1
+		rf.persist()
+	}
+	rf.setRole(Follower)
+	rf.leaderId = args.LeaderId
+	reply.Term = rf.currentTerm
+
+	if args.LastIncludedIndex <= rf.commitIndex {
+		// we already have all of it.
+		return
+	}
+
+	rf.logf(LevelInfo, "installing snapshot", "from", args.LeaderId,
+		"lastIncludedIndex", args.LastIncludedIndex, "lastIncludedTerm", args.LastIncludedTerm)
+	rf.compact(args.LastIncludedIndex, args.LastIncludedTerm)
+	rf.snapshot = args.Data
+	rf.snapshotPending = true
+	rf.setCommitIndex(args.LastIncludedIndex)
+	rf.persistWithSnapshot()
+
+	rf.clock.Go(rf.ApplyLog)
+}
+
+// caller must hold rf.mu.
+func (rf *Raft) installSnapshotArgs() InstallSnapshotArgs {
+	return InstallSnapshotArgs{
+		Term:              rf.currentTerm,
+		LeaderId:          rf.me,
+		LastIncludedIndex: rf.baseIndex(),
+		LastIncludedTerm:  rf.log[0].Term,
+		Data:              rf.snapshot,
+	}
+}
+
+func (rf *Raft) sendInstallSnapshot(ctx context.Context, server int, args *InstallSnapshotArgs) {
+	var reply InstallSnapshotReply
+	rf.notify(func(o Observer) { o.RPCSent(rf.me, server, "Raft.InstallSnapshot", args) })
+	if err := rf.transport.Call(ctx, server, "Raft.InstallSnapshot", args, &reply); err != nil {
+		rf.callFailed(server, "Raft.InstallSnapshot", err)
+		return
+	}
+	rf.notify(func(o Observer) { o.RPCReplied(rf.me, server, "Raft.InstallSnapshot", args, &reply) })
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.state != Leader || args.Term != rf.currentTerm {
+		return
+	}
+	rf.lastContact[server] = rf.clock.Now()
+	if reply.Term > rf.currentTerm {
+		rf.setTerm(reply.Term)
+		rf.setRole(Follower)
+		rf.votedFor = -1
+		rf.persist()
+		rf.electionResetEvent = rf.clock.Now()
+		return
+	}
+	if args.LastIncludedIndex > rf.matchIndex[server] {
+		rf.matchIndex[server] = args.LastIncludedIndex
+	}
+	rf.nextIndex[server] = rf.matchIndex[server] + 1
+}
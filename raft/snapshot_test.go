@@ -0,0 +1,48 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// a service that snapshots from its apply loop, reading an
+// unbuffered applyCh, must not deadlock with ApplyLog.
+func TestSnapshotFromApplyLoop(t *testing.T) {
+	applyCh := make(chan ApplyMsg)
+	rf, fc := makeFuzzRaft(MakePersister(), applyCh)
+	rf.AppendEntries(&AppendEntriesArgs{Term: 1, LeaderId: 1,
+		Entries: []LogEntry{{1, 101, 1}, {1, 102, 2}, {1, 103, 3}}, LeaderCommit: 3}, &AppendEntriesReply{})
+	go fc.run()
+
+	done := make(chan error)
+	go func() {
+		for i := 1; i <= 3; i++ {
+			m := <-applyCh
+			if !m.CommandValid || m.CommandIndex != i {
+				done <- errors.New("applied out of order")
+				return
+			}
+			if err := rf.Snapshot(m.CommandIndex, []byte{byte(i)}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Snapshot() from the apply loop deadlocked")
+	}
+
+	if err := rf.Snapshot(4, nil); !errors.Is(err, ErrNotApplied) {
+		t.Fatalf("Snapshot() of an unapplied index returned %v, expected %v", err, ErrNotApplied)
+	}
+	if err := rf.Snapshot(2, nil); err != nil {
+		t.Fatalf("Snapshot() of a compacted index returned %v", err)
+	}
+}
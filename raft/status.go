@@ -0,0 +1,133 @@
+package raft
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// a consistent snapshot of one peer's state, from Status().
+type Status struct {
+	Me          int    `json:"me"`
+	Role        string `json:"role"`
+	Term        int    `json:"term"`
+	VotedFor    int    `json:"votedFor"` // -1 if none this term
+	Leader      int    `json:"leader"`   // leader of Term as far as this peer knows, or -1
+	CommitIndex int    `json:"commitIndex"`
+	LastApplied int    `json:"lastApplied"`
+
+	// the oldest and newest entries in the log. an empty log
+	// has FirstLogIndex == LastLogIndex+1; entries before
+	// FirstLogIndex are in the snapshot.
+	FirstLogIndex int `json:"firstLogIndex"`
+	FirstLogTerm  int `json:"firstLogTerm"`
+	LastLogIndex  int `json:"lastLogIndex"`
+	LastLogTerm   int `json:"lastLogTerm"`
+
+	Peers []PeerStatus `json:"peers,omitempty"` // leaders only; indexed by peer, self included
+
+	RaftStateSize int `json:"raftStateSize"` // bytes of persisted state
+	SnapshotSize  int `json:"snapshotSize"`
+}
+
+// what a leader knows about one of its followers.
+type PeerStatus struct {
+	NextIndex   int       `json:"nextIndex"`
+	MatchIndex  int       `json:"matchIndex"`
+	LastContact time.Time `json:"lastContact"` // last reply to an AppendEntries this term; zero if none
+}
+
+// Status returns a snapshot of the peer's state. it is safe to
+// call at any time from any goroutine, including after Kill().
+func (rf *Raft) Status() Status {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.statusLocked()
+}
+
+// Inspect returns Status() and a copy of the log, read at the
+// same moment, for checkers that compare peers' logs. the first
+// entry is at Status().FirstLogIndex; earlier ones are in the
+// snapshot.
+func (rf *Raft) Inspect() (Status, []LogEntry) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	entries := make([]LogEntry, len(rf.log)-1)
+	copy(entries, rf.log[1:])
+	return rf.statusLocked(), entries
+}
+
+func (rf *Raft) statusLocked() Status {
+	st := Status{
+		Me:          rf.me,
+		Role:        rf.state,
+		Term:        rf.currentTerm,
+		VotedFor:    rf.votedFor,
+		Leader:      rf.leaderId,
+		CommitIndex: rf.commitIndex,
+		LastApplied: rf.lastApplied,
+	}
+
+	last := rf.log[len(rf.log)-1]
+	st.LastLogIndex, st.LastLogTerm = last.Index, last.Term
+	st.FirstLogIndex = rf.log[0].Index + 1 // log[0] is the sentinel
+	if len(rf.log) > 1 {
+		st.FirstLogTerm = rf.log[1].Term
+	}
+
+	if rf.state == Leader {
+		st.Peers = make([]PeerStatus, len(rf.peers))
+		for i := range rf.peers {
+			st.Peers[i] = PeerStatus{
+				NextIndex:   rf.nextIndex[i],
+				MatchIndex:  rf.matchIndex[i],
+				LastContact: rf.lastContact[i],
+			}
+		}
+		st.Peers[rf.me] = PeerStatus{NextIndex: last.Index + 1, MatchIndex: last.Index, LastContact: rf.clock.Now()}
+	}
+
+	st.RaftStateSize = rf.persister.RaftStateSize()
+	st.SnapshotSize = len(rf.snapshot)
+	return st
+}
+
+// Entries returns a copy of the log entries with indices in
+// [from, to], cut short at the end of the log. it fails with
+// ErrCompacted if from is already in the snapshot.
+func (rf *Raft) Entries(from, to int) ([]LogEntry, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if from <= rf.baseIndex() {
+		return nil, ErrCompacted
+	}
+	to = min(to, rf.lastIndex())
+	if to < from {
+		return []LogEntry{}, nil
+	}
+	entries := make([]LogEntry, to-from+1)
+	copy(entries, rf.log[from-rf.baseIndex():])
+	return entries, nil
+}
+
+func (st Status) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "peer %d: %s term=%d votedFor=%d leader=%d commit=%d applied=%d log=[%d(t%d)..%d(t%d)] state=%dB snapshot=%dB",
+		st.Me, st.Role, st.Term, st.VotedFor, st.Leader, st.CommitIndex, st.LastApplied,
+		st.FirstLogIndex, st.FirstLogTerm, st.LastLogIndex, st.LastLogTerm, st.RaftStateSize, st.SnapshotSize)
+	for i, p := range st.Peers {
+		if i == st.Me {
+			continue
+		}
+		contact := "never"
+		if !p.LastContact.IsZero() {
+			// the leader's own LastContact is when st was taken,
+			// by the peer's clock.
+			ago := st.Peers[st.Me].LastContact.Sub(p.LastContact)
+			contact = ago.Round(time.Millisecond).String() + " ago"
+		}
+		fmt.Fprintf(&b, "\n  peer %d: next=%d match=%d contact=%s", i, p.NextIndex, p.MatchIndex, contact)
+	}
+	return b.String()
+}
@@ -1,4 +1,4 @@
-package raft
+package raft_test
 
 //
 // Raft tests.
@@ -9,7 +9,23 @@ package raft
 //
 
 import (
-	"math/rand"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mitraft/labrpc"
+	"mitraft/prom"
+	"mitraft/raft"
+	"mitraft/raft/raftsim"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -20,94 +36,315 @@ import (
 // (much more than the paper's range of timeouts).
 const RaftElectionTimeout = 1000 * time.Millisecond
 
+func make_config(t *testing.T, n int, unreliable bool) *raftsim.Cluster {
+	return raftsim.MakeCluster(t, n, raftsim.Options{Unreliable: unreliable})
+}
+
+func randstring(n int) string {
+	b := make([]byte, 2*n)
+	crand.Read(b)
+	s := base64.URLEncoding.EncodeToString(b)
+	return s[0:n]
+}
+
+// fixes the random choices of every test (see testSeed in raftsim).
+var _ = flag.Int64("seed", 0, "seed for random choices; 0 picks one")
+
+// how long TestSoak2C runs, e.g. -soak=30m (with -timeout to match).
+var soakFlag = flag.Duration("soak", 0, "how long TestSoak2C runs; 0 means 10s")
+
+// whether TestFuzzCorpus rewrites the fuzz targets' seed corpora.
+var fuzzCorpusFlag = flag.Bool("fuzzcorpus", false, "write the fuzz targets' seed corpora from a cluster run")
+
 func TestInitialElection2A(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2A): initial election")
+	cfg.Begin("Test (2A): initial election")
 
 	// is a leader elected?
-	cfg.checkOneLeader()
+	cfg.CheckOneLeader()
 
 	// sleep a bit to avoid racing with followers learning of the
 	// election, then check that all peers agree on the term.
-	time.Sleep(50 * time.Millisecond)
-	term1 := cfg.checkTerms()
+	cfg.Clock().Sleep(50 * time.Millisecond)
+	term1 := cfg.CheckTerms()
 	if term1 < 1 {
 		t.Fatalf("term is %v, but should be at least 1", term1)
 	}
 
 	// does the leader+term stay the same if there is no network failure?
-	time.Sleep(2 * RaftElectionTimeout)
-	term2 := cfg.checkTerms()
+	cfg.Clock().Sleep(2 * RaftElectionTimeout)
+	term2 := cfg.CheckTerms()
 	if term1 != term2 {
 		//fmt.Printf("warning: term changed even though there were no failures")
 	}
 
 	// there should still be a leader.
-	cfg.checkOneLeader()
+	cfg.CheckOneLeader()
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestReElection2A(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2A): election after network failure")
+	cfg.Begin("Test (2A): election after network failure")
 
-	leader1 := cfg.checkOneLeader()
+	leader1 := cfg.CheckOneLeader()
 
 	// if the leader disconnects, a new one should be elected.
-	cfg.disconnect(leader1)
-	cfg.checkOneLeader()
+	cfg.Disconnect(leader1)
+	cfg.CheckOneLeader()
 
 	// if the old leader rejoins, that shouldn't
 	// disturb the new leader.
-	cfg.connect(leader1)
-	leader2 := cfg.checkOneLeader()
+	cfg.Connect(leader1)
+	leader2 := cfg.CheckOneLeader()
 
 	// if there's no quorum, no leader should
 	// be elected.
-	cfg.disconnect(leader2)
-	cfg.disconnect((leader2 + 1) % servers)
-	time.Sleep(2 * RaftElectionTimeout)
-	cfg.checkNoLeader()
+	cfg.Disconnect(leader2)
+	cfg.Disconnect((leader2 + 1) % servers)
+	cfg.Clock().Sleep(2 * RaftElectionTimeout)
+	cfg.CheckNoLeader()
 
 	// if a quorum arises, it should elect a leader.
-	cfg.connect((leader2 + 1) % servers)
-	cfg.checkOneLeader()
+	cfg.Connect((leader2 + 1) % servers)
+	cfg.CheckOneLeader()
 
 	// re-join of last node shouldn't prevent leader from existing.
-	cfg.connect(leader2)
-	cfg.checkOneLeader()
+	cfg.Connect(leader2)
+	cfg.CheckOneLeader()
+
+	cfg.End()
+}
+
+// peers should rarely split the vote: most first elections of
+// a healthy cluster should be won in term 1. in real time, since
+// it's how the peers' tickers interleave that splits votes.
+func TestSplitVotes2A(t *testing.T) {
+	const runs = 10
+	servers := 5
+	terms := 0
+	for run := 0; run < runs; run++ {
+		t.Run(fmt.Sprintf("run%v", run), func(t *testing.T) {
+			t.Setenv("RAFT_SIM", "")
+			cfg := make_config(t, servers, false)
+			defer cfg.Cleanup()
+			cfg.CheckOneLeader()
+			terms += cfg.CheckTerms()
+		})
+	}
+	fmt.Printf("Test (2A): split votes ...\n  ... %v first elections took %v terms\n", runs, terms)
+	if terms > runs+runs/5 {
+		t.Fatalf("%v first elections took %v terms; expected at most %v", runs, terms, runs+runs/5)
+	}
+}
 
-	cfg.end()
+// how many goroutines' stacks contain fn, e.g. "pkg.f(" for
+// calls of f but not of closures inside it.
+func goroutinesIn(fn string) int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	count := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, fn) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestAbandonRPCs2A(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2A): RPCs for an old term are abandoned")
+
+	// an isolated server stands for election again and again.
+	// RequestVotes to unreachable peers take up to 7 seconds to
+	// fail, but each new term gives up on the last one's.
+	leader := cfg.CheckOneLeader()
+	other := (leader + 1) % servers
+	cfg.Disconnect(other)
+	cfg.Clock().Sleep(4 * RaftElectionTimeout)
+	if term, _ := cfg.Raft(other).GetState(); term < 4 {
+		t.Fatalf("isolated server only reached term %v", term)
+	}
+	// there may be two terms' worth for a moment.
+	if n := goroutinesIn("raft.(*Raft).sendRequestVote("); n > 2*(servers-1) {
+		t.Fatalf("%v RequestVotes outstanding, expected at most %v", n, 2*(servers-1))
+	}
+
+	cfg.Connect(other)
+	cfg.CheckOneLeader()
+
+	// and a killed server gives up on all of them.
+	cfg.Disconnect(other)
+	cfg.Clock().Sleep(RaftElectionTimeout)
+	cfg.Crash(other)
+	cfg.Clock().Sleep(100 * time.Millisecond)
+	if n := goroutinesIn("raft.(*Raft).sendRequestVote("); n > 0 {
+		t.Fatalf("%v RequestVotes outstanding after Kill", n)
+	}
+
+	cfg.End()
+}
+
+func TestLogging2A(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2A): structured logs carry node, term and role")
+
+	leader := cfg.CheckOneLeader()
+	term, _ := cfg.Raft(leader).GetState()
+
+	recs, ok := cfg.LogRecords()
+	if !ok {
+		t.Skip("RAFT_LOG is set; logs go to stderr")
+	}
+	elected, votes := false, 0
+	for _, r := range recs {
+		if r.Node < 0 || r.Node >= servers || r.Role == "" {
+			t.Fatalf("record without node or role: %v", r)
+		}
+		switch r.Msg {
+		case "elected leader":
+			if r.Node == leader && r.Term == term && r.Role == raft.Leader && r.Level == raft.LevelInfo {
+				elected = true
+			}
+		case "vote granted":
+			if r.Term == term && r.Role == raft.Follower {
+				votes++
+			}
+		}
+	}
+	if !elected {
+		t.Fatalf("no record of %v being elected in term %v", leader, term)
+	}
+	if votes < servers/2 {
+		t.Fatalf("only %v votes logged for term %v", votes, term)
+	}
+
+	// the text form.
+	var b strings.Builder
+	lg := raft.NewTextLogger(&b, raft.LevelInfo)
+	lg.Log(raft.Record{Time: time.Now(), Level: raft.LevelInfo, Node: 2, Term: 7, Role: raft.Leader,
+		Msg: "log conflict", Attrs: []interface{}{"hint", 4}})
+	if !lg.Enabled(raft.LevelWarn) || lg.Enabled(raft.LevelDebug) {
+		t.Fatalf("wrong levels enabled")
+	}
+	if !strings.HasSuffix(b.String(), "INFO  node=2 term=7 role=Leader log conflict hint=4\n") {
+		t.Fatalf("wrong text record %q", b.String())
+	}
+
+	cfg.End()
 }
 
 func TestBasicAgree2B(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2B): basic agreement")
+	cfg.Begin("Test (2B): basic agreement")
 
 	iters := 3
 	for index := 1; index < iters+1; index++ {
-		nd, _ := cfg.nCommitted(index)
+		nd, _ := cfg.NCommitted(index)
 		if nd > 0 {
 			t.Fatalf("some have committed before Start()")
 		}
 
-		xindex := cfg.one(index*100, servers, false)
+		xindex := cfg.One(index*100, servers, false)
 		if xindex != index {
 			t.Fatalf("got index %v but expected %v", xindex, index)
 		}
 	}
 
-	cfg.end()
+	cfg.End()
+}
+
+func TestStatus2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): Status() snapshots")
+
+	// hammer Status() while the cluster elects and agrees. a
+	// simulation runs one thing at a time, so there's no point
+	// there, and a loop that never sleeps would stop its clock.
+	var stop int32
+	var wg sync.WaitGroup
+	for i := 0; i < servers && !cfg.Simulated(); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				cfg.Raft(i).Status()
+			}
+		}(i)
+	}
+
+	leader := cfg.CheckOneLeader()
+	iters := 3
+	for i := 1; i <= iters; i++ {
+		cfg.One(i*100, servers, false)
+	}
+	cfg.Clock().Sleep(RaftElectionTimeout / 5) // let the followers learn the commit
+
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	st := cfg.Raft(leader).Status()
+	term, _ := cfg.Raft(leader).GetState()
+	if st.Role != raft.Leader || st.Term != term || st.Leader != leader || st.VotedFor != leader {
+		t.Fatalf("wrong leader status %v", st)
+	}
+	if st.CommitIndex != iters || st.LastApplied != iters ||
+		st.FirstLogIndex != 1 || st.LastLogIndex != iters || st.LastLogTerm != term {
+		t.Fatalf("wrong log in leader status %v", st)
+	}
+	if st.RaftStateSize != cfg.Persister(leader).RaftStateSize() {
+		t.Fatalf("RaftStateSize %v, expected %v", st.RaftStateSize, cfg.Persister(leader).RaftStateSize())
+	}
+	if len(st.Peers) != servers {
+		t.Fatalf("leader status has %v peers, expected %v", len(st.Peers), servers)
+	}
+	for i, p := range st.Peers {
+		if p.MatchIndex != iters || p.NextIndex != iters+1 {
+			t.Fatalf("peer %v: match %v next %v, expected %v %v", i, p.MatchIndex, p.NextIndex, iters, iters+1)
+		}
+		if cfg.Clock().Since(p.LastContact) > RaftElectionTimeout {
+			t.Fatalf("peer %v: last contact %v ago", i, cfg.Clock().Since(p.LastContact))
+		}
+	}
+
+	for i := 0; i < servers; i++ {
+		if i == leader {
+			continue
+		}
+		st := cfg.Raft(i).Status()
+		if st.Role != raft.Follower || st.Leader != leader || st.Peers != nil || st.CommitIndex != iters {
+			t.Fatalf("wrong follower status %v", st)
+		}
+	}
+
+	cfg.End()
 }
 
 // check, based on counting bytes of RPCs, that
@@ -115,84 +352,84 @@ func TestBasicAgree2B(t *testing.T) {
 func TestRPCBytes2B(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2B): RPC byte count")
+	cfg.Begin("Test (2B): RPC byte count")
 
-	cfg.one(99, servers, false)
-	bytes0 := cfg.bytesTotal()
+	cfg.One(99, servers, false)
+	bytes0 := cfg.BytesTotal()
 
 	iters := 10
 	var sent int64 = 0
 	for index := 2; index < iters+2; index++ {
 		cmd := randstring(5000)
-		xindex := cfg.one(cmd, servers, false)
+		xindex := cfg.One(cmd, servers, false)
 		if xindex != index {
 			t.Fatalf("got index %v but expected %v", xindex, index)
 		}
 		sent += int64(len(cmd))
 	}
 
-	bytes1 := cfg.bytesTotal()
+	bytes1 := cfg.BytesTotal()
 	got := bytes1 - bytes0
 	expected := int64(servers) * sent
 	if got > expected+50000 {
 		t.Fatalf("too many RPC bytes; got %v, expected %v", got, expected)
 	}
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestFailAgree2B(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2B): agreement despite follower disconnection")
+	cfg.Begin("Test (2B): agreement despite follower disconnection")
 
-	cfg.one(101, servers, false)
+	cfg.One(101, servers, false)
 
 	// disconnect one follower from the network.
-	leader := cfg.checkOneLeader()
-	cfg.disconnect((leader + 1) % servers)
+	leader := cfg.CheckOneLeader()
+	cfg.Disconnect((leader + 1) % servers)
 
 	// the leader and remaining follower should be
 	// able to agree despite the disconnected follower.
-	cfg.one(102, servers-1, false)
-	cfg.one(103, servers-1, false)
-	time.Sleep(RaftElectionTimeout)
-	cfg.one(104, servers-1, false)
-	cfg.one(105, servers-1, false)
+	cfg.One(102, servers-1, false)
+	cfg.One(103, servers-1, false)
+	cfg.Clock().Sleep(RaftElectionTimeout)
+	cfg.One(104, servers-1, false)
+	cfg.One(105, servers-1, false)
 
 	// re-connect
-	cfg.connect((leader + 1) % servers)
+	cfg.Connect((leader + 1) % servers)
 
 	// the full set of servers should preserve
 	// previous agreements, and be able to agree
 	// on new commands.
-	cfg.one(106, servers, true)
-	time.Sleep(RaftElectionTimeout)
-	cfg.one(107, servers, true)
+	cfg.One(106, servers, true)
+	cfg.Clock().Sleep(RaftElectionTimeout)
+	cfg.One(107, servers, true)
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestFailNoAgree2B(t *testing.T) {
 	servers := 5
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2B): no agreement if too many followers disconnect")
+	cfg.Begin("Test (2B): no agreement if too many followers disconnect")
 
-	cfg.one(10, servers, false)
+	cfg.One(10, servers, false)
 
 	// 3 of 5 followers disconnect
-	leader := cfg.checkOneLeader()
-	cfg.disconnect((leader + 1) % servers)
-	cfg.disconnect((leader + 2) % servers)
-	cfg.disconnect((leader + 3) % servers)
+	leader := cfg.CheckOneLeader()
+	cfg.Disconnect((leader + 1) % servers)
+	cfg.Disconnect((leader + 2) % servers)
+	cfg.Disconnect((leader + 3) % servers)
 
-	index, _, ok := cfg.rafts[leader].Start(20)
+	index, _, ok := cfg.Raft(leader).Start(20)
 	if ok != true {
 		t.Fatalf("leader rejected Start()")
 	}
@@ -200,22 +437,22 @@ func TestFailNoAgree2B(t *testing.T) {
 		t.Fatalf("expected index 2, got %v", index)
 	}
 
-	time.Sleep(2 * RaftElectionTimeout)
+	cfg.Clock().Sleep(2 * RaftElectionTimeout)
 
-	n, _ := cfg.nCommitted(index)
+	n, _ := cfg.NCommitted(index)
 	if n > 0 {
 		t.Fatalf("%v committed but no majority", n)
 	}
 
 	// repair
-	cfg.connect((leader + 1) % servers)
-	cfg.connect((leader + 2) % servers)
-	cfg.connect((leader + 3) % servers)
+	cfg.Connect((leader + 1) % servers)
+	cfg.Connect((leader + 2) % servers)
+	cfg.Connect((leader + 3) % servers)
 
 	// the disconnected majority may have chosen a leader from
 	// among their own ranks, forgetting index 2.
-	leader2 := cfg.checkOneLeader()
-	index2, _, ok2 := cfg.rafts[leader2].Start(30)
+	leader2 := cfg.CheckOneLeader()
+	index2, _, ok2 := cfg.Raft(leader2).Start(30)
 	if ok2 == false {
 		t.Fatalf("leader2 rejected Start()")
 	}
@@ -223,41 +460,40 @@ func TestFailNoAgree2B(t *testing.T) {
 		t.Fatalf("unexpected index %v", index2)
 	}
 
-	cfg.one(1000, servers, true)
+	cfg.One(1000, servers, true)
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestConcurrentStarts2B(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2B): concurrent Start()s")
+	cfg.Begin("Test (2B): concurrent Start()s")
 
 	var success bool
 loop:
 	for try := 0; try < 5; try++ {
 		if try > 0 {
 			// give solution some time to settle
-			time.Sleep(3 * time.Second)
+			cfg.Clock().Sleep(3 * time.Second)
 		}
 
-		leader := cfg.checkOneLeader()
-		_, term, ok := cfg.rafts[leader].Start(1)
+		leader := cfg.CheckOneLeader()
+		_, term, ok := cfg.Raft(leader).Start(1)
 		if !ok {
 			// leader moved on really quickly
 			continue
 		}
 
 		iters := 5
-		var wg sync.WaitGroup
+		wg := cfg.Group()
 		is := make(chan int, iters)
 		for ii := 0; ii < iters; ii++ {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				i, term1, ok := cfg.rafts[leader].Start(100 + i)
+			i := ii
+			wg.Go(func() {
+				i, term1, ok := cfg.Raft(leader).Start(100 + i)
 				if term1 != term {
 					return
 				}
@@ -265,14 +501,14 @@ loop:
 					return
 				}
 				is <- i
-			}(ii)
+			})
 		}
 
 		wg.Wait()
 		close(is)
 
 		for j := 0; j < servers; j++ {
-			if t, _ := cfg.rafts[j].GetState(); t != term {
+			if t, _ := cfg.Raft(j).GetState(); t != term {
 				// term changed -- can't expect low RPC counts
 				continue loop
 			}
@@ -281,7 +517,7 @@ loop:
 		failed := false
 		cmds := []int{}
 		for index := range is {
-			cmd := cfg.wait(index, servers, term)
+			cmd := cfg.Wait(index, servers, term)
 			if ix, ok := cmd.(int); ok {
 				if ix == -1 {
 					// peers have moved on to later terms
@@ -326,134 +562,276 @@ loop:
 		t.Fatalf("term changed too often")
 	}
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestRejoin2B(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2B): rejoin of partitioned leader")
+	cfg.Begin("Test (2B): rejoin of partitioned leader")
 
-	cfg.one(101, servers, true)
+	cfg.One(101, servers, true)
 
 	// leader network failure
-	leader1 := cfg.checkOneLeader()
-	cfg.disconnect(leader1)
+	leader1 := cfg.CheckOneLeader()
+	cfg.Disconnect(leader1)
 
 	// make old leader try to agree on some entries
-	cfg.rafts[leader1].Start(102)
-	cfg.rafts[leader1].Start(103)
-	cfg.rafts[leader1].Start(104)
+	cfg.Raft(leader1).Start(102)
+	cfg.Raft(leader1).Start(103)
+	cfg.Raft(leader1).Start(104)
 
 	// new leader commits, also for index=2
-	cfg.one(103, 2, true)
+	cfg.One(103, 2, true)
 
 	// new leader network failure
-	leader2 := cfg.checkOneLeader()
-	cfg.disconnect(leader2)
+	leader2 := cfg.CheckOneLeader()
+	cfg.Disconnect(leader2)
 
 	// old leader connected again
-	cfg.connect(leader1)
+	cfg.Connect(leader1)
 
-	cfg.one(104, 2, true)
+	cfg.One(104, 2, true)
 
 	// all together now
-	cfg.connect(leader2)
+	cfg.Connect(leader2)
 
-	cfg.one(105, servers, true)
+	cfg.One(105, servers, true)
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestBackup2B(t *testing.T) {
 	servers := 5
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2B): leader backs up quickly over incorrect follower logs")
+	cfg.Begin("Test (2B): leader backs up quickly over incorrect follower logs")
 
-	cfg.one(rand.Int(), servers, true)
+	cfg.One(cfg.Rand().Int(), servers, true)
 
 	// put leader and one follower in a partition
-	leader1 := cfg.checkOneLeader()
-	cfg.disconnect((leader1 + 2) % servers)
-	cfg.disconnect((leader1 + 3) % servers)
-	cfg.disconnect((leader1 + 4) % servers)
+	leader1 := cfg.CheckOneLeader()
+	cfg.Disconnect((leader1 + 2) % servers)
+	cfg.Disconnect((leader1 + 3) % servers)
+	cfg.Disconnect((leader1 + 4) % servers)
 
 	// submit lots of commands that won't commit
 	for i := 0; i < 50; i++ {
-		cfg.rafts[leader1].Start(rand.Int())
+		cfg.Raft(leader1).Start(cfg.Rand().Int())
 	}
 
-	time.Sleep(RaftElectionTimeout / 2)
+	cfg.Clock().Sleep(RaftElectionTimeout / 2)
 
-	cfg.disconnect((leader1 + 0) % servers)
-	cfg.disconnect((leader1 + 1) % servers)
+	cfg.Disconnect((leader1 + 0) % servers)
+	cfg.Disconnect((leader1 + 1) % servers)
 
 	// allow other partition to recover
-	cfg.connect((leader1 + 2) % servers)
-	cfg.connect((leader1 + 3) % servers)
-	cfg.connect((leader1 + 4) % servers)
+	cfg.Connect((leader1 + 2) % servers)
+	cfg.Connect((leader1 + 3) % servers)
+	cfg.Connect((leader1 + 4) % servers)
 
 	// lots of successful commands to new group.
 	for i := 0; i < 50; i++ {
-		cfg.one(rand.Int(), 3, true)
+		cfg.One(cfg.Rand().Int(), 3, true)
 	}
 
 	// now another partitioned leader and one follower
-	leader2 := cfg.checkOneLeader()
+	leader2 := cfg.CheckOneLeader()
 	other := (leader1 + 2) % servers
 	if leader2 == other {
 		other = (leader2 + 1) % servers
 	}
-	cfg.disconnect(other)
+	cfg.Disconnect(other)
 
 	// lots more commands that won't commit
 	for i := 0; i < 50; i++ {
-		cfg.rafts[leader2].Start(rand.Int())
+		cfg.Raft(leader2).Start(cfg.Rand().Int())
 	}
 
-	time.Sleep(RaftElectionTimeout / 2)
+	cfg.Clock().Sleep(RaftElectionTimeout / 2)
 
 	// bring original leader back to life,
 	for i := 0; i < servers; i++ {
-		cfg.disconnect(i)
+		cfg.Disconnect(i)
 	}
-	cfg.connect((leader1 + 0) % servers)
-	cfg.connect((leader1 + 1) % servers)
-	cfg.connect(other)
+	cfg.Connect((leader1 + 0) % servers)
+	cfg.Connect((leader1 + 1) % servers)
+	cfg.Connect(other)
 
 	// lots of successful commands to new group.
 	for i := 0; i < 50; i++ {
-		cfg.one(rand.Int(), 3, true)
+		cfg.One(cfg.Rand().Int(), 3, true)
 	}
 
 	// now everyone
 	for i := 0; i < servers; i++ {
-		cfg.connect(i)
+		cfg.Connect(i)
+	}
+	cfg.One(cfg.Rand().Int(), servers, true)
+
+	cfg.End()
+}
+
+func TestPartitionLeader2B(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): leader isolated with one follower")
+
+	cfg.One(101, servers, true)
+
+	leader1 := cfg.CheckOneLeader()
+	follower := (leader1 + 1) % servers
+	cfg.Isolate(leader1, follower)
+
+	// the minority can't commit.
+	index, _, ok := cfg.Raft(leader1).Start(102)
+	if !ok {
+		t.Fatalf("leader rejected Start()")
+	}
+	cfg.Clock().Sleep(RaftElectionTimeout)
+	if n, _ := cfg.NCommitted(index); n > 0 {
+		t.Fatalf("%v committed in a minority partition", n)
+	}
+
+	// the majority can.
+	for i := 0; i < 5; i++ {
+		cfg.One(103+i, 3, true)
+	}
+
+	// after healing, the old leader's entry is overwritten and
+	// everyone agrees.
+	cfg.Heal()
+	cfg.One(110, servers, true)
+	if _, cmd := cfg.NCommitted(index); cmd == 102 {
+		t.Fatalf("entry from the minority partition committed")
+	}
+
+	cfg.End()
+}
+
+func TestBridgeNode2B(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): one server bridges a partition")
+
+	cfg.One(101, servers, true)
+
+	// 0 and 1 can't see 3 and 4, but 2 sees everyone. either
+	// side can win 2's vote and so a majority.
+	cfg.Bridge(2, []int{0, 1}, []int{3, 4})
+	for i := 0; i < 10; i++ {
+		cfg.One(102+i, 3, true)
+	}
+
+	cfg.Heal()
+	cfg.One(120, servers, true)
+
+	cfg.End()
+}
+
+func TestOneWayLink2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): one-way link failures")
+
+	cfg.One(101, servers, true)
+
+	// the leader can't reach a follower, which still reaches
+	// the leader: the follower times out and forces an election.
+	leader1 := cfg.CheckOneLeader()
+	follower := (leader1 + 1) % servers
+	cfg.CutLink(leader1, follower)
+	for i := 0; i < 5; i++ {
+		cfg.One(102+i, 2, true)
+	}
+	cfg.RestoreLink(leader1, follower)
+	cfg.One(110, servers, true)
+
+	// a leader that hears everyone but can't send is replaced,
+	// and steps down when the new leader's RPCs reach it.
+	leader2 := cfg.CheckOneLeader()
+	for i := 0; i < servers; i++ {
+		if i != leader2 {
+			cfg.CutLink(leader2, i)
+		}
 	}
-	cfg.one(rand.Int(), servers, true)
+	for i := 0; i < 5; i++ {
+		cfg.One(111+i, 2, true)
+	}
+	cfg.Heal()
+	cfg.One(120, servers, true)
 
-	cfg.end()
+	cfg.End()
+}
+
+func TestStaleAppend2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): stale AppendEntries doesn't truncate the log")
+
+	cfg.One(101, servers, false)
+	cfg.One(102, servers, false)
+	cfg.One(103, servers, false)
+
+	leader := cfg.CheckOneLeader()
+	follower := (leader + 1) % servers
+	cfg.Disconnect(follower)
+
+	// what the leader sent when its log held only 101, arriving now.
+	rf := cfg.Raft(follower)
+	term, _ := rf.GetState()
+	first, err := rf.Entries(1, 1)
+	if err != nil {
+		t.Fatalf("Entries: %v", err)
+	}
+	args := raft.AppendEntriesArgs{Term: term, LeaderId: leader, Entries: first, LeaderCommit: 1}
+	reply := raft.AppendEntriesReply{}
+	rf.AppendEntries(&args, &reply)
+	if !reply.Success {
+		t.Fatalf("stale AppendEntries failed")
+	}
+	if st := rf.Status(); st.LastLogIndex != 3 {
+		t.Fatalf("stale AppendEntries truncated the log to %v entries", st.LastLogIndex)
+	}
+
+	// and a duplicate of it changes nothing either.
+	rf.AppendEntries(&args, &reply)
+	if st := rf.Status(); st.LastLogIndex != 3 {
+		t.Fatalf("duplicate AppendEntries truncated the log to %v entries", st.LastLogIndex)
+	}
+
+	cfg.Connect(follower)
+	cfg.One(104, servers, true)
+
+	cfg.End()
 }
 
 func TestCount2B(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2B): RPC counts aren't too high")
+	cfg.Begin("Test (2B): RPC counts aren't too high")
 
 	rpcs := func() (n int) {
 		for j := 0; j < servers; j++ {
-			n += cfg.rpcCount(j)
+			n += cfg.RPCCount(j)
 		}
 		return
 	}
 
-	leader := cfg.checkOneLeader()
+	leader := cfg.CheckOneLeader()
 
 	total1 := rpcs()
 
@@ -467,23 +845,23 @@ loop:
 	for try := 0; try < 5; try++ {
 		if try > 0 {
 			// give solution some time to settle
-			time.Sleep(3 * time.Second)
+			cfg.Clock().Sleep(3 * time.Second)
 		}
 
-		leader = cfg.checkOneLeader()
+		leader = cfg.CheckOneLeader()
 		total1 = rpcs()
 
 		iters := 10
-		starti, term, ok := cfg.rafts[leader].Start(1)
+		starti, term, ok := cfg.Raft(leader).Start(1)
 		if !ok {
 			// leader moved on really quickly
 			continue
 		}
 		cmds := []int{}
 		for i := 1; i < iters+2; i++ {
-			x := int(rand.Int31())
+			x := int(cfg.Rand().Int31())
 			cmds = append(cmds, x)
-			index1, term1, ok := cfg.rafts[leader].Start(x)
+			index1, term1, ok := cfg.Raft(leader).Start(x)
 			if term1 != term {
 				// Term changed while starting
 				continue loop
@@ -498,7 +876,7 @@ loop:
 		}
 
 		for i := 1; i < iters+1; i++ {
-			cmd := cfg.wait(starti+i, servers, term)
+			cmd := cfg.Wait(starti+i, servers, term)
 			if ix, ok := cmd.(int); ok == false || ix != cmds[i-1] {
 				if ix == -1 {
 					// term changed -- try again
@@ -511,12 +889,12 @@ loop:
 		failed := false
 		total2 = 0
 		for j := 0; j < servers; j++ {
-			if t, _ := cfg.rafts[j].GetState(); t != term {
+			if t, _ := cfg.Raft(j).GetState(); t != term {
 				// term changed -- can't expect low RPC counts
 				// need to keep going to update total2
 				failed = true
 			}
-			total2 += cfg.rpcCount(j)
+			total2 += cfg.RPCCount(j)
 		}
 
 		if failed {
@@ -535,140 +913,699 @@ loop:
 		t.Fatalf("term changed too often")
 	}
 
-	time.Sleep(RaftElectionTimeout)
+	cfg.Clock().Sleep(RaftElectionTimeout)
 
 	total3 := 0
 	for j := 0; j < servers; j++ {
-		total3 += cfg.rpcCount(j)
+		total3 += cfg.RPCCount(j)
 	}
 
 	if total3-total2 > 3*20 {
 		t.Fatalf("too many RPCs (%v) for 1 second of idleness\n", total3-total2)
 	}
 
-	cfg.end()
+	cfg.End()
+}
+
+// counts the events each peer reports.
+type countingObserver struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (co *countingObserver) add(event string) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	co.counts[event]++
+}
+
+func (co *countingObserver) get(event string) int {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.counts[event]
+}
+
+func (co *countingObserver) RoleChanged(peer int, term int, from, to string) {
+	co.add("role:" + to)
+}
+func (co *countingObserver) TermChanged(peer int, from, to int) { co.add("term") }
+func (co *countingObserver) VoteGranted(peer int, term int, candidate int) {
+	co.add("vote")
+}
+func (co *countingObserver) EntryAppended(peer int, entry raft.LogEntry) { co.add("appended") }
+func (co *countingObserver) CommitAdvanced(peer int, from, to int)       { co.add("commit") }
+func (co *countingObserver) EntryApplied(peer int, entry raft.LogEntry)  { co.add("applied") }
+func (co *countingObserver) RPCSent(peer int, to int, svcMeth string, args interface{}) {
+	co.add("sent:" + svcMeth)
+}
+func (co *countingObserver) RPCReceived(peer int, from int, svcMeth string, args interface{}) {
+	co.add("received:" + svcMeth)
+}
+func (co *countingObserver) RPCReplied(peer int, to int, svcMeth string, args, reply interface{}) {
+	co.add("replied:" + svcMeth)
+}
+func (co *countingObserver) PeerUnreachable(peer int, to int, svcMeth string) {
+	co.add("unreachable")
+}
+func (co *countingObserver) Killed(peer int) { co.add("killed") }
+
+func TestObserver2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): observers see elections, replication and RPCs")
+
+	leader1 := cfg.CheckOneLeader()
+
+	// two observers, both of which should hear everything.
+	co1 := &countingObserver{counts: map[string]int{}}
+	co2 := &countingObserver{counts: map[string]int{}}
+	cfg.Observe(co1)
+	cfg.Observe(co2)
+
+	// force an election.
+	cfg.Disconnect(leader1)
+	cfg.CheckOneLeader()
+
+	iters := 3
+	for i := 0; i < iters; i++ {
+		cfg.One(100+i, servers-1, false)
+	}
+
+	// the old leader is unreachable until it rejoins, and then
+	// must step down and catch up.
+	cfg.Clock().Sleep(RaftElectionTimeout / 2)
+	cfg.Connect(leader1)
+	cfg.One(200, servers, true)
+	cfg.Crash(leader1)
+
+	for _, co := range []*countingObserver{co1, co2} {
+		if co.get("role:"+raft.Candidate) < 1 || co.get("role:"+raft.Leader) < 1 || co.get("term") < 1 {
+			t.Fatalf("missed the election: %v", co.counts)
+		}
+		if co.get("vote") < 1 {
+			t.Fatalf("no votes granted: %v", co.counts)
+		}
+		if co.get("role:"+raft.Follower) < 1 {
+			t.Fatalf("old leader never stepped down: %v", co.counts)
+		}
+		// every server appends and applies every entry;
+		// leader1 catches up on the first iters on rejoining.
+		if n := co.get("appended"); n < servers*(iters+1) {
+			t.Fatalf("%v appends, expected at least %v", n, servers*(iters+1))
+		}
+		if n := co.get("applied"); n < servers*(iters+1) {
+			t.Fatalf("%v applies, expected at least %v", n, servers*(iters+1))
+		}
+		if co.get("commit") < 1 {
+			t.Fatalf("commit never advanced: %v", co.counts)
+		}
+		if co.get("sent:Raft.AppendEntries") < 1 || co.get("received:Raft.AppendEntries") < 1 ||
+			co.get("sent:Raft.RequestVote") < 1 || co.get("received:Raft.RequestVote") < 1 ||
+			co.get("replied:Raft.AppendEntries") < 1 || co.get("replied:Raft.RequestVote") < 1 {
+			t.Fatalf("missing RPC events: %v", co.counts)
+		}
+		if co.get("unreachable") < 1 {
+			t.Fatalf("no unreachable peers reported: %v", co.counts)
+		}
+		if co.get("killed") != 1 {
+			t.Fatalf("%v kills reported, expected 1", co.get("killed"))
+		}
+	}
+
+	cfg.End()
+}
+
+// value of the first series in a Prometheus text scrape
+// whose name and labels start with prefix.
+func scrapeValue(t *testing.T, body string, prefix string) float64 {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			f := strings.Fields(line)
+			v, err := strconv.ParseFloat(f[len(f)-1], 64)
+			if err != nil {
+				t.Fatalf("bad sample %q", line)
+			}
+			return v
+		}
+	}
+	t.Fatalf("no %v in scrape:\n%v", prefix, body)
+	return 0
+}
+
+func TestPrometheus2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): Prometheus metrics endpoint")
+
+	reg := prom.NewRegistry()
+	pm := raft.NewPromMetrics(reg)
+	for i := 0; i < servers; i++ {
+		pm.Watch(cfg.Raft(i))
+	}
+	srv := httptest.NewServer(prom.Handler(reg))
+	defer srv.Close()
+
+	scrape := func() string {
+		resp, err := srv.Client().Get(srv.URL)
+		if err != nil {
+			t.Fatalf("scrape: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	leader1 := cfg.CheckOneLeader()
+	iters := 5
+	for i := 1; i <= iters; i++ {
+		cfg.One(i*100, servers, false)
+	}
+
+	body := scrape()
+	node := fmt.Sprintf(`{node="%v"}`, leader1)
+	term, _ := cfg.Raft(leader1).GetState()
+	if v := scrapeValue(t, body, "raft_term"+node); v != float64(term) {
+		t.Fatalf("raft_term %v, expected %v", v, term)
+	}
+	if v := scrapeValue(t, body, "raft_role"+node); v != 2 {
+		t.Fatalf("leader has raft_role %v", v)
+	}
+	if v := scrapeValue(t, body, "raft_log_length"+node); v != float64(iters) {
+		t.Fatalf("raft_log_length %v, expected %v", v, iters)
+	}
+	if v := scrapeValue(t, body, "raft_commit_index"+node); v != float64(iters) {
+		t.Fatalf("raft_commit_index %v, expected %v", v, iters)
+	}
+	if v := scrapeValue(t, body, "raft_persisted_state_bytes"+node); v != float64(cfg.Persister(leader1).RaftStateSize()) {
+		t.Fatalf("raft_persisted_state_bytes %v, expected %v", v, cfg.Persister(leader1).RaftStateSize())
+	}
+	if v := scrapeValue(t, body, "raft_append_entries_sent_total"+node); v < 1 {
+		t.Fatalf("no AppendEntries counted")
+	}
+	if v := scrapeValue(t, body, "raft_replication_latency_seconds_count"+node); v != float64(iters) {
+		t.Fatalf("%v replication latencies, expected %v", v, iters)
+	}
+
+	// crash the leader; the new one should record a failover.
+	cfg.Crash(leader1)
+	leader2 := cfg.CheckOneLeader()
+	cfg.Clock().Sleep(RaftElectionTimeout / 2)
+
+	body = scrape()
+	node = fmt.Sprintf(`{node="%v"}`, leader2)
+	if v := scrapeValue(t, body, "raft_elections_won_total"+node); v < 1 {
+		t.Fatalf("new leader %v has won no elections", leader2)
+	}
+	if v := scrapeValue(t, body, "raft_failover_seconds_count"+node); v < 1 {
+		t.Fatalf("no failover recorded for new leader %v", leader2)
+	}
+	started := 0.0
+	for i := 0; i < servers; i++ {
+		started += scrapeValue(t, body, fmt.Sprintf(`raft_elections_started_total{node="%v"}`, i))
+	}
+	if started < 1 {
+		t.Fatalf("no elections started")
+	}
+
+	cfg.End()
+}
+
+func TestTracing2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): per-entry traces across leader and followers")
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	sink, err := raft.NewFileSink(path)
+	if err != nil {
+		t.Fatalf("NewFileSink: %v", err)
+	}
+	tr := raft.NewTracer(sink)
+	for i := 0; i < servers; i++ {
+		cfg.Raft(i).SetTracer(tr)
+	}
+
+	cfg.CheckOneLeader()
+	iters := 3
+	for i := 1; i <= iters; i++ {
+		cfg.One(i*100, servers, true)
+	}
+	// let the last acks reach the leader.
+	cfg.Clock().Sleep(200 * time.Millisecond)
+	sink.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	byTrace := map[string][]raft.OtlpSpan{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var req raft.OtlpExportRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatalf("bad OTLP/JSON line %q: %v", line, err)
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, sp := range ss.Spans {
+					byTrace[sp.TraceId] = append(byTrace[sp.TraceId], sp)
+				}
+			}
+		}
+	}
+
+	complete := 0
+	for id, spans := range byTrace {
+		if len(id) != 32 {
+			t.Fatalf("trace id %q is not 16 bytes of hex", id)
+		}
+		names := map[string]int{}
+		ids := map[string]string{} // span id -> name
+		for _, sp := range spans {
+			names[sp.Name]++
+			ids[sp.SpanId] = sp.Name
+			start, _ := strconv.ParseInt(sp.StartTimeUnixNano, 10, 64)
+			end, _ := strconv.ParseInt(sp.EndTimeUnixNano, 10, 64)
+			if end < start {
+				t.Fatalf("span %v ends before it starts", sp.Name)
+			}
+		}
+		for _, sp := range spans {
+			parent := ids[sp.ParentSpanId]
+			switch sp.Name {
+			case "raft.propose":
+				if sp.ParentSpanId != "" {
+					t.Fatalf("root span has a parent")
+				}
+			case "raft.follower_append":
+				if parent != "raft.replicate" {
+					t.Fatalf("follower_append's parent is %q, expected raft.replicate: %+v", parent, spans)
+				}
+			default:
+				if parent != "raft.propose" {
+					t.Fatalf("%v's parent is %q, expected raft.propose", sp.Name, parent)
+				}
+			}
+		}
+		if names["raft.propose"] == 1 && names["raft.leader_append"] == 1 &&
+			names["raft.queue"] == 1 && names["raft.commit_wait"] == 1 && names["raft.apply"] == 1 &&
+			names["raft.replicate"] == servers-1 && names["raft.follower_append"] >= servers-1 {
+			complete++
+		}
+	}
+	if complete < iters {
+		t.Fatalf("only %v of %v entries have complete traces: %v", complete, iters, byTrace)
+	}
+
+	cfg.End()
+}
+
+func TestEventLog2B(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("RAFT_EVENTS", dir)
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): cluster event trace")
+
+	cfg.Net().LongDelays(false) // so RPCs to the crashed follower fail quickly
+	cfg.One(101, servers, false)
+	leader := cfg.CheckOneLeader()
+	follower := (leader + 1) % servers
+	cfg.Crash(follower)
+	cfg.One(102, servers-1, false)
+	cfg.Clock().Sleep(RaftElectionTimeout / 2)
+	cfg.Events().Flush()
+
+	f, err := os.Open(filepath.Join(dir, t.Name()+".jsonl"))
+	if err != nil {
+		t.Fatalf("no trace: %v", err)
+	}
+	defer f.Close()
+	events, err := raft.ReadEvents(f)
+	if err != nil {
+		t.Fatalf("ReadEvents: %v", err)
+	}
+
+	kinds := map[string]int{}
+	applied := map[int]interface{}{}
+	var last time.Time
+	for _, e := range events {
+		kinds[e.Kind]++
+		if e.Time.Before(last) {
+			t.Fatalf("events out of order at %+v", e)
+		}
+		last = e.Time
+		switch e.Kind {
+		case raft.EventSend, raft.EventDeliver, raft.EventReply, raft.EventDrop:
+			if e.Peer < 0 || e.Peer >= servers || e.Peer == e.Node || e.Method == "" {
+				t.Fatalf("bad RPC event %+v", e)
+			}
+		case raft.EventRole:
+			if e.Role == raft.Leader && e.Node != leader {
+				t.Fatalf("%v elected, but leader is %v", e.Node, leader)
+			}
+		case raft.EventApply:
+			applied[e.Index] = e.Command
+		case raft.EventCrash:
+			if e.Node != follower {
+				t.Fatalf("crash of %v, expected %v", e.Node, follower)
+			}
+		}
+	}
+	for _, k := range []string{raft.EventSend, raft.EventDeliver, raft.EventReply, raft.EventDrop, raft.EventRole, raft.EventTerm, raft.EventCommit, raft.EventApply} {
+		if kinds[k] == 0 {
+			t.Fatalf("no %v events: %v", k, kinds)
+		}
+	}
+	if kinds[raft.EventCrash] != 1 {
+		t.Fatalf("%v crash events, expected 1", kinds[raft.EventCrash])
+	}
+	// JSON numbers decode as float64.
+	if applied[1] != 101.0 || applied[2] != 102.0 {
+		t.Fatalf("wrong commands applied: %v", applied)
+	}
+
+	cfg.End()
+}
+
+// the drop_rate column of the replication_latency.csv rows
+// for log indices in [from, to].
+func dropRates(t *testing.T, dir string, from, to int) map[string]int {
+	data, err := os.ReadFile(filepath.Join(dir, "replication_latency.csv"))
+	if err != nil {
+		t.Fatalf("no metrics: %v", err)
+	}
+	rates := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+		cols := strings.Split(line, ",")
+		if index, _ := strconv.Atoi(cols[4]); index >= from && index <= to {
+			rates[cols[1]]++
+		}
+	}
+	return rates
+}
+
+func TestFaultModel2B(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("RAFT_METRICS_DIR", dir)
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): fault model and the drop_rate metric")
+
+	cfg.SetFaults(labrpc.FaultModel{Drop: 0.05, Latency: labrpc.Uniform{Max: 5 * time.Millisecond}})
+	for i := 1; i <= 5; i++ {
+		cfg.One(100+i, servers, true)
+	}
+	if r := dropRates(t, dir, 1, 5); r["0.05"] == 0 || len(r) != 1 {
+		t.Fatalf("drop_rate %v, expected 0.05", r)
+	}
+
+	// every link its own model, kept when a server restarts.
+	fm := labrpc.FaultModel{Drop: 0.15, Duplicate: 0.5}
+	for i := 0; i < servers; i++ {
+		for j := 0; j < servers; j++ {
+			if i != j {
+				cfg.SetLinkFaults(i, j, &fm)
+			}
+		}
+	}
+	follower := (cfg.CheckOneLeader() + 1) % servers
+	cfg.Crash(follower)
+	cfg.Start(follower)
+	cfg.Connect(follower)
+	if r := cfg.Raft(follower).DropRate(); r != 0.15 {
+		t.Fatalf("restarted server's drop rate %v, expected 0.15", r)
+	}
+	for i := 6; i <= 10; i++ {
+		cfg.One(100+i, servers, true)
+	}
+	if r := dropRates(t, dir, 6, 10); r["0.15"] == 0 || len(r) != 1 {
+		t.Fatalf("drop_rate %v, expected 0.15", r)
+	}
+
+	cfg.End()
+}
+
+// send an admin API request, decode the JSON reply into v
+// (if not nil), and return the status code.
+func adminCall(t *testing.T, srv *httptest.Server, method, path string, v interface{}) int {
+	req, _ := http.NewRequest(method, srv.URL+path, nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%v %v: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%v %v: Content-Type %q", method, path, ct)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%v %v: bad JSON: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin2B(t *testing.T) {
+	servers := 3
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2B): HTTP admin API")
+
+	leader := cfg.CheckOneLeader()
+	iters := 5
+	for i := 1; i <= iters; i++ {
+		cfg.One(i*100, servers, true)
+	}
+
+	srv := httptest.NewServer(raft.NewAdminHandler(cfg.Raft(leader), raft.AdminOptions{
+		Snapshot: func() (int, error) { return cfg.Snapshot(leader) },
+	}))
+	defer srv.Close()
+
+	var st raft.Status
+	if code := adminCall(t, srv, "GET", "/status", &st); code != http.StatusOK {
+		t.Fatalf("GET /status: %v", code)
+	}
+	if st.Me != leader || st.Role != raft.Leader || st.CommitIndex != iters || len(st.Peers) != servers {
+		t.Fatalf("wrong status %v", st)
+	}
+
+	var lg struct {
+		From, To int
+		Entries  []struct{ Index, Term, Command int }
+	}
+	if code := adminCall(t, srv, "GET", "/log?from=2&to=3", &lg); code != http.StatusOK {
+		t.Fatalf("GET /log: %v", code)
+	}
+	if lg.From != 2 || lg.To != 3 || len(lg.Entries) != 2 ||
+		lg.Entries[0].Index != 2 || lg.Entries[0].Command != 200 || lg.Entries[1].Command != 300 {
+		t.Fatalf("wrong log %+v", lg)
+	}
+	if code := adminCall(t, srv, "GET", "/log?from=x", nil); code != http.StatusBadRequest {
+		t.Fatalf("GET /log?from=x: %v, expected %v", code, http.StatusBadRequest)
+	}
+	if code := adminCall(t, srv, "POST", "/status", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /status: %v, expected %v", code, http.StatusMethodNotAllowed)
+	}
+
+	// a follower misses some entries, which the leader then
+	// compacts away; it must catch up by InstallSnapshot.
+	lagging := (leader + 1) % servers
+	cfg.Disconnect(lagging)
+	for i := iters + 1; i <= 2*iters; i++ {
+		cfg.One(i*100, servers-1, true)
+	}
+	if code := adminCall(t, srv, "POST", "/snapshot", &st); code != http.StatusOK {
+		t.Fatalf("POST /snapshot: %v", code)
+	}
+	if st.FirstLogIndex != 2*iters+1 || st.SnapshotSize == 0 {
+		t.Fatalf("log not compacted: %v", st)
+	}
+	if code := adminCall(t, srv, "GET", "/log?from=1", nil); code != http.StatusGone {
+		t.Fatalf("GET /log of compacted entries: %v, expected %v", code, http.StatusGone)
+	}
+	ahead := httptest.NewServer(raft.NewAdminHandler(cfg.Raft(leader), raft.AdminOptions{
+		Snapshot: func() (int, error) { return 0, raft.ErrNotApplied },
+	}))
+	defer ahead.Close()
+	if code := adminCall(t, ahead, "POST", "/snapshot", nil); code != http.StatusConflict {
+		t.Fatalf("POST /snapshot ahead of applied entries: %v, expected %v", code, http.StatusConflict)
+	}
+	cfg.Connect(lagging)
+	cfg.One(2*iters*100+100, servers, true)
+
+	// the rejoining follower's higher term may have forced a new
+	// election; hand leadership from whoever won to someone else.
+	leader2 := cfg.CheckOneLeader()
+	target := (leader2 + 1) % servers
+	srv2 := httptest.NewServer(raft.NewAdminHandler(cfg.Raft(leader2), raft.AdminOptions{}))
+	defer srv2.Close()
+	if code := adminCall(t, srv2, "POST", "/snapshot", nil); code != http.StatusNotImplemented {
+		t.Fatalf("POST /snapshot without a service: %v, expected %v", code, http.StatusNotImplemented)
+	}
+	if code := adminCall(t, srv2, "POST", fmt.Sprintf("/transfer-leadership?to=%v", target), &st); code != http.StatusOK {
+		t.Fatalf("POST /transfer-leadership: %v", code)
+	}
+	if st.Role == raft.Leader {
+		t.Fatalf("old leader still leading after transfer: %v", st)
+	}
+	if leader3 := cfg.CheckOneLeader(); leader3 != target {
+		t.Fatalf("leadership went to %v, expected %v", leader3, target)
+	}
+	if code := adminCall(t, srv2, "POST", "/step-down", nil); code != http.StatusConflict {
+		t.Fatalf("POST /step-down on a follower: %v, expected %v", code, http.StatusConflict)
+	}
+
+	// the server that took the snapshot restarts from it.
+	cfg.Start(leader)
+	cfg.Connect(leader)
+	cfg.One(2*iters*100+200, servers, true)
+
+	leader4 := cfg.CheckOneLeader()
+	srv3 := httptest.NewServer(raft.NewAdminHandler(cfg.Raft(leader4), raft.AdminOptions{}))
+	defer srv3.Close()
+	if code := adminCall(t, srv3, "POST", "/step-down", &st); code != http.StatusOK || st.Role != raft.Follower {
+		t.Fatalf("POST /step-down: %v %v", code, st)
+	}
+	if leader5 := cfg.CheckOneLeader(); leader5 == leader4 {
+		t.Fatalf("%v stepped down but was re-elected at once", leader4)
+	}
+	cfg.One(2*iters*100+300, servers, true)
+
+	cfg.End()
 }
 
 func TestPersist12C(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2C): basic persistence")
+	cfg.Begin("Test (2C): basic persistence")
 
-	cfg.one(11, servers, true)
+	cfg.One(11, servers, true)
 
 	// crash and re-start all
 	for i := 0; i < servers; i++ {
-		cfg.start1(i)
+		cfg.Start(i)
 	}
 	for i := 0; i < servers; i++ {
-		cfg.disconnect(i)
-		cfg.connect(i)
+		cfg.Disconnect(i)
+		cfg.Connect(i)
 	}
 
-	cfg.one(12, servers, true)
+	cfg.One(12, servers, true)
 
-	leader1 := cfg.checkOneLeader()
-	cfg.disconnect(leader1)
-	cfg.start1(leader1)
-	cfg.connect(leader1)
+	leader1 := cfg.CheckOneLeader()
+	cfg.Disconnect(leader1)
+	cfg.Start(leader1)
+	cfg.Connect(leader1)
 
-	cfg.one(13, servers, true)
+	cfg.One(13, servers, true)
 
-	leader2 := cfg.checkOneLeader()
-	cfg.disconnect(leader2)
-	cfg.one(14, servers-1, true)
-	cfg.start1(leader2)
-	cfg.connect(leader2)
+	leader2 := cfg.CheckOneLeader()
+	cfg.Disconnect(leader2)
+	cfg.One(14, servers-1, true)
+	cfg.Start(leader2)
+	cfg.Connect(leader2)
 
-	cfg.wait(4, servers, -1) // wait for leader2 to join before killing i3
+	cfg.Wait(4, servers, -1) // wait for leader2 to join before killing i3
 
-	i3 := (cfg.checkOneLeader() + 1) % servers
-	cfg.disconnect(i3)
-	cfg.one(15, servers-1, true)
-	cfg.start1(i3)
-	cfg.connect(i3)
+	i3 := (cfg.CheckOneLeader() + 1) % servers
+	cfg.Disconnect(i3)
+	cfg.One(15, servers-1, true)
+	cfg.Start(i3)
+	cfg.Connect(i3)
 
-	cfg.one(16, servers, true)
+	cfg.One(16, servers, true)
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestPersist22C(t *testing.T) {
 	servers := 5
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2C): more persistence")
+	cfg.Begin("Test (2C): more persistence")
 
 	index := 1
 	for iters := 0; iters < 5; iters++ {
-		cfg.one(10+index, servers, true)
+		cfg.One(10+index, servers, true)
 		index++
 
-		leader1 := cfg.checkOneLeader()
+		leader1 := cfg.CheckOneLeader()
 
-		cfg.disconnect((leader1 + 1) % servers)
-		cfg.disconnect((leader1 + 2) % servers)
+		cfg.Disconnect((leader1 + 1) % servers)
+		cfg.Disconnect((leader1 + 2) % servers)
 
-		cfg.one(10+index, servers-2, true)
+		cfg.One(10+index, servers-2, true)
 		index++
 
-		cfg.disconnect((leader1 + 0) % servers)
-		cfg.disconnect((leader1 + 3) % servers)
-		cfg.disconnect((leader1 + 4) % servers)
+		cfg.Disconnect((leader1 + 0) % servers)
+		cfg.Disconnect((leader1 + 3) % servers)
+		cfg.Disconnect((leader1 + 4) % servers)
 
-		cfg.start1((leader1 + 1) % servers)
-		cfg.start1((leader1 + 2) % servers)
-		cfg.connect((leader1 + 1) % servers)
-		cfg.connect((leader1 + 2) % servers)
+		cfg.Start((leader1 + 1) % servers)
+		cfg.Start((leader1 + 2) % servers)
+		cfg.Connect((leader1 + 1) % servers)
+		cfg.Connect((leader1 + 2) % servers)
 
-		time.Sleep(RaftElectionTimeout)
+		cfg.Clock().Sleep(RaftElectionTimeout)
 
-		cfg.start1((leader1 + 3) % servers)
-		cfg.connect((leader1 + 3) % servers)
+		cfg.Start((leader1 + 3) % servers)
+		cfg.Connect((leader1 + 3) % servers)
 
-		cfg.one(10+index, servers-2, true)
+		cfg.One(10+index, servers-2, true)
 		index++
 
-		cfg.connect((leader1 + 4) % servers)
-		cfg.connect((leader1 + 0) % servers)
+		cfg.Connect((leader1 + 4) % servers)
+		cfg.Connect((leader1 + 0) % servers)
 	}
 
-	cfg.one(1000, servers, true)
+	cfg.One(1000, servers, true)
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestPersist32C(t *testing.T) {
 	servers := 3
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2C): partitioned leader and one follower crash, leader restarts")
+	cfg.Begin("Test (2C): partitioned leader and one follower crash, leader restarts")
 
-	cfg.one(101, 3, true)
+	cfg.One(101, 3, true)
 
-	leader := cfg.checkOneLeader()
-	cfg.disconnect((leader + 2) % servers)
+	leader := cfg.CheckOneLeader()
+	cfg.Disconnect((leader + 2) % servers)
 
-	cfg.one(102, 2, true)
+	cfg.One(102, 2, true)
 
-	cfg.crash1((leader + 0) % servers)
-	cfg.crash1((leader + 1) % servers)
-	cfg.connect((leader + 2) % servers)
-	cfg.start1((leader + 0) % servers)
-	cfg.connect((leader + 0) % servers)
+	cfg.Crash((leader + 0) % servers)
+	cfg.Crash((leader + 1) % servers)
+	cfg.Connect((leader + 2) % servers)
+	cfg.Start((leader + 0) % servers)
+	cfg.Connect((leader + 0) % servers)
 
-	cfg.one(103, 2, true)
+	cfg.One(103, 2, true)
 
-	cfg.start1((leader + 1) % servers)
-	cfg.connect((leader + 1) % servers)
+	cfg.Start((leader + 1) % servers)
+	cfg.Connect((leader + 1) % servers)
 
-	cfg.one(104, servers, true)
+	cfg.One(104, servers, true)
 
-	cfg.end()
+	cfg.End()
 }
 
 // Test the scenarios described in Figure 8 of the extended Raft paper. Each
@@ -682,172 +1619,256 @@ func TestPersist32C(t *testing.T) {
 func TestFigure82C(t *testing.T) {
 	servers := 5
 	cfg := make_config(t, servers, false)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2C): Figure 8")
+	cfg.Begin("Test (2C): Figure 8")
 
-	cfg.one(rand.Int(), 1, true)
+	cfg.One(cfg.Rand().Int(), 1, true)
 
 	nup := servers
 	for iters := 0; iters < 1000; iters++ {
 		leader := -1
 		for i := 0; i < servers; i++ {
-			if cfg.rafts[i] != nil {
-				_, _, ok := cfg.rafts[i].Start(rand.Int())
+			if cfg.Raft(i) != nil {
+				_, _, ok := cfg.Raft(i).Start(cfg.Rand().Int())
 				if ok {
 					leader = i
 				}
 			}
 		}
 
-		if (rand.Int() % 1000) < 100 {
-			ms := rand.Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+		if (cfg.Rand().Int() % 1000) < 100 {
+			ms := cfg.Rand().Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
+			cfg.Clock().Sleep(time.Duration(ms) * time.Millisecond)
 		} else {
-			ms := (rand.Int63() % 13)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			ms := (cfg.Rand().Int63() % 13)
+			cfg.Clock().Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
 		if leader != -1 {
-			cfg.crash1(leader)
+			cfg.Crash(leader)
 			nup -= 1
 		}
 
 		if nup < 3 {
-			s := rand.Int() % servers
-			if cfg.rafts[s] == nil {
-				cfg.start1(s)
-				cfg.connect(s)
+			s := cfg.Rand().Int() % servers
+			if cfg.Raft(s) == nil {
+				cfg.Start(s)
+				cfg.Connect(s)
 				nup += 1
 			}
 		}
 	}
 
 	for i := 0; i < servers; i++ {
-		if cfg.rafts[i] == nil {
-			cfg.start1(i)
-			cfg.connect(i)
+		if cfg.Raft(i) == nil {
+			cfg.Start(i)
+			cfg.Connect(i)
 		}
 	}
 
-	cfg.one(rand.Int(), servers, true)
+	cfg.One(cfg.Rand().Int(), servers, true)
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestUnreliableAgree2C(t *testing.T) {
 	servers := 5
 	cfg := make_config(t, servers, true)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2C): unreliable agreement")
+	cfg.Begin("Test (2C): unreliable agreement")
 
-	var wg sync.WaitGroup
+	wg := cfg.Group()
 
 	for iters := 1; iters < 50; iters++ {
 		for j := 0; j < 4; j++ {
-			wg.Add(1)
-			go func(iters, j int) {
-				defer wg.Done()
-				cfg.one((100*iters)+j, 1, true)
-			}(iters, j)
+			iters, j := iters, j
+			wg.Go(func() {
+				cfg.One((100*iters)+j, 1, true)
+			})
 		}
-		cfg.one(iters, 1, true)
+		cfg.One(iters, 1, true)
 	}
 
-	cfg.setunreliable(false)
+	cfg.SetUnreliable(false)
+
+	wg.Wait()
+
+	cfg.One(100, servers, true)
+
+	cfg.End()
+}
+
+func TestReorderedAgree2C(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2C): agreement with stale and duplicate requests")
+
+	cfg.SetRequestReordering(true)
+
+	wg := cfg.Group()
+
+	for iters := 1; iters < 50; iters++ {
+		for j := 0; j < 4; j++ {
+			iters, j := iters, j
+			wg.Go(func() {
+				cfg.One((100*iters)+j, 1, true)
+			})
+		}
+		cfg.One(iters, 1, true)
+		if iters%10 == 0 {
+			// a new leader, so that stale requests from an old
+			// one arrive too.
+			leader := cfg.CheckOneLeader()
+			cfg.Disconnect(leader)
+			cfg.One(iters+1000, 3, true)
+			cfg.Connect(leader)
+		}
+	}
 
 	wg.Wait()
+	cfg.SetRequestReordering(false)
+
+	cfg.One(100, servers, true)
+
+	cfg.End()
+}
+
+func TestFigure8Reordered2C(t *testing.T) {
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test (2C): Figure 8 (stale and duplicate requests)")
+
+	cfg.SetRequestReordering(true)
+	cfg.One(cfg.Rand().Int()%10000, 1, true)
+
+	nup := servers
+	for iters := 0; iters < 1000; iters++ {
+		leader := -1
+		for i := 0; i < servers; i++ {
+			_, _, ok := cfg.Raft(i).Start(cfg.Rand().Int() % 10000)
+			if ok && cfg.Connected(i) {
+				leader = i
+			}
+		}
+
+		if (cfg.Rand().Int() % 1000) < 100 {
+			ms := cfg.Rand().Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
+			cfg.Clock().Sleep(time.Duration(ms) * time.Millisecond)
+		} else {
+			ms := (cfg.Rand().Int63() % 13)
+			cfg.Clock().Sleep(time.Duration(ms) * time.Millisecond)
+		}
+
+		if leader != -1 && (cfg.Rand().Int()%1000) < int(RaftElectionTimeout/time.Millisecond)/2 {
+			cfg.Disconnect(leader)
+			nup -= 1
+		}
 
-	cfg.one(100, servers, true)
+		if nup < 3 {
+			s := cfg.Rand().Int() % servers
+			if cfg.Connected(s) == false {
+				cfg.Connect(s)
+				nup += 1
+			}
+		}
+	}
 
-	cfg.end()
+	for i := 0; i < servers; i++ {
+		if cfg.Connected(i) == false {
+			cfg.Connect(i)
+		}
+	}
+
+	cfg.One(cfg.Rand().Int()%10000, servers, true)
+
+	cfg.End()
 }
 
 func TestFigure8Unreliable2C(t *testing.T) {
 	servers := 5
 	cfg := make_config(t, servers, true)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
-	cfg.begin("Test (2C): Figure 8 (unreliable)")
+	cfg.Begin("Test (2C): Figure 8 (unreliable)")
 
-	cfg.one(rand.Int()%10000, 1, true)
+	cfg.One(cfg.Rand().Int()%10000, 1, true)
 
 	nup := servers
 	for iters := 0; iters < 1000; iters++ {
 		if iters == 200 {
-			cfg.setlongreordering(true)
+			cfg.SetLongReordering(true)
 		}
 		leader := -1
 		for i := 0; i < servers; i++ {
-			_, _, ok := cfg.rafts[i].Start(rand.Int() % 10000)
-			if ok && cfg.connected[i] {
+			_, _, ok := cfg.Raft(i).Start(cfg.Rand().Int() % 10000)
+			if ok && cfg.Connected(i) {
 				leader = i
 			}
 		}
 
-		if (rand.Int() % 1000) < 100 {
-			ms := rand.Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+		if (cfg.Rand().Int() % 1000) < 100 {
+			ms := cfg.Rand().Int63() % (int64(RaftElectionTimeout/time.Millisecond) / 2)
+			cfg.Clock().Sleep(time.Duration(ms) * time.Millisecond)
 		} else {
-			ms := (rand.Int63() % 13)
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			ms := (cfg.Rand().Int63() % 13)
+			cfg.Clock().Sleep(time.Duration(ms) * time.Millisecond)
 		}
 
-		if leader != -1 && (rand.Int()%1000) < int(RaftElectionTimeout/time.Millisecond)/2 {
-			cfg.disconnect(leader)
+		if leader != -1 && (cfg.Rand().Int()%1000) < int(RaftElectionTimeout/time.Millisecond)/2 {
+			cfg.Disconnect(leader)
 			nup -= 1
 		}
 
 		if nup < 3 {
-			s := rand.Int() % servers
-			if cfg.connected[s] == false {
-				cfg.connect(s)
+			s := cfg.Rand().Int() % servers
+			if cfg.Connected(s) == false {
+				cfg.Connect(s)
 				nup += 1
 			}
 		}
 	}
 
 	for i := 0; i < servers; i++ {
-		if cfg.connected[i] == false {
-			cfg.connect(i)
+		if cfg.Connected(i) == false {
+			cfg.Connect(i)
 		}
 	}
 
-	cfg.one(rand.Int()%10000, servers, true)
+	cfg.One(cfg.Rand().Int()%10000, servers, true)
 
-	cfg.end()
+	cfg.End()
 }
 
 func internalChurn(t *testing.T, unreliable bool) {
 
 	servers := 5
 	cfg := make_config(t, servers, unreliable)
-	defer cfg.cleanup()
+	defer cfg.Cleanup()
 
 	if unreliable {
-		cfg.begin("Test (2C): unreliable churn")
+		cfg.Begin("Test (2C): unreliable churn")
 	} else {
-		cfg.begin("Test (2C): churn")
+		cfg.Begin("Test (2C): churn")
 	}
 
 	stop := int32(0)
 
 	// create concurrent clients
-	cfn := func(me int, ch chan []int) {
-		var ret []int
-		ret = nil
-		defer func() { ch <- ret }()
+	cfn := func(me int) []int {
 		values := []int{}
 		for atomic.LoadInt32(&stop) == 0 {
-			x := rand.Int()
+			x := cfg.Rand().Int()
 			index := -1
 			ok := false
 			for i := 0; i < servers; i++ {
 				// try them all, maybe one of them is a leader
-				cfg.mu.Lock()
-				rf := cfg.rafts[i]
-				cfg.mu.Unlock()
+				rf := cfg.Raft(i)
 				if rf != nil {
 					index1, _, ok1 := rf.Start(x)
 					if ok1 {
@@ -860,51 +1881,52 @@ func internalChurn(t *testing.T, unreliable bool) {
 				// maybe leader will commit our value, maybe not.
 				// but don't wait forever.
 				for _, to := range []int{10, 20, 50, 100, 200} {
-					nd, cmd := cfg.nCommitted(index)
+					nd, cmd := cfg.NCommitted(index)
 					if nd > 0 {
 						if xx, ok := cmd.(int); ok {
 							if xx == x {
 								values = append(values, x)
 							}
 						} else {
-							cfg.t.Fatalf("wrong command type")
+							t.Fatalf("wrong command type")
 						}
 						break
 					}
-					time.Sleep(time.Duration(to) * time.Millisecond)
+					cfg.Clock().Sleep(time.Duration(to) * time.Millisecond)
 				}
 			} else {
-				time.Sleep(time.Duration(79+me*17) * time.Millisecond)
+				cfg.Clock().Sleep(time.Duration(79+me*17) * time.Millisecond)
 			}
 		}
-		ret = values
+		return values
 	}
 
 	ncli := 3
-	cha := []chan []int{}
+	results := make([][]int, ncli) // nil if the client failed
+	clients := cfg.Group()
 	for i := 0; i < ncli; i++ {
-		cha = append(cha, make(chan []int))
-		go cfn(i, cha[i])
+		i := i
+		clients.Go(func() { results[i] = cfn(i) })
 	}
 
 	for iters := 0; iters < 20; iters++ {
-		if (rand.Int() % 1000) < 200 {
-			i := rand.Int() % servers
-			cfg.disconnect(i)
+		if (cfg.Rand().Int() % 1000) < 200 {
+			i := cfg.Rand().Int() % servers
+			cfg.Disconnect(i)
 		}
 
-		if (rand.Int() % 1000) < 500 {
-			i := rand.Int() % servers
-			if cfg.rafts[i] == nil {
-				cfg.start1(i)
+		if (cfg.Rand().Int() % 1000) < 500 {
+			i := cfg.Rand().Int() % servers
+			if cfg.Raft(i) == nil {
+				cfg.Start(i)
 			}
-			cfg.connect(i)
+			cfg.Connect(i)
 		}
 
-		if (rand.Int() % 1000) < 200 {
-			i := rand.Int() % servers
-			if cfg.rafts[i] != nil {
-				cfg.crash1(i)
+		if (cfg.Rand().Int() % 1000) < 200 {
+			i := cfg.Rand().Int() % servers
+			if cfg.Raft(i) != nil {
+				cfg.Crash(i)
 			}
 		}
 
@@ -912,36 +1934,36 @@ func internalChurn(t *testing.T, unreliable bool) {
 		// keep up, but not so infrequent that everything has settled
 		// down from one change to the next. Pick a value smaller than
 		// the election timeout, but not hugely smaller.
-		time.Sleep((RaftElectionTimeout * 7) / 10)
+		cfg.Clock().Sleep((RaftElectionTimeout * 7) / 10)
 	}
 
-	time.Sleep(RaftElectionTimeout)
-	cfg.setunreliable(false)
+	cfg.Clock().Sleep(RaftElectionTimeout)
+	cfg.SetUnreliable(false)
 	for i := 0; i < servers; i++ {
-		if cfg.rafts[i] == nil {
-			cfg.start1(i)
+		if cfg.Raft(i) == nil {
+			cfg.Start(i)
 		}
-		cfg.connect(i)
+		cfg.Connect(i)
 	}
 
 	atomic.StoreInt32(&stop, 1)
+	clients.Wait()
 
 	values := []int{}
-	for i := 0; i < ncli; i++ {
-		vv := <-cha[i]
+	for _, vv := range results {
 		if vv == nil {
 			t.Fatal("client failed")
 		}
 		values = append(values, vv...)
 	}
 
-	time.Sleep(RaftElectionTimeout)
+	cfg.Clock().Sleep(RaftElectionTimeout)
 
-	lastIndex := cfg.one(rand.Int(), servers, true)
+	lastIndex := cfg.One(cfg.Rand().Int(), servers, true)
 
 	really := make([]int, lastIndex+1)
 	for index := 1; index <= lastIndex; index++ {
-		v := cfg.wait(index, servers, -1)
+		v := cfg.Wait(index, servers, -1)
 		if vi, ok := v.(int); ok {
 			really = append(really, vi)
 		} else {
@@ -957,11 +1979,11 @@ func internalChurn(t *testing.T, unreliable bool) {
 			}
 		}
 		if ok == false {
-			cfg.t.Fatalf("didn't find a value")
+			t.Fatalf("didn't find a value")
 		}
 	}
 
-	cfg.end()
+	cfg.End()
 }
 
 func TestReliableChurn2C(t *testing.T) {
@@ -971,3 +1993,105 @@ func TestReliableChurn2C(t *testing.T) {
 func TestUnreliableChurn2C(t *testing.T) {
 	internalChurn(t, true)
 }
+
+// crashes, partitions, pauses, slow disks and lossy links, piled
+// up at random under clients of a key/value store; see raftsim's soak.go.
+func TestSoak2C(t *testing.T) {
+	budget := 10 * time.Second
+	if *soakFlag > 0 {
+		budget = *soakFlag
+	}
+
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin(fmt.Sprintf("Test (2C): soak for %v", budget))
+
+	cfg.Soak(budget)
+
+	cfg.End()
+}
+
+// the requests each peer receives, as FuzzHandlers input.
+type rpcRecorder struct {
+	raft.NopObserver
+	mu   sync.Mutex
+	rpcs map[int][]byte
+}
+
+// enough for a corpus entry to be quick to run.
+const maxRecorded = 4096
+
+func (rr *rpcRecorder) RPCReceived(peer int, from int, svcMeth string, args interface{}) {
+	if svcMeth != "Raft.AppendEntries" && svcMeth != "Raft.RequestVote" {
+		return
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if len(rr.rpcs[peer]) < maxRecorded {
+		rr.rpcs[peer] = append(rr.rpcs[peer], raft.HandlerFuzzInput([]interface{}{args})...)
+	}
+}
+
+// write a fuzz corpus entry, in the format go test reads.
+func writeCorpus(t *testing.T, target string, name string, data []byte) {
+	dir := filepath.Join("testdata", "fuzz", target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	entry := fmt.Sprintf("go test fuzz v1\n[]byte(%q)\n", data)
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(entry), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// seed FuzzHandlers and FuzzReadPersist (fuzz_test.go) with what
+// a cluster's peers received and persisted through elections,
+// partitions and restarts.
+//
+// go test ./raft -run TestFuzzCorpus -fuzzcorpus
+func TestFuzzCorpus(t *testing.T) {
+	if !*fuzzCorpusFlag {
+		t.Skip("-fuzzcorpus not set")
+	}
+	servers := 5
+	cfg := make_config(t, servers, false)
+	defer cfg.Cleanup()
+
+	cfg.Begin("Test: fuzz corpora from a cluster run")
+
+	rr := &rpcRecorder{rpcs: map[int][]byte{}}
+	cfg.Observe(rr)
+
+	cfg.One(cfg.Rand().Int(), servers, true)
+	leader := cfg.CheckOneLeader()
+	cfg.Disconnect(leader)
+	for i := 0; i < 3; i++ {
+		cfg.One(cfg.Rand().Int(), servers-1, true)
+	}
+	// the old leader takes entries it can't commit.
+	for i := 0; i < 3; i++ {
+		cfg.Raft(leader).Start(cfg.Rand().Int())
+	}
+	follower := (cfg.CheckOneLeader() + 1) % servers
+	if follower == leader {
+		follower = (follower + 1) % servers
+	}
+	cfg.Crash(follower)
+	cfg.One(cfg.Rand().Int(), servers-2, true)
+	cfg.Connect(leader)
+	cfg.Start(follower)
+	cfg.Connect(follower)
+	cfg.One(cfg.Rand().Int(), servers, true)
+
+	for i := 0; i < servers; i++ {
+		rr.mu.Lock()
+		rpcs := rr.rpcs[i]
+		rr.mu.Unlock()
+		writeCorpus(t, "FuzzHandlers", fmt.Sprintf("cluster-%v", i), rpcs)
+		writeCorpus(t, "FuzzReadPersist", fmt.Sprintf("cluster-%v", i), cfg.Persister(i).ReadRaftState())
+	}
+
+	cfg.End()
+}
@@ -0,0 +1,416 @@
+package raft
+
+//
+// per-entry tracing.
+//
+// tr := NewTracer(sink) -- e.g. sink, err := NewFileSink("trace.jsonl")
+// rf.SetTracer(tr)      -- on every peer; they may share one Tracer
+//
+// every entry a traced leader accepts in Start() gets its own
+// trace, whose id travels to the followers in
+// AppendEntriesArgs.Traces. the spans are:
+//
+//   raft.propose           Start() until the leader applies the entry (root)
+//     raft.leader_append   appending and persisting on the leader
+//     raft.queue           waiting for the first AppendEntries to carry it
+//     raft.replicate       sent to one follower until it acks (one per follower)
+//       raft.follower_append   the follower's handler, persist included
+//     raft.commit_wait     persisted on the leader until a majority has it
+//     raft.apply           committed until delivered on applyCh
+//
+// a leader that loses its leadership ends its open spans
+// with raft.abandoned=1, as it does the raft.replicate span
+// of a follower that still has not acked an entry applied
+// traceKeep entries ago.
+//
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// what a follower needs to attach its spans to a leader's trace.
+type TraceContext struct {
+	TraceId string
+	SpanId  string // the leader's raft.replicate span for this follower
+}
+
+type Span struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string // "" for a root span
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Attrs        map[string]int // e.g. raft.node, raft.index
+}
+
+// a SpanSink receives finished spans.
+type SpanSink interface {
+	Export(spans []Span) error
+}
+
+type Tracer struct {
+	sink SpanSink
+}
+
+func NewTracer(sink SpanSink) *Tracer {
+	tr := &Tracer{}
+	tr.sink = sink
+	return tr
+}
+
+// a random id of n bytes, in hex: 16 for traces, 8 for spans.
+// caller must hold rf.mu.
+func (rf *Raft) newId(n int) string {
+	b := make([]byte, n)
+	rf.traceRand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// caller must hold rf.mu.
+func (rf *Raft) span(traceId, parent, name string, start time.Time, attrs map[string]int) *Span {
+	return &Span{
+		TraceId:      traceId,
+		SpanId:       rf.newId(8),
+		ParentSpanId: parent,
+		Name:         name,
+		Start:        start,
+		Attrs:        attrs,
+	}
+}
+
+func (tr *Tracer) end(s *Span, end time.Time) {
+	s.End = end
+	tr.sink.Export([]Span{*s})
+}
+
+// SetTracer turns tracing on (or off, with nil) for this peer.
+func (rf *Raft) SetTracer(tr *Tracer) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.tracer = tr
+	rf.traces = map[int]*entryTrace{}
+
+	// ids come from the peer's own Options, so that a seeded
+	// run traces with the same ids each time.
+	var seed int64
+	switch {
+	case rf.rand != nil:
+		seed = rf.rand.Int63()
+	case rf.seed != 0:
+		seed = rf.seed + int64(rf.me)
+	default:
+		seed = rand.Int63()
+	}
+	rf.traceRand = rand.New(rand.NewSource(seed))
+}
+
+// how far behind the last applied entry a trace can be
+// before its unacked raft.replicate spans are abandoned.
+const traceKeep = 1000
+
+// the leader's open spans for one entry.
+type entryTrace struct {
+	root      *Span
+	queue     *Span
+	commit    *Span
+	apply     *Span
+	replicate map[int]*Span // peer -> span
+}
+
+func (rf *Raft) attrs(index int) map[string]int {
+	return map[string]int{"raft.node": rf.me, "raft.index": index, "raft.term": rf.currentTerm}
+}
+
+// Start() appended entry to the leader's log at t0, and has
+// just persisted it. caller must hold rf.mu.
+func (rf *Raft) traceStart(index int, t0 time.Time) {
+	if rf.tracer == nil {
+		return
+	}
+	tr := rf.tracer
+	now := rf.clock.Now()
+	et := &entryTrace{replicate: map[int]*Span{}}
+	et.root = rf.span(rf.newId(16), "", "raft.propose", t0, rf.attrs(index))
+	tr.end(rf.span(et.root.TraceId, et.root.SpanId, "raft.leader_append", t0, rf.attrs(index)), now)
+	et.queue = rf.span(et.root.TraceId, et.root.SpanId, "raft.queue", now, rf.attrs(index))
+	et.commit = rf.span(et.root.TraceId, et.root.SpanId, "raft.commit_wait", now, rf.attrs(index))
+	rf.traces[index] = et
+}
+
+// args are about to go to peer; give each traced entry a
+// raft.replicate span, unless it already has one, and tell
+// the follower about it. caller must hold rf.mu.
+func (rf *Raft) traceSend(peer int, args *AppendEntriesArgs) {
+	if rf.tracer == nil || len(args.Entries) == 0 {
+		return
+	}
+	tr := rf.tracer
+	now := rf.clock.Now()
+	traced := false
+	ctxs := make([]TraceContext, len(args.Entries))
+	for i, e := range args.Entries {
+		et, ok := rf.traces[e.Index]
+		if !ok {
+			continue
+		}
+		if et.queue != nil {
+			tr.end(et.queue, now)
+			et.queue = nil
+		}
+		sp, ok := et.replicate[peer]
+		if !ok {
+			a := rf.attrs(e.Index)
+			a["raft.peer"] = peer
+			sp = rf.span(et.root.TraceId, et.root.SpanId, "raft.replicate", now, a)
+			et.replicate[peer] = sp
+		}
+		ctxs[i] = TraceContext{TraceId: sp.TraceId, SpanId: sp.SpanId}
+		traced = true
+	}
+	if traced {
+		args.Traces = ctxs
+	}
+}
+
+// peer acked args. caller must hold rf.mu.
+func (rf *Raft) traceAck(peer int, args *AppendEntriesArgs) {
+	if rf.tracer == nil {
+		return
+	}
+	now := rf.clock.Now()
+	for _, e := range args.Entries {
+		if et, ok := rf.traces[e.Index]; ok {
+			if sp, ok := et.replicate[peer]; ok && sp.End.IsZero() {
+				rf.tracer.end(sp, now)
+			}
+			rf.traceForget(e.Index, et)
+		}
+	}
+}
+
+// drop index's trace once it has been applied and every
+// follower has acked. caller must hold rf.mu.
+func (rf *Raft) traceForget(index int, et *entryTrace) {
+	if et.root.End.IsZero() {
+		return
+	}
+	for _, sp := range et.replicate {
+		if sp.End.IsZero() {
+			return
+		}
+	}
+	delete(rf.traces, index)
+}
+
+// commitIndex has moved up to index on the leader.
+// caller must hold rf.mu.
+func (rf *Raft) traceCommit(index int) {
+	if rf.tracer == nil {
+		return
+	}
+	now := rf.clock.Now()
+	for i, et := range rf.traces {
+		if i <= index && et.commit != nil {
+			rf.tracer.end(et.commit, now)
+			et.commit = nil
+			et.apply = rf.span(et.root.TraceId, et.root.SpanId, "raft.apply", now, rf.attrs(i))
+		}
+	}
+}
+
+// the leader has delivered index on applyCh. caller must hold rf.mu.
+func (rf *Raft) traceApply(index int) {
+	if rf.tracer == nil {
+		return
+	}
+	et, ok := rf.traces[index]
+	if !ok {
+		return
+	}
+	now := rf.clock.Now()
+	if et.apply != nil {
+		rf.tracer.end(et.apply, now)
+		et.apply = nil
+	}
+	rf.tracer.end(et.root, now)
+	rf.traceForget(index, et)
+
+	// give up on followers that are far behind.
+	for i, old := range rf.traces {
+		if i > index-traceKeep || old.root.End.IsZero() {
+			continue
+		}
+		for _, sp := range old.replicate {
+			if sp.End.IsZero() {
+				sp.Attrs["raft.abandoned"] = 1
+				rf.tracer.end(sp, now)
+			}
+		}
+		delete(rf.traces, i)
+	}
+}
+
+// no longer leader: end every open span. caller must hold rf.mu.
+func (rf *Raft) traceAbandon() {
+	if rf.tracer == nil || len(rf.traces) == 0 {
+		return
+	}
+	now := rf.clock.Now()
+	for _, et := range rf.traces {
+		open := []*Span{et.queue, et.commit, et.apply}
+		for _, sp := range et.replicate {
+			open = append(open, sp)
+		}
+		open = append(open, et.root)
+		for _, sp := range open {
+			if sp != nil && sp.End.IsZero() {
+				sp.Attrs["raft.abandoned"] = 1
+				rf.tracer.end(sp, now)
+			}
+		}
+	}
+	rf.traces = map[int]*entryTrace{}
+}
+
+// a follower's handler appended the traced entries in args,
+// having started at t0. caller must hold rf.mu.
+func (rf *Raft) traceFollowerAppend(args *AppendEntriesArgs, t0 time.Time) {
+	if rf.tracer == nil {
+		return
+	}
+	now := rf.clock.Now()
+	for i, ctx := range args.Traces {
+		if ctx.TraceId == "" || i >= len(args.Entries) {
+			continue
+		}
+		a := rf.attrs(args.Entries[i].Index)
+		a["raft.leader"] = args.LeaderId
+		rf.tracer.end(rf.span(ctx.TraceId, ctx.SpanId, "raft.follower_append", t0, a), now)
+	}
+}
+
+//
+// a SpanSink that appends spans to a file as OpenTelemetry
+// OTLP/JSON, one ExportTraceServiceRequest per line -- the
+// same layout as the OpenTelemetry Collector's file exporter.
+//
+
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (fs *FileSink) Export(spans []Span) error {
+	b, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.w.Write(b)
+	return fs.w.WriteByte('\n')
+}
+
+func (fs *FileSink) Flush() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.w.Flush()
+}
+
+func (fs *FileSink) Close() error {
+	if err := fs.Flush(); err != nil {
+		return err
+	}
+	return fs.f.Close()
+}
+
+//
+// the OTLP/JSON encoding.
+//
+
+type otlpValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"` // int64s are strings in OTLP/JSON
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"` // 1 is SPAN_KIND_INTERNAL
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpRequest(spans []Span) otlpExportRequest {
+	ss := otlpScopeSpans{}
+	ss.Scope.Name = "mitraft/raft"
+	for _, s := range spans {
+		keys := make([]string, 0, len(s.Attrs))
+		for k := range s.Attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var attrs []otlpKeyValue
+		for _, k := range keys {
+			attrs = append(attrs, otlpKeyValue{k, otlpValue{IntValue: strconv.Itoa(s.Attrs[k])}})
+		}
+		ss.Spans = append(ss.Spans, otlpSpan{
+			TraceId:           s.TraceId,
+			SpanId:            s.SpanId,
+			ParentSpanId:      s.ParentSpanId,
+			Name:              s.Name,
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attrs,
+		})
+	}
+	rs := otlpResourceSpans{}
+	rs.Resource.Attributes = []otlpKeyValue{{"service.name", otlpValue{StringValue: "raft"}}}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return otlpExportRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
@@ -0,0 +1,156 @@
+package raft
+
+//
+// leadership transfer (Raft thesis 3.10).
+//
+// rf.TransferLeadership(target, timeout) -- stop taking new commands,
+//   bring target's log up to date, then tell it to start an election
+//   at once with TimeoutNow; target wins before anyone else times out.
+// rf.StepDown() -- stop leading, and hold off our own next election
+//   long enough for another peer to win.
+// rf.ForceElection() -- stand for election now.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNotLeader          = errors.New("raft: not the leader")
+	ErrTransferInProgress = errors.New("raft: leadership transfer already in progress")
+	ErrTransferTimeout    = errors.New("raft: leadership transfer timed out")
+)
+
+// how long a peer that stepped down waits before it may stand again.
+const stepDownHoldoff = 500 * time.Millisecond
+
+// how often TransferLeadership checks on target.
+const transferPoll = 10 * time.Millisecond
+
+type TimeoutNowArgs struct {
+	Term     int
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	Term int
+}
+
+// TransferLeadership hands leadership to target, or, if target
+// is -1, to the most up-to-date follower. Start() refuses new
+// commands while it runs. it returns nil once this peer has
+// stepped down after sending TimeoutNow.
+func (rf *Raft) TransferLeadership(target int, timeout time.Duration) error {
+	rf.mu.Lock()
+	if rf.state != Leader {
+		rf.mu.Unlock()
+		return ErrNotLeader
+	}
+	if rf.leadTransferee != -1 {
+		rf.mu.Unlock()
+		return ErrTransferInProgress
+	}
+	if target == -1 {
+		for i := range rf.peers {
+			if i != rf.me && (target == -1 || rf.matchIndex[i] > rf.matchIndex[target]) {
+				target = i
+			}
+		}
+	}
+	if target < 0 || target >= len(rf.peers) || target == rf.me {
+		rf.mu.Unlock()
+		return fmt.Errorf("raft: cannot transfer leadership to peer %d", target)
+	}
+	rf.leadTransferee = target
+	term := rf.currentTerm
+	rf.logf(LevelInfo, "transferring leadership", "to", target)
+	rf.mu.Unlock()
+
+	defer func() {
+		rf.mu.Lock()
+		if rf.currentTerm == term && rf.leadTransferee == target {
+			rf.leadTransferee = -1
+		}
+		rf.mu.Unlock()
+	}()
+
+	sent := false
+	for deadline := rf.clock.Now().Add(timeout); rf.clock.Now().Before(deadline); rf.clock.Sleep(transferPoll) {
+		rf.mu.Lock()
+		if rf.state != Leader || rf.currentTerm != term {
+			rf.mu.Unlock()
+			if sent {
+				return nil
+			}
+			return ErrNotLeader
+		}
+		caughtUp := rf.matchIndex[target] == rf.lastIndex()
+		args := TimeoutNowArgs{Term: term, LeaderId: rf.me}
+		ctx := rf.ctx
+		rf.mu.Unlock()
+
+		// heartbeats bring target up to date meanwhile.
+		if caughtUp && !sent {
+			sent = rf.sendTimeoutNow(ctx, target, &args)
+		}
+	}
+	return ErrTransferTimeout
+}
+
+func (rf *Raft) sendTimeoutNow(ctx context.Context, server int, args *TimeoutNowArgs) bool {
+	var reply TimeoutNowReply
+	rf.notify(func(o Observer) { o.RPCSent(rf.me, server, "Raft.TimeoutNow", args) })
+	if err := rf.transport.Call(ctx, server, "Raft.TimeoutNow", args, &reply); err != nil {
+		rf.callFailed(server, "Raft.TimeoutNow", err)
+		// abandoned because our term moved on, most likely to
+		// target's election, before its reply got back.
+		return err == context.Canceled
+	}
+	rf.notify(func(o Observer) { o.RPCReplied(rf.me, server, "Raft.TimeoutNow", args, &reply) })
+	return reply.Term == args.Term
+}
+
+// TimeoutNow RPC handler: the leader of args.Term wants us to
+// take over, and has made sure our log is as long as its own.
+func (rf *Raft) TimeoutNow(args *TimeoutNowArgs, reply *TimeoutNowReply) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.notify(func(o Observer) { o.RPCReceived(rf.me, args.LeaderId, "Raft.TimeoutNow", args) })
+
+	reply.Term = rf.currentTerm
+	if args.Term != rf.currentTerm || rf.state != Follower {
+		return
+	}
+	rf.logf(LevelInfo, "election forced by leader", "from", args.LeaderId)
+	rf.clock.Go(rf.startElection)
+}
+
+// ForceElection starts an election at once, as if the peer's
+// election timeout had run out. a leader ignores it.
+func (rf *Raft) ForceElection() {
+	rf.mu.Lock()
+	leader := rf.state == Leader
+	rf.mu.Unlock()
+	if !leader && !rf.killed() {
+		rf.startElection()
+	}
+}
+
+// StepDown makes a leader a follower without a new term. it
+// won't stand for election again for a while, so the rest of
+// the cluster should elect someone else.
+func (rf *Raft) StepDown() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.state != Leader {
+		return ErrNotLeader
+	}
+	rf.setRole(Follower)
+	rf.leaderId = -1
+	rf.electionResetEvent = rf.clock.Now().Add(stepDownHoldoff)
+	return nil
+}
@@ -0,0 +1,101 @@
+package shardctrler
+
+//
+// Shardctrler clerk.
+//
+
+import (
+	"crypto/rand"
+	"math/big"
+	"mitraft/labrpc"
+	"time"
+)
+
+type Clerk struct {
+	servers  []*labrpc.ClientEnd
+	clientId int64
+	seqNum   int
+	leader   int // last server known to be leader
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	x := bigx.Int64()
+	return x
+}
+
+func MakeClerk(servers []*labrpc.ClientEnd) *Clerk {
+	ck := new(Clerk)
+	ck.servers = servers
+	ck.clientId = nrand()
+	return ck
+}
+
+func (ck *Clerk) Query(num int) Config {
+	args := &QueryArgs{Num: num}
+	for {
+		// try each known server.
+		for i := 0; i < len(ck.servers); i++ {
+			srv := ck.servers[(ck.leader+i)%len(ck.servers)]
+			var reply QueryReply
+			ok := srv.Call("ShardCtrler.Query", args, &reply)
+			if ok && reply.WrongLeader == false && reply.Err == OK {
+				ck.leader = (ck.leader + i) % len(ck.servers)
+				return reply.Config
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (ck *Clerk) Join(servers map[int][]string) {
+	ck.seqNum++
+	args := &JoinArgs{Servers: servers, ClientId: ck.clientId, SeqNum: ck.seqNum}
+	for {
+		for i := 0; i < len(ck.servers); i++ {
+			srv := ck.servers[(ck.leader+i)%len(ck.servers)]
+			var reply JoinReply
+			ok := srv.Call("ShardCtrler.Join", args, &reply)
+			if ok && reply.WrongLeader == false && reply.Err == OK {
+				ck.leader = (ck.leader + i) % len(ck.servers)
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (ck *Clerk) Leave(gids []int) {
+	ck.seqNum++
+	args := &LeaveArgs{GIDs: gids, ClientId: ck.clientId, SeqNum: ck.seqNum}
+	for {
+		for i := 0; i < len(ck.servers); i++ {
+			srv := ck.servers[(ck.leader+i)%len(ck.servers)]
+			var reply LeaveReply
+			ok := srv.Call("ShardCtrler.Leave", args, &reply)
+			if ok && reply.WrongLeader == false && reply.Err == OK {
+				ck.leader = (ck.leader + i) % len(ck.servers)
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (ck *Clerk) Move(shard int, gid int) {
+	ck.seqNum++
+	args := &MoveArgs{Shard: shard, GID: gid, ClientId: ck.clientId, SeqNum: ck.seqNum}
+	for {
+		for i := 0; i < len(ck.servers); i++ {
+			srv := ck.servers[(ck.leader+i)%len(ck.servers)]
+			var reply MoveReply
+			ok := srv.Call("ShardCtrler.Move", args, &reply)
+			if ok && reply.WrongLeader == false && reply.Err == OK {
+				ck.leader = (ck.leader + i) % len(ck.servers)
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,160 @@
+package shardctrler
+
+//
+// Shard controller: assigns shards to replication groups.
+//
+// RPC interface:
+// Join(servers) -- add a set of groups (gid -> server-list mapping).
+// Leave(gids) -- delete a set of groups.
+// Move(shard, gid) -- hand off one shard from current owner to gid.
+// Query(num) -> fetch Config # num, or latest config if num==-1.
+//
+// A Config (configuration) describes a set of replica groups, and the
+// replica group responsible for each shard. Configs are numbered. Config
+// #0 is the initial configuration, with no groups and all shards
+// assigned to group 0 (the invalid group).
+//
+// You will need to add fields to the RPC argument structs.
+//
+
+import "sort"
+
+// The number of shards.
+const NShards = 10
+
+// A configuration -- an assignment of shards to groups.
+// Please don't change this.
+type Config struct {
+	Num    int              // config number
+	Shards [NShards]int     // shard -> gid
+	Groups map[int][]string // gid -> servers[]
+}
+
+const (
+	OK             = "OK"
+	ErrWrongLeader = "ErrWrongLeader"
+	ErrTimeout     = "ErrTimeout"
+)
+
+type Err string
+
+type JoinArgs struct {
+	Servers  map[int][]string // new GID -> servers mappings
+	ClientId int64
+	SeqNum   int
+}
+
+type JoinReply struct {
+	WrongLeader bool
+	Err         Err
+}
+
+type LeaveArgs struct {
+	GIDs     []int
+	ClientId int64
+	SeqNum   int
+}
+
+type LeaveReply struct {
+	WrongLeader bool
+	Err         Err
+}
+
+type MoveArgs struct {
+	Shard    int
+	GID      int
+	ClientId int64
+	SeqNum   int
+}
+
+type MoveReply struct {
+	WrongLeader bool
+	Err         Err
+}
+
+type QueryArgs struct {
+	Num int // desired config number
+}
+
+type QueryReply struct {
+	WrongLeader bool
+	Err         Err
+	Config      Config
+}
+
+// deep copy of a config, so that the caller can't
+// alias the controller's Groups map.
+func (cf Config) Copy() Config {
+	nc := Config{Num: cf.Num, Shards: cf.Shards}
+	nc.Groups = make(map[int][]string, len(cf.Groups))
+	for gid, servers := range cf.Groups {
+		nc.Groups[gid] = append([]string{}, servers...)
+	}
+	return nc
+}
+
+// spread the shards as evenly as possible over the groups in
+// cf.Groups, moving as few shards as possible. every replica
+// runs this on the same input, so it must be deterministic:
+// map iteration order is never allowed to leak into the result.
+func (cf *Config) rebalance() {
+	if len(cf.Groups) == 0 {
+		for s := range cf.Shards {
+			cf.Shards[s] = 0
+		}
+		return
+	}
+
+	owned := map[int][]int{}
+	orphans := []int{}
+	for shard, gid := range cf.Shards {
+		if _, ok := cf.Groups[gid]; ok {
+			owned[gid] = append(owned[gid], shard)
+		} else {
+			orphans = append(orphans, shard)
+		}
+	}
+
+	// most-loaded groups first, ties broken by gid, so that
+	// the groups that get the extra shards are the ones that
+	// already have them.
+	gids := make([]int, 0, len(cf.Groups))
+	for gid := range cf.Groups {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool {
+		if len(owned[gids[i]]) != len(owned[gids[j]]) {
+			return len(owned[gids[i]]) > len(owned[gids[j]])
+		}
+		return gids[i] < gids[j]
+	})
+
+	target := func(i int) int {
+		n := NShards / len(gids)
+		if i < NShards%len(gids) {
+			n++
+		}
+		return n
+	}
+
+	for i, gid := range gids {
+		for len(owned[gid]) > target(i) {
+			last := len(owned[gid]) - 1
+			orphans = append(orphans, owned[gid][last])
+			owned[gid] = owned[gid][:last]
+		}
+	}
+	sort.Ints(orphans)
+	for i, gid := range gids {
+		for len(owned[gid]) < target(i) {
+			owned[gid] = append(owned[gid], orphans[0])
+			orphans = orphans[1:]
+		}
+	}
+
+	for gid, shards := range owned {
+		for _, shard := range shards {
+			cf.Shards[shard] = gid
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package shardctrler
+
+import (
+	"mitraft/labgob"
+	"mitraft/labrpc"
+	"mitraft/raft"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long an RPC handler waits for its operation to
+// come out of the Raft log before giving up.
+const applyTimeout = 800 * time.Millisecond
+
+const (
+	opJoin  = "Join"
+	opLeave = "Leave"
+	opMove  = "Move"
+	opQuery = "Query"
+)
+
+type ShardCtrler struct {
+	mu      sync.Mutex
+	me      int
+	rf      *raft.Raft
+	applyCh chan raft.ApplyMsg
+	dead    int32 // set by Kill()
+
+	configs []Config // indexed by config num
+
+	lastSeq map[int64]int         // client id -> highest applied SeqNum
+	waiters map[int]chan opResult // log index -> waiting RPC handler
+}
+
+type Op struct {
+	Type     string
+	Servers  map[int][]string // Join
+	GIDs     []int            // Leave
+	Shard    int              // Move
+	GID      int              // Move
+	Num      int              // Query
+	ClientId int64
+	SeqNum   int
+}
+
+type opResult struct {
+	clientId int64
+	seqNum   int
+	typ      string
+	config   Config
+}
+
+// hand an operation to Raft and wait until it has been
+// applied at the index Raft picked for it. returns false
+// if this server isn't the leader, or if some other
+// operation ended up at that index (leadership changed).
+func (sc *ShardCtrler) submit(op Op) (opResult, bool) {
+	index, _, isLeader := sc.rf.Start(op)
+	if !isLeader {
+		return opResult{}, false
+	}
+
+	sc.mu.Lock()
+	ch := make(chan opResult, 1)
+	sc.waiters[index] = ch
+	sc.mu.Unlock()
+
+	defer func() {
+		sc.mu.Lock()
+		if sc.waiters[index] == ch {
+			delete(sc.waiters, index)
+		}
+		sc.mu.Unlock()
+	}()
+
+	select {
+	case res := <-ch:
+		if res.clientId != op.ClientId || res.seqNum != op.SeqNum || res.typ != op.Type {
+			return opResult{}, false
+		}
+		return res, true
+	case <-time.After(applyTimeout):
+		return opResult{}, false
+	}
+}
+
+func (sc *ShardCtrler) Join(args *JoinArgs, reply *JoinReply) {
+	op := Op{Type: opJoin, Servers: args.Servers, ClientId: args.ClientId, SeqNum: args.SeqNum}
+	if _, ok := sc.submit(op); !ok {
+		reply.WrongLeader = true
+		reply.Err = ErrWrongLeader
+		return
+	}
+	reply.Err = OK
+}
+
+func (sc *ShardCtrler) Leave(args *LeaveArgs, reply *LeaveReply) {
+	op := Op{Type: opLeave, GIDs: args.GIDs, ClientId: args.ClientId, SeqNum: args.SeqNum}
+	if _, ok := sc.submit(op); !ok {
+		reply.WrongLeader = true
+		reply.Err = ErrWrongLeader
+		return
+	}
+	reply.Err = OK
+}
+
+func (sc *ShardCtrler) Move(args *MoveArgs, reply *MoveReply) {
+	op := Op{Type: opMove, Shard: args.Shard, GID: args.GID, ClientId: args.ClientId, SeqNum: args.SeqNum}
+	if _, ok := sc.submit(op); !ok {
+		reply.WrongLeader = true
+		reply.Err = ErrWrongLeader
+		return
+	}
+	reply.Err = OK
+}
+
+func (sc *ShardCtrler) Query(args *QueryArgs, reply *QueryReply) {
+	// queries go through the log too, so that a deposed
+	// leader can't answer with a stale configuration.
+	op := Op{Type: opQuery, Num: args.Num, ClientId: nrand()}
+	res, ok := sc.submit(op)
+	if !ok {
+		reply.WrongLeader = true
+		reply.Err = ErrWrongLeader
+		return
+	}
+	reply.Err = OK
+	reply.Config = res.config
+}
+
+// apply one committed operation to the config list.
+// duplicate Join/Leave/Move requests (client retries)
+// are recognized by SeqNum and applied only once.
+func (sc *ShardCtrler) applyOp(op Op) opResult {
+	res := opResult{clientId: op.ClientId, seqNum: op.SeqNum, typ: op.Type}
+
+	if op.Type == opQuery {
+		if op.Num < 0 || op.Num >= len(sc.configs) {
+			res.config = sc.configs[len(sc.configs)-1].Copy()
+		} else {
+			res.config = sc.configs[op.Num].Copy()
+		}
+		return res
+	}
+
+	if op.SeqNum <= sc.lastSeq[op.ClientId] {
+		return res
+	}
+	sc.lastSeq[op.ClientId] = op.SeqNum
+
+	cf := sc.configs[len(sc.configs)-1].Copy()
+	cf.Num++
+
+	switch op.Type {
+	case opJoin:
+		for gid, servers := range op.Servers {
+			cf.Groups[gid] = append([]string{}, servers...)
+		}
+		cf.rebalance()
+	case opLeave:
+		for _, gid := range op.GIDs {
+			delete(cf.Groups, gid)
+			for shard := range cf.Shards {
+				if cf.Shards[shard] == gid {
+					cf.Shards[shard] = 0
+				}
+			}
+		}
+		cf.rebalance()
+	case opMove:
+		if op.Shard >= 0 && op.Shard < NShards {
+			cf.Shards[op.Shard] = op.GID
+		}
+	}
+
+	sc.configs = append(sc.configs, cf)
+	return res
+}
+
+func (sc *ShardCtrler) applier() {
+	for m := range sc.applyCh {
+		// keep draining after Kill(), since Raft holds its
+		// lock while it sends on applyCh.
+		if sc.killed() || !m.CommandValid {
+			continue
+		}
+		op, ok := m.Command.(Op)
+		if !ok {
+			continue
+		}
+
+		sc.mu.Lock()
+		res := sc.applyOp(op)
+		if ch, ok := sc.waiters[m.CommandIndex]; ok {
+			ch <- res
+			delete(sc.waiters, m.CommandIndex)
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// the tester calls Kill() when a ShardCtrler instance won't
+// be needed again. you are not required to do anything
+// in Kill(), but it might be convenient to (for example)
+// turn off debug output from this instance.
+func (sc *ShardCtrler) Kill() {
+	atomic.StoreInt32(&sc.dead, 1)
+	sc.rf.Kill()
+}
+
+func (sc *ShardCtrler) killed() bool {
+	z := atomic.LoadInt32(&sc.dead)
+	return z == 1
+}
+
+// needed by shardkv tester
+func (sc *ShardCtrler) Raft() *raft.Raft {
+	return sc.rf
+}
+
+// servers[] contains the ports of the set of
+// servers that will cooperate via Raft to
+// form the fault-tolerant shardctrler service.
+// me is the index of the current server in servers[].
+func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister) *ShardCtrler {
+	labgob.Register(Op{})
+
+	sc := new(ShardCtrler)
+	sc.me = me
+
+	sc.configs = make([]Config, 1)
+	sc.configs[0].Groups = map[int][]string{}
+
+	sc.lastSeq = make(map[int64]int)
+	sc.waiters = make(map[int]chan opResult)
+
+	sc.applyCh = make(chan raft.ApplyMsg)
+	sc.rf = raft.Make(servers, me, persister, sc.applyCh)
+
+	go sc.applier()
+
+	return sc
+}
@@ -0,0 +1,82 @@
+package shardkv
+
+//
+// Sharded key/value server.
+// Lots of replica groups, each running Raft.
+// Shardctrler decides which group serves each shard.
+// Shardctrler may change shard assignment from time to time.
+//
+// You will have to modify these definitions.
+//
+
+import "mitraft/shardctrler"
+
+const (
+	OK             = "OK"
+	ErrNoKey       = "ErrNoKey"
+	ErrWrongGroup  = "ErrWrongGroup"
+	ErrWrongLeader = "ErrWrongLeader"
+	ErrNotReady    = "ErrNotReady" // peer group hasn't reached the same config yet
+)
+
+type Err string
+
+// Put or Append
+type PutAppendArgs struct {
+	Key      string
+	Value    string
+	Op       string // "Put" or "Append"
+	ClientId int64
+	SeqNum   int
+}
+
+type PutAppendReply struct {
+	Err Err
+}
+
+type GetArgs struct {
+	Key      string
+	ClientId int64
+	SeqNum   int
+}
+
+type GetReply struct {
+	Err   Err
+	Value string
+}
+
+// sent by a group that gained shards in config ConfigNum
+// to the group that owned them in config ConfigNum-1.
+type PullShardArgs struct {
+	ConfigNum int
+	Shards    []int
+}
+
+type PullShardReply struct {
+	Err     Err
+	Data    map[int]map[string]string // shard -> key/value pairs
+	LastSeq map[int64]int             // client id -> highest applied SeqNum
+}
+
+// sent by the new owner once it has installed the shards,
+// so that the old owner can forget them.
+type DeleteShardArgs struct {
+	ConfigNum int
+	Shards    []int
+}
+
+type DeleteShardReply struct {
+	Err Err
+}
+
+// which shard is a key in?
+// please use this function,
+// and please do not change it.
+func key2shard(key string) int {
+	shard := 0
+	if len(key) > 0 {
+		shard = int(key[0])
+	}
+	shard %= shardctrler.NShards
+	return shard
+}
@@ -0,0 +1,447 @@
+package shardkv
+
+//
+// support for sharded k/v tester.
+//
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"mitraft/labrpc"
+	"mitraft/lincheck"
+	"mitraft/raft"
+	"mitraft/shardctrler"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func randstring(n int) string {
+	b := make([]byte, 2*n)
+	crand.Read(b)
+	s := base64.URLEncoding.EncodeToString(b)
+	return s[0:n]
+}
+
+func makeSeed() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := crand.Int(crand.Reader, max)
+	x := bigx.Int64()
+	return x
+}
+
+// Randomize server handles
+func random_handles(kvh []*labrpc.ClientEnd) []*labrpc.ClientEnd {
+	sa := make([]*labrpc.ClientEnd, len(kvh))
+	copy(sa, kvh)
+	for i := range sa {
+		j := rand.Intn(i + 1)
+		sa[i], sa[j] = sa[j], sa[i]
+	}
+	return sa
+}
+
+type group struct {
+	gid       int
+	servers   []*ShardKV
+	saved     []*raft.Persister
+	endnames  [][]string // names of each server's ends to the rest of its group
+	mendnames [][]string // names of each server's ends to the controllers
+}
+
+type config struct {
+	mu    sync.Mutex
+	t     *testing.T
+	net   *labrpc.Network
+	start time.Time // time at which make_config() was called
+	t0    time.Time // time at which test_test.go called cfg.begin()
+	rpcs0 int       // rpcTotal() at start of test
+
+	nctrlers      int
+	ctrlerservers []*shardctrler.ShardCtrler
+	mck           *shardctrler.Clerk
+
+	ngroups int
+	n       int // servers per k/v group
+	groups  []*group
+
+	clerks       map[*Clerk][]string
+	clientIds    map[*Clerk]int    // for history
+	history      *lincheck.History // of every Get, Put and Append through cfg
+	maxraftstate int
+}
+
+// how long end() may spend checking that the history is
+// linearizable before giving it the benefit of the doubt.
+const linearizabilityCheckTimeout = 4 * time.Second
+
+var ncpu_once sync.Once
+
+func (cfg *config) checkTimeout() {
+	// enforce a two minute real-time limit on each test
+	if !cfg.t.Failed() && time.Since(cfg.start) > 120*time.Second {
+		cfg.t.Fatal("test took longer than 120 seconds")
+	}
+}
+
+func (cfg *config) cleanup() {
+	for gi := 0; gi < cfg.ngroups; gi++ {
+		cfg.ShutdownGroup(gi)
+	}
+	for i := 0; i < cfg.nctrlers; i++ {
+		cfg.ctrlerservers[i].Kill()
+	}
+	cfg.net.Cleanup()
+	cfg.checkTimeout()
+}
+
+// controller server name for labrpc.
+func (cfg *config) ctrlername(i int) string {
+	return "ctrler" + strconv.Itoa(i)
+}
+
+// shard server name for labrpc.
+// i'th server of group gid.
+func (cfg *config) servername(gid int, i int) string {
+	return "server-" + strconv.Itoa(gid) + "-" + strconv.Itoa(i)
+}
+
+func (cfg *config) makeClient() *Clerk {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	// ClientEnds to talk to controller service.
+	ends := make([]*labrpc.ClientEnd, cfg.nctrlers)
+	endnames := make([]string, cfg.nctrlers)
+	for j := 0; j < cfg.nctrlers; j++ {
+		endnames[j] = randstring(20)
+		ends[j] = cfg.net.MakeEnd(endnames[j])
+		cfg.net.Connect(endnames[j], cfg.ctrlername(j))
+		cfg.net.Enable(endnames[j], true)
+	}
+
+	ck := MakeClerk(ends, func(servername string) *labrpc.ClientEnd {
+		name := randstring(20)
+		end := cfg.net.MakeEnd(name)
+		cfg.net.Connect(name, servername)
+		cfg.net.Enable(name, true)
+		return end
+	})
+	cfg.clerks[ck] = endnames
+	cfg.clientIds[ck] = len(cfg.clientIds)
+	return ck
+}
+
+// the tests' Get, Put and Append: ck's, recorded in cfg.history.
+func (cfg *config) Get(ck *Clerk, key string) string {
+	p := cfg.history.Invoke(cfg.clientId(ck), lincheck.KvInput{Op: "Get", Key: key})
+	v := ck.Get(key)
+	p.Return(lincheck.KvOutput{Value: v})
+	return v
+}
+
+func (cfg *config) Put(ck *Clerk, key string, value string) {
+	p := cfg.history.Invoke(cfg.clientId(ck), lincheck.KvInput{Op: "Put", Key: key, Value: value})
+	ck.Put(key, value)
+	p.Return(lincheck.KvOutput{})
+}
+
+func (cfg *config) Append(ck *Clerk, key string, value string) {
+	p := cfg.history.Invoke(cfg.clientId(ck), lincheck.KvInput{Op: "Append", Key: key, Value: value})
+	ck.Append(key, value)
+	p.Return(lincheck.KvOutput{})
+}
+
+func (cfg *config) clientId(ck *Clerk) int {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	return cfg.clientIds[ck]
+}
+
+// fail the test if the history isn't linearizable, and write
+// the part that isn't to a page that shows why.
+func (cfg *config) checkLinearizable() {
+	res, info := lincheck.Check(lincheck.KvModel, cfg.history.Operations(), linearizabilityCheckTimeout)
+	switch res {
+	case lincheck.Illegal:
+		f, err := os.CreateTemp("", "shardkv-*.html")
+		if err == nil {
+			info.WriteHTML(f)
+			f.Close()
+			fmt.Printf("info: wrote the history to %v\n", f.Name())
+		}
+		cfg.t.Fatal("history is not linearizable")
+	case lincheck.Unknown:
+		fmt.Printf("info: linearizability check timed out, assuming the history is ok\n")
+	}
+}
+
+func (cfg *config) deleteClient(ck *Clerk) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	v := cfg.clerks[ck]
+	for i := 0; i < len(v); i++ {
+		cfg.net.Enable(v[i], false)
+	}
+	delete(cfg.clerks, ck)
+}
+
+// Shutdown i'th server of gi'th group, by isolating it
+func (cfg *config) ShutdownServer(gi int, i int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+
+	gg := cfg.groups[gi]
+
+	// prevent this server from sending
+	for j := 0; j < len(gg.servers); j++ {
+		name := gg.endnames[i][j]
+		cfg.net.Enable(name, false)
+	}
+	for j := 0; j < len(gg.mendnames[i]); j++ {
+		name := gg.mendnames[i][j]
+		cfg.net.Enable(name, false)
+	}
+
+	// disable client connections to the server.
+	// it's important to do this before creating
+	// the new Persister in saved[i], to avoid
+	// the possibility of the server returning a
+	// positive reply to an Append but persisting
+	// the result in the superseded Persister.
+	cfg.net.DeleteServer(cfg.servername(gg.gid, i))
+
+	// a fresh persister, in case old instance
+	// continues to update the Persister.
+	// but copy old persister's content so that we always
+	// pass Make() the last persisted state.
+	if gg.saved[i] != nil {
+		gg.saved[i] = gg.saved[i].Copy()
+	}
+
+	kv := gg.servers[i]
+	if kv != nil {
+		cfg.mu.Unlock()
+		kv.Kill()
+		cfg.mu.Lock()
+		gg.servers[i] = nil
+	}
+}
+
+func (cfg *config) ShutdownGroup(gi int) {
+	for i := 0; i < cfg.n; i++ {
+		cfg.ShutdownServer(gi, i)
+	}
+}
+
+// start i'th server in gi'th group
+func (cfg *config) StartServer(gi int, i int) {
+	cfg.mu.Lock()
+
+	gg := cfg.groups[gi]
+
+	// a fresh set of outgoing ClientEnd names
+	// to talk to other servers in this group.
+	gg.endnames[i] = make([]string, cfg.n)
+	for j := 0; j < cfg.n; j++ {
+		gg.endnames[i][j] = randstring(20)
+	}
+
+	// and the connections to other servers in this group.
+	ends := make([]*labrpc.ClientEnd, cfg.n)
+	for j := 0; j < cfg.n; j++ {
+		ends[j] = cfg.net.MakeEnd(gg.endnames[i][j])
+		cfg.net.Connect(gg.endnames[i][j], cfg.servername(gg.gid, j))
+		cfg.net.Enable(gg.endnames[i][j], true)
+	}
+
+	// ends to talk to shardctrler service
+	mends := make([]*labrpc.ClientEnd, cfg.nctrlers)
+	gg.mendnames[i] = make([]string, cfg.nctrlers)
+	for j := 0; j < cfg.nctrlers; j++ {
+		gg.mendnames[i][j] = randstring(20)
+		mends[j] = cfg.net.MakeEnd(gg.mendnames[i][j])
+		cfg.net.Connect(gg.mendnames[i][j], cfg.ctrlername(j))
+		cfg.net.Enable(gg.mendnames[i][j], true)
+	}
+
+	// a fresh persister, so old instance doesn't overwrite
+	// new instance's persisted state.
+	// give the fresh persister a copy of the old persister's
+	// state, so that the spec is that we pass StartKVServer()
+	// the last persisted state.
+	if gg.saved[i] != nil {
+		gg.saved[i] = gg.saved[i].Copy()
+	} else {
+		gg.saved[i] = raft.MakePersister()
+	}
+	cfg.mu.Unlock()
+
+	gg.servers[i] = StartServer(ends, i, gg.saved[i], cfg.maxraftstate,
+		gg.gid, mends,
+		func(servername string) *labrpc.ClientEnd {
+			name := randstring(20)
+			end := cfg.net.MakeEnd(name)
+			cfg.net.Connect(name, servername)
+			cfg.net.Enable(name, true)
+			return end
+		})
+
+	kvsvc := labrpc.MakeService(gg.servers[i])
+	rfsvc := labrpc.MakeService(gg.servers[i].rf)
+	srv := labrpc.MakeServer()
+	srv.AddService(kvsvc)
+	srv.AddService(rfsvc)
+	cfg.net.AddServer(cfg.servername(gg.gid, i), srv)
+}
+
+func (cfg *config) StartGroup(gi int) {
+	for i := 0; i < cfg.n; i++ {
+		cfg.StartServer(gi, i)
+	}
+}
+
+func (cfg *config) StartCtrlerserver(i int) {
+	// ClientEnds to talk to other controller replicas.
+	ends := make([]*labrpc.ClientEnd, cfg.nctrlers)
+	for j := 0; j < cfg.nctrlers; j++ {
+		endname := randstring(20)
+		ends[j] = cfg.net.MakeEnd(endname)
+		cfg.net.Connect(endname, cfg.ctrlername(j))
+		cfg.net.Enable(endname, true)
+	}
+
+	p := raft.MakePersister()
+
+	cfg.ctrlerservers[i] = shardctrler.StartServer(ends, i, p)
+
+	msvc := labrpc.MakeService(cfg.ctrlerservers[i])
+	rfsvc := labrpc.MakeService(cfg.ctrlerservers[i].Raft())
+	srv := labrpc.MakeServer()
+	srv.AddService(msvc)
+	srv.AddService(rfsvc)
+	cfg.net.AddServer(cfg.ctrlername(i), srv)
+}
+
+func (cfg *config) shardclerk() *shardctrler.Clerk {
+	// ClientEnds to talk to ctrler service.
+	ends := make([]*labrpc.ClientEnd, cfg.nctrlers)
+	for j := 0; j < cfg.nctrlers; j++ {
+		name := randstring(20)
+		ends[j] = cfg.net.MakeEnd(name)
+		cfg.net.Connect(name, cfg.ctrlername(j))
+		cfg.net.Enable(name, true)
+	}
+
+	return shardctrler.MakeClerk(ends)
+}
+
+// tell the shardctrler that a group is joining.
+func (cfg *config) join(gi int) {
+	cfg.joinm([]int{gi})
+}
+
+func (cfg *config) joinm(gis []int) {
+	m := make(map[int][]string, len(gis))
+	for _, g := range gis {
+		gid := cfg.groups[g].gid
+		servernames := make([]string, cfg.n)
+		for i := 0; i < cfg.n; i++ {
+			servernames[i] = cfg.servername(gid, i)
+		}
+		m[gid] = servernames
+	}
+	cfg.mck.Join(m)
+}
+
+// tell the shardctrler that a group is leaving.
+func (cfg *config) leave(gi int) {
+	cfg.leavem([]int{gi})
+}
+
+func (cfg *config) leavem(gis []int) {
+	gids := make([]int, 0, len(gis))
+	for _, g := range gis {
+		gids = append(gids, cfg.groups[g].gid)
+	}
+	cfg.mck.Leave(gids)
+}
+
+func make_config(t *testing.T, n int, unreliable bool, maxraftstate int) *config {
+	ncpu_once.Do(func() {
+		if runtime.NumCPU() < 2 {
+			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
+		}
+		rand.Seed(makeSeed())
+	})
+	runtime.GOMAXPROCS(4)
+	cfg := &config{}
+	cfg.t = t
+	cfg.maxraftstate = maxraftstate
+	cfg.net = labrpc.MakeNetwork()
+	cfg.start = time.Now()
+
+	// controller
+	cfg.nctrlers = 3
+	cfg.ctrlerservers = make([]*shardctrler.ShardCtrler, cfg.nctrlers)
+	for i := 0; i < cfg.nctrlers; i++ {
+		cfg.StartCtrlerserver(i)
+	}
+	cfg.mck = cfg.shardclerk()
+
+	cfg.ngroups = 3
+	cfg.groups = make([]*group, cfg.ngroups)
+	cfg.n = n
+	for gi := 0; gi < cfg.ngroups; gi++ {
+		gg := &group{}
+		cfg.groups[gi] = gg
+		gg.gid = 100 + gi
+		gg.servers = make([]*ShardKV, cfg.n)
+		gg.saved = make([]*raft.Persister, cfg.n)
+		gg.endnames = make([][]string, cfg.n)
+		gg.mendnames = make([][]string, cfg.n)
+		for i := 0; i < cfg.n; i++ {
+			cfg.StartServer(gi, i)
+		}
+	}
+
+	cfg.clerks = make(map[*Clerk][]string)
+	cfg.clientIds = make(map[*Clerk]int)
+	cfg.history = lincheck.NewHistory()
+
+	cfg.net.Reliable(!unreliable)
+
+	return cfg
+}
+
+// start a Test.
+// print the Test message.
+// e.g. cfg.begin("Test: static shards")
+func (cfg *config) begin(description string) {
+	fmt.Printf("%s ...\n", description)
+	cfg.t0 = time.Now()
+	cfg.rpcs0 = cfg.net.GetTotalCount()
+}
+
+// end a Test -- the fact that we got here means there
+// was no failure.
+// print the Passed message,
+// and some performance numbers.
+func (cfg *config) end() {
+	cfg.checkTimeout()
+	cfg.checkLinearizable()
+	if !cfg.t.Failed() {
+		t := time.Since(cfg.t0).Seconds()           // real time
+		nrpc := cfg.net.GetTotalCount() - cfg.rpcs0 // number of RPC sends
+
+		fmt.Printf("  ... Passed --")
+		fmt.Printf("  %4.1f  %d %d %5d\n", t, cfg.ngroups, cfg.n, nrpc)
+	}
+}
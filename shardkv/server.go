@@ -0,0 +1,548 @@
+package shardkv
+
+import (
+	"mitraft/labgob"
+	"mitraft/labrpc"
+	"mitraft/raft"
+	"mitraft/shardctrler"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long an RPC handler waits for its operation to
+// come out of the Raft log before giving up.
+const applyTimeout = 800 * time.Millisecond
+
+// how often the leader polls the controller and
+// pushes shard migration forward.
+const pollInterval = 100 * time.Millisecond
+
+const (
+	opGet          = "Get"
+	opPut          = "Put"
+	opAppend       = "Append"
+	opConfig       = "Config"
+	opInsertShards = "InsertShards"
+	opDeleteShards = "DeleteShards"
+)
+
+// lifecycle of a shard on one group, across a config change.
+// a group only moves on to the next config once every
+// shard it holds is back to Serving.
+type shardState int
+
+const (
+	Serving   shardState = iota // owned, data present
+	Pulling                     // owned, waiting for data from the previous owner
+	BePulling                   // no longer owned, data kept until the new owner has it
+	GCing                       // owned and serving, previous owner not yet told to delete
+)
+
+type Shard struct {
+	State shardState
+	Data  map[string]string
+}
+
+func (sh *Shard) copyData() map[string]string {
+	data := make(map[string]string, len(sh.Data))
+	for k, v := range sh.Data {
+		data[k] = v
+	}
+	return data
+}
+
+type Op struct {
+	Type     string
+	Key      string
+	Value    string
+	ClientId int64
+	SeqNum   int
+
+	Config    shardctrler.Config        // Config
+	ConfigNum int                       // InsertShards, DeleteShards
+	Shards    []int                     // DeleteShards
+	Data      map[int]map[string]string // InsertShards
+	LastSeq   map[int64]int             // InsertShards
+}
+
+type opResult struct {
+	clientId int64
+	seqNum   int
+	err      Err
+	value    string
+}
+
+type ShardKV struct {
+	mu           sync.Mutex
+	me           int
+	rf           *raft.Raft
+	applyCh      chan raft.ApplyMsg
+	make_end     func(string) *labrpc.ClientEnd
+	gid          int
+	ctrlers      []*labrpc.ClientEnd
+	maxraftstate int   // snapshot if log grows this big
+	dead         int32 // set by Kill()
+
+	mck        *shardctrler.Clerk
+	config     shardctrler.Config // config this group is currently in
+	prevConfig shardctrler.Config // the one before, to find previous owners
+	shards     map[int]*Shard     // shards this group holds, by shard number
+	lastSeq    map[int64]int      // client id -> highest applied SeqNum
+
+	waiters map[int]chan opResult        // log index -> waiting RPC handler
+	ends    map[string]*labrpc.ClientEnd // cached make_end() results
+}
+
+// hand an operation to Raft and wait until it has been
+// applied at the index Raft picked for it. the caller
+// must not hold kv.mu, since the applier needs it.
+func (kv *ShardKV) submit(op Op) opResult {
+	index, _, isLeader := kv.rf.Start(op)
+	if !isLeader {
+		return opResult{err: ErrWrongLeader}
+	}
+
+	kv.mu.Lock()
+	ch := make(chan opResult, 1)
+	kv.waiters[index] = ch
+	kv.mu.Unlock()
+
+	defer func() {
+		kv.mu.Lock()
+		if kv.waiters[index] == ch {
+			delete(kv.waiters, index)
+		}
+		kv.mu.Unlock()
+	}()
+
+	select {
+	case res := <-ch:
+		if res.clientId != op.ClientId || res.seqNum != op.SeqNum {
+			// some other leader's entry ended up at our index.
+			return opResult{err: ErrWrongLeader}
+		}
+		return res
+	case <-time.After(applyTimeout):
+		return opResult{err: ErrWrongLeader}
+	}
+}
+
+// can this group serve requests for shard right now?
+// caller must hold kv.mu.
+func (kv *ShardKV) canServe(shard int) bool {
+	sh, ok := kv.shards[shard]
+	return ok && kv.config.Shards[shard] == kv.gid &&
+		(sh.State == Serving || sh.State == GCing)
+}
+
+func (kv *ShardKV) Get(args *GetArgs, reply *GetReply) {
+	// only the leader's view of the config counts; a lagging
+	// follower would turn the client away from the right group.
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	kv.mu.Lock()
+	serving := kv.canServe(key2shard(args.Key))
+	kv.mu.Unlock()
+	if !serving {
+		reply.Err = ErrWrongGroup
+		return
+	}
+
+	res := kv.submit(Op{Type: opGet, Key: args.Key, ClientId: args.ClientId, SeqNum: args.SeqNum})
+	reply.Err = res.err
+	reply.Value = res.value
+}
+
+func (kv *ShardKV) PutAppend(args *PutAppendArgs, reply *PutAppendReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	kv.mu.Lock()
+	serving := kv.canServe(key2shard(args.Key))
+	kv.mu.Unlock()
+	if !serving {
+		reply.Err = ErrWrongGroup
+		return
+	}
+
+	res := kv.submit(Op{Type: args.Op, Key: args.Key, Value: args.Value, ClientId: args.ClientId, SeqNum: args.SeqNum})
+	reply.Err = res.err
+}
+
+// hand over the contents of shards this group gave up in
+// args.ConfigNum. the data is frozen once the group has applied
+// that config, so it can be read without going through Raft.
+func (kv *ShardKV) PullShard(args *PullShardArgs, reply *PullShardReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.config.Num != args.ConfigNum {
+		reply.Err = ErrNotReady
+		return
+	}
+
+	reply.Data = make(map[int]map[string]string)
+	for _, shard := range args.Shards {
+		sh, ok := kv.shards[shard]
+		if !ok || sh.State != BePulling {
+			reply.Err = ErrNotReady
+			return
+		}
+		reply.Data[shard] = sh.copyData()
+	}
+	reply.LastSeq = make(map[int64]int, len(kv.lastSeq))
+	for id, seq := range kv.lastSeq {
+		reply.LastSeq[id] = seq
+	}
+	reply.Err = OK
+}
+
+// the new owner of args.Shards has installed them;
+// drop our copy through the log.
+func (kv *ShardKV) DeleteShard(args *DeleteShardArgs, reply *DeleteShardReply) {
+	if _, isLeader := kv.rf.GetState(); !isLeader {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	kv.mu.Lock()
+	num := kv.config.Num
+	kv.mu.Unlock()
+
+	if num > args.ConfigNum {
+		// already deleted, and moved on.
+		reply.Err = OK
+		return
+	}
+	if num < args.ConfigNum {
+		reply.Err = ErrNotReady
+		return
+	}
+
+	res := kv.submit(Op{Type: opDeleteShards, ConfigNum: args.ConfigNum, Shards: args.Shards, ClientId: nrand()})
+	reply.Err = res.err
+}
+
+func (kv *ShardKV) applyClientOp(op Op) opResult {
+	res := opResult{clientId: op.ClientId, seqNum: op.SeqNum, err: OK}
+
+	shard := key2shard(op.Key)
+	if !kv.canServe(shard) {
+		res.err = ErrWrongGroup
+		return res
+	}
+	data := kv.shards[shard].Data
+
+	switch op.Type {
+	case opGet:
+		v, ok := data[op.Key]
+		if !ok {
+			res.err = ErrNoKey
+		}
+		res.value = v
+	case opPut, opAppend:
+		if op.SeqNum <= kv.lastSeq[op.ClientId] {
+			// a retry of something we already did.
+			return res
+		}
+		kv.lastSeq[op.ClientId] = op.SeqNum
+		if op.Type == opPut {
+			data[op.Key] = op.Value
+		} else {
+			data[op.Key] += op.Value
+		}
+	}
+	return res
+}
+
+// move from the current config to next, marking the shards
+// that have to be fetched from, or handed to, other groups.
+func (kv *ShardKV) applyConfig(next shardctrler.Config) {
+	if next.Num != kv.config.Num+1 || !kv.stable() {
+		return
+	}
+
+	for shard := 0; shard < shardctrler.NShards; shard++ {
+		wasOurs := kv.config.Shards[shard] == kv.gid
+		isOurs := next.Shards[shard] == kv.gid
+		switch {
+		case isOurs && !wasOurs:
+			if kv.config.Shards[shard] == 0 {
+				// nobody owned it before; nothing to fetch.
+				kv.shards[shard] = &Shard{State: Serving, Data: map[string]string{}}
+			} else {
+				kv.shards[shard] = &Shard{State: Pulling, Data: map[string]string{}}
+			}
+		case wasOurs && !isOurs:
+			kv.shards[shard].State = BePulling
+		}
+	}
+
+	kv.prevConfig = kv.config
+	kv.config = next.Copy()
+}
+
+func (kv *ShardKV) applyInsertShards(op Op) {
+	if op.ConfigNum != kv.config.Num {
+		return
+	}
+	for shard, data := range op.Data {
+		sh, ok := kv.shards[shard]
+		if !ok || sh.State != Pulling {
+			continue
+		}
+		for k, v := range data {
+			sh.Data[k] = v
+		}
+		sh.State = GCing
+	}
+	for id, seq := range op.LastSeq {
+		if seq > kv.lastSeq[id] {
+			kv.lastSeq[id] = seq
+		}
+	}
+}
+
+// applied on both sides of a migration: the old owner
+// forgets the shards, the new owner stops reminding it to.
+func (kv *ShardKV) applyDeleteShards(op Op) {
+	if op.ConfigNum != kv.config.Num {
+		return
+	}
+	for _, shard := range op.Shards {
+		sh, ok := kv.shards[shard]
+		if !ok {
+			continue
+		}
+		if sh.State == BePulling {
+			delete(kv.shards, shard)
+		} else if sh.State == GCing {
+			sh.State = Serving
+		}
+	}
+}
+
+// are all shards done migrating for the current config?
+// caller must hold kv.mu.
+func (kv *ShardKV) stable() bool {
+	for _, sh := range kv.shards {
+		if sh.State != Serving {
+			return false
+		}
+	}
+	return true
+}
+
+func (kv *ShardKV) applier() {
+	for m := range kv.applyCh {
+		// keep draining after Kill(), since Raft holds its
+		// lock while it sends on applyCh.
+		if kv.killed() || !m.CommandValid {
+			continue
+		}
+		op, ok := m.Command.(Op)
+		if !ok {
+			continue
+		}
+
+		kv.mu.Lock()
+		res := opResult{clientId: op.ClientId, seqNum: op.SeqNum, err: OK}
+		switch op.Type {
+		case opGet, opPut, opAppend:
+			res = kv.applyClientOp(op)
+		case opConfig:
+			kv.applyConfig(op.Config)
+		case opInsertShards:
+			kv.applyInsertShards(op)
+		case opDeleteShards:
+			kv.applyDeleteShards(op)
+		}
+		if ch, ok := kv.waiters[m.CommandIndex]; ok {
+			ch <- res
+			delete(kv.waiters, m.CommandIndex)
+		}
+		kv.mu.Unlock()
+	}
+}
+
+// shards in the given state, grouped by the gid that
+// owned them in the previous config.
+// caller must hold kv.mu.
+func (kv *ShardKV) shardsByPrevOwner(state shardState) map[int][]int {
+	byGid := map[int][]int{}
+	for shard, sh := range kv.shards {
+		if sh.State == state {
+			gid := kv.prevConfig.Shards[shard]
+			byGid[gid] = append(byGid[gid], shard)
+		}
+	}
+	return byGid
+}
+
+func (kv *ShardKV) endFor(server string) *labrpc.ClientEnd {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	end, ok := kv.ends[server]
+	if !ok {
+		end = kv.make_end(server)
+		kv.ends[server] = end
+	}
+	return end
+}
+
+// leader only: pick up the next configuration once the
+// current one has fully settled.
+func (kv *ShardKV) pollConfig() {
+	kv.mu.Lock()
+	num := kv.config.Num
+	ready := kv.stable()
+	kv.mu.Unlock()
+	if !ready {
+		return
+	}
+
+	next := kv.mck.Query(num + 1)
+	if next.Num == num+1 {
+		kv.rf.Start(Op{Type: opConfig, Config: next, ClientId: nrand()})
+	}
+}
+
+// leader only: fetch every shard we are still waiting for.
+func (kv *ShardKV) pullShards() {
+	kv.mu.Lock()
+	num := kv.config.Num
+	byGid := kv.shardsByPrevOwner(Pulling)
+	groups := kv.prevConfig.Copy().Groups
+	kv.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for gid, shards := range byGid {
+		wg.Add(1)
+		go func(servers []string, shards []int) {
+			defer wg.Done()
+			args := PullShardArgs{ConfigNum: num, Shards: shards}
+			for _, server := range servers {
+				var reply PullShardReply
+				if kv.endFor(server).Call("ShardKV.PullShard", &args, &reply) && reply.Err == OK {
+					kv.rf.Start(Op{Type: opInsertShards, ConfigNum: num, Data: reply.Data, LastSeq: reply.LastSeq, ClientId: nrand()})
+					return
+				}
+			}
+		}(groups[gid], shards)
+	}
+	wg.Wait()
+}
+
+// leader only: tell previous owners that they can
+// drop the shards we have installed.
+func (kv *ShardKV) deleteShards() {
+	kv.mu.Lock()
+	num := kv.config.Num
+	byGid := kv.shardsByPrevOwner(GCing)
+	groups := kv.prevConfig.Copy().Groups
+	kv.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for gid, shards := range byGid {
+		wg.Add(1)
+		go func(servers []string, shards []int) {
+			defer wg.Done()
+			args := DeleteShardArgs{ConfigNum: num, Shards: shards}
+			for _, server := range servers {
+				var reply DeleteShardReply
+				if kv.endFor(server).Call("ShardKV.DeleteShard", &args, &reply) && reply.Err == OK {
+					kv.submit(Op{Type: opDeleteShards, ConfigNum: num, Shards: shards, ClientId: nrand()})
+					return
+				}
+			}
+		}(groups[gid], shards)
+	}
+	wg.Wait()
+}
+
+// run f every pollInterval while this server is the leader.
+func (kv *ShardKV) leaderLoop(f func()) {
+	for !kv.killed() {
+		if _, isLeader := kv.rf.GetState(); isLeader {
+			f()
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// the tester calls Kill() when a ShardKV instance won't
+// be needed again. you are not required to do anything
+// in Kill(), but it might be convenient to (for example)
+// turn off debug output from this instance.
+func (kv *ShardKV) Kill() {
+	atomic.StoreInt32(&kv.dead, 1)
+	kv.rf.Kill()
+}
+
+func (kv *ShardKV) killed() bool {
+	z := atomic.LoadInt32(&kv.dead)
+	return z == 1
+}
+
+// servers[] contains the ports of the servers in this group.
+//
+// me is the index of the current server in servers[].
+//
+// the k/v server should store snapshots through the underlying Raft
+// implementation, which should call persister.SaveStateAndSnapshot() to
+// atomically save the Raft state along with the snapshot.
+// this Raft does not compact its log yet, so maxraftstate
+// is recorded but not acted on.
+//
+// gid is this group's GID, for interacting with the shardctrler.
+//
+// pass ctrlers[] to shardctrler.MakeClerk() so you can send
+// RPCs to the shardctrler.
+//
+// make_end(servername) turns a server name from a
+// Config.Groups[gid][i] into a labrpc.ClientEnd on which you can
+// send RPCs. You'll need this to send RPCs to other groups.
+//
+// StartServer() must return quickly, so it should start goroutines
+// for any long-running work.
+func StartServer(servers []*labrpc.ClientEnd, me int, persister *raft.Persister, maxraftstate int, gid int, ctrlers []*labrpc.ClientEnd, make_end func(string) *labrpc.ClientEnd) *ShardKV {
+	// call labgob.Register on structures you want
+	// Go's RPC library to marshall/unmarshall.
+	labgob.Register(Op{})
+
+	kv := new(ShardKV)
+	kv.me = me
+	kv.maxraftstate = maxraftstate
+	kv.make_end = make_end
+	kv.gid = gid
+	kv.ctrlers = ctrlers
+
+	kv.mck = shardctrler.MakeClerk(kv.ctrlers)
+	kv.config = shardctrler.Config{Groups: map[int][]string{}}
+	kv.prevConfig = shardctrler.Config{Groups: map[int][]string{}}
+	kv.shards = make(map[int]*Shard)
+	kv.lastSeq = make(map[int64]int)
+	kv.waiters = make(map[int]chan opResult)
+	kv.ends = make(map[string]*labrpc.ClientEnd)
+
+	kv.applyCh = make(chan raft.ApplyMsg)
+	kv.rf = raft.Make(servers, me, persister, kv.applyCh)
+
+	go kv.applier()
+	go kv.leaderLoop(kv.pollConfig)
+	go kv.leaderLoop(kv.pullShards)
+	go kv.leaderLoop(kv.deleteShards)
+
+	return kv
+}
@@ -0,0 +1,440 @@
+package shardkv
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func check(cfg *config, ck *Clerk, key string, value string) {
+	v := cfg.Get(ck, key)
+	if v != value {
+		cfg.t.Fatalf("Get(%v): expected:\n%v\nreceived:\n%v", key, value, v)
+	}
+}
+
+// test static 2-way sharding, without shard movement.
+func TestStaticShards(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: static shards")
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+	cfg.join(1)
+
+	n := 10
+	ka := make([]string, n)
+	va := make([]string, n)
+	for i := 0; i < n; i++ {
+		ka[i] = strconv.Itoa(i) // ensure multiple shards
+		va[i] = randstring(20)
+		cfg.Put(ck, ka[i], va[i])
+	}
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+	}
+
+	// make sure that the data really is sharded by
+	// shutting down one shard and checking that some
+	// Get()s don't succeed.
+	cfg.ShutdownGroup(1)
+	cfg.checkTimeout() // forbid ShutdownGroup() from taking too long
+
+	ch := make(chan string)
+	for xi := 0; xi < n; xi++ {
+		ck1 := cfg.makeClient() // only one call allowed per client
+		go func(i int) {
+			v := cfg.Get(ck1, ka[i])
+			if v != va[i] {
+				ch <- "Get(" + ka[i] + "): expected:\n" + va[i] + "\nreceived:\n" + v
+			} else {
+				ch <- ""
+			}
+		}(xi)
+	}
+
+	// wait a bit, only about half the Gets should succeed.
+	ndone := 0
+	done := false
+	for done == false {
+		select {
+		case err := <-ch:
+			if err != "" {
+				t.Fatal(err)
+			}
+			ndone += 1
+		case <-time.After(time.Second * 2):
+			done = true
+			break
+		}
+	}
+
+	if ndone != 5 {
+		t.Fatalf("expected 5 completions with one shard dead; got %v\n", ndone)
+	}
+
+	// bring the crashed shard/group back to life.
+	cfg.StartGroup(1)
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+	}
+
+	cfg.end()
+}
+
+func TestJoinLeave(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: join then leave")
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	n := 10
+	ka := make([]string, n)
+	va := make([]string, n)
+	for i := 0; i < n; i++ {
+		ka[i] = strconv.Itoa(i) // ensure multiple shards
+		va[i] = randstring(5)
+		cfg.Put(ck, ka[i], va[i])
+	}
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+	}
+
+	cfg.join(1)
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+		x := randstring(5)
+		cfg.Append(ck, ka[i], x)
+		va[i] += x
+	}
+
+	cfg.leave(0)
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+		x := randstring(5)
+		cfg.Append(ck, ka[i], x)
+		va[i] += x
+	}
+
+	// allow time for shards to transfer.
+	time.Sleep(1 * time.Second)
+
+	cfg.checkTimeout()
+	cfg.ShutdownGroup(0)
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+	}
+
+	cfg.end()
+}
+
+// old owners must forget shards once the new owner has them.
+func TestDeleteAfterMove(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: old owners delete moved shards")
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	n := 10
+	for i := 0; i < n; i++ {
+		cfg.Put(ck, strconv.Itoa(i), randstring(20))
+	}
+
+	cfg.join(1)
+	cfg.leave(0)
+
+	// wait for every group to settle on the latest config.
+	latest := cfg.mck.Query(-1).Num
+	for iters := 0; ; iters++ {
+		settled := true
+		for gi := 0; gi < 2; gi++ {
+			for _, kv := range cfg.groups[gi].servers {
+				kv.mu.Lock()
+				if kv.config.Num != latest || !kv.stable() {
+					settled = false
+				}
+				kv.mu.Unlock()
+			}
+		}
+		if settled {
+			break
+		}
+		if iters > 100 {
+			t.Fatalf("groups did not settle on config %v", latest)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, kv := range cfg.groups[0].servers {
+		kv.mu.Lock()
+		held := len(kv.shards)
+		kv.mu.Unlock()
+		if held != 0 {
+			t.Fatalf("group %v still holds %v shards after leaving", kv.gid, held)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestMissChange(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: servers miss configuration changes")
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	n := 10
+	ka := make([]string, n)
+	va := make([]string, n)
+	for i := 0; i < n; i++ {
+		ka[i] = strconv.Itoa(i) // ensure multiple shards
+		va[i] = randstring(20)
+		cfg.Put(ck, ka[i], va[i])
+	}
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+	}
+
+	cfg.join(1)
+
+	cfg.ShutdownServer(0, 0)
+	cfg.ShutdownServer(1, 0)
+	cfg.ShutdownServer(2, 0)
+
+	cfg.join(2)
+	cfg.leave(1)
+	cfg.leave(0)
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+		x := randstring(20)
+		cfg.Append(ck, ka[i], x)
+		va[i] += x
+	}
+
+	cfg.join(1)
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+		x := randstring(20)
+		cfg.Append(ck, ka[i], x)
+		va[i] += x
+	}
+
+	cfg.StartServer(0, 0)
+	cfg.StartServer(1, 0)
+	cfg.StartServer(2, 0)
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+		x := randstring(20)
+		cfg.Append(ck, ka[i], x)
+		va[i] += x
+	}
+
+	time.Sleep(2 * time.Second)
+
+	cfg.ShutdownServer(0, 1)
+	cfg.ShutdownServer(1, 1)
+	cfg.ShutdownServer(2, 1)
+
+	cfg.join(0)
+	cfg.leave(2)
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+		x := randstring(20)
+		cfg.Append(ck, ka[i], x)
+		va[i] += x
+	}
+
+	cfg.StartServer(0, 1)
+	cfg.StartServer(1, 1)
+	cfg.StartServer(2, 1)
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+	}
+
+	cfg.end()
+}
+
+func TestConcurrent1(t *testing.T) {
+	cfg := make_config(t, 3, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: concurrent puts and configuration changes")
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	n := 10
+	ka := make([]string, n)
+	va := make([]string, n)
+	for i := 0; i < n; i++ {
+		ka[i] = strconv.Itoa(i) // ensure multiple shards
+		va[i] = randstring(5)
+		cfg.Put(ck, ka[i], va[i])
+	}
+
+	var done int32
+	ch := make(chan bool)
+
+	ff := func(i int) {
+		defer func() { ch <- true }()
+		ck1 := cfg.makeClient()
+		for atomic.LoadInt32(&done) == 0 {
+			x := randstring(5)
+			cfg.Append(ck1, ka[i], x)
+			va[i] += x
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		go ff(i)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	cfg.join(1)
+	time.Sleep(500 * time.Millisecond)
+	cfg.join(2)
+	time.Sleep(500 * time.Millisecond)
+	cfg.leave(0)
+
+	cfg.ShutdownGroup(0)
+	time.Sleep(100 * time.Millisecond)
+	cfg.ShutdownGroup(1)
+	time.Sleep(100 * time.Millisecond)
+	cfg.ShutdownGroup(2)
+
+	cfg.leave(2)
+
+	time.Sleep(100 * time.Millisecond)
+	cfg.StartGroup(0)
+	cfg.StartGroup(1)
+	cfg.StartGroup(2)
+
+	time.Sleep(100 * time.Millisecond)
+	cfg.join(0)
+	cfg.leave(1)
+	time.Sleep(500 * time.Millisecond)
+	cfg.join(1)
+
+	time.Sleep(1 * time.Second)
+
+	atomic.StoreInt32(&done, 1)
+	for i := 0; i < n; i++ {
+		<-ch
+	}
+
+	for i := 0; i < n; i++ {
+		check(cfg, ck, ka[i], va[i])
+	}
+
+	cfg.end()
+}
+
+func TestUnreliable1(t *testing.T) {
+	cfg := make_config(t, 3, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: unreliable 1")
+
+	ck := cfg.makeClient()
+
+	cfg.join(0)
+
+	n := 10
+	ka := make([]string, n)
+	va := make([]string, n)
+	for i := 0; i < n; i++ {
+		ka[i] = strconv.Itoa(i) // ensure multiple shards
+		va[i] = randstring(5)
+		cfg.Put(ck, ka[i], va[i])
+	}
+
+	cfg.join(1)
+	cfg.join(2)
+	cfg.leave(0)
+
+	for ii := 0; ii < n*2; ii++ {
+		i := ii % n
+		check(cfg, ck, ka[i], va[i])
+		x := randstring(5)
+		cfg.Append(ck, ka[i], x)
+		va[i] += x
+	}
+
+	cfg.join(0)
+	cfg.leave(1)
+
+	for ii := 0; ii < n*2; ii++ {
+		i := ii % n
+		check(cfg, ck, ka[i], va[i])
+	}
+
+	cfg.end()
+}
+
+// a client's retried Append must not be applied twice,
+// even when the retry lands on a different group than
+// the original because the shard moved in between.
+func TestDuplicateAcrossMove(t *testing.T) {
+	cfg := make_config(t, 3, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: duplicate detection across shard moves")
+
+	cfg.join(0)
+
+	const nclients = 5
+	var wg sync.WaitGroup
+	vals := make([]string, nclients)
+	for ci := 0; ci < nclients; ci++ {
+		wg.Add(1)
+		go func(ci int) {
+			defer wg.Done()
+			ck := cfg.makeClient()
+			key := strconv.Itoa(ci)
+			for i := 0; i < 10; i++ {
+				x := strconv.Itoa(i) + " "
+				cfg.Append(ck, key, x)
+				vals[ci] += x
+			}
+		}(ci)
+	}
+
+	cfg.join(1)
+	cfg.join(2)
+	cfg.leave(0)
+	wg.Wait()
+
+	ck := cfg.makeClient()
+	for ci := 0; ci < nclients; ci++ {
+		check(cfg, ck, strconv.Itoa(ci), vals[ci])
+	}
+
+	cfg.end()
+}